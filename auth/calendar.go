@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"time"
+)
+
+// Calendar apps can't send an Authorization header, so a lesson feed is opened with a secret token in its URL
+// instead. Each user has at most one, creating a new one stops the old URL working.
+
+// CreateCalendarFeedToken creates the user's calendar feed token, replacing the one they had
+func CreateCalendarFeedToken(userID, role string) (string, types.CalendarFeed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	token, err := NewOpaqueToken()
+	if err != nil {
+		return "", types.CalendarFeed{}, err
+	}
+
+	feed := types.CalendarFeed{
+		TokenHash: HashToken(token),
+		UserID:    userID,
+		Role:      role,
+		CreatedAt: time.Now().UTC().Unix(),
+	}
+	collection := db.MongoClient.Database(db.DbName).Collection(db.CalendarFeedsCollection)
+	_, err = collection.ReplaceOne(ctx, bson.M{"userId": userID}, feed, options.Replace().SetUpsert(true))
+	if err != nil {
+		fmt.Println("Error saving calendar feed token:", err)
+		return "", types.CalendarFeed{}, err
+	}
+
+	return token, feed, nil
+}
+
+// FindCalendarFeed looks up the feed a token opens, ErrInvalidToken when it doesn't open one
+func FindCalendarFeed(token string) (types.CalendarFeed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.CalendarFeedsCollection)
+
+	var feed types.CalendarFeed
+	err := collection.FindOne(ctx, bson.M{"tokenHash": HashToken(token)}).Decode(&feed)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return feed, ErrInvalidToken
+	}
+	return feed, err
+}
+
+// RevokeCalendarFeed stops the user's calendar feed URL working and reports whether they had one
+func RevokeCalendarFeed(userID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.CalendarFeedsCollection)
+	result, err := collection.DeleteOne(ctx, bson.M{"userId": userID})
+	if err != nil {
+		fmt.Println("Error revoking calendar feed:", err)
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmailLimiter limits how often an address can be sent an email, in memory. Handlers check it before looking the
+// address up, so the answer is the same whether or not an account uses it and can't be used to find accounts.
+type EmailLimiter struct {
+	mu          sync.Mutex
+	sent        map[string][]time.Time
+	lastPrune   time.Time
+	MinInterval time.Duration // Least time between two emails to the same address
+	PerHour     int           // Most emails an address gets in an hour
+}
+
+// DefaultEmailLimiter is shared by the handlers that email a code to an address someone typed in, each with its own
+// purpose so a verification email doesn't hold up a password reset
+var DefaultEmailLimiter = NewEmailLimiter(1*time.Minute, 5)
+
+func NewEmailLimiter(minInterval time.Duration, perHour int) *EmailLimiter {
+	return &EmailLimiter{
+		sent:        map[string][]time.Time{},
+		MinInterval: minInterval,
+		PerHour:     perHour,
+	}
+}
+
+// Allow records an email for the purpose to the address and returns 0, or returns how long to wait without recording
+// anything when the address has had too many
+func (l *EmailLimiter) Allow(purpose, emailAddress string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > time.Minute {
+		l.prune(now)
+	}
+
+	key := purpose + ":" + strings.ToLower(strings.TrimSpace(emailAddress))
+	recent := []time.Time{}
+	for _, sentAt := range l.sent[key] {
+		if now.Sub(sentAt) < time.Hour {
+			recent = append(recent, sentAt)
+		}
+	}
+
+	if len(recent) > 0 {
+		if wait := recent[len(recent)-1].Add(l.MinInterval).Sub(now); wait > 0 {
+			l.sent[key] = recent
+			return wait
+		}
+	}
+	if len(recent) >= l.PerHour {
+		l.sent[key] = recent
+		return recent[0].Add(time.Hour).Sub(now)
+	}
+
+	l.sent[key] = append(recent, now)
+	return 0
+}
+
+// prune drops addresses that haven't had an email in the last hour so the map doesn't grow forever
+func (l *EmailLimiter) prune(now time.Time) {
+	for key, times := range l.sent {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= time.Hour {
+			delete(l.sent, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// WriteTooManyEmails responds with a 429 and a Retry-After header in whole seconds
+func WriteTooManyEmails(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many emails have been sent to this address. Try again in %d seconds.", seconds), http.StatusTooManyRequests)
+}
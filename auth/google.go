@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultGoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// googleJWKSCacheTTL is how long fetched Google signing keys are reused before fetching them again
+var googleJWKSCacheTTL = 1 * time.Hour
+
+var googleIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+var ErrEmailNotVerified = errors.New("google account email is not verified")
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// googleJWKSMinRefetch is the least time between two fetches, so tokens with made up kids can't make us fetch the
+// keys on every request
+var googleJWKSMinRefetch = 1 * time.Minute
+
+var googleKeys = struct {
+	sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetching    chan struct{} // Closed once the fetch in progress is done, nil when there isn't one
+}{}
+
+// VerifyGoogleIDToken checks the signature of a Google ID token against Google's JWKS, then checks the issuer,
+// audience and expiry and returns the verified claims. The JWKS is read from GOOGLE_JWKS_FILE when set (for
+// local testing), otherwise from GOOGLE_JWKS_URL which defaults to Google's certs endpoint. GOOGLE_CLIENT_ID is a
+// comma separated list of the OAuth client IDs the token may be issued for.
+func VerifyGoogleIDToken(idToken string) (types.GoogleIDTokenClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return types.GoogleIDTokenClaims{}, ErrInvalidToken
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return types.GoogleIDTokenClaims{}, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerBytes, &header); err != nil || header.Alg != "RS256" {
+		return types.GoogleIDTokenClaims{}, ErrInvalidToken
+	}
+
+	publicKey, err := googlePublicKey(header.Kid)
+	if err != nil {
+		return types.GoogleIDTokenClaims{}, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return types.GoogleIDTokenClaims{}, ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return types.GoogleIDTokenClaims{}, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return types.GoogleIDTokenClaims{}, ErrInvalidToken
+	}
+	var claims types.GoogleIDTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return types.GoogleIDTokenClaims{}, ErrInvalidToken
+	}
+
+	if !contains(googleIssuers, claims.Issuer) {
+		fmt.Println("Google ID token has an unexpected issuer:", claims.Issuer)
+		return types.GoogleIDTokenClaims{}, ErrInvalidToken
+	}
+	if !contains(googleClientIDs(), claims.Audience) {
+		fmt.Println("Google ID token has an unexpected audience:", claims.Audience)
+		return types.GoogleIDTokenClaims{}, ErrInvalidToken
+	}
+	// Allow a little clock skew between us and Google
+	now := time.Now().UTC().Unix()
+	if now > claims.ExpiresAt+30 {
+		return types.GoogleIDTokenClaims{}, ErrExpiredToken
+	}
+	if claims.IssuedAt > now+30 {
+		return types.GoogleIDTokenClaims{}, ErrInvalidToken
+	}
+	if claims.Subject == "" || claims.Email == "" {
+		return types.GoogleIDTokenClaims{}, ErrInvalidToken
+	}
+	if !claims.IsEmailVerified() {
+		return types.GoogleIDTokenClaims{}, ErrEmailNotVerified
+	}
+
+	return claims, nil
+}
+
+func googlePublicKey(kid string) (*rsa.PublicKey, error) {
+	for {
+		googleKeys.Lock()
+		key, known := googleKeys.keys[kid]
+		if known && time.Since(googleKeys.fetchedAt) < googleJWKSCacheTTL {
+			googleKeys.Unlock()
+			return key, nil
+		}
+		if time.Since(googleKeys.attemptedAt) < googleJWKSMinRefetch {
+			googleKeys.Unlock()
+			if known {
+				return key, nil
+			}
+			return nil, ErrInvalidToken
+		}
+		// Only one request fetches, the others wait for it and look again
+		if wait := googleKeys.fetching; wait != nil {
+			googleKeys.Unlock()
+			<-wait
+			continue
+		}
+		done := make(chan struct{})
+		googleKeys.fetching = done
+		googleKeys.Unlock()
+
+		// Google rotates its keys, so an unknown kid means it's time to fetch them again. The lock isn't held while
+		// fetching so logins with known keys carry on meanwhile.
+		keys, err := loadGoogleJWKS()
+
+		googleKeys.Lock()
+		googleKeys.fetching = nil
+		googleKeys.attemptedAt = time.Now()
+		if err == nil {
+			googleKeys.keys = keys
+			googleKeys.fetchedAt = googleKeys.attemptedAt
+		}
+		googleKeys.Unlock()
+		close(done)
+
+		if err != nil {
+			fmt.Println("Error loading Google JWKS:", err)
+			if known {
+				return key, nil
+			}
+			return nil, err
+		}
+
+		key, ok := keys[kid]
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		return key, nil
+	}
+}
+
+func loadGoogleJWKS() (map[string]*rsa.PublicKey, error) {
+	var data []byte
+	if path := os.Getenv("GOOGLE_JWKS_FILE"); path != "" {
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data = fileData
+	} else {
+		url := os.Getenv("GOOGLE_JWKS_URL")
+		if url == "" {
+			url = defaultGoogleJWKSURL
+		}
+
+		client := http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status fetching JWKS: %s", resp.Status)
+		}
+
+		data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var keySet jsonWebKeySet
+	if err := json.Unmarshal(data, &keySet); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range keySet.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
+
+func googleClientIDs() []string {
+	var clientIDs []string
+	for _, clientID := range strings.Split(os.Getenv("GOOGLE_CLIENT_ID"), ",") {
+		if clientID = strings.TrimSpace(clientID); clientID != "" {
+			clientIDs = append(clientIDs, clientID)
+		}
+	}
+	return clientIDs
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
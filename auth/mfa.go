@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"time"
+)
+
+const purposeMFA = "mfa"
+
+// ChallengeTokenTTL is how long a user has to enter their TOTP code after entering their password
+var ChallengeTokenTTL = 5 * time.Minute
+
+var ErrTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+
+// UserCollection returns the collection and id field that hold users with the given role
+func UserCollection(role string) (string, string) {
+	if role == RoleTeacher || role == RoleAdmin {
+		return db.TeachersCollection, "teacherid"
+	}
+	return db.StudentsCollection, "studentid"
+}
+
+// FindUserIDByEmail looks up the StudentID or TeacherID of the account with the email address
+func FindUserIDByEmail(role, emailAddress string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if role == RoleTeacher || role == RoleAdmin {
+		var teacher types.Teacher
+		collection := db.MongoClient.Database(db.DbName).Collection(db.TeachersCollection)
+		err := collection.FindOne(ctx, bson.M{"emailaddress": emailAddress}).Decode(&teacher)
+		return teacher.TeacherID, err
+	}
+
+	var student types.Student
+	collection := db.MongoClient.Database(db.DbName).Collection(db.StudentsCollection)
+	err := collection.FindOne(ctx, bson.M{"emailaddress": emailAddress}).Decode(&student)
+	return student.StudentId, err
+}
+
+// GenerateChallengeToken creates the token handed out after a correct password when the user still needs to enter a TOTP code
+func GenerateChallengeToken(userID, role string) (types.MFAChallengeResponse, error) {
+	token, expiresAt, err := generateToken(userID, role, purposeMFA, ChallengeTokenTTL)
+	if err != nil {
+		return types.MFAChallengeResponse{}, err
+	}
+
+	return types.MFAChallengeResponse{
+		MFARequired:    true,
+		ChallengeToken: token,
+		ExpiresAt:      expiresAt,
+	}, nil
+}
+
+// ParseChallengeToken verifies a token created by GenerateChallengeToken
+func ParseChallengeToken(token string) (types.TokenClaims, error) {
+	claims, err := parseToken(token)
+	if err != nil {
+		return types.TokenClaims{}, err
+	}
+	if claims.Purpose != purposeMFA {
+		return types.TokenClaims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// VerifySecondFactor checks a TOTP code or a recovery code for the user. A TOTP code can only be used once
+// and a recovery code is removed once it has been used.
+func VerifySecondFactor(role, userID, code string) (bool, error) {
+	mfa, err := LoadMFASettings(role, userID)
+	if err != nil {
+		return false, err
+	}
+	if !mfa.TOTPEnabled {
+		return false, ErrTOTPNotEnabled
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collectionName, idField := UserCollection(role)
+	collection := db.MongoClient.Database(db.DbName).Collection(collectionName)
+
+	if step, ok := ValidateTOTP(mfa.TOTPSecret, code, time.Now().UTC()); ok {
+		result, err := collection.UpdateOne(ctx, bson.M{
+			idField:        userID,
+			"totplaststep": bson.M{"$lt": step},
+		}, bson.M{
+			"$set": bson.M{"totplaststep": step},
+		})
+		if err != nil {
+			return false, err
+		}
+		if result.ModifiedCount == 0 {
+			fmt.Println("Rejected reused TOTP code for", role, userID)
+			return false, nil
+		}
+		return true, nil
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{
+		idField:         userID,
+		"recoverycodes": HashToken(NormalizeRecoveryCode(code)),
+	}, bson.M{
+		"$pull": bson.M{"recoverycodes": HashToken(NormalizeRecoveryCode(code))},
+	})
+	if err != nil {
+		return false, err
+	}
+	if result.ModifiedCount == 1 {
+		fmt.Println("Recovery code used for", role, userID)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// LoadMFASettings returns the two-factor fields for a student or teacher
+func LoadMFASettings(role, userID string) (types.MFASettings, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collectionName, idField := UserCollection(role)
+	collection := db.MongoClient.Database(db.DbName).Collection(collectionName)
+
+	var mfa types.MFASettings
+	err := collection.FindOne(ctx, bson.M{idField: userID}).Decode(&mfa)
+	if err != nil {
+		fmt.Println("Error loading two-factor settings for", role, userID, ":", err)
+		return types.MFASettings{}, err
+	}
+	return mfa, nil
+}
+
+// WriteMFAChallenge responds with a challenge token instead of the profile when the user still has to enter a TOTP code
+func WriteMFAChallenge(w http.ResponseWriter, userID, role string) {
+	challenge, err := GenerateChallengeToken(userID, role)
+	if err != nil {
+		http.Error(w, "Error generating two-factor challenge", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(challenge)
+}
+
+// VerifyChallenge is the second step of a two-factor login. It checks the challenge token and the code, writing
+// the error response itself when either is wrong, and returns the claims of the user that passed.
+func VerifyChallenge(w http.ResponseWriter, r *http.Request, challengeToken, code string, roles ...string) (types.TokenClaims, bool) {
+	claims, err := ParseChallengeToken(challengeToken)
+	if err != nil || !contains(roles, claims.Role) {
+		http.Error(w, "Invalid or expired two-factor challenge. Please log in again.", http.StatusUnauthorized)
+		return types.TokenClaims{}, false
+	}
+
+	clientIP := ClientIP(r)
+	if retryAfter := DefaultLoginLimiter.Check(claims.Role, claims.UserID, clientIP); retryAfter > 0 {
+		WriteTooManyAttempts(w, retryAfter)
+		return types.TokenClaims{}, false
+	}
+
+	ok, err := VerifySecondFactor(claims.Role, claims.UserID, code)
+	if err != nil {
+		http.Error(w, "Error verifying two-factor code", http.StatusInternalServerError)
+		return types.TokenClaims{}, false
+	}
+	if !ok {
+		DefaultLoginLimiter.Failure(claims.Role, claims.UserID, clientIP)
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return types.TokenClaims{}, false
+	}
+	DefaultLoginLimiter.Success(claims.Role, claims.UserID)
+
+	return claims, true
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"strings"
+)
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// RequireAuth rejects requests that don't carry a valid "Authorization: Bearer <token>" header with a 401
+func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Missing access token", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := ParseAccessToken(token)
+		if err != nil {
+			fmt.Println("Rejected request to", r.URL.Path, "with invalid access token:", err)
+			w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+			http.Error(w, "Invalid or expired access token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// bearerToken returns the access token from the Authorization header. Browsers can't set headers on a WebSocket
+// handshake, so those may pass it as the access_token query parameter instead.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer "), true
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		if token := r.URL.Query().Get("access_token"); token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// ClaimsFromRequest returns the token claims that RequireAuth attached to the request
+func ClaimsFromRequest(r *http.Request) (types.TokenClaims, bool) {
+	claims, ok := r.Context().Value(claimsContextKey).(types.TokenClaims)
+	return claims, ok
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/utils"
+	"time"
+)
+
+// SetPassword stores a new hash for the user's password. The legacy salt field is cleared because argon2id hashes
+// carry their own salt.
+func SetPassword(role, userID, password string) error {
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		fmt.Println("Error hashing password:", err)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collectionName, idField := UserCollection(role)
+
+	collection := db.MongoClient.Database(db.DbName).Collection(collectionName)
+	_, err = collection.UpdateOne(ctx, bson.M{idField: userID}, bson.M{
+		"$set": bson.M{
+			"password": hashedPassword,
+			"salt":     "",
+		},
+	})
+	if err != nil {
+		fmt.Println("Error saving new password:", err)
+		return err
+	}
+
+	return nil
+}
+
+// UpgradePasswordHash rehashes the password after a successful login if the stored hash is weaker than current
+// settings. Failing to upgrade doesn't fail the login, the hash is upgraded on the next one instead.
+func UpgradePasswordHash(role, userID, password string, needsRehash bool) {
+	if !needsRehash {
+		return
+	}
+
+	if err := SetPassword(role, userID, password); err != nil {
+		fmt.Println("Error upgrading password hash for", userID, ":", err)
+		return
+	}
+	fmt.Println("Upgraded password hash for", userID)
+}
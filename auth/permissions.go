@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"time"
+)
+
+// RoleAdmin is a teacher that can also manage other teachers and every student
+const RoleAdmin = "admin"
+
+// RequireRole works like RequireAuth but also responds with a 403 when the caller's role isn't one of roles
+func RequireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := ClaimsFromRequest(r)
+		for _, role := range roles {
+			if claims.Role == role {
+				next(w, r)
+				return
+			}
+		}
+
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+	})
+}
+
+// IsStaff reports whether the caller is a teacher or an admin
+func IsStaff(claims types.TokenClaims) bool {
+	return claims.Role == RoleTeacher || claims.Role == RoleAdmin
+}
+
+// CanAccessStudent reports whether the caller may read or modify the given student. Students can only access
+// themselves, teachers can access the students assigned to them, and admins can access everyone.
+func CanAccessStudent(claims types.TokenClaims, studentID string) (bool, error) {
+	switch claims.Role {
+	case RoleAdmin:
+		return true, nil
+	case RoleStudent:
+		return claims.UserID == studentID, nil
+	case RoleTeacher:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		collection := db.MongoClient.Database(db.DbName).Collection(db.StudentsCollection)
+		var student types.Student
+		err := collection.FindOne(ctx, bson.M{"studentid": studentID}).Decode(&student)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return false, nil
+			}
+			fmt.Println("Error finding student while checking permissions:", err)
+			return false, err
+		}
+
+		return student.TeacherID == claims.UserID, nil
+	}
+
+	return false, nil
+}
+
+// CanAccessTeacher reports whether the caller may modify the given teacher, which is only the teacher themselves or an admin
+func CanAccessTeacher(claims types.TokenClaims, teacherID string) bool {
+	return claims.Role == RoleAdmin || (claims.Role == RoleTeacher && claims.UserID == teacherID)
+}
+
+// CanAccessLesson reports whether the caller is the lesson's student, the lesson's teacher, or an admin
+func CanAccessLesson(claims types.TokenClaims, lesson types.Lesson) bool {
+	switch claims.Role {
+	case RoleAdmin:
+		return true
+	case RoleTeacher:
+		return lesson.TeacherID == claims.UserID
+	case RoleStudent:
+		return lesson.StudentId == claims.UserID
+	}
+
+	return false
+}
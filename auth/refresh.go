@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"time"
+)
+
+// RefreshTokenTTL is how long a refresh token can be exchanged for a new access token
+var RefreshTokenTTL = 30 * 24 * time.Hour
+
+// ErrTokenReuse is returned when an already rotated refresh token is presented again. The whole family gets revoked
+// when this happens since it means the token was most likely stolen.
+var ErrTokenReuse = errors.New("refresh token reuse detected")
+
+// IssueSessionTokens creates an access token plus a refresh token that starts a new token family, this is what every login handler hands out
+func IssueSessionTokens(userID, role string) (types.SessionTokens, error) {
+	accessToken, expiresAt, err := GenerateAccessToken(userID, role)
+	if err != nil {
+		return types.SessionTokens{}, err
+	}
+
+	refreshToken, err := issueRefreshToken(userID, role, uuid.New().String())
+	if err != nil {
+		return types.SessionTokens{}, err
+	}
+
+	return types.SessionTokens{
+		AccessToken:  accessToken,
+		ExpiresAt:    expiresAt,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new access/refresh token pair in the same family.
+// Each refresh token can only be used once.
+func RotateRefreshToken(refreshToken string) (types.SessionTokens, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.RefreshTokensCollection)
+
+	var stored types.RefreshToken
+	err := collection.FindOne(ctx, bson.M{"tokenHash": HashToken(refreshToken)}).Decode(&stored)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return types.SessionTokens{}, ErrInvalidToken
+		}
+		return types.SessionTokens{}, err
+	}
+
+	if stored.IsRevoked {
+		return types.SessionTokens{}, ErrInvalidToken
+	}
+	if stored.UsedAt != 0 {
+		fmt.Println("Refresh token reuse detected for user", stored.UserID, "revoking token family", stored.FamilyID)
+		if _, err := revokeRefreshTokens(bson.M{"familyId": stored.FamilyID}); err != nil {
+			return types.SessionTokens{}, err
+		}
+		return types.SessionTokens{}, ErrTokenReuse
+	}
+	if time.Now().UTC().After(stored.ExpiresAt) {
+		return types.SessionTokens{}, ErrExpiredToken
+	}
+
+	// Only one request can flip usedAt, a concurrent request with the same token is treated as reuse
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"tokenHash": stored.TokenHash,
+		"usedAt":    0,
+		"isRevoked": false,
+	}, bson.M{
+		"$set": bson.M{"usedAt": time.Now().UTC().Unix()},
+	})
+	if err != nil {
+		return types.SessionTokens{}, err
+	}
+	if result.ModifiedCount == 0 {
+		if _, err := revokeRefreshTokens(bson.M{"familyId": stored.FamilyID}); err != nil {
+			return types.SessionTokens{}, err
+		}
+		return types.SessionTokens{}, ErrTokenReuse
+	}
+
+	accessToken, expiresAt, err := GenerateAccessToken(stored.UserID, stored.Role)
+	if err != nil {
+		return types.SessionTokens{}, err
+	}
+
+	newRefreshToken, err := issueRefreshToken(stored.UserID, stored.Role, stored.FamilyID)
+	if err != nil {
+		return types.SessionTokens{}, err
+	}
+
+	return types.SessionTokens{
+		AccessToken:  accessToken,
+		ExpiresAt:    expiresAt,
+		RefreshToken: newRefreshToken,
+	}, nil
+}
+
+// RevokeRefreshTokenFamily revokes the family the given refresh token belongs to, i.e. logs out that one session
+func RevokeRefreshTokenFamily(refreshToken string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.RefreshTokensCollection)
+
+	var stored types.RefreshToken
+	err := collection.FindOne(ctx, bson.M{"tokenHash": HashToken(refreshToken)}).Decode(&stored)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrInvalidToken
+		}
+		return err
+	}
+
+	_, err = revokeRefreshTokens(bson.M{"familyId": stored.FamilyID})
+	return err
+}
+
+// RevokeAllRefreshTokens revokes every session the user has and returns how many tokens were revoked
+func RevokeAllRefreshTokens(userID string) (int64, error) {
+	return revokeRefreshTokens(bson.M{"userId": userID})
+}
+
+func revokeRefreshTokens(filter bson.M) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter["isRevoked"] = false
+	collection := db.MongoClient.Database(db.DbName).Collection(db.RefreshTokensCollection)
+	result, err := collection.UpdateMany(ctx, filter, bson.M{
+		"$set": bson.M{"isRevoked": true},
+	})
+	if err != nil {
+		fmt.Println("Error revoking refresh tokens:", err)
+		return 0, err
+	}
+
+	return result.ModifiedCount, nil
+}
+
+func issueRefreshToken(userID, role, familyID string) (string, error) {
+	refreshToken, err := NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	collection := db.MongoClient.Database(db.DbName).Collection(db.RefreshTokensCollection)
+	_, err = collection.InsertOne(ctx, types.RefreshToken{
+		TokenHash: HashToken(refreshToken),
+		FamilyID:  familyID,
+		UserID:    userID,
+		Role:      role,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(RefreshTokenTTL),
+		UsedAt:    0,
+		IsRevoked: false,
+	})
+	if err != nil {
+		fmt.Println("Error inserting refresh token into the database:", err)
+		return "", err
+	}
+
+	return refreshToken, nil
+}
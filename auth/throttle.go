@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThrottlePolicy decides how failed logins for one key (an account or a client IP) are slowed down
+type ThrottlePolicy struct {
+	FreeAttempts    int           // Failures allowed before any backoff kicks in
+	BaseDelay       time.Duration // Backoff after the first failure past FreeAttempts, doubled for every failure after that
+	MaxDelay        time.Duration
+	LockoutAfter    int // Failures after which the key is locked out completely
+	LockoutDuration time.Duration
+	ResetAfter      time.Duration // Failures are forgotten after this long without a new one
+}
+
+type attemptRecord struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// LoginLimiter counts failed logins per account and per client IP in memory
+type LoginLimiter struct {
+	mu            sync.Mutex
+	records       map[string]*attemptRecord
+	AccountPolicy ThrottlePolicy
+	IPPolicy      ThrottlePolicy
+}
+
+// DefaultLoginLimiter is shared by every login handler
+var DefaultLoginLimiter = NewLoginLimiter()
+
+func NewLoginLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		records: map[string]*attemptRecord{},
+		AccountPolicy: ThrottlePolicy{
+			FreeAttempts:    3,
+			BaseDelay:       2 * time.Second,
+			MaxDelay:        5 * time.Minute,
+			LockoutAfter:    10,
+			LockoutDuration: 30 * time.Minute,
+			ResetAfter:      1 * time.Hour,
+		},
+		// One IP can be a whole school behind a NAT, so it gets a lot more room than a single account
+		IPPolicy: ThrottlePolicy{
+			FreeAttempts:    20,
+			BaseDelay:       1 * time.Second,
+			MaxDelay:        10 * time.Minute,
+			LockoutAfter:    100,
+			LockoutDuration: 1 * time.Hour,
+			ResetAfter:      1 * time.Hour,
+		},
+	}
+}
+
+func accountKey(userType, emailAddress string) string {
+	return "account:" + userType + ":" + strings.ToLower(strings.TrimSpace(emailAddress))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns how long the caller has to wait before trying to log in again, 0 means they can try now
+func (l *LoginLimiter) Check(userType, emailAddress, ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	wait := l.blockedFor(accountKey(userType, emailAddress), now)
+	if ipWait := l.blockedFor(ipKey(ip), now); ipWait > wait {
+		wait = ipWait
+	}
+	return wait
+}
+
+// Failure records a failed login for the account and the IP
+func (l *LoginLimiter) Failure(userType, emailAddress, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.recordFailure(accountKey(userType, emailAddress), l.AccountPolicy, now)
+	l.recordFailure(ipKey(ip), l.IPPolicy, now)
+	l.prune(now)
+}
+
+// Success clears the failures for the account. The IP's failures are kept so one good login can't reset a spray.
+func (l *LoginLimiter) Success(userType, emailAddress string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.records, accountKey(userType, emailAddress))
+}
+
+// UnlockAccount clears a lockout on an account, used by admins
+func (l *LoginLimiter) UnlockAccount(userType, emailAddress string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := accountKey(userType, emailAddress)
+	_, existed := l.records[key]
+	delete(l.records, key)
+	return existed
+}
+
+// UnlockIP clears a lockout on a client IP, used by admins
+func (l *LoginLimiter) UnlockIP(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ipKey(ip)
+	_, existed := l.records[key]
+	delete(l.records, key)
+	return existed
+}
+
+func (l *LoginLimiter) blockedFor(key string, now time.Time) time.Duration {
+	record, ok := l.records[key]
+	if !ok || !now.Before(record.blockedUntil) {
+		return 0
+	}
+	return record.blockedUntil.Sub(now)
+}
+
+func (l *LoginLimiter) recordFailure(key string, policy ThrottlePolicy, now time.Time) {
+	record, ok := l.records[key]
+	if !ok || now.Sub(record.lastFailure) > policy.ResetAfter {
+		record = &attemptRecord{}
+		l.records[key] = record
+	}
+
+	record.failures++
+	record.lastFailure = now
+
+	switch {
+	case record.failures >= policy.LockoutAfter:
+		record.blockedUntil = now.Add(policy.LockoutDuration)
+		fmt.Println("Too many failed logins for", key, "locked out until", record.blockedUntil.UTC())
+	case record.failures > policy.FreeAttempts:
+		exponent := float64(record.failures - policy.FreeAttempts - 1)
+		delay := time.Duration(float64(policy.BaseDelay) * math.Pow(2, exponent))
+		if delay > policy.MaxDelay || delay <= 0 {
+			delay = policy.MaxDelay
+		}
+		record.blockedUntil = now.Add(delay)
+	}
+}
+
+// prune drops records that can no longer affect anything so the map doesn't grow forever
+func (l *LoginLimiter) prune(now time.Time) {
+	for key, record := range l.records {
+		resetAfter := l.AccountPolicy.ResetAfter
+		if strings.HasPrefix(key, "ip:") {
+			resetAfter = l.IPPolicy.ResetAfter
+		}
+		if now.After(record.blockedUntil) && now.Sub(record.lastFailure) > resetAfter {
+			delete(l.records, key)
+		}
+	}
+}
+
+// WriteTooManyAttempts responds with a 429 and a Retry-After header in whole seconds
+func WriteTooManyAttempts(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many failed login attempts. Try again in %d seconds.", seconds), http.StatusTooManyRequests)
+}
+
+// ClientIP returns the caller's IP. X-Forwarded-For is only trusted when TRUST_PROXY is "true", since clients can set it to anything.
+func ClientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RoleStudent = "student"
+	RoleTeacher = "teacher"
+)
+
+// AccessTokenTTL is how long a signed access token is valid for after it is issued, clients use a refresh token to get a new one
+var AccessTokenTTL = 15 * time.Minute
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+)
+
+var (
+	secretOnce sync.Once
+	secret     []byte
+)
+
+// tokenSecret returns the HMAC key from the JWT_SECRET env variable. If it is not set, a random key is generated,
+// which means tokens won't survive a server restart.
+func tokenSecret() []byte {
+	secretOnce.Do(func() {
+		if envSecret := os.Getenv("JWT_SECRET"); envSecret != "" {
+			secret = []byte(envSecret)
+			return
+		}
+
+		log.Println("JWT_SECRET is not set... generating a random signing key for this process")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Failed to generate token signing key: %v", err)
+		}
+	})
+
+	return secret
+}
+
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// GenerateAccessToken creates a signed HS256 JWT for the given user and role, returning the token and its expiry (unix seconds)
+func GenerateAccessToken(userID, role string) (string, int64, error) {
+	return generateToken(userID, role, "", AccessTokenTTL)
+}
+
+// ParseAccessToken verifies the signature and expiry of a token created by GenerateAccessToken and returns its claims
+func ParseAccessToken(token string) (types.TokenClaims, error) {
+	claims, err := parseToken(token)
+	if err != nil {
+		return types.TokenClaims{}, err
+	}
+	// Tokens made for something else, like an MFA challenge, can't be used to call the API
+	if claims.Purpose != "" {
+		return types.TokenClaims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func generateToken(userID, role, purpose string, ttl time.Duration) (string, int64, error) {
+	now := time.Now().UTC()
+	claims := types.TokenClaims{
+		UserID:    userID,
+		Role:      role,
+		Purpose:   purpose,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", 0, err
+	}
+
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + sign(unsigned), claims.ExpiresAt, nil
+}
+
+func parseToken(token string) (types.TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return types.TokenClaims{}, ErrInvalidToken
+	}
+
+	expected := sign(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return types.TokenClaims{}, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return types.TokenClaims{}, ErrInvalidToken
+	}
+
+	var claims types.TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return types.TokenClaims{}, ErrInvalidToken
+	}
+	if claims.UserID == "" || claims.Role == "" {
+		return types.TokenClaims{}, ErrInvalidToken
+	}
+	if time.Now().UTC().Unix() >= claims.ExpiresAt {
+		return types.TokenClaims{}, ErrExpiredToken
+	}
+
+	return claims, nil
+}
+
+func sign(unsigned string) string {
+	mac := hmac.New(sha256.New, tokenSecret())
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewOpaqueToken returns a random URL safe token for things like refresh and password reset tokens
+func NewOpaqueToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// HashToken is what gets stored for opaque tokens so a database leak doesn't hand out live tokens
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
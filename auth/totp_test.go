@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors, "12345678901234567890" in base32
+var rfc6238Secret = base32NoPadding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	// RFC 6238 appendix B lists 8 digit codes, authenticator apps show the last 6
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	key := []byte("12345678901234567890")
+	for _, test := range tests {
+		step := test.unix / totpPeriod
+		if got := totpCode(key, step); got != test.code {
+			t.Errorf("totpCode at %d = %s, want %s", test.unix, got, test.code)
+		}
+		gotStep, ok := ValidateTOTP(rfc6238Secret, test.code, time.Unix(test.unix, 0))
+		if !ok || gotStep != step {
+			t.Errorf("ValidateTOTP(%s) at %d = %d, %v, want step %d", test.code, test.unix, gotStep, ok, step)
+		}
+	}
+}
+
+func TestValidateTOTPWindow(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name   string
+		offset int64 // Steps between the code and now
+		valid  bool
+	}{
+		{"current step", 0, true},
+		{"one step behind", -1, true},
+		{"one step ahead", 1, true},
+		{"two steps behind", -2, false},
+		{"two steps ahead", 2, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code := totpCode(key, step+test.offset)
+			gotStep, ok := ValidateTOTP(rfc6238Secret, code, now)
+			if ok != test.valid {
+				t.Fatalf("ValidateTOTP = %v, want %v", ok, test.valid)
+			}
+			// The step the code was made for, not the current one, is what gets recorded against reuse
+			if ok && gotStep != step+test.offset {
+				t.Errorf("ValidateTOTP matched step %d, want %d", gotStep, step+test.offset)
+			}
+		})
+	}
+}
+
+func TestValidateTOTPInput(t *testing.T) {
+	now := time.Unix(59, 0)
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		valid  bool
+	}{
+		{"spaces in the code", rfc6238Secret, " 287 082 ", true},
+		{"lower case secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", true},
+		{"wrong code", rfc6238Secret, "287083", false},
+		{"too short", rfc6238Secret, "28708", false},
+		{"8 digits", rfc6238Secret, "94287082", false},
+		{"invalid secret", "not base32!", "287082", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, ok := ValidateTOTP(test.secret, test.code, now); ok != test.valid {
+				t.Errorf("ValidateTOTP(%q, %q) = %v, want %v", test.secret, test.code, ok, test.valid)
+			}
+		})
+	}
+}
+
+func TestVerifySecondFactorRejectsReusedStep(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("a code works once", func(mt *mtest.T) {
+		db.MongoClient = mt.Client
+
+		// The database is mocked, so it's told what a real one would answer for the last step stored
+		key := []byte("12345678901234567890")
+		step := time.Now().Unix() / totpPeriod
+		code := totpCode(key, step)
+		lastStep := step - 3
+
+		verify := func() bool {
+			mt.Helper()
+			mt.ClearEvents()
+			modified := 0
+			if lastStep < step {
+				modified = 1
+			}
+			mt.AddMockResponses(
+				mtest.CreateCursorResponse(0, db.DbName+"."+db.StudentsCollection, mtest.FirstBatch, bson.D{
+					{Key: "studentid", Value: "student-1"},
+					{Key: "totpsecret", Value: rfc6238Secret},
+					{Key: "totpenabled", Value: true},
+					{Key: "totplaststep", Value: lastStep},
+				}),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: modified}, bson.E{Key: "nModified", Value: modified}),
+			)
+
+			ok, err := VerifySecondFactor(RoleStudent, "student-1", code)
+			if err != nil {
+				mt.Fatalf("VerifySecondFactor: %v", err)
+			}
+
+			mt.GetStartedEvent() // find
+			update := mt.GetStartedEvent()
+			if update == nil || update.CommandName != "update" {
+				mt.Fatal("the used step wasn't recorded")
+			}
+			statement := update.Command.Lookup("updates", "0")
+			if before, _ := statement.Document().Lookup("q", "totplaststep", "$lt").AsInt64OK(); before != step {
+				mt.Fatalf("the update only applies while totplaststep < %d, want < %d", before, step)
+			}
+			if ok {
+				lastStep = statement.Document().Lookup("u", "$set", "totplaststep").AsInt64()
+			}
+			return ok
+		}
+
+		if !verify() {
+			mt.Fatal("a fresh code was rejected")
+		}
+		if lastStep != step {
+			mt.Fatalf("totplaststep = %d after the code was used, want %d", lastStep, step)
+		}
+		if verify() {
+			mt.Fatal("a code for a step that was already used was accepted")
+		}
+	})
+}
@@ -0,0 +1,448 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// MaxAttachmentSize is the largest file that can be attached, the same limit as profile images
+	MaxAttachmentSize = 10 << 20
+	// MaxAttachmentsPerMessage is how many attachments one message can reference
+	MaxAttachmentsPerMessage = 10
+	// Thumbnails fit in a square this many pixels wide
+	thumbnailSize = 256
+	// Images bigger than this aren't decoded for a thumbnail, a small file can still decompress to a huge image. 12
+	// megapixels is what most phone cameras take and already about 48MB once decoded.
+	maxThumbnailSourcePixels = 12_000_000
+	// thumbnailSamples is the most source pixels averaged along each side of a thumbnail pixel, so scaling down a big
+	// image costs the same as a small one
+	thumbnailSamples = 4
+)
+
+// AttachmentsDir is where attachment files and thumbnails are kept. Unlike profile images it isn't served directly,
+// files are only handed out to room members.
+var AttachmentsDir = filepath.Join("uploads", "chatAttachments")
+
+// AttachmentQuota is the most bytes of attachments a user can store, CHAT_ATTACHMENT_QUOTA_MB or 100MB
+var AttachmentQuota int64 = attachmentQuotaFromEnv()
+
+// UnattachedAttachmentTTL is how long an upload can wait to be sent with a message before it's removed
+var UnattachedAttachmentTTL = 24 * time.Hour
+
+// AllowedAttachmentTypes are the content types that can be attached, as detected by http.DetectContentType
+var AllowedAttachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+var (
+	ErrAttachmentType      = errors.New("attachments must be JPEG, PNG, GIF or WebP images or PDF documents")
+	ErrAttachmentTooLarge  = fmt.Errorf("attachments cannot be larger than %d MB", MaxAttachmentSize>>20)
+	ErrAttachmentQuota     = errors.New("attachment storage quota exceeded, delete some messages with attachments first")
+	ErrUnknownAttachment   = errors.New("attachment not found in the chat room")
+	ErrTooManyAttachments  = fmt.Errorf("a message can have at most %d attachments", MaxAttachmentsPerMessage)
+	ErrAttachmentNotExists = errors.New("attachment does not exist")
+)
+
+func attachmentQuotaFromEnv() int64 {
+	if v, err := strconv.ParseInt(os.Getenv("CHAT_ATTACHMENT_QUOTA_MB"), 10, 64); err == nil && v > 0 {
+		return v << 20
+	}
+	return 100 << 20
+}
+
+// SaveAttachment stores a file uploaded to a room and makes a thumbnail for images. The content type is sniffed from
+// the file rather than trusted from the client.
+//
+// Attachments aren't end to end encrypted like message bodies, the server has to read them to check their type and
+// make thumbnails. They are only ever served to members of the room.
+func SaveAttachment(uploaderID, roomID, fileName string, file io.Reader) (types.ChatAttachment, error) {
+	room, err := DefaultStore.Room(roomID)
+	if err != nil {
+		return types.ChatAttachment{}, err
+	}
+	if !contains(room.MemberIDs, uploaderID) {
+		return types.ChatAttachment{}, ErrNotRoomMember
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, MaxAttachmentSize+1))
+	if err != nil {
+		return types.ChatAttachment{}, err
+	}
+	if len(data) > MaxAttachmentSize {
+		return types.ChatAttachment{}, ErrAttachmentTooLarge
+	}
+
+	contentType := http.DetectContentType(data)
+	if !AllowedAttachmentTypes[contentType] {
+		return types.ChatAttachment{}, ErrAttachmentType
+	}
+
+	// The space is reserved before the file is written so two uploads at once can't both fit in the last of the quota
+	if err := reserveAttachmentQuota(uploaderID, int64(len(data))); err != nil {
+		return types.ChatAttachment{}, err
+	}
+
+	attachment := types.ChatAttachment{
+		AttachmentID: uuid.New().String(),
+		RoomID:       roomID,
+		UploaderID:   uploaderID,
+		FileName:     filepath.Base(fileName),
+		ContentType:  contentType,
+		Size:         int64(len(data)),
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	if err := os.MkdirAll(AttachmentsDir, 0o755); err != nil {
+		releaseAttachmentQuota(uploaderID, attachment.Size)
+		return types.ChatAttachment{}, err
+	}
+	if err := os.WriteFile(AttachmentPath(attachment.AttachmentID, false), data, 0o644); err != nil {
+		fmt.Println("Error saving chat attachment:", err)
+		releaseAttachmentQuota(uploaderID, attachment.Size)
+		return types.ChatAttachment{}, err
+	}
+
+	// A missing thumbnail isn't worth failing the upload for, clients fall back to a file icon
+	attachment.HasThumbnail, err = saveThumbnail(attachment.AttachmentID, data)
+	if err != nil {
+		fmt.Println("Error making chat attachment thumbnail:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatAttachmentsCollection)
+	if _, err := collection.InsertOne(ctx, attachment); err != nil {
+		fmt.Println("Error inserting chat attachment:", err)
+		removeAttachmentFiles(attachment.AttachmentID)
+		releaseAttachmentQuota(uploaderID, attachment.Size)
+		return types.ChatAttachment{}, err
+	}
+
+	return attachment, nil
+}
+
+// AttachmentPath is where the attachment or its thumbnail is on disk
+func AttachmentPath(attachmentID string, thumbnail bool) string {
+	if thumbnail {
+		return filepath.Join(AttachmentsDir, attachmentID+"_thumb.png")
+	}
+	return filepath.Join(AttachmentsDir, attachmentID)
+}
+
+// AttachmentUsage is how many bytes of attachments the user has stored, including uploads not sent yet
+func AttachmentUsage(userID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := ensureAttachmentUsage(ctx, userID); err != nil {
+		return 0, err
+	}
+
+	var usage types.ChatAttachmentUsage
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatAttachmentUsageCollection)
+	if err := collection.FindOne(ctx, bson.M{"userId": userID}).Decode(&usage); err != nil {
+		fmt.Println("Error loading attachment usage:", err)
+		return 0, err
+	}
+	return usage.Bytes, nil
+}
+
+// reserveAttachmentQuota adds size bytes to the user's usage, or returns ErrAttachmentQuota without changing it when
+// they don't fit. The check and the increment are one update, so uploads at the same time can't overshoot the quota.
+func reserveAttachmentQuota(userID string, size int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := ensureAttachmentUsage(ctx, userID); err != nil {
+		return err
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatAttachmentUsageCollection)
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"userId": userID,
+		"bytes":  bson.M{"$lte": AttachmentQuota - size},
+	}, bson.M{"$inc": bson.M{"bytes": size}})
+	if err != nil {
+		fmt.Println("Error reserving attachment quota:", err)
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrAttachmentQuota
+	}
+	return nil
+}
+
+// releaseAttachmentQuota gives back the space of a deleted or failed upload
+func releaseAttachmentQuota(userID string, size int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatAttachmentUsageCollection)
+	if _, err := collection.UpdateOne(ctx, bson.M{"userId": userID}, bson.M{"$inc": bson.M{"bytes": -size}}); err != nil {
+		fmt.Println("Error releasing attachment quota:", err)
+	}
+}
+
+// ensureAttachmentUsage creates the user's usage document from the attachments they already have the first time it's
+// needed. When two requests both create it the unique index keeps the first.
+func ensureAttachmentUsage(ctx context.Context, userID string) error {
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatAttachmentUsageCollection)
+	count, err := collection.CountDocuments(ctx, bson.M{"userId": userID}, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	attachments := db.MongoClient.Database(db.DbName).Collection(db.ChatAttachmentsCollection)
+	cursor, err := attachments.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"uploaderId": userID}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$size"}}}},
+	})
+	if err != nil {
+		fmt.Println("Error adding up attachment usage:", err)
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Total int64 `bson:"total"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return err
+	}
+
+	usage := types.ChatAttachmentUsage{UserID: userID}
+	if len(results) > 0 {
+		usage.Bytes = results[0].Total
+	}
+	if _, err := collection.InsertOne(ctx, usage); err != nil && !mongo.IsDuplicateKeyError(err) {
+		fmt.Println("Error saving attachment usage:", err)
+		return err
+	}
+	return nil
+}
+
+// FindAttachment loads an attachment, ErrAttachmentNotExists if there isn't one
+func FindAttachment(attachmentID string) (types.ChatAttachment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatAttachmentsCollection)
+
+	var attachment types.ChatAttachment
+	err := collection.FindOne(ctx, bson.M{"attachmentId": attachmentID}).Decode(&attachment)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return attachment, ErrAttachmentNotExists
+	}
+	return attachment, err
+}
+
+// checkAttachments makes sure a message only references attachments its sender uploaded to the same room
+func checkAttachments(senderID, roomID string, attachmentIDs []string) error {
+	if len(attachmentIDs) == 0 {
+		return nil
+	}
+	if len(attachmentIDs) > MaxAttachmentsPerMessage {
+		return ErrTooManyAttachments
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatAttachmentsCollection)
+	count, err := collection.CountDocuments(ctx, bson.M{
+		"attachmentId": bson.M{"$in": attachmentIDs},
+		"roomId":       roomID,
+		"uploaderId":   senderID,
+		"messageId":    "",
+	})
+	if err != nil {
+		return err
+	}
+	if count != int64(len(attachmentIDs)) {
+		return ErrUnknownAttachment
+	}
+	return nil
+}
+
+// attachToMessage records which message the attachments were sent with, so they go when it's deleted
+func attachToMessage(message types.ChatMessage) {
+	if len(message.AttachmentIDs) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatAttachmentsCollection)
+	_, err := collection.UpdateMany(ctx, bson.M{"attachmentId": bson.M{"$in": message.AttachmentIDs}, "messageId": ""}, bson.M{
+		"$set": bson.M{"messageId": message.MessageID},
+	})
+	if err != nil {
+		fmt.Println("Error linking attachments to message:", err)
+	}
+}
+
+// DeleteAttachments removes the matching attachments and their files, e.g. {"roomId": ...} when a room is deleted, and
+// gives their space back to the uploaders
+func DeleteAttachments(filter bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatAttachmentsCollection)
+	cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"attachmentId": 1, "uploaderId": 1, "size": 1}))
+	if err != nil {
+		return err
+	}
+	attachments := []types.ChatAttachment{}
+	err = cursor.All(ctx, &attachments)
+	cursor.Close(ctx)
+	if err != nil {
+		return err
+	}
+
+	// One at a time with the filter still applied, so an attachment is only released once and one sent with a message
+	// in the meantime isn't removed by the cleanup of unsent uploads
+	for _, attachment := range attachments {
+		deleteFilter := bson.M{"attachmentId": attachment.AttachmentID}
+		for key, value := range filter {
+			if key != "attachmentId" {
+				deleteFilter[key] = value
+			}
+		}
+		result, err := collection.DeleteOne(ctx, deleteFilter)
+		if err != nil {
+			return err
+		}
+		if result.DeletedCount == 0 {
+			continue
+		}
+		releaseAttachmentQuota(attachment.UploaderID, attachment.Size)
+		removeAttachmentFiles(attachment.AttachmentID)
+	}
+	return nil
+}
+
+// RemoveUnattachedAttachments removes uploads that weren't sent with a message within UnattachedAttachmentTTL
+func RemoveUnattachedAttachments() error {
+	return DeleteAttachments(bson.M{
+		"messageId": "",
+		"createdAt": bson.M{"$lt": time.Now().UTC().Add(-UnattachedAttachmentTTL)},
+	})
+}
+
+// StartAttachmentCleanupJob runs RemoveUnattachedAttachments every interval
+func StartAttachmentCleanupJob(interval time.Duration) {
+	go func() {
+		for {
+			if err := RemoveUnattachedAttachments(); err != nil {
+				fmt.Println("Error removing unsent chat attachments:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func removeAttachmentFiles(attachmentID string) {
+	for _, path := range []string{AttachmentPath(attachmentID, false), AttachmentPath(attachmentID, true)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("Error removing chat attachment file:", err)
+		}
+	}
+}
+
+// saveThumbnail writes a PNG thumbnail for JPEG, PNG and GIF images. Anything else, like PDFs and WebP images, is
+// skipped without an error.
+func saveThumbnail(attachmentID string, data []byte) (bool, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false, nil
+	}
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return false, fmt.Errorf("%s image is too large to make a thumbnail of", format)
+	}
+
+	source, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+
+	out, err := os.Create(AttachmentPath(attachmentID, true))
+	if err != nil {
+		return false, err
+	}
+	defer out.Close()
+
+	if err := png.Encode(out, thumbnail(source, thumbnailSize)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// thumbnail scales the image down to fit in a size by size square. Each thumbnail pixel averages a grid of at most
+// thumbnailSamples by thumbnailSamples pixels read straight from the decoded image, without copying it first.
+func thumbnail(source image.Image, size int) image.Image {
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return source
+	}
+
+	newWidth, newHeight := size, height*size/width
+	if height > width {
+		newWidth, newHeight = width*size/height, size
+	}
+	newWidth, newHeight = max(newWidth, 1), max(newHeight, 1)
+
+	result := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		y0, y1 := y*height/newHeight, max((y+1)*height/newHeight, y*height/newHeight+1)
+		stepY := max((y1-y0)/thumbnailSamples, 1)
+		for x := 0; x < newWidth; x++ {
+			x0, x1 := x*width/newWidth, max((x+1)*width/newWidth, x*width/newWidth+1)
+			stepX := max((x1-x0)/thumbnailSamples, 1)
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy += stepY {
+				for sx := x0; sx < x1; sx += stepX {
+					pr, pg, pb, pa := source.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r += pr >> 8
+					g += pg >> 8
+					b += pb >> 8
+					a += pa >> 8
+					n++
+				}
+			}
+
+			i := y*result.Stride + x*4
+			result.Pix[i], result.Pix[i+1], result.Pix[i+2], result.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return result
+}
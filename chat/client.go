@@ -0,0 +1,209 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Time allowed to write a frame to the client
+	writeWait = 10 * time.Second
+	// A client that hasn't answered a ping in this long is considered gone
+	pongWait = 60 * time.Second
+	// Pings have to go out before pongWait runs out
+	pingPeriod = (pongWait * 9) / 10
+	// Largest frame accepted from a client, a message body and its moderationText
+	maxFrameSize = 2*MaxMessageLength + 1024
+	// Events queued for a client before it counts as too slow and is disconnected
+	sendBufferSize = 256
+	// Most messages replayed to a reconnecting client before it is told to resync instead
+	resumeLimit = 500
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Connections are authenticated with a bearer token rather than cookies, so any origin is fine
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Client is one WebSocket connection
+type Client struct {
+	hub       *Hub
+	conn      *websocket.Conn
+	userID    string
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ServeWS upgrades the request and serves the connection until it closes. Clients that reconnect pass the ID of the
+// last message they received as last_message_id and get everything they missed first.
+func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request, userID string) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written the error response
+		fmt.Println("Error upgrading WebSocket connection:", err)
+		return
+	}
+
+	client := &Client{
+		hub:    h,
+		conn:   conn,
+		userID: userID,
+		send:   make(chan []byte, sendBufferSize),
+		done:   make(chan struct{}),
+	}
+
+	// Registering before the replay means nothing sent in between is lost. It can arrive twice, clients drop
+	// messages with an ID they already have.
+	h.register(client)
+
+	if lastMessageID := r.URL.Query().Get("last_message_id"); lastMessageID != "" {
+		if err := client.resume(lastMessageID); err != nil {
+			fmt.Println("Error replaying missed chat messages:", err)
+			h.unregister(client)
+			conn.Close()
+			return
+		}
+	}
+
+	go client.writePump()
+	go client.readPump()
+}
+
+func (c *Client) resume(lastMessageID string) error {
+	messages, complete, err := DefaultStore.MessagesAfter(c.userID, lastMessageID, resumeLimit)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		if err := c.writeEvent(types.ChatEvent{Type: EventMessage, RoomID: messages[i].RoomID, Message: &messages[i]}); err != nil {
+			return err
+		}
+	}
+	if !complete {
+		return c.writeEvent(types.ChatEvent{Type: EventResync})
+	}
+	return nil
+}
+
+func (c *Client) writeEvent(event types.ChatEvent) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteJSON(event)
+}
+
+// disconnect tells writePump to close the connection. send is never closed, so the hub can't send on a closed channel.
+func (c *Client) disconnect() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister(c)
+		c.disconnect()
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				fmt.Println("Chat connection closed unexpectedly:", err)
+			}
+			return
+		}
+
+		var frame types.ChatClientFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			c.sendError("", "Invalid frame")
+			continue
+		}
+		c.handleFrame(frame)
+	}
+}
+
+func (c *Client) handleFrame(frame types.ChatClientFrame) {
+	switch frame.Type {
+	case EventMessage:
+		if err := DefaultWordFilter.CheckMessage(frame.WordFilterVersion, frame.Body, frame.ModerationText); err != nil {
+			c.sendError(frame.RoomID, err.Error())
+			return
+		}
+		_, err := c.hub.SendMessage(types.ChatMessage{
+			RoomID:        frame.RoomID,
+			SenderID:      c.userID,
+			Body:          frame.Body,
+			KeyVersion:    frame.KeyVersion,
+			ClientID:      frame.ClientID,
+			AttachmentIDs: frame.AttachmentIDs,
+			SearchTokens:  frame.SearchTokens,
+		})
+		if err != nil {
+			c.sendError(frame.RoomID, err.Error())
+		}
+	case ReceiptDelivered, ReceiptRead:
+		if _, err := c.hub.UpdateReadState(c.userID, frame.RoomID, frame.MessageID, frame.Type); err != nil {
+			c.sendError(frame.RoomID, err.Error())
+		}
+	case "typing_start", "typing_stop":
+		if err := c.hub.SetTyping(c.userID, frame.RoomID, frame.Type == "typing_start"); err != nil {
+			c.sendError(frame.RoomID, err.Error())
+		}
+	default:
+		c.sendError(frame.RoomID, "Unknown frame type "+frame.Type)
+	}
+}
+
+// sendError reports a problem to this connection only
+func (c *Client) sendError(roomID, message string) {
+	payload, _ := json.Marshal(types.ChatEvent{Type: EventError, RoomID: roomID, Error: message})
+	select {
+	case c.send <- payload:
+	default:
+		c.disconnect()
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case payload := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-c.done:
+			// Either the client is gone or it couldn't keep up, in which case it reconnects with last_message_id
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "client too slow"))
+			return
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	WordFilterMask   = "mask"
+	WordFilterReject = "reject"
+)
+
+var (
+	ErrFilteredWord      = errors.New("text contains words that aren't allowed")
+	ErrWordFilterVersion = errors.New("the word filter has changed, fetch the current one from /chats/wordFilter")
+	ErrModerationText    = errors.New("moderationText with the plain text of the message is required")
+)
+
+// WordFilter is the list of words that aren't allowed in chat. Message bodies are end to end encrypted so clients
+// apply it before encrypting and send the plain text next to the ciphertext for the server to check again, see
+// CheckMessage. That check only catches well behaved clients that made a mistake, the server can't see whether the
+// plain text matches the ciphertext. The server applies it itself to the plain text it keeps, like room names.
+type WordFilter struct {
+	Mode    string
+	Words   []string
+	Version string
+	pattern *regexp.Regexp
+}
+
+// DefaultWordFilter is read from the file in CHAT_WORD_FILTER_FILE, one word per line, with CHAT_WORD_FILTER_MODE
+// "mask" (default) or "reject"
+var DefaultWordFilter = LoadWordFilter(os.Getenv("CHAT_WORD_FILTER_FILE"), os.Getenv("CHAT_WORD_FILTER_MODE"))
+
+// LoadWordFilter reads a word list. Without a file, or if it can't be read, nothing is filtered.
+func LoadWordFilter(path, mode string) WordFilter {
+	if mode != WordFilterReject {
+		mode = WordFilterMask
+	}
+	if path == "" {
+		return NewWordFilter(mode, nil)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Error opening chat word filter, nothing will be filtered:", err)
+		return NewWordFilter(mode, nil)
+	}
+	defer file.Close()
+
+	words := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, word)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Error reading chat word filter, nothing will be filtered:", err)
+		return NewWordFilter(mode, nil)
+	}
+	return NewWordFilter(mode, words)
+}
+
+// NewWordFilter builds a filter that matches the words case insensitively and only as whole words
+func NewWordFilter(mode string, words []string) WordFilter {
+	filter := WordFilter{Mode: mode, Words: []string{}}
+	for _, word := range words {
+		word = strings.ToLower(strings.TrimSpace(word))
+		if word != "" && !contains(filter.Words, word) {
+			filter.Words = append(filter.Words, word)
+		}
+	}
+	if len(filter.Words) == 0 {
+		return filter
+	}
+	sort.Strings(filter.Words)
+
+	quoted := make([]string, len(filter.Words))
+	for i, word := range filter.Words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	filter.pattern = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+
+	// Clients send this back so the server knows they filtered with the current list
+	sum := sha256.Sum256([]byte(mode + "\n" + strings.Join(filter.Words, "\n")))
+	filter.Version = hex.EncodeToString(sum[:8])
+	return filter
+}
+
+// Apply masks the filtered words in text, or returns ErrFilteredWord in reject mode
+func (f WordFilter) Apply(text string) (string, error) {
+	if f.pattern == nil || !f.pattern.MatchString(text) {
+		return text, nil
+	}
+	if f.Mode == WordFilterReject {
+		return text, ErrFilteredWord
+	}
+	return f.pattern.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", len([]rune(word)))
+	}), nil
+}
+
+// CheckMessage makes sure a client filtered a message with the current list before encrypting it. The client sends
+// the plain text it encrypted as moderationText, which is only checked here and never stored or logged. Text that
+// still has a filtered word is refused in either mode, in mask mode the client should have masked it. The filter is
+// client enforced: a modified client can send clean moderationText with any ciphertext.
+func (f WordFilter) CheckMessage(version, body, moderationText string) error {
+	if f.Version != "" && version != f.Version {
+		return ErrWordFilterVersion
+	}
+	if len(moderationText) > MaxMessageLength {
+		return ErrMessageLength
+	}
+	if f.pattern == nil {
+		return nil
+	}
+	if body != "" && strings.TrimSpace(moderationText) == "" {
+		return ErrModerationText
+	}
+	if f.pattern.MatchString(moderationText) {
+		return ErrFilteredWord
+	}
+	return nil
+}
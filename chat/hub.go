@@ -0,0 +1,216 @@
+package chat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"strings"
+	"sync"
+)
+
+const (
+	EventMessage         = "message"
+	EventMessageUpdated  = "message_updated"
+	EventMessageDeleted  = "message_deleted"
+	EventReceipt         = "receipt"
+	EventTyping          = "typing"
+	EventRoomDeleted     = "room_deleted"
+	EventRoomKeyRotated  = "room_key_rotated"
+	EventRemovedFromRoom = "removed_from_room"
+	EventResync          = "resync"
+	EventError           = "error"
+)
+
+// MaxMessageLength is the longest message body in bytes
+const MaxMessageLength = 8 * 1024
+
+// MaxSearchTokens is how many blind index tokens a message can have, one per distinct word
+const MaxSearchTokens = 512
+
+const minCiphertextLength = 12 + 16
+
+var (
+	ErrNotRoomMember   = errors.New("user is not a member of the chat room")
+	ErrEmptyMessage    = errors.New("message body cannot be empty")
+	ErrMessageLength   = fmt.Errorf("message body cannot be longer than %d bytes", MaxMessageLength)
+	ErrNotCiphertext   = errors.New("message body must be base64 AES-GCM ciphertext")
+	ErrStaleKeyVersion = errors.New("message is encrypted with an old room key, fetch the current one from /chats/keys")
+	ErrSearchTokens    = fmt.Errorf("searchTokens must be at most %d blind index tokens of 32 lowercase hex characters", MaxSearchTokens)
+)
+
+// Hub keeps track of the connected WebSocket clients and delivers events to them. A user can be connected from more
+// than one device, each connection is its own client.
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[string]map[*Client]struct{}
+}
+
+// DefaultHub is the hub behind /ws
+var DefaultHub = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{
+		clients: make(map[string]map[*Client]struct{}),
+	}
+}
+
+func (h *Hub) register(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clients[client.userID] == nil {
+		h.clients[client.userID] = make(map[*Client]struct{})
+	}
+	h.clients[client.userID][client] = struct{}{}
+}
+
+func (h *Hub) unregister(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.clients[client.userID], client)
+	if len(h.clients[client.userID]) == 0 {
+		delete(h.clients, client.userID)
+	}
+}
+
+// IsOnline reports whether the user has at least one open connection
+func (h *Hub) IsOnline(userID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.clients[userID]) > 0
+}
+
+// SendToUsers delivers the event to every connection of the given users. It never blocks, a client that has fallen
+// too far behind is disconnected and catches up with last_message_id when it reconnects.
+func (h *Hub) SendToUsers(userIDs []string, event types.ChatEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println("Error encoding chat event:", err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, userID := range userIDs {
+		for client := range h.clients[userID] {
+			select {
+			case client.send <- payload:
+			default:
+				fmt.Println("Disconnecting slow chat client for user", userID)
+				client.disconnect()
+			}
+		}
+	}
+}
+
+// PublishToRoom delivers the event to every member of the room
+func (h *Hub) PublishToRoom(roomID string, event types.ChatEvent) error {
+	room, err := DefaultStore.Room(roomID)
+	if err != nil {
+		return err
+	}
+
+	h.SendToUsers(room.MemberIDs, event)
+	return nil
+}
+
+// SendMessage stores a message from a room member and delivers it to everyone in the room, the sender included.
+// The body has to be encrypted with the room's current key.
+func (h *Hub) SendMessage(message types.ChatMessage) (types.ChatMessage, error) {
+	room, err := DefaultStore.Room(message.RoomID)
+	if err != nil {
+		return types.ChatMessage{}, err
+	}
+	if !contains(room.MemberIDs, message.SenderID) {
+		return types.ChatMessage{}, ErrNotRoomMember
+	}
+	if IsMuted(room, message.SenderID) {
+		return types.ChatMessage{}, ErrMuted
+	}
+	// A message can be just attachments, but anything in the body has to be encrypted
+	if message.Body != "" || len(message.AttachmentIDs) == 0 {
+		if err := ValidateCiphertext(message.Body, message.KeyVersion, room); err != nil {
+			return types.ChatMessage{}, err
+		}
+	}
+	if err := ValidateSearchTokens(message.SearchTokens); err != nil {
+		return types.ChatMessage{}, err
+	}
+	if err := checkAttachments(message.SenderID, message.RoomID, message.AttachmentIDs); err != nil {
+		return types.ChatMessage{}, err
+	}
+
+	message, err = DefaultStore.SaveMessage(types.ChatMessage{
+		RoomID:        message.RoomID,
+		SenderID:      message.SenderID,
+		Body:          message.Body,
+		KeyVersion:    message.KeyVersion,
+		ClientID:      message.ClientID,
+		AttachmentIDs: message.AttachmentIDs,
+		SearchTokens:  message.SearchTokens,
+	})
+	if err != nil {
+		return types.ChatMessage{}, err
+	}
+	attachToMessage(message)
+
+	h.SendToUsers(room.MemberIDs, types.ChatEvent{
+		Type:    EventMessage,
+		RoomID:  message.RoomID,
+		Message: &message,
+	})
+	return message, nil
+}
+
+// ValidateCiphertext checks that a message body looks like AES-GCM output under the room's current key. The server
+// can't decrypt it, this only stops clients from sending plain text by mistake.
+func ValidateCiphertext(body string, keyVersion int, room types.ChatRoom) error {
+	if strings.TrimSpace(body) == "" {
+		return ErrEmptyMessage
+	}
+	if len(body) > MaxMessageLength {
+		return ErrMessageLength
+	}
+
+	// 12 byte nonce and 16 byte tag at the very least
+	ciphertext, err := base64.StdEncoding.DecodeString(body)
+	if err != nil || len(ciphertext) < minCiphertextLength {
+		return ErrNotCiphertext
+	}
+	if keyVersion != room.KeyVersion {
+		return ErrStaleKeyVersion
+	}
+	return nil
+}
+
+// ValidateSearchTokens checks the shape of a message's blind index tokens. The server can't tell whether they match
+// the body, a client sending wrong ones only makes its own messages harder to find.
+func ValidateSearchTokens(tokens []string) error {
+	if len(tokens) > MaxSearchTokens {
+		return ErrSearchTokens
+	}
+	for _, token := range tokens {
+		if !IsSearchToken(token) {
+			return ErrSearchTokens
+		}
+	}
+	return nil
+}
+
+// IsSearchToken reports whether token is 16 bytes in lowercase hex
+func IsSearchToken(token string) bool {
+	if len(token) != 32 {
+		return false
+	}
+	for _, c := range token {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/utils"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissingPublicKey = errors.New("chat room member has no usable public key")
+	ErrRoomChanged      = errors.New("chat room changed while its key was being rotated")
+)
+
+// WrapRoomKey makes a new room key and wraps it with every member's public key. The plain key is dropped as soon as
+// it's wrapped, so the server can never read the messages encrypted with it.
+func WrapRoomKey(roomID string, keyVersion int, memberIDs []string) ([]types.ChatRoomKey, error) {
+	roomKey, err := utils.GenerateSymmetricKey()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	keys := make([]types.ChatRoomKey, 0, len(memberIDs))
+	for _, memberID := range memberIDs {
+		// Public keys are saved under the ID with underscores, see SavePublicKey in the create handlers
+		wrappedKey, err := utils.EncryptSymmetricKey(strings.ReplaceAll(memberID, "-", "_"), roomKey)
+		if err != nil {
+			fmt.Println("Error wrapping room key for", memberID, err)
+			return nil, fmt.Errorf("%w: %s", ErrMissingPublicKey, memberID)
+		}
+
+		keys = append(keys, types.ChatRoomKey{
+			RoomID:     roomID,
+			KeyVersion: keyVersion,
+			UserID:     memberID,
+			WrappedKey: wrappedKey,
+			CreatedAt:  now,
+		})
+	}
+	return keys, nil
+}
+
+// SaveRoomKeys stores wrapped keys in chatRoomKeysCollection
+func SaveRoomKeys(keys []types.ChatRoomKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	documents := make([]interface{}, len(keys))
+	for i, key := range keys {
+		documents[i] = key
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomKeysCollection)
+	if _, err := collection.InsertMany(ctx, documents); err != nil {
+		fmt.Println("Error inserting chat room keys:", err)
+		return err
+	}
+	return nil
+}
+
+// RotateRoomKey sets the room's members and moves it to a new key that only those members can unwrap. Anyone removed
+// keeps the old keys they already had but can't read anything sent after this. The room is only updated if nobody
+// else rotated it in the meantime, otherwise ErrRoomChanged is returned and the caller can retry.
+func RotateRoomKey(room types.ChatRoom, memberIDs []string) (types.ChatRoom, error) {
+	keyVersion := room.KeyVersion + 1
+	keys, err := WrapRoomKey(room.RoomID, keyVersion, memberIDs)
+	if err != nil {
+		return types.ChatRoom{}, err
+	}
+	if err := SaveRoomKeys(keys); err != nil {
+		return types.ChatRoom{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomsCollection)
+	result, err := collection.UpdateOne(ctx, bson.M{"roomId": room.RoomID, "keyVersion": room.KeyVersion}, bson.M{
+		"$set": bson.M{
+			"memberIds":  memberIDs,
+			"keyVersion": keyVersion,
+			"updatedAt":  now,
+		},
+	})
+	if err == nil && result.MatchedCount == 0 {
+		err = ErrRoomChanged
+	}
+	if err != nil {
+		fmt.Println("Error updating chat room key version:", err)
+		// The keys belong to a version that never became current
+		keysCollection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomKeysCollection)
+		if _, deleteErr := keysCollection.DeleteMany(ctx, bson.M{"roomId": room.RoomID, "keyVersion": keyVersion}); deleteErr != nil {
+			fmt.Println("Error deleting unused chat room keys:", deleteErr)
+		}
+		return types.ChatRoom{}, err
+	}
+
+	removedIDs := []string{}
+	for _, memberID := range room.MemberIDs {
+		if !contains(memberIDs, memberID) {
+			removedIDs = append(removedIDs, memberID)
+		}
+	}
+	addedIDs := []string{}
+	for _, memberID := range memberIDs {
+		if !contains(room.MemberIDs, memberID) {
+			addedIDs = append(addedIDs, memberID)
+		}
+	}
+	if err := startReadStates(room.RoomID, addedIDs, now); err != nil {
+		fmt.Println("Error starting read states for room", room.RoomID+":", err)
+	}
+
+	room.MemberIDs = memberIDs
+	room.KeyVersion = keyVersion
+	room.UpdatedAt = now
+
+	DefaultHub.SendToUsers(memberIDs, types.ChatEvent{Type: EventRoomKeyRotated, RoomID: room.RoomID, KeyVersion: keyVersion})
+	DefaultHub.SendToUsers(removedIDs, types.ChatEvent{Type: EventRemovedFromRoom, RoomID: room.RoomID})
+
+	return room, nil
+}
+
+// RoomKeysForUser returns every key of the room wrapped for the user, oldest version first. Members only get the
+// versions from while they were in the room.
+func RoomKeysForUser(roomID, userID string) ([]types.ChatRoomKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomKeysCollection)
+	cursor, err := collection.Find(ctx, bson.M{"roomId": roomID, "userId": userID}, options.Find().SetSort(bson.D{{Key: "keyVersion", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	keys := []types.ChatRoomKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"time"
+)
+
+// MaxMuteDuration is the longest a member can be muted for
+const MaxMuteDuration = 30 * 24 * time.Hour
+
+var (
+	ErrMuted          = errors.New("you are muted in this chat room")
+	ErrBanned         = errors.New("user is banned from this chat room")
+	ErrCannotModerate = errors.New("only admins can mute or ban teachers")
+)
+
+// CanModerate reports whether the user can mute and ban members and handle reports in the room: admins and teachers
+// in the room can. Creating a room doesn't make a student a moderator of it.
+func CanModerate(room types.ChatRoom, userID, role string) bool {
+	if role == auth.RoleAdmin {
+		return true
+	}
+	return role == auth.RoleTeacher && contains(room.MemberIDs, userID)
+}
+
+// CheckModerationTarget returns ErrCannotModerate when a caller with the role can't mute or ban the user. Teachers
+// and admins can only be muted or banned by an admin.
+func CheckModerationTarget(userID, callerRole string) error {
+	if callerRole == auth.RoleAdmin {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Admins are teachers too
+	collection := db.MongoClient.Database(db.DbName).Collection(db.TeachersCollection)
+	count, err := collection.CountDocuments(ctx, bson.M{"teacherid": userID}, options.Count().SetLimit(1))
+	if err != nil {
+		fmt.Println("Error checking whether a chat member is staff:", err)
+		return err
+	}
+	if count > 0 {
+		return ErrCannotModerate
+	}
+	return nil
+}
+
+// IsMuted reports whether the member can't send messages right now
+func IsMuted(room types.ChatRoom, userID string) bool {
+	until, ok := room.MutedUntil[userID]
+	return ok && time.Now().Before(until)
+}
+
+// MuteMember stops a member from sending messages until the mute runs out, a zero duration unmutes them
+func MuteMember(room types.ChatRoom, userID string, duration time.Duration) error {
+	if !contains(room.MemberIDs, userID) {
+		return ErrNotRoomMember
+	}
+
+	update := bson.M{"$unset": bson.M{"mutedUntil." + userID: ""}}
+	if duration > 0 {
+		update = bson.M{"$set": bson.M{"mutedUntil." + userID: time.Now().UTC().Add(duration)}}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomsCollection)
+	if _, err := collection.UpdateOne(ctx, bson.M{"roomId": room.RoomID}, update); err != nil {
+		fmt.Println("Error updating chat room mutes:", err)
+		return err
+	}
+	return nil
+}
+
+// BanMember removes a member from the room, moving it to a new key, and stops them being added back
+func BanMember(room types.ChatRoom, userID string) (types.ChatRoom, error) {
+	if contains(room.MemberIDs, userID) {
+		memberIDs := []string{}
+		for _, memberID := range room.MemberIDs {
+			if memberID != userID {
+				memberIDs = append(memberIDs, memberID)
+			}
+		}
+
+		var err error
+		room, err = RotateRoomKey(room, memberIDs)
+		if err != nil {
+			return types.ChatRoom{}, err
+		}
+	}
+
+	return setBanned(room, userID, true)
+}
+
+// UnbanMember lets a banned user be added to the room again
+func UnbanMember(room types.ChatRoom, userID string) (types.ChatRoom, error) {
+	return setBanned(room, userID, false)
+}
+
+func setBanned(room types.ChatRoom, userID string, banned bool) (types.ChatRoom, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$pull": bson.M{"bannedIds": userID}}
+	if banned {
+		update = bson.M{"$addToSet": bson.M{"bannedIds": userID}, "$unset": bson.M{"mutedUntil." + userID: ""}}
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomsCollection)
+	if _, err := collection.UpdateOne(ctx, bson.M{"roomId": room.RoomID}, update); err != nil {
+		fmt.Println("Error updating chat room bans:", err)
+		return types.ChatRoom{}, err
+	}
+
+	return FindRoom(room.RoomID)
+}
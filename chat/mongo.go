@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"time"
+)
+
+// MongoStore keeps rooms and messages in chatRoomsCollection and chatMessagesCollection
+type MongoStore struct{}
+
+func (MongoStore) Room(roomID string) (types.ChatRoom, error) {
+	return FindRoom(roomID)
+}
+
+func (MongoStore) SaveMessage(message types.ChatMessage) (types.ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	message.MessageID = primitive.NewObjectID().Hex()
+	message.CreatedAt = time.Now().UTC()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+	if _, err := collection.InsertOne(ctx, message); err != nil {
+		fmt.Println("Error inserting chat message:", err)
+		return types.ChatMessage{}, err
+	}
+
+	roomsCollection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomsCollection)
+	_, err := roomsCollection.UpdateOne(ctx, bson.M{"roomId": message.RoomID}, bson.M{
+		"$set": bson.M{"updatedAt": message.CreatedAt},
+	})
+	if err != nil {
+		// The message is saved, the room only sorts a little lower in the list
+		fmt.Println("Error updating chat room timestamp:", err)
+	}
+
+	return message, nil
+}
+
+func (MongoStore) MessagesAfter(userID, lastMessageID string, limit int) ([]types.ChatMessage, bool, error) {
+	if _, err := primitive.ObjectIDFromHex(lastMessageID); err != nil {
+		return nil, false, nil
+	}
+
+	roomIDs, err := RoomIDsForUser(userID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+	cursor, err := collection.Find(ctx, bson.M{
+		"roomId":    bson.M{"$in": roomIDs},
+		"messageId": bson.M{"$gt": lastMessageID},
+	}, options.Find().SetSort(bson.D{{Key: "messageId", Value: 1}}).SetLimit(int64(limit)+1))
+	if err != nil {
+		return nil, false, err
+	}
+	defer cursor.Close(ctx)
+
+	messages := []types.ChatMessage{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, false, err
+	}
+	if len(messages) > limit {
+		return messages[:limit], false, nil
+	}
+	return messages, true, nil
+}
+
+// FindRoom loads a chat room, ErrRoomNotFound if it doesn't exist
+func FindRoom(roomID string) (types.ChatRoom, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomsCollection)
+
+	var room types.ChatRoom
+	err := collection.FindOne(ctx, bson.M{"roomId": roomID}).Decode(&room)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return room, ErrRoomNotFound
+	}
+	return room, err
+}
+
+// RoomIDsForUser returns the IDs of every room the user is a member of
+func RoomIDsForUser(userID string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomsCollection)
+	roomIDs, err := collection.Distinct(ctx, "roomId", bson.M{"memberIds": userID})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if id, ok := roomID.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
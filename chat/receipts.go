@@ -0,0 +1,218 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"time"
+)
+
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+var (
+	ErrInvalidReceipt = errors.New("receipt status must be either \"delivered\" or \"read\"")
+	ErrUnknownMessage = errors.New("message is not in the chat room")
+)
+
+// UpdateReadState moves the user's delivered or read watermark in the room up to messageID and tells the room.
+// Watermarks only ever move forward, so receipts arriving out of order are harmless.
+func (h *Hub) UpdateReadState(userID, roomID, messageID, status string) (types.ChatReadState, error) {
+	if status != ReceiptDelivered && status != ReceiptRead {
+		return types.ChatReadState{}, ErrInvalidReceipt
+	}
+
+	room, err := DefaultStore.Room(roomID)
+	if err != nil {
+		return types.ChatReadState{}, err
+	}
+	if !contains(room.MemberIDs, userID) {
+		return types.ChatReadState{}, ErrNotRoomMember
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messagesCollection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+	count, err := messagesCollection.CountDocuments(ctx, bson.M{"roomId": roomID, "messageId": messageID})
+	if err != nil {
+		fmt.Println("Error finding the receipt's message:", err)
+		return types.ChatReadState{}, err
+	}
+	if count == 0 {
+		return types.ChatReadState{}, ErrUnknownMessage
+	}
+
+	// Message IDs are ObjectIDs in hex, so $max on the strings keeps the newest
+	update := bson.M{
+		"$max": bson.M{"deliveredMessageId": messageID},
+		"$set": bson.M{"updatedAt": time.Now().UTC()},
+	}
+	if status == ReceiptRead {
+		update["$max"] = bson.M{"deliveredMessageId": messageID, "readMessageId": messageID}
+	} else {
+		update["$setOnInsert"] = bson.M{"readMessageId": ""}
+	}
+
+	var state types.ChatReadState
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatReadStatesCollection)
+	err = collection.FindOneAndUpdate(ctx, bson.M{"roomId": roomID, "userId": userID}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&state)
+	if err != nil {
+		fmt.Println("Error updating chat read state:", err)
+		return types.ChatReadState{}, err
+	}
+
+	// The user's other devices get it too, so their unread badges clear
+	h.SendToUsers(room.MemberIDs, types.ChatEvent{Type: EventReceipt, RoomID: roomID, ReadState: &state})
+	return state, nil
+}
+
+// SetTyping tells the other members of the room that the user started or stopped typing. Nothing is stored, clients
+// that miss the stop hide the indicator on their own after a few seconds.
+func (h *Hub) SetTyping(userID, roomID string, isTyping bool) error {
+	room, err := DefaultStore.Room(roomID)
+	if err != nil {
+		return err
+	}
+	if !contains(room.MemberIDs, userID) {
+		return ErrNotRoomMember
+	}
+
+	others := make([]string, 0, len(room.MemberIDs))
+	for _, memberID := range room.MemberIDs {
+		if memberID != userID {
+			others = append(others, memberID)
+		}
+	}
+
+	h.SendToUsers(others, types.ChatEvent{Type: EventTyping, RoomID: roomID, UserID: userID, IsTyping: isTyping})
+	return nil
+}
+
+// ReadStates returns the watermarks of every member of the room that has any
+func ReadStates(roomID string) ([]types.ChatReadState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatReadStatesCollection)
+	cursor, err := collection.Find(ctx, bson.M{"roomId": roomID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	states := []types.ChatReadState{}
+	if err := cursor.All(ctx, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// UnreadCounts counts the messages after the user's read watermark in each of their rooms. Their own messages and
+// deleted ones don't count.
+func UnreadCounts(userID string) ([]types.ChatUnreadCount, error) {
+	roomIDs, err := RoomIDsForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	statesCollection := db.MongoClient.Database(db.DbName).Collection(db.ChatReadStatesCollection)
+	cursor, err := statesCollection.Find(ctx, bson.M{"userId": userID, "roomId": bson.M{"$in": roomIDs}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	states := []types.ChatReadState{}
+	if err := cursor.All(ctx, &states); err != nil {
+		return nil, err
+	}
+	readMessageIDs := make(map[string]string, len(states))
+	for _, state := range states {
+		readMessageIDs[state.RoomID] = state.ReadMessageID
+	}
+
+	counts := make([]types.ChatUnreadCount, 0, len(roomIDs))
+	if len(roomIDs) == 0 {
+		return counts, nil
+	}
+
+	// One aggregation for every room, each branch of the $or uses the roomId/messageId index
+	afterWatermarks := make(bson.A, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		afterWatermarks = append(afterWatermarks, bson.M{"roomId": roomID, "messageId": bson.M{"$gt": readMessageIDs[roomID]}})
+	}
+	messagesCollection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+	countsCursor, err := messagesCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$or": afterWatermarks, "senderId": bson.M{"$ne": userID}, "isDeleted": false}}},
+		{{Key: "$group", Value: bson.M{"_id": "$roomId", "unread": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer countsCursor.Close(ctx)
+
+	var grouped []struct {
+		RoomID string `bson:"_id"`
+		Unread int64  `bson:"unread"`
+	}
+	if err := countsCursor.All(ctx, &grouped); err != nil {
+		return nil, err
+	}
+	unreadByRoom := make(map[string]int64, len(grouped))
+	for _, group := range grouped {
+		unreadByRoom[group.RoomID] = group.Unread
+	}
+
+	for _, roomID := range roomIDs {
+		counts = append(counts, types.ChatUnreadCount{
+			RoomID:        roomID,
+			UnreadCount:   unreadByRoom[roomID],
+			ReadMessageID: readMessageIDs[roomID],
+		})
+	}
+	return counts, nil
+}
+
+// startReadStates puts the watermarks of members who just joined the room at the time they joined, so the messages
+// sent before that don't count as unread for them. Members coming back keep any later watermark they had.
+func startReadStates(roomID string, userIDs []string, joinedAt time.Time) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Message IDs are ObjectIDs in hex, which start with their creation time
+	joined := primitive.NewObjectIDFromTimestamp(joinedAt).Hex()
+	models := make([]mongo.WriteModel, 0, len(userIDs))
+	for _, userID := range userIDs {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"roomId": roomID, "userId": userID}).
+			SetUpdate(bson.M{
+				"$max": bson.M{"deliveredMessageId": joined, "readMessageId": joined},
+				"$set": bson.M{"updatedAt": joinedAt},
+			}).
+			SetUpsert(true))
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatReadStatesCollection)
+	if _, err := collection.BulkWrite(ctx, models); err != nil {
+		fmt.Println("Error starting read states for new chat members:", err)
+		return err
+	}
+	return nil
+}
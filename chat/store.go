@@ -0,0 +1,106 @@
+package chat
+
+import (
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"sync"
+	"time"
+)
+
+var ErrRoomNotFound = errors.New("chat room not found")
+
+// Store is where the hub looks up room members and keeps messages so reconnecting clients can catch up
+type Store interface {
+	// Room returns the room with its members and current key version
+	Room(roomID string) (types.ChatRoom, error)
+	// SaveMessage stores a new message and returns it with MessageID and CreatedAt set
+	SaveMessage(message types.ChatMessage) (types.ChatMessage, error)
+	// MessagesAfter returns up to limit messages sent after lastMessageID in the user's rooms, oldest first.
+	// complete is false when older messages were missed and the client has to reload its rooms.
+	MessagesAfter(userID, lastMessageID string, limit int) (messages []types.ChatMessage, complete bool, err error)
+}
+
+// DefaultStore is used by the hub. It only keeps rooms and messages in memory until a persistent store is set in main.
+var DefaultStore Store = NewMemoryStore()
+
+// MemoryStore keeps rooms and the most recent messages in memory, useful for development
+type MemoryStore struct {
+	mu       sync.RWMutex
+	rooms    map[string]types.ChatRoom
+	messages []types.ChatMessage
+	limit    int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		rooms: make(map[string]types.ChatRoom),
+		limit: 1000,
+	}
+}
+
+// SetRoom creates or replaces a room
+func (s *MemoryStore) SetRoom(room types.ChatRoom) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room.MemberIDs = append([]string(nil), room.MemberIDs...)
+	s.rooms[room.RoomID] = room
+}
+
+func (s *MemoryStore) Room(roomID string) (types.ChatRoom, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, ok := s.rooms[roomID]
+	if !ok {
+		return types.ChatRoom{}, ErrRoomNotFound
+	}
+	room.MemberIDs = append([]string(nil), room.MemberIDs...)
+	return room, nil
+}
+
+func (s *MemoryStore) SaveMessage(message types.ChatMessage) (types.ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message.MessageID = primitive.NewObjectID().Hex()
+	message.CreatedAt = time.Now().UTC()
+
+	s.messages = append(s.messages, message)
+	if len(s.messages) > s.limit {
+		s.messages = s.messages[len(s.messages)-s.limit:]
+	}
+	return message, nil
+}
+
+func (s *MemoryStore) MessagesAfter(userID, lastMessageID string, limit int) ([]types.ChatMessage, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Anything older than what is still kept can't be replayed
+	if len(s.messages) > 0 && lastMessageID < s.messages[0].MessageID {
+		return nil, false, nil
+	}
+
+	messages := []types.ChatMessage{}
+	for _, message := range s.messages {
+		if message.MessageID <= lastMessageID || !contains(s.rooms[message.RoomID].MemberIDs, userID) {
+			continue
+		}
+		if len(messages) == limit {
+			return messages, false, nil
+		}
+		messages = append(messages, message)
+	}
+	return messages, true, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
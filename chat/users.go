@@ -0,0 +1,199 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/events"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"time"
+)
+
+// The chat profile in usersCollection is a copy of the student or teacher record. It is only ever written from
+// those records: on their events as they change, and by ReconcileChatUsers for anything an event missed.
+
+// SubscribeToUserEvents keeps usersCollection in sync with student and teacher records
+func SubscribeToUserEvents() {
+	events.Subscribe(func(event events.Event) error {
+		return SyncChatUser(event.Role, event.UserID)
+	}, events.StudentCreated, events.StudentUpdated, events.TeacherCreated, events.TeacherUpdated)
+
+	events.Subscribe(func(event events.Event) error {
+		return DeleteChatUser(event.UserID)
+	}, events.StudentDeleted, events.TeacherDeleted)
+}
+
+// ErrUserRecordNotFound is returned when there's no student or teacher record behind a chat user
+var ErrUserRecordNotFound = errors.New("no student or teacher record for the chat user")
+
+// CreateChatUser creates the chat profile for an existing student or teacher, or refreshes it if it exists already
+func CreateChatUser(role, userID string) error {
+	profile, err := loadChatProfile(role, userID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrUserRecordNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return saveChatProfile(profile)
+}
+
+// SyncChatUser copies the current student or teacher record into usersCollection, or removes the chat user if the
+// record is gone
+func SyncChatUser(role, userID string) error {
+	profile, err := loadChatProfile(role, userID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return DeleteChatUser(userID)
+	}
+	if err != nil {
+		return err
+	}
+	return saveChatProfile(profile)
+}
+
+// DeleteChatUser removes the user's chat profile
+func DeleteChatUser(userID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.UsersCollection)
+	if _, err := collection.DeleteOne(ctx, bson.M{"userId": userID}); err != nil {
+		fmt.Println("Error deleting chat user:", err)
+		return err
+	}
+	return nil
+}
+
+// ReconcileChatUsers rewrites every chat profile from the student and teacher records and removes profiles whose
+// record no longer exists
+func ReconcileChatUsers() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	userIDs := make(map[string]bool)
+	for _, role := range []string{auth.RoleStudent, auth.RoleTeacher} {
+		collectionName, _ := auth.UserCollection(role)
+		cursor, err := db.MongoClient.Database(db.DbName).Collection(collectionName).Find(ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+
+		for cursor.Next(ctx) {
+			profile, err := decodeChatProfile(role, cursor)
+			if err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+			if err := saveChatProfile(profile); err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+			userIDs[profile.UserId] = true
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.UsersCollection)
+	existing, err := collection.Distinct(ctx, "userId", bson.M{})
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, value := range existing {
+		userID, ok := value.(string)
+		if !ok || userIDs[userID] {
+			continue
+		}
+		if err := DeleteChatUser(userID); err != nil {
+			return err
+		}
+		removed++
+	}
+
+	fmt.Println("Reconciled", len(userIDs), "chat users, removed", removed)
+	return nil
+}
+
+// StartChatUserReconciliation runs ReconcileChatUsers now and then every interval
+func StartChatUserReconciliation(interval time.Duration) {
+	go func() {
+		for {
+			if err := ReconcileChatUsers(); err != nil {
+				fmt.Println("Error reconciling chat users:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func loadChatProfile(role, userID string) (types.CreateUserRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collectionName, idField := auth.UserCollection(role)
+	result := db.MongoClient.Database(db.DbName).Collection(collectionName).FindOne(ctx, bson.M{idField: userID})
+	if err := result.Err(); err != nil {
+		return types.CreateUserRequest{}, err
+	}
+	return decodeChatProfile(role, result)
+}
+
+func decodeChatProfile(role string, document interface{ Decode(interface{}) error }) (types.CreateUserRequest, error) {
+	if role == auth.RoleTeacher || role == auth.RoleAdmin {
+		var teacher types.Teacher
+		if err := document.Decode(&teacher); err != nil {
+			return types.CreateUserRequest{}, err
+		}
+		return types.CreateUserRequest{
+			UserId:            teacher.TeacherID,
+			UserType:          auth.RoleTeacher,
+			PreferredName:     teacher.PreferredName,
+			FirstName:         teacher.FirstName,
+			LastName:          teacher.LastName,
+			ProfilePictureURL: teacher.ProfilePictureURL,
+		}, nil
+	}
+
+	var student types.Student
+	if err := document.Decode(&student); err != nil {
+		return types.CreateUserRequest{}, err
+	}
+	return types.CreateUserRequest{
+		UserId:            student.StudentId,
+		UserType:          auth.RoleStudent,
+		PreferredName:     student.PreferredName,
+		FirstName:         student.FirstName,
+		LastName:          student.LastName,
+		ProfilePictureURL: student.ProfilePictureURL,
+	}, nil
+}
+
+func saveChatProfile(profile types.CreateUserRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.UsersCollection)
+	_, err := collection.UpdateOne(ctx, bson.M{"userId": profile.UserId}, bson.M{
+		"$set": bson.M{
+			"userType":          profile.UserType,
+			"preferredName":     profile.PreferredName,
+			"firstName":         profile.FirstName,
+			"lastName":          profile.LastName,
+			"profilePictureUrl": profile.ProfilePictureURL,
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		fmt.Println("Error saving chat user:", err)
+	}
+	return err
+}
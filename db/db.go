@@ -10,5 +10,20 @@ var TeachersCollection = "teachers"
 var StudentsCollection = "students"
 var UsersCollection = "users"
 var LessonsCollection = "lessons"
+var LessonSeriesCollection = "lessonSeries"
+var TeacherAvailabilityCollection = "teacherAvailability"
 var StudentAssignmentsCollection = "assignments"
 var StudentGamesCollection = "games"
+var RefreshTokensCollection = "refreshTokens"
+var PasswordResetsCollection = "passwordResets"
+var ChatRoomsCollection = "chatRooms"
+var ChatMessagesCollection = "chatMessages"
+var ChatRoomKeysCollection = "chatRoomKeys"
+var ChatReadStatesCollection = "chatReadStates"
+var ChatAttachmentsCollection = "chatAttachments"
+var ChatAttachmentUsageCollection = "chatAttachmentUsage"
+var ChatReportsCollection = "chatReports"
+var DeletedAccountsCollection = "deletedAccounts"
+var DataExportsCollection = "dataExports"
+var CalendarFeedsCollection = "calendarFeeds"
+var SchedulingLocksCollection = "schedulingLocks"
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+)
+
+// EnsureIndexes creates the indexes the server relies on. CreateMany is a no-op for indexes that already exist.
+func EnsureIndexes(ctx context.Context) error {
+	indexes := map[string][]mongo.IndexModel{
+		RefreshTokensCollection: {
+			{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "familyId", Value: 1}}},
+			{Keys: bson.D{{Key: "userId", Value: 1}}},
+			// Mongo removes expired refresh tokens on its own
+			{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		RegistrationCollection: {
+			{Keys: bson.D{{Key: "registrationcode", Value: 1}}},
+			{Keys: bson.D{{Key: "registrationid", Value: 1}}},
+			{Keys: bson.D{{Key: "teacherid", Value: 1}, {Key: "createdat", Value: -1}}},
+		},
+		VerificationsCollection: {
+			{Keys: bson.D{{Key: "tokenHash", Value: 1}}},
+			{Keys: bson.D{{Key: "email", Value: 1}, {Key: "createdAt", Value: -1}}},
+			{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		LessonsCollection: {
+			{Keys: bson.D{{Key: "lessonid", Value: 1}}},
+			{Keys: bson.D{{Key: "teacherid", Value: 1}, {Key: "scheduleddatetime", Value: -1}}},
+			{Keys: bson.D{{Key: "studentid", Value: 1}, {Key: "scheduleddatetime", Value: -1}}},
+			{Keys: bson.D{{Key: "teacherid", Value: 1}, {Key: "importuid", Value: 1}}},
+			// Generating a series twice never duplicates an occurrence
+			{
+				Keys:    bson.D{{Key: "seriesid", Value: 1}, {Key: "occurrencestart", Value: 1}},
+				Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"seriesid": bson.M{"$type": "string"}}),
+			},
+		},
+		LessonSeriesCollection: {
+			{Keys: bson.D{{Key: "seriesid", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "teacherid", Value: 1}}},
+			{Keys: bson.D{{Key: "studentid", Value: 1}}},
+			{Keys: bson.D{{Key: "generateduntil", Value: 1}}},
+		},
+		TeacherAvailabilityCollection: {
+			{Keys: bson.D{{Key: "teacherid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		UsersCollection: {
+			{Keys: bson.D{{Key: "userId", Value: 1}}},
+		},
+		ChatRoomsCollection: {
+			{Keys: bson.D{{Key: "roomId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "memberIds", Value: 1}, {Key: "updatedAt", Value: -1}}},
+		},
+		ChatMessagesCollection: {
+			{Keys: bson.D{{Key: "messageId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			// History pages backwards through a room by messageId
+			{Keys: bson.D{{Key: "roomId", Value: 1}, {Key: "messageId", Value: -1}}},
+			// Bodies are encrypted, search goes through the blind index tokens. They're hashes, so no stemming.
+			{Keys: bson.D{{Key: "searchTokens", Value: "text"}}, Options: options.Index().SetDefaultLanguage("none")},
+		},
+		ChatRoomKeysCollection: {
+			{Keys: bson.D{{Key: "roomId", Value: 1}, {Key: "keyVersion", Value: 1}, {Key: "userId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "roomId", Value: 1}}},
+		},
+		ChatReadStatesCollection: {
+			{Keys: bson.D{{Key: "roomId", Value: 1}, {Key: "userId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "userId", Value: 1}}},
+		},
+		ChatAttachmentsCollection: {
+			{Keys: bson.D{{Key: "attachmentId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "uploaderId", Value: 1}}},
+			{Keys: bson.D{{Key: "roomId", Value: 1}}},
+			{Keys: bson.D{{Key: "messageId", Value: 1}, {Key: "createdAt", Value: 1}}},
+		},
+		// One running total per user, reserved with a conditional $inc
+		ChatAttachmentUsageCollection: {
+			{Keys: bson.D{{Key: "userId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		ChatReportsCollection: {
+			{Keys: bson.D{{Key: "reportId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "roomId", Value: 1}, {Key: "createdAt", Value: 1}}},
+			// One report per reporter and message
+			{Keys: bson.D{{Key: "messageId", Value: 1}, {Key: "reporterId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		DeletedAccountsCollection: {
+			{Keys: bson.D{{Key: "userId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "purgeAt", Value: 1}}},
+		},
+		DataExportsCollection: {
+			{Keys: bson.D{{Key: "exportId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "expiresAt", Value: 1}}},
+		},
+		CalendarFeedsCollection: {
+			{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			// One feed per user, creating a new one replaces the old
+			{Keys: bson.D{{Key: "userId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		// One lock per teacher, student or room, see lockSchedules in the lessons handlers. Locks left by a crash expire.
+		SchedulingLocksCollection: {
+			{Keys: bson.D{{Key: "resource", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		PasswordResetsCollection: {
+			{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+	}
+
+	for collectionName, models := range indexes {
+		collection := MongoClient.Database(DbName).Collection(collectionName)
+		if _, err := collection.Indexes().CreateMany(ctx, models); err != nil {
+			log.Printf("Error creating indexes for %s: %v", collectionName, err)
+			return err
+		}
+	}
+
+	return nil
+}
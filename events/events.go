@@ -0,0 +1,65 @@
+package events
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Event types for changes to student and teacher records
+const (
+	StudentCreated = "student.created"
+	StudentUpdated = "student.updated"
+	StudentDeleted = "student.deleted"
+	TeacherCreated = "teacher.created"
+	TeacherUpdated = "teacher.updated"
+	TeacherDeleted = "teacher.deleted"
+)
+
+// Event says that a record changed. It only carries IDs, subscribers load the current record themselves so events
+// handled late or twice still leave things right.
+type Event struct {
+	Type       string
+	Role       string // "student" or "teacher"
+	UserID     string
+	OccurredAt time.Time
+}
+
+// Handler is called for every published event it subscribed to
+type Handler func(event Event) error
+
+var (
+	mu          sync.RWMutex
+	subscribers = make(map[string][]Handler)
+)
+
+// Subscribe calls the handler for every event of the given types
+func Subscribe(handler Handler, eventTypes ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, eventType := range eventTypes {
+		subscribers[eventType] = append(subscribers[eventType], handler)
+	}
+}
+
+// Publish hands the event to its subscribers before returning. Delivery is in process and best effort: a failing
+// subscriber is logged and doesn't fail the request that changed the record, reconciliation jobs catch up later.
+func Publish(eventType, role, userID string) {
+	event := Event{
+		Type:       eventType,
+		Role:       role,
+		UserID:     userID,
+		OccurredAt: time.Now().UTC(),
+	}
+
+	mu.RLock()
+	handlers := append([]Handler(nil), subscribers[eventType]...)
+	mu.RUnlock()
+
+	for _, handler := range handlers {
+		if err := handler(event); err != nil {
+			fmt.Println("Error handling", event.Type, "event for", event.UserID+":", err)
+		}
+	}
+}
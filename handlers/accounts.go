@@ -0,0 +1,410 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/events"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deleting a student or teacher moves their record to deletedAccountsCollection, so nothing else finds the account
+// any more, and only removes everything that belongs to it once the grace period is over.
+
+// AccountDeletionGracePeriod is how long a deleted account can be restored for, ACCOUNT_DELETION_GRACE_DAYS or 30 days
+var AccountDeletionGracePeriod = accountDeletionGracePeriodFromEnv()
+
+var (
+	ErrAccountNotFound = errors.New("account not found")
+	ErrEmailInUse      = errors.New("another account uses this email address now")
+)
+
+func accountDeletionGracePeriodFromEnv() time.Duration {
+	if v, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS")); err == nil && v >= 0 {
+		return time.Duration(v) * 24 * time.Hour
+	}
+	return 30 * 24 * time.Hour
+}
+
+// accountRole is the role events and deleted accounts are recorded under, admins are stored as teachers
+func accountRole(role string) string {
+	if collectionName, _ := auth.UserCollection(role); collectionName == db.TeachersCollection {
+		return auth.RoleTeacher
+	}
+	return auth.RoleStudent
+}
+
+// SoftDeleteAccount moves the student or teacher into deletedAccountsCollection and signs them out everywhere
+func SoftDeleteAccount(role, userID, deletedBy string) (types.DeletedAccount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	role = accountRole(role)
+	collectionName, idField := auth.UserCollection(role)
+	collection := db.MongoClient.Database(db.DbName).Collection(collectionName)
+
+	record, err := collection.FindOne(ctx, bson.M{idField: userID}).Raw()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return types.DeletedAccount{}, ErrAccountNotFound
+	}
+	if err != nil {
+		fmt.Println("Error finding the account to delete:", err)
+		return types.DeletedAccount{}, err
+	}
+
+	now := time.Now().UTC()
+	account := types.DeletedAccount{
+		UserID:    userID,
+		Role:      role,
+		Record:    record,
+		DeletedBy: deletedBy,
+		DeletedAt: now,
+		PurgeAt:   now.Add(AccountDeletionGracePeriod),
+	}
+	if email, ok := record.Lookup("emailaddress").StringValueOK(); ok {
+		account.Email = email
+	}
+	if teacherID, ok := record.Lookup("teacherid").StringValueOK(); ok && role == auth.RoleStudent {
+		account.TeacherID = teacherID
+	}
+
+	// The copy goes in first, so a failure in between never loses the record
+	deletedCollection := db.MongoClient.Database(db.DbName).Collection(db.DeletedAccountsCollection)
+	if _, err := deletedCollection.InsertOne(ctx, account); err != nil {
+		fmt.Println("Error inserting deleted account:", err)
+		return types.DeletedAccount{}, err
+	}
+	if _, err := collection.DeleteOne(ctx, bson.M{idField: userID}); err != nil {
+		fmt.Println("Error deleting the account:", err)
+		if _, undoErr := deletedCollection.DeleteOne(ctx, bson.M{"userId": userID}); undoErr != nil {
+			fmt.Println("Error undoing the account deletion:", undoErr)
+		}
+		return types.DeletedAccount{}, err
+	}
+
+	if _, err := auth.RevokeAllRefreshTokens(userID); err != nil {
+		fmt.Println("Error signing out deleted account:", err)
+	}
+	if _, err := auth.RevokeCalendarFeed(userID); err != nil {
+		fmt.Println("Error turning off the deleted account's calendar feed:", err)
+	}
+
+	if role == auth.RoleTeacher {
+		events.Publish(events.TeacherDeleted, role, userID)
+	} else {
+		events.Publish(events.StudentDeleted, role, userID)
+	}
+
+	fmt.Println("Deleted", role, userID, "- it will be purged at", account.PurgeAt)
+	return account, nil
+}
+
+// FindDeletedAccount loads an account waiting to be purged
+func FindDeletedAccount(userID string) (types.DeletedAccount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.DeletedAccountsCollection)
+
+	var account types.DeletedAccount
+	err := collection.FindOne(ctx, bson.M{"userId": userID}).Decode(&account)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return account, ErrAccountNotFound
+	}
+	return account, err
+}
+
+// RestoreAccount puts a deleted account back as it was. It fails with ErrEmailInUse if someone signed up with the
+// same email address in the meantime.
+func RestoreAccount(account types.DeletedAccount) error {
+	if account.Email != "" {
+		_, err := auth.FindUserIDByEmail(account.Role, account.Email)
+		if err == nil {
+			return ErrEmailInUse
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collectionName, _ := auth.UserCollection(account.Role)
+	collection := db.MongoClient.Database(db.DbName).Collection(collectionName)
+	if _, err := collection.InsertOne(ctx, account.Record); err != nil {
+		fmt.Println("Error restoring the account:", err)
+		return err
+	}
+
+	deletedCollection := db.MongoClient.Database(db.DbName).Collection(db.DeletedAccountsCollection)
+	if _, err := deletedCollection.DeleteOne(ctx, bson.M{"userId": account.UserID}); err != nil {
+		// The account works again, the purge job skips accounts that exist
+		fmt.Println("Error removing the restored account from deleted accounts:", err)
+	}
+
+	// Recreates the chat profile
+	if account.Role == auth.RoleTeacher {
+		events.Publish(events.TeacherCreated, account.Role, account.UserID)
+	} else {
+		events.Publish(events.StudentCreated, account.Role, account.UserID)
+	}
+
+	fmt.Println("Restored", account.Role, account.UserID)
+	return nil
+}
+
+// PurgeAccount removes everything that belongs to a deleted account: its lessons, assignments, games, tokens, chat
+// data and messages (see purgeChatData), the reports it filed or is named in, data exports, public key and profile
+// picture, and finally the deleted account itself. A teacher's students are left without a teacher. It can be run
+// again after a failure.
+func PurgeAccount(account types.DeletedAccount) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// An account restored while the job was running is left alone
+	collectionName, idField := auth.UserCollection(account.Role)
+	count, err := db.MongoClient.Database(db.DbName).Collection(collectionName).CountDocuments(ctx, bson.M{idField: account.UserID})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	deletes := map[string]bson.M{
+		db.VerificationsCollection:       {"userId": account.UserID},
+		db.PasswordResetsCollection:      {"userId": account.UserID},
+		db.RefreshTokensCollection:       {"userId": account.UserID},
+		db.CalendarFeedsCollection:       {"userId": account.UserID},
+		db.UsersCollection:               {"userId": account.UserID},
+		db.ChatReadStatesCollection:      {"userId": account.UserID},
+		db.ChatRoomKeysCollection:        {"userId": account.UserID},
+		db.ChatAttachmentUsageCollection: {"userId": account.UserID},
+		db.StudentAssignmentsCollection:  {"studentid": account.UserID},
+		db.StudentGamesCollection:        {"studentid": account.UserID},
+		db.LessonsCollection:             {"studentid": account.UserID},
+		db.LessonSeriesCollection:        {"studentid": account.UserID},
+		// Reports quote the reported message and the reporter's reason, so they go whichever side the account was on
+		db.ChatReportsCollection: {"$or": bson.A{bson.M{"reporterId": account.UserID}, bson.M{"senderId": account.UserID}}},
+	}
+	if account.Role == auth.RoleTeacher {
+		delete(deletes, db.StudentAssignmentsCollection)
+		delete(deletes, db.StudentGamesCollection)
+		deletes[db.LessonsCollection] = bson.M{"teacherid": account.UserID}
+		deletes[db.LessonSeriesCollection] = bson.M{"teacherid": account.UserID}
+		deletes[db.TeacherAvailabilityCollection] = bson.M{"teacherid": account.UserID}
+		deletes[db.RegistrationCollection] = bson.M{"teacherid": account.UserID}
+	}
+
+	for collectionName, filter := range deletes {
+		if _, err := db.MongoClient.Database(db.DbName).Collection(collectionName).DeleteMany(ctx, filter); err != nil {
+			fmt.Println("Error purging", collectionName, "for", account.UserID+":", err)
+			return err
+		}
+	}
+
+	// An export whose zip couldn't be removed is left behind, the purge is tried again until it's gone
+	if _, err := removeDataExports(ctx, bson.M{"userId": account.UserID}); err != nil {
+		return err
+	}
+	exportsLeft, err := db.MongoClient.Database(db.DbName).Collection(db.DataExportsCollection).CountDocuments(ctx, bson.M{"userId": account.UserID})
+	if err != nil {
+		return err
+	}
+	if exportsLeft > 0 {
+		return fmt.Errorf("%d data exports could not be removed", exportsLeft)
+	}
+
+	if err := purgeChatData(ctx, account.UserID); err != nil {
+		return err
+	}
+
+	// Their students stay, without a teacher until an admin assigns them another one
+	if account.Role == auth.RoleTeacher {
+		studentsCollection := db.MongoClient.Database(db.DbName).Collection(db.StudentsCollection)
+		if _, err := studentsCollection.UpdateMany(ctx, bson.M{"teacherid": account.UserID}, bson.M{"$set": bson.M{"teacherid": ""}}); err != nil {
+			return err
+		}
+	}
+
+	if err := removeAccountFiles(ctx, account); err != nil {
+		return err
+	}
+
+	deletedCollection := db.MongoClient.Database(db.DbName).Collection(db.DeletedAccountsCollection)
+	if _, err := deletedCollection.DeleteOne(ctx, bson.M{"userId": account.UserID}); err != nil {
+		return err
+	}
+
+	fmt.Println("Purged", account.Role, account.UserID)
+	return nil
+}
+
+// purgeChatData replaces the account's messages with tombstones, like deleting them one by one, so the rest of the
+// room still sees that something was said. The account stops being a member of its rooms, rooms it created are left
+// without a creator so only admins can delete them, and rooms nobody is left in are removed.
+func purgeChatData(ctx context.Context, userID string) error {
+	if err := chat.DeleteAttachments(bson.M{"uploaderId": userID}); err != nil {
+		return err
+	}
+
+	messagesCollection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+	if _, err := messagesCollection.UpdateMany(ctx, bson.M{"senderId": userID, "isDeleted": false}, bson.M{
+		"$set":   bson.M{"body": "", "isDeleted": true, "deletedAt": time.Now().UTC()},
+		"$unset": bson.M{"attachmentIds": "", "searchTokens": ""},
+	}); err != nil {
+		return err
+	}
+
+	// Rooms nobody else is in go first, so running the purge again after a failure still finds them
+	roomsCollection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomsCollection)
+	emptyRoomIDs, err := roomsCollection.Distinct(ctx, "roomId", bson.M{
+		"$or":       bson.A{bson.M{"memberIds": userID}, bson.M{"createdBy": userID}},
+		"memberIds": bson.M{"$not": bson.M{"$elemMatch": bson.M{"$ne": userID}}},
+	})
+	if err != nil {
+		return err
+	}
+	if len(emptyRoomIDs) > 0 {
+		inEmptyRoom := bson.M{"roomId": bson.M{"$in": emptyRoomIDs}}
+		if err := chat.DeleteAttachments(inEmptyRoom); err != nil {
+			return err
+		}
+		for _, collectionName := range []string{db.ChatMessagesCollection, db.ChatRoomKeysCollection, db.ChatReadStatesCollection,
+			db.ChatReportsCollection, db.ChatRoomsCollection} {
+			if _, err := db.MongoClient.Database(db.DbName).Collection(collectionName).DeleteMany(ctx, inEmptyRoom); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := roomsCollection.UpdateMany(ctx, bson.M{"memberIds": userID}, bson.M{
+		"$pull":  bson.M{"memberIds": userID},
+		"$unset": bson.M{"mutedUntil." + userID: ""},
+	}); err != nil {
+		return err
+	}
+	if _, err := roomsCollection.UpdateMany(ctx, bson.M{"createdBy": userID}, bson.M{"$set": bson.M{"createdBy": ""}}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// removeAccountFiles removes the account's public key and its profile picture, unless another account uses the same
+// picture file
+func removeAccountFiles(ctx context.Context, account types.DeletedAccount) error {
+	keyPath := filepath.Join("keys", strings.ReplaceAll(account.UserID, "-", "_")+".pem")
+	if err := os.Remove(keyPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	pictureURL, _ := account.Record.Lookup("profilepictureurl").StringValueOK()
+	if !strings.Contains(pictureURL, "/uploads/profileImages/") {
+		return nil
+	}
+	fileName := path.Base(pictureURL)
+	if fileName == "" || fileName == "." || fileName == "/" {
+		return nil
+	}
+
+	for _, collectionName := range []string{db.StudentsCollection, db.TeachersCollection} {
+		count, err := db.MongoClient.Database(db.DbName).Collection(collectionName).CountDocuments(ctx, bson.M{"profilepictureurl": pictureURL})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+	}
+
+	if err := os.Remove(filepath.Join("uploads", "profileImages", fileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// PurgeExpiredAccounts purges every deleted account whose grace period is over
+func PurgeExpiredAccounts() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.DeletedAccountsCollection)
+	cursor, err := collection.Find(ctx, bson.M{"purgeAt": bson.M{"$lte": time.Now().UTC()}}, options.Find().SetLimit(100))
+	if err != nil {
+		return 0, err
+	}
+
+	accounts := []types.DeletedAccount{}
+	err = cursor.All(ctx, &accounts)
+	cursor.Close(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, account := range accounts {
+		if err := PurgeAccount(account); err != nil {
+			fmt.Println("Error purging", account.Role, account.UserID+", will retry:", err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// StartAccountPurgeJob runs PurgeExpiredAccounts every interval
+func StartAccountPurgeJob(interval time.Duration) {
+	go func() {
+		for {
+			if _, err := PurgeExpiredAccounts(); err != nil {
+				fmt.Println("Error purging deleted accounts:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// ListDeletedAccountsHandler lists the accounts that can still be restored, next to be purged first
+func ListDeletedAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.DeletedAccountsCollection)
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "purgeAt", Value: 1}}))
+	if err != nil {
+		fmt.Println("Error listing deleted accounts:", err)
+		http.Error(w, "Error listing deleted accounts", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	accounts := []types.DeletedAccount{}
+	if err := cursor.All(ctx, &accounts); err != nil {
+		fmt.Println("Error decoding deleted accounts:", err)
+		http.Error(w, "Error listing deleted accounts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.ListDeletedAccountsResponse{Accounts: accounts})
+}
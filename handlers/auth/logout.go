@@ -0,0 +1,89 @@
+package authHandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+)
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.LogoutRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	response, err := logout(req)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Error logging out", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func logout(req types.LogoutRequest) (types.LogoutResponse, error) {
+	err := auth.RevokeRefreshTokenFamily(req.RefreshToken)
+	if err != nil {
+		fmt.Println("Error revoking refresh token family:", err)
+		return types.LogoutResponse{
+			IsLoggedOut: false,
+		}, err
+	}
+
+	return types.LogoutResponse{
+		IsLoggedOut: true,
+	}, nil
+}
+
+// LogoutAllHandler revokes every refresh token the caller has, e.g. when a device was lost. Needs auth.RequireAuth.
+func LogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := auth.ClaimsFromRequest(r)
+	if !ok {
+		http.Error(w, "Missing access token", http.StatusUnauthorized)
+		return
+	}
+
+	response, err := logoutAll(claims.UserID)
+	if err != nil {
+		http.Error(w, "Error logging out of all sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func logoutAll(userID string) (types.LogoutAllResponse, error) {
+	revoked, err := auth.RevokeAllRefreshTokens(userID)
+	if err != nil {
+		fmt.Println("Error revoking all refresh tokens for user", userID, ":", err)
+		return types.LogoutAllResponse{
+			IsLoggedOut: false,
+		}, err
+	}
+
+	return types.LogoutAllResponse{
+		IsLoggedOut:     true,
+		SessionsRevoked: revoked,
+	}, nil
+}
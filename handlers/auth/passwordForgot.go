@@ -0,0 +1,127 @@
+package authHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/mailer"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"os"
+	"time"
+)
+
+// PasswordResetTTL is how long an emailed password reset token can be used for
+var PasswordResetTTL = 1 * time.Hour
+
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.ForgotPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.EmailAddress == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserType == "" {
+		req.UserType = auth.RoleStudent
+	}
+	if req.UserType != auth.RoleStudent && req.UserType != auth.RoleTeacher {
+		http.Error(w, "Invalid request body, \"user_type\" must be either \"student\" or \"teacher\"", http.StatusBadRequest)
+		return
+	}
+
+	fmt.Println("ForgotPassword request incoming...")
+
+	// Limited before the account is looked up, so addresses with and without an account are answered alike
+	if wait := auth.DefaultEmailLimiter.Allow("passwordReset", req.EmailAddress); wait > 0 {
+		auth.WriteTooManyEmails(w, wait)
+		return
+	}
+
+	response, err := forgotPassword(req)
+	if err != nil {
+		http.Error(w, "Error sending password reset email", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func forgotPassword(req types.ForgotPasswordRequest) (types.ForgotPasswordResponse, error) {
+	// The response is the same whether or not the account exists so this can't be used to find accounts
+	response := types.ForgotPasswordResponse{
+		IsSent: true,
+	}
+
+	userID, err := auth.FindUserIDByEmail(req.UserType, req.EmailAddress)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			fmt.Println("Password reset requested for unknown", req.UserType, "email")
+			return response, nil
+		}
+		return types.ForgotPasswordResponse{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	collection := db.MongoClient.Database(db.DbName).Collection(db.PasswordResetsCollection)
+
+	// Only the newest reset email should work
+	_, err = collection.UpdateMany(ctx, bson.M{"userId": userID, "usedAt": 0}, bson.M{
+		"$set": bson.M{"usedAt": now.Unix()},
+	})
+	if err != nil {
+		fmt.Println("Error invalidating old password reset tokens:", err)
+		return types.ForgotPasswordResponse{}, err
+	}
+
+	token, err := auth.NewOpaqueToken()
+	if err != nil {
+		return types.ForgotPasswordResponse{}, err
+	}
+
+	_, err = collection.InsertOne(ctx, types.PasswordReset{
+		TokenHash: auth.HashToken(token),
+		UserID:    userID,
+		Role:      req.UserType,
+		Email:     req.EmailAddress,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(PasswordResetTTL),
+		UsedAt:    0,
+	})
+	if err != nil {
+		fmt.Println("Error inserting password reset token into the database:", err)
+		return types.ForgotPasswordResponse{}, err
+	}
+
+	body := fmt.Sprintf("Someone asked to reset the password for your Aspire To Expand account.\n\n"+
+		"Your password reset code is:\n\n%s\n\n"+
+		"It expires in %d minutes and can only be used once. If you didn't ask for this you can ignore this email.\n",
+		token, int(PasswordResetTTL.Minutes()))
+	if resetURL := os.Getenv("PASSWORD_RESET_URL"); resetURL != "" {
+		body += fmt.Sprintf("\nOr open this link to choose a new password: %s?token=%s\n", resetURL, token)
+	}
+
+	err = mailer.Send(types.EmailMessage{
+		To:      req.EmailAddress,
+		Subject: "Reset your Aspire To Expand password",
+		Body:    body,
+	})
+	if err != nil {
+		return types.ForgotPasswordResponse{}, err
+	}
+
+	return response, nil
+}
@@ -0,0 +1,91 @@
+package authHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"time"
+)
+
+// MinPasswordLength is the shortest password accepted when resetting a password
+const MinPasswordLength = 8
+
+var errInvalidResetToken = errors.New("password reset token is invalid, expired or already used")
+
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.ResetPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.NewPassword) < MinPasswordLength {
+		http.Error(w, fmt.Sprintf("Invalid request body, \"new_password\" must be at least %d characters", MinPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Println("ResetPassword request incoming...")
+
+	response, err := resetPassword(req)
+	if err != nil {
+		if errors.Is(err, errInvalidResetToken) {
+			http.Error(w, "Password reset code is invalid or has expired", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func resetPassword(req types.ResetPasswordRequest) (types.ResetPasswordResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	collection := db.MongoClient.Database(db.DbName).Collection(db.PasswordResetsCollection)
+
+	// Marking the token as used in the same query that finds it makes sure it can only be used once
+	var reset types.PasswordReset
+	err := collection.FindOneAndUpdate(ctx, bson.M{
+		"tokenHash": auth.HashToken(req.Token),
+		"usedAt":    0,
+		"expiresAt": bson.M{"$gt": now},
+	}, bson.M{
+		"$set": bson.M{"usedAt": now.Unix()},
+	}).Decode(&reset)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return types.ResetPasswordResponse{IsReset: false}, errInvalidResetToken
+		}
+		fmt.Println("Error finding password reset token:", err)
+		return types.ResetPasswordResponse{IsReset: false}, err
+	}
+
+	if err := auth.SetPassword(reset.Role, reset.UserID, req.NewPassword); err != nil {
+		return types.ResetPasswordResponse{IsReset: false}, err
+	}
+
+	// Anyone who was signed in with the old password gets signed out
+	if _, err := auth.RevokeAllRefreshTokens(reset.UserID); err != nil {
+		return types.ResetPasswordResponse{IsReset: false}, err
+	}
+
+	return types.ResetPasswordResponse{
+		IsReset: true,
+	}, nil
+}
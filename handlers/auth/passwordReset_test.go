@@ -0,0 +1,233 @@
+package authHandlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/mailer"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// The database is mocked, it answers each command with the next queued response and records what was sent. The
+// tests check the queries themselves with matchesResetQuery to decide what a real database would have answered.
+
+var resetCodePattern = regexp.MustCompile(`reset code is:\n\n(\S+)\n`)
+
+func postJSON(t *testing.T, handler http.HandlerFunc, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload)))
+	return recorder
+}
+
+// useMemoryMailer captures the emails sent during the test
+func useMemoryMailer(t *testing.T) *mailer.MemoryMailer {
+	t.Helper()
+	previous := mailer.Default
+	memory := &mailer.MemoryMailer{}
+	mailer.Default = memory
+	t.Cleanup(func() { mailer.Default = previous })
+	return memory
+}
+
+// startedCommand returns the next command sent to the database with the given name, failing if there isn't one
+func startedCommand(mt *mtest.T, name string) bson.Raw {
+	mt.Helper()
+	for event := mt.GetStartedEvent(); event != nil; event = mt.GetStartedEvent() {
+		if event.CommandName == name {
+			return event.Command
+		}
+	}
+	mt.Fatalf("no %s command was sent", name)
+	return nil
+}
+
+// requestReset runs the forgot password flow for a student and returns the emailed code and the stored reset
+func requestReset(mt *mtest.T, memory *mailer.MemoryMailer, emailAddress string) (string, types.PasswordReset) {
+	mt.Helper()
+	mt.AddMockResponses(
+		mtest.CreateCursorResponse(0, db.DbName+"."+db.StudentsCollection, mtest.FirstBatch, bson.D{
+			{Key: "studentid", Value: "student-1"},
+			{Key: "emailaddress", Value: emailAddress},
+		}),
+		mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+		mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+	)
+
+	recorder := postJSON(mt.T, ForgotPasswordHandler, types.ForgotPasswordRequest{EmailAddress: emailAddress, UserType: auth.RoleStudent})
+	if recorder.Code != http.StatusOK {
+		mt.Fatalf("forgot password answered %d: %s", recorder.Code, recorder.Body)
+	}
+
+	sent := memory.Sent()
+	if len(sent) != 1 || sent[0].To != emailAddress {
+		mt.Fatalf("got emails %+v, want one to %s", sent, emailAddress)
+	}
+	match := resetCodePattern.FindStringSubmatch(sent[0].Body)
+	if match == nil {
+		mt.Fatalf("no reset code in the email:\n%s", sent[0].Body)
+	}
+	code := match[1]
+
+	insert := startedCommand(mt, "insert")
+	var reset types.PasswordReset
+	if err := insert.Lookup("documents", "0").Unmarshal(&reset); err != nil {
+		mt.Fatalf("decoding the stored reset: %v", err)
+	}
+	if reset.TokenHash != auth.HashToken(code) || reset.TokenHash == code {
+		mt.Fatalf("stored token hash %q isn't the hash of the emailed code", reset.TokenHash)
+	}
+	if reset.UserID != "student-1" || reset.UsedAt != 0 {
+		mt.Fatalf("stored reset %+v, want an unused one for student-1", reset)
+	}
+	return code, reset
+}
+
+// matchesResetQuery reports whether the reset is found by the query resetPassword sent with findAndModify
+func matchesResetQuery(mt *mtest.T, query bson.Raw, reset types.PasswordReset) bool {
+	mt.Helper()
+	var filter struct {
+		TokenHash string `bson:"tokenHash"`
+		UsedAt    int64  `bson:"usedAt"`
+		ExpiresAt struct {
+			After time.Time `bson:"$gt"`
+		} `bson:"expiresAt"`
+	}
+	if err := bson.Unmarshal(query, &filter); err != nil {
+		mt.Fatalf("decoding the reset query: %v", err)
+	}
+	if elements, _ := query.Elements(); len(elements) != 3 {
+		mt.Fatalf("the reset query %s isn't the tokenHash, usedAt and expiresAt query these tests expect", query)
+	}
+	if filter.ExpiresAt.After.IsZero() {
+		mt.Fatalf("the reset query %s doesn't check the expiry", query)
+	}
+	return reset.TokenHash == filter.TokenHash && reset.UsedAt == filter.UsedAt && reset.ExpiresAt.After(filter.ExpiresAt.After)
+}
+
+// resetWith sends the code to ResetPasswordHandler, with the database answering as it would for the stored reset
+func resetWith(mt *mtest.T, code string, stored *types.PasswordReset) (*httptest.ResponseRecorder, bson.Raw) {
+	mt.Helper()
+	mt.ClearEvents()
+	mt.ClearMockResponses()
+
+	// The mock can't look at a query before answering it, so the handler runs once to see the query it sends and then
+	// again with the answer a real database would give
+	storedDocument, err := bson.Marshal(stored)
+	if err != nil {
+		mt.Fatal(err)
+	}
+	found := mtest.CreateSuccessResponse(
+		bson.E{Key: "value", Value: bson.Raw(storedDocument)},
+		bson.E{Key: "lastErrorObject", Value: bson.D{{Key: "n", Value: 1}, {Key: "updatedExisting", Value: true}}},
+	)
+	notFound := mtest.CreateSuccessResponse(
+		bson.E{Key: "value", Value: nil},
+		bson.E{Key: "lastErrorObject", Value: bson.D{{Key: "n", Value: 0}, {Key: "updatedExisting", Value: false}}},
+	)
+
+	mt.AddMockResponses(notFound)
+	postJSON(mt.T, ResetPasswordHandler, types.ResetPasswordRequest{Token: code, NewPassword: "a new password"})
+	command := startedCommand(mt, "findAndModify")
+	query := command.Lookup("query").Document()
+
+	mt.ClearEvents()
+	mt.ClearMockResponses()
+	if matchesResetQuery(mt, query, *stored) {
+		mt.AddMockResponses(
+			found,
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}, bson.E{Key: "nModified", Value: 2}),
+		)
+	} else {
+		mt.AddMockResponses(notFound)
+	}
+
+	recorder := postJSON(mt.T, ResetPasswordHandler, types.ResetPasswordRequest{Token: code, NewPassword: "a new password"})
+	command = startedCommand(mt, "findAndModify")
+	return recorder, command
+}
+
+// markUsed applies the findAndModify update to the stored reset
+func markUsed(mt *mtest.T, command bson.Raw, stored *types.PasswordReset) {
+	mt.Helper()
+	usedAt, ok := command.Lookup("update", "$set", "usedAt").AsInt64OK()
+	if !ok || usedAt == 0 {
+		mt.Fatalf("the reset doesn't mark the token as used: %s", command.Lookup("update"))
+	}
+	stored.UsedAt = usedAt
+}
+
+func TestForgotAndResetPassword(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("the emailed code resets the password once", func(mt *mtest.T) {
+		db.MongoClient = mt.Client
+		memory := useMemoryMailer(mt.T)
+
+		code, stored := requestReset(mt, memory, "reset-once@example.com")
+
+		recorder, command := resetWith(mt, code, &stored)
+		if recorder.Code != http.StatusOK {
+			mt.Fatalf("reset answered %d: %s", recorder.Code, recorder.Body)
+		}
+		var response types.ResetPasswordResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || !response.IsReset {
+			mt.Fatalf("got %+v, %v, want IsReset", response, err)
+		}
+		if update := startedCommand(mt, "update"); update.Lookup("update").StringValue() != db.StudentsCollection {
+			mt.Fatalf("the new password was saved in %s", update.Lookup("update"))
+		}
+		if revoke := startedCommand(mt, "update"); revoke.Lookup("update").StringValue() != db.RefreshTokensCollection {
+			mt.Fatalf("refresh tokens weren't revoked, got an update of %s", revoke.Lookup("update"))
+		}
+		markUsed(mt, command, &stored)
+
+		recorder, _ = resetWith(mt, code, &stored)
+		if recorder.Code != http.StatusBadRequest {
+			mt.Fatalf("reusing the code answered %d, want 400", recorder.Code)
+		}
+		if event := mt.GetStartedEvent(); event != nil {
+			mt.Fatalf("a reused code still sent %s", event.CommandName)
+		}
+	})
+
+	mt.Run("an expired code is refused", func(mt *mtest.T) {
+		db.MongoClient = mt.Client
+		memory := useMemoryMailer(mt.T)
+
+		code, stored := requestReset(mt, memory, "reset-expired@example.com")
+		if ttl := time.Until(stored.ExpiresAt); ttl <= 0 || ttl > PasswordResetTTL {
+			mt.Fatalf("the code expires in %v, want at most %v", ttl, PasswordResetTTL)
+		}
+		stored.ExpiresAt = time.Now().Add(-time.Minute)
+
+		recorder, _ := resetWith(mt, code, &stored)
+		if recorder.Code != http.StatusBadRequest {
+			mt.Fatalf("an expired code answered %d, want 400", recorder.Code)
+		}
+	})
+
+	mt.Run("a different code is refused", func(mt *mtest.T) {
+		db.MongoClient = mt.Client
+		memory := useMemoryMailer(mt.T)
+
+		_, stored := requestReset(mt, memory, "reset-wrong@example.com")
+		recorder, _ := resetWith(mt, "not-the-emailed-code", &stored)
+		if recorder.Code != http.StatusBadRequest {
+			mt.Fatalf("a wrong code answered %d, want 400", recorder.Code)
+		}
+	})
+}
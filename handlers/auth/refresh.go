@@ -0,0 +1,51 @@
+package authHandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+)
+
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.RefreshTokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	response, err := refreshToken(req)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrExpiredToken) || errors.Is(err, auth.ErrTokenReuse) {
+			http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Error refreshing session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func refreshToken(req types.RefreshTokenRequest) (types.RefreshTokenResponse, error) {
+	tokens, err := auth.RotateRefreshToken(req.RefreshToken)
+	if err != nil {
+		fmt.Println("Error rotating refresh token:", err)
+		return types.RefreshTokenResponse{}, err
+	}
+
+	return types.RefreshTokenResponse{
+		AccessToken:  tokens.AccessToken,
+		ExpiresAt:    tokens.ExpiresAt,
+		RefreshToken: tokens.RefreshToken,
+	}, nil
+}
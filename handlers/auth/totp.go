@@ -0,0 +1,232 @@
+package authHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+var (
+	errTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	errTOTPNotEnrolling   = errors.New("two-factor enrollment has not been started")
+	errInvalidTOTPCode    = errors.New("invalid two-factor code")
+)
+
+// TOTPEnrollHandler starts two-factor enrollment by generating a secret. It isn't used for logins until TOTPConfirmHandler succeeds.
+func TOTPEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	response, err := enrollTOTP(claims)
+	if err != nil {
+		if errors.Is(err, errTOTPAlreadyEnabled) {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Error starting two-factor enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func enrollTOTP(claims types.TokenClaims) (types.TOTPEnrollResponse, error) {
+	mfa, err := auth.LoadMFASettings(claims.Role, claims.UserID)
+	if err != nil {
+		return types.TOTPEnrollResponse{}, err
+	}
+	if mfa.TOTPEnabled {
+		return types.TOTPEnrollResponse{}, errTOTPAlreadyEnabled
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return types.TOTPEnrollResponse{}, err
+	}
+
+	err = updateMFASettings(claims, bson.M{
+		"$set": bson.M{
+			"totpsecret":  secret,
+			"totpenabled": false,
+		},
+	})
+	if err != nil {
+		return types.TOTPEnrollResponse{}, err
+	}
+
+	return types.TOTPEnrollResponse{
+		Secret:     secret,
+		OTPAuthURI: auth.TOTPURI(secret, mfa.EmailAddress),
+	}, nil
+}
+
+// TOTPConfirmHandler finishes enrollment once the user proves their authenticator works, and returns the recovery codes
+func TOTPConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.TOTPConfirmRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Code == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	response, err := confirmTOTP(claims, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, errTOTPAlreadyEnabled):
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		case errors.Is(err, errTOTPNotEnrolling):
+			http.Error(w, "Start two-factor enrollment first", http.StatusBadRequest)
+		case errors.Is(err, errInvalidTOTPCode):
+			http.Error(w, "Invalid two-factor code", http.StatusBadRequest)
+		default:
+			http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func confirmTOTP(claims types.TokenClaims, req types.TOTPConfirmRequest) (types.TOTPConfirmResponse, error) {
+	mfa, err := auth.LoadMFASettings(claims.Role, claims.UserID)
+	if err != nil {
+		return types.TOTPConfirmResponse{}, err
+	}
+	if mfa.TOTPEnabled {
+		return types.TOTPConfirmResponse{}, errTOTPAlreadyEnabled
+	}
+	if mfa.TOTPSecret == "" {
+		return types.TOTPConfirmResponse{}, errTOTPNotEnrolling
+	}
+
+	step, ok := auth.ValidateTOTP(mfa.TOTPSecret, req.Code, time.Now().UTC())
+	if !ok {
+		return types.TOTPConfirmResponse{}, errInvalidTOTPCode
+	}
+
+	recoveryCodes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return types.TOTPConfirmResponse{}, err
+	}
+	hashedCodes := make([]string, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		hashedCodes = append(hashedCodes, auth.HashToken(auth.NormalizeRecoveryCode(code)))
+	}
+
+	err = updateMFASettings(claims, bson.M{
+		"$set": bson.M{
+			"totpenabled":   true,
+			"totplaststep":  step,
+			"recoverycodes": hashedCodes,
+		},
+	})
+	if err != nil {
+		return types.TOTPConfirmResponse{}, err
+	}
+	fmt.Println("Two-factor authentication enabled for", claims.Role, claims.UserID)
+
+	return types.TOTPConfirmResponse{
+		IsEnabled:     true,
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
+
+// TOTPDisableHandler turns off two-factor authentication, which needs a current TOTP code or a recovery code
+func TOTPDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.TOTPDisableRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Code == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	clientIP := auth.ClientIP(r)
+	if retryAfter := auth.DefaultLoginLimiter.Check(claims.Role, claims.UserID, clientIP); retryAfter > 0 {
+		auth.WriteTooManyAttempts(w, retryAfter)
+		return
+	}
+
+	response, err := disableTOTP(claims, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrTOTPNotEnabled):
+			http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		case errors.Is(err, errInvalidTOTPCode):
+			auth.DefaultLoginLimiter.Failure(claims.Role, claims.UserID, clientIP)
+			http.Error(w, "Invalid two-factor code", http.StatusBadRequest)
+		default:
+			http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func disableTOTP(claims types.TokenClaims, req types.TOTPDisableRequest) (types.TOTPDisableResponse, error) {
+	ok, err := auth.VerifySecondFactor(claims.Role, claims.UserID, req.Code)
+	if err != nil {
+		return types.TOTPDisableResponse{IsDisabled: false}, err
+	}
+	if !ok {
+		return types.TOTPDisableResponse{IsDisabled: false}, errInvalidTOTPCode
+	}
+
+	err = updateMFASettings(claims, bson.M{
+		"$set": bson.M{
+			"totpsecret":    "",
+			"totpenabled":   false,
+			"recoverycodes": []string{},
+		},
+	})
+	if err != nil {
+		return types.TOTPDisableResponse{IsDisabled: false}, err
+	}
+	fmt.Println("Two-factor authentication disabled for", claims.Role, claims.UserID)
+
+	return types.TOTPDisableResponse{
+		IsDisabled: true,
+	}, nil
+}
+
+func updateMFASettings(claims types.TokenClaims, update bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collectionName, idField := auth.UserCollection(claims.Role)
+	collection := db.MongoClient.Database(db.DbName).Collection(collectionName)
+
+	_, err := collection.UpdateOne(ctx, bson.M{idField: claims.UserID}, update)
+	if err != nil {
+		fmt.Println("Error updating two-factor settings:", err)
+		return err
+	}
+	return nil
+}
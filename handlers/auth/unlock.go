@@ -0,0 +1,48 @@
+package authHandlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+)
+
+// UnlockAccountHandler clears a login lockout for an account and/or a client IP. Admins only.
+func UnlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.UnlockAccountRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || (req.EmailAddress == "" && req.IPAddress == "") {
+		http.Error(w, "Invalid request body, \"email_address\" or \"ip_address\" is required", http.StatusBadRequest)
+		return
+	}
+	if req.UserType == "" {
+		req.UserType = auth.RoleStudent
+	}
+
+	response := unlockAccount(req)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func unlockAccount(req types.UnlockAccountRequest) types.UnlockAccountResponse {
+	response := types.UnlockAccountResponse{}
+
+	if req.EmailAddress != "" {
+		response.WasAccountLocked = auth.DefaultLoginLimiter.UnlockAccount(req.UserType, req.EmailAddress)
+		fmt.Println("Unlocked", req.UserType, "account", req.EmailAddress)
+	}
+	if req.IPAddress != "" {
+		response.WasIPLocked = auth.DefaultLoginLimiter.UnlockIP(req.IPAddress)
+		fmt.Println("Unlocked IP address", req.IPAddress)
+	}
+	response.IsUnlocked = true
+
+	return response
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"sort"
+	"time"
+)
+
+// A teacher's availability is their weekly working hours, less time off and holidays. Students book lessons inside
+// it, see lessonsHandlers.ListSlotsHandler.
+
+const DefaultSlotMinutes = 60
+
+var (
+	ErrNoAvailability      = errors.New("the teacher hasn't published their availability")
+	ErrInvalidAvailability = errors.New("invalid availability")
+)
+
+// TimeRange is a period from Start up to, but not including, End
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Overlaps reports whether the two ranges share any time
+func (t TimeRange) Overlaps(other TimeRange) bool {
+	return t.Start.Before(other.End) && other.Start.Before(t.End)
+}
+
+// Contains reports whether other is entirely inside t
+func (t TimeRange) Contains(other TimeRange) bool {
+	return !other.Start.Before(t.Start) && !other.End.After(t.End)
+}
+
+// UserTimeZone is the time zone on a student's or teacher's profile, or UTC when they haven't set one
+func UserTimeZone(role, userID string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collectionName, idField := auth.UserCollection(role)
+	collection := db.MongoClient.Database(db.DbName).Collection(collectionName)
+
+	var profile struct {
+		TimeZone string `bson:"timezone"`
+	}
+	err := collection.FindOne(ctx, bson.M{idField: userID}, options.FindOne().SetProjection(bson.M{"timezone": 1})).Decode(&profile)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return "", err
+	}
+	if _, err := time.LoadLocation(profile.TimeZone); profile.TimeZone == "" || err != nil {
+		return "UTC", nil
+	}
+	return profile.TimeZone, nil
+}
+
+// ValidateAvailability fills in the defaults and checks every window, time off and holiday
+func ValidateAvailability(availability *types.TeacherAvailability) error {
+	if availability.TimeZone == "" {
+		timeZone, err := UserTimeZone(auth.RoleTeacher, availability.TeacherID)
+		if err != nil {
+			return err
+		}
+		availability.TimeZone = timeZone
+	}
+	if _, err := time.LoadLocation(availability.TimeZone); err != nil {
+		return fmt.Errorf("%w: unknown time zone %q", ErrInvalidAvailability, availability.TimeZone)
+	}
+
+	if availability.SlotMinutes == 0 {
+		availability.SlotMinutes = DefaultSlotMinutes
+	}
+	if availability.SlotMinutes < 5 || availability.SlotMinutes > 8*60 {
+		return fmt.Errorf("%w: slot_minutes must be between 5 and 480", ErrInvalidAvailability)
+	}
+
+	if availability.WeeklyHours == nil {
+		availability.WeeklyHours = []types.AvailabilityWindow{}
+	}
+	for _, window := range availability.WeeklyHours {
+		if window.Weekday < 0 || window.Weekday > 6 {
+			return fmt.Errorf("%w: weekday must be between 0 (Sunday) and 6 (Saturday)", ErrInvalidAvailability)
+		}
+		start, startErr := parseClock(window.Start)
+		end, endErr := parseClock(window.End)
+		if startErr != nil || endErr != nil {
+			return fmt.Errorf("%w: weekly hours must look like 15:00", ErrInvalidAvailability)
+		}
+		if end <= start {
+			return fmt.Errorf("%w: weekly hours must end after they start on the same day", ErrInvalidAvailability)
+		}
+	}
+	sort.Slice(availability.WeeklyHours, func(i, j int) bool {
+		a, b := availability.WeeklyHours[i], availability.WeeklyHours[j]
+		if a.Weekday != b.Weekday {
+			return a.Weekday < b.Weekday
+		}
+		return a.Start < b.Start
+	})
+
+	if availability.TimeOff == nil {
+		availability.TimeOff = []types.TimeOff{}
+	}
+	for _, timeOff := range availability.TimeOff {
+		if timeOff.End <= timeOff.Start {
+			return fmt.Errorf("%w: time off must end after it starts", ErrInvalidAvailability)
+		}
+	}
+	sort.Slice(availability.TimeOff, func(i, j int) bool {
+		return availability.TimeOff[i].Start < availability.TimeOff[j].Start
+	})
+
+	if availability.Holidays == nil {
+		availability.Holidays = []types.Holiday{}
+	}
+	for _, holiday := range availability.Holidays {
+		if _, err := time.Parse("2006-01-02", holiday.Date); err != nil {
+			return fmt.Errorf("%w: holiday dates must look like 2006-01-02", ErrInvalidAvailability)
+		}
+	}
+	sort.Slice(availability.Holidays, func(i, j int) bool {
+		return availability.Holidays[i].Date < availability.Holidays[j].Date
+	})
+
+	return nil
+}
+
+// parseClock turns "15:30" into the minutes since midnight
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// SaveAvailability replaces the teacher's availability
+func SaveAvailability(availability types.TeacherAvailability) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.TeacherAvailabilityCollection)
+	_, err := collection.ReplaceOne(ctx, bson.M{"teacherid": availability.TeacherID}, availability, options.Replace().SetUpsert(true))
+	if err != nil {
+		fmt.Println("Error saving teacher availability:", err)
+	}
+	return err
+}
+
+// FindAvailability loads the teacher's availability, ErrNoAvailability when they haven't published any
+func FindAvailability(teacherID string) (types.TeacherAvailability, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.TeacherAvailabilityCollection)
+
+	var availability types.TeacherAvailability
+	err := collection.FindOne(ctx, bson.M{"teacherid": teacherID}).Decode(&availability)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return availability, ErrNoAvailability
+	}
+	if err != nil {
+		fmt.Println("Error finding teacher availability:", err)
+	}
+	return availability, err
+}
+
+// AvailableRanges returns the teacher's working hours that overlap from and to, in order, without holidays and time
+// off. They aren't cut to from and to, so slots stay lined up with the start of the hours. Hours are in the
+// availability's time zone, so they keep their wall clock time across daylight saving changes.
+func AvailableRanges(availability types.TeacherAvailability, from, to time.Time) []TimeRange {
+	loc, err := time.LoadLocation(availability.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	holidays := map[string]bool{}
+	for _, holiday := range availability.Holidays {
+		holidays[holiday.Date] = true
+	}
+
+	ranges := []TimeRange{}
+	localFrom := from.In(loc)
+	for day := time.Date(localFrom.Year(), localFrom.Month(), localFrom.Day(), 0, 0, 0, 0, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if holidays[day.Format("2006-01-02")] {
+			continue
+		}
+
+		for _, window := range availability.WeeklyHours {
+			if window.Weekday != int(day.Weekday()) {
+				continue
+			}
+			start, _ := parseClock(window.Start)
+			end, _ := parseClock(window.End)
+			working := TimeRange{
+				Start: time.Date(day.Year(), day.Month(), day.Day(), start/60, start%60, 0, 0, loc),
+				End:   time.Date(day.Year(), day.Month(), day.Day(), end/60, end%60, 0, 0, loc),
+			}
+			if working.End.After(from) && working.Start.Before(to) {
+				ranges = append(ranges, subtractTimeOff(working, availability.TimeOff)...)
+			}
+		}
+	}
+	return ranges
+}
+
+// subtractTimeOff cuts the time off out of a range, which can leave it in several pieces
+func subtractTimeOff(working TimeRange, timeOff []types.TimeOff) []TimeRange {
+	pieces := []TimeRange{working}
+	for _, off := range timeOff {
+		offRange := TimeRange{Start: time.Unix(off.Start, 0), End: time.Unix(off.End, 0)}
+
+		remaining := []TimeRange{}
+		for _, piece := range pieces {
+			if !piece.Overlaps(offRange) {
+				remaining = append(remaining, piece)
+				continue
+			}
+			if piece.Start.Before(offRange.Start) {
+				remaining = append(remaining, TimeRange{Start: piece.Start, End: offRange.Start})
+			}
+			if offRange.End.Before(piece.End) {
+				remaining = append(remaining, TimeRange{Start: offRange.End, End: piece.End})
+			}
+		}
+		pieces = remaining
+	}
+	return pieces
+}
+
+// StudentTeacherID is the teacher the student is assigned to
+func StudentTeacherID(studentID string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.StudentsCollection)
+
+	var student struct {
+		TeacherID string `bson:"teacherid"`
+	}
+	err := collection.FindOne(ctx, bson.M{"studentid": studentID}, options.FindOne().SetProjection(bson.M{"teacherid": 1})).Decode(&student)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", ErrAccountNotFound
+	}
+	return student.TeacherID, err
+}
@@ -0,0 +1,134 @@
+package chatsHandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"mime"
+	"net/http"
+	"os"
+)
+
+// UploadAttachmentHandler stores a file for a room, the same multipart upload as profile images with the room in
+// "roomId" and the file in "file". The returned attachmentId is then sent in a message's attachmentIds.
+func UploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Some room for the other form fields and multipart headers
+	r.Body = http.MaxBytesReader(w, r.Body, chat.MaxAttachmentSize+(1<<20))
+	err := r.ParseMultipartForm(chat.MaxAttachmentSize)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeChatError(w, chat.ErrAttachmentTooLarge, "")
+			return
+		}
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	roomID := r.FormValue("roomId")
+	if roomID == "" {
+		http.Error(w, "Invalid request body, \"roomId\" cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Unable to retrieve file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	claims, _ := auth.ClaimsFromRequest(r)
+
+	attachment, err := chat.SaveAttachment(claims.UserID, roomID, handler.Filename, file)
+	if err != nil {
+		writeChatError(w, err, "Unable to save file")
+		return
+	}
+
+	used, err := chat.AttachmentUsage(claims.UserID)
+	if err != nil {
+		// The upload worked, the usage is only informational
+		used = 0
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.UploadAttachmentResponse{
+		IsUploaded: true,
+		Attachment: attachment,
+		QuotaUsed:  used,
+		QuotaLimit: chat.AttachmentQuota,
+	})
+}
+
+// GetAttachmentHandler serves an attachment, or its thumbnail with thumbnail=true, to members of its room
+func GetAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	attachmentID := r.URL.Query().Get("attachmentId")
+	thumbnail := r.URL.Query().Get("thumbnail") == "true"
+	if attachmentID == "" {
+		http.Error(w, "Invalid request query, \"attachmentId\" cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	attachment, err := chat.FindAttachment(attachmentID)
+	if errors.Is(err, chat.ErrAttachmentNotExists) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error finding chat attachment:", err)
+		http.Error(w, "Error getting the attachment", http.StatusInternalServerError)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	room, err := chat.DefaultStore.Room(attachment.RoomID)
+	if err != nil {
+		writeChatError(w, err, "Error getting the attachment")
+		return
+	}
+	if !containsID(room.MemberIDs, claims.UserID) {
+		writeChatError(w, chat.ErrNotRoomMember, "")
+		return
+	}
+	if thumbnail && !attachment.HasThumbnail {
+		http.Error(w, "Attachment has no thumbnail", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(chat.AttachmentPath(attachment.AttachmentID, thumbnail))
+	if err != nil {
+		fmt.Println("Error opening chat attachment:", err)
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	contentType := attachment.ContentType
+	if thumbnail {
+		contentType = "image/png"
+	}
+
+	// The sniffed type is what gets served, browsers mustn't guess something else
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if !thumbnail {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}))
+	}
+	http.ServeContent(w, r, attachment.FileName, attachment.CreatedAt, file)
+}
@@ -1,7 +1,136 @@
 package chatsHandlers
 
-import "net/http"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"strings"
+	"time"
+)
 
-func CreateChatRoomHandler(w http.ResponseWriter, r *http.Request) {}
+// MaxRoomMembers is the most members a chat room can have
+const MaxRoomMembers = 100
 
-func createChatRoom() {}
+var errUnknownChatMember = errors.New("chat room member does not exist")
+
+// CreateChatRoomHandler creates a room and its first key, wrapped for every member
+func CreateChatRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.CreateChatRoomRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.MemberIDs) >= MaxRoomMembers {
+		http.Error(w, fmt.Sprintf("Invalid request body, a chat room can have at most %d members", MaxRoomMembers), http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+
+	response, err := createChatRoom(req, claims.UserID)
+	if errors.Is(err, errUnknownChatMember) {
+		http.Error(w, "Every member must be an existing chat user", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, chat.ErrFilteredWord) {
+		http.Error(w, "Invalid request body, the room name contains words that aren't allowed", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, chat.ErrMissingPublicKey) {
+		http.Error(w, "Every member must have uploaded a public key, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error creating the chat room", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func createChatRoom(req types.CreateChatRoomRequest, creatorID string) (types.CreateChatRoomResponse, error) {
+	// The creator is always a member, duplicates are dropped
+	memberIDs := []string{creatorID}
+	for _, memberID := range req.MemberIDs {
+		memberID = strings.TrimSpace(memberID)
+		if memberID != "" && !containsID(memberIDs, memberID) {
+			memberIDs = append(memberIDs, memberID)
+		}
+	}
+
+	// Room names aren't encrypted, so the server filters them itself
+	name, err := chat.DefaultWordFilter.Apply(strings.TrimSpace(req.Name))
+	if err != nil {
+		return types.CreateChatRoomResponse{IsCreated: false}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Members have to exist in usersCollection
+	usersCollection := db.MongoClient.Database(db.DbName).Collection(db.UsersCollection)
+	count, err := usersCollection.CountDocuments(ctx, bson.M{"userId": bson.M{"$in": memberIDs}})
+	if err != nil {
+		fmt.Println("Error counting chat room members:", err)
+		return types.CreateChatRoomResponse{IsCreated: false}, err
+	}
+	if count != int64(len(memberIDs)) {
+		return types.CreateChatRoomResponse{IsCreated: false}, errUnknownChatMember
+	}
+
+	roomID := uuid.New().String()
+	keys, err := chat.WrapRoomKey(roomID, 1, memberIDs)
+	if err != nil {
+		return types.CreateChatRoomResponse{IsCreated: false}, err
+	}
+	if err := chat.SaveRoomKeys(keys); err != nil {
+		return types.CreateChatRoomResponse{IsCreated: false}, err
+	}
+
+	now := time.Now().UTC()
+	room := types.ChatRoom{
+		RoomID:     roomID,
+		Name:       name,
+		MemberIDs:  memberIDs,
+		CreatedBy:  creatorID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		KeyVersion: 1,
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomsCollection)
+	_, err = collection.InsertOne(ctx, room)
+	if err != nil {
+		fmt.Println("Error inserting chat room into the database:", err)
+		return types.CreateChatRoomResponse{IsCreated: false}, err
+	}
+
+	return types.CreateChatRoomResponse{
+		IsCreated: true,
+		Room:      room,
+	}, nil
+}
+
+func containsID(ids []string, id string) bool {
+	for _, existing := range ids {
+		if existing == id {
+			return true
+		}
+	}
+	return false
+}
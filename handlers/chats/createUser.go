@@ -2,15 +2,15 @@ package chatsHandlers
 
 import (
 	"encoding/json"
-	"fmt"
-	"go.mongodb.org/mongo-driver/bson"
-	"golang.org/x/net/context"
-	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"errors"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"net/http"
-	"time"
 )
 
+// CreateUserHandler (re)creates a chat profile from the student or teacher record. Profiles are normally created
+// when the record is, this is for accounts that are missing one.
 func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
@@ -24,7 +24,17 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := createUser(req)
+	claims, _ := auth.ClaimsFromRequest(r)
+	if claims.UserID != req.UserId && claims.Role != auth.RoleAdmin {
+		http.Error(w, "You do not have permission to modify this chat user", http.StatusForbidden)
+		return
+	}
+
+	response, err := createUser(req, chatUserRole(req.UserType, claims))
+	if errors.Is(err, chat.ErrUserRecordNotFound) {
+		http.Error(w, "No student or teacher exists with this userId", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error creating the user", http.StatusInternalServerError)
 		return
@@ -34,21 +44,8 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func createUser(req types.CreateUserRequest) (types.CreateUserResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	collection := db.MongoClient.Database(db.DbName).Collection(db.UsersCollection)
-	_, err := collection.InsertOne(ctx, bson.M{
-		"userId":            req.UserId,
-		"userType":          req.UserType,
-		"preferredName":     req.PreferredName,
-		"firstName":         req.FirstName,
-		"lastName":          req.LastName,
-		"profilePictureUrl": req.ProfilePictureURL,
-	})
-	if err != nil {
-		fmt.Println("Error inserting user into the database: ", err)
+func createUser(req types.CreateUserRequest, role string) (types.CreateUserResponse, error) {
+	if err := chat.CreateChatUser(role, req.UserId); err != nil {
 		return types.CreateUserResponse{
 			IsCreated: false,
 		}, err
@@ -58,3 +55,12 @@ func createUser(req types.CreateUserRequest) (types.CreateUserResponse, error) {
 		IsCreated: true,
 	}, nil
 }
+
+// chatUserRole is the role of the record behind a chat user. Users changing their own profile are whatever their
+// token says, admins name the userType.
+func chatUserRole(userType string, claims types.TokenClaims) string {
+	if claims.Role == auth.RoleAdmin && (userType == auth.RoleTeacher || userType == auth.RoleStudent) {
+		return userType
+	}
+	return claims.Role
+}
@@ -1,7 +1,98 @@
 package chatsHandlers
 
-import "net/http"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"time"
+)
 
-func DeleteChatRoomHandler(w http.ResponseWriter, r *http.Request) {}
+// DeleteChatRoomHandler deletes a room with its messages, keys and attachments. Only the room's creator or an admin can.
+func DeleteChatRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
 
-func deleteChatRoom() {}
+	var req types.DeleteChatRoomRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	room, err := chat.FindRoom(req.RoomID)
+	if errors.Is(err, chat.ErrRoomNotFound) {
+		http.Error(w, "Chat room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error deleting the chat room", http.StatusInternalServerError)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	if room.CreatedBy != claims.UserID && claims.Role != auth.RoleAdmin {
+		http.Error(w, "You do not have permission to delete this chat room", http.StatusForbidden)
+		return
+	}
+
+	response, err := deleteChatRoom(room)
+	if err != nil {
+		http.Error(w, "Error deleting the chat room", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func deleteChatRoom(room types.ChatRoom) (types.DeleteChatRoomResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomsCollection)
+	_, err := collection.DeleteOne(ctx, bson.M{"roomId": room.RoomID})
+	if err != nil {
+		fmt.Println("Error deleting the chat room from the database:", err)
+		return types.DeleteChatRoomResponse{IsDeleted: false}, err
+	}
+
+	messagesCollection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+	_, err = messagesCollection.DeleteMany(ctx, bson.M{"roomId": room.RoomID})
+	if err != nil {
+		fmt.Println("Error deleting the chat room's messages from the database:", err)
+		return types.DeleteChatRoomResponse{IsDeleted: false}, err
+	}
+
+	keysCollection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomKeysCollection)
+	_, err = keysCollection.DeleteMany(ctx, bson.M{"roomId": room.RoomID})
+	if err != nil {
+		fmt.Println("Error deleting the chat room's keys from the database:", err)
+		return types.DeleteChatRoomResponse{IsDeleted: false}, err
+	}
+
+	readStatesCollection := db.MongoClient.Database(db.DbName).Collection(db.ChatReadStatesCollection)
+	_, err = readStatesCollection.DeleteMany(ctx, bson.M{"roomId": room.RoomID})
+	if err != nil {
+		// Nothing reads them once the room is gone
+		fmt.Println("Error deleting the chat room's read receipts from the database:", err)
+	}
+
+	if err := chat.DeleteAttachments(bson.M{"roomId": room.RoomID}); err != nil {
+		fmt.Println("Error deleting the chat room's attachments:", err)
+		return types.DeleteChatRoomResponse{IsDeleted: false}, err
+	}
+
+	// The room is gone from the store, so members are told directly
+	chat.DefaultHub.SendToUsers(room.MemberIDs, types.ChatEvent{Type: chat.EventRoomDeleted, RoomID: room.RoomID})
+
+	return types.DeleteChatRoomResponse{IsDeleted: true}, nil
+}
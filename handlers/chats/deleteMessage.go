@@ -1,7 +1,97 @@
 package chatsHandlers
 
-import "net/http"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"time"
+)
 
-func DeleteMessageHandler(w http.ResponseWriter, r *http.Request) {}
+// DeleteMessageHandler replaces a message with a tombstone, so history still shows that something was said. The
+// sender or anyone who can moderate the room can delete a message, which is how a reported message is taken down.
+func DeleteMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
 
-func deleteMessage() {}
+	var req types.DeleteMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	message, err := findMessage(req.MessageID)
+	if err != nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	claims, _ := auth.ClaimsFromRequest(r)
+	if message.SenderID != claims.UserID {
+		room, err := chat.DefaultStore.Room(message.RoomID)
+		if err != nil {
+			writeChatError(w, err, "Error deleting the message")
+			return
+		}
+		if !chat.CanModerate(room, claims.UserID, claims.Role) {
+			http.Error(w, "You do not have permission to delete this message", http.StatusForbidden)
+			return
+		}
+	}
+
+	response, err := deleteMessage(req)
+	if err != nil {
+		http.Error(w, "Error deleting the message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func deleteMessage(req types.DeleteMessageRequest) (types.DeleteMessageResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+
+	var message types.ChatMessage
+	err := collection.FindOneAndUpdate(ctx, bson.M{"messageId": req.MessageID}, bson.M{
+		"$set": bson.M{
+			"body":      "",
+			"isDeleted": true,
+			"deletedAt": time.Now().UTC(),
+		},
+		"$unset": bson.M{"attachmentIds": "", "searchTokens": ""},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&message)
+	if err != nil {
+		fmt.Println("Error deleting the message from the database:", err)
+		return types.DeleteMessageResponse{IsDeleted: false}, err
+	}
+
+	// The tombstone doesn't need them and they count against the sender's quota
+	if err := chat.DeleteAttachments(bson.M{"messageId": message.MessageID}); err != nil {
+		fmt.Println("Error deleting the message's attachments:", err)
+	}
+
+	if err := chat.DefaultHub.PublishToRoom(message.RoomID, types.ChatEvent{
+		Type:    chat.EventMessageDeleted,
+		RoomID:  message.RoomID,
+		Message: &message,
+	}); err != nil {
+		fmt.Println("Error publishing message deletion:", err)
+	}
+
+	return types.DeleteMessageResponse{
+		IsDeleted: true,
+		Message:   message,
+	}, nil
+}
@@ -0,0 +1,25 @@
+package chatsHandlers
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"time"
+)
+
+func findMessage(messageID string) (types.ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+	var message types.ChatMessage
+	err := collection.FindOne(ctx, bson.M{"messageId": messageID}).Decode(&message)
+	if err != nil {
+		fmt.Println("Error finding chat message", messageID, "in the database:", err)
+		return types.ChatMessage{}, err
+	}
+
+	return message, nil
+}
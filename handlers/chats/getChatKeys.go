@@ -0,0 +1,50 @@
+package chatsHandlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+)
+
+// GetChatRoomKeysHandler returns the caller's wrapped keys for a room. Clients unwrap them with their private key,
+// the current version encrypts new messages and the older ones decrypt history.
+func GetChatRoomKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roomID := r.URL.Query().Get("roomId")
+	if roomID == "" {
+		http.Error(w, "Invalid request query, \"roomId\" cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	room, err := chat.DefaultStore.Room(roomID)
+	if err != nil {
+		writeChatError(w, err, "Error getting the chat room keys")
+		return
+	}
+	if !containsID(room.MemberIDs, claims.UserID) {
+		writeChatError(w, chat.ErrNotRoomMember, "")
+		return
+	}
+
+	keys, err := chat.RoomKeysForUser(roomID, claims.UserID)
+	if err != nil {
+		fmt.Println("Error finding chat room keys:", err)
+		http.Error(w, "Error getting the chat room keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.GetChatRoomKeysResponse{
+		RoomID:     roomID,
+		KeyVersion: room.KeyVersion,
+		Keys:       keys,
+	})
+}
@@ -1,8 +1,54 @@
 package chatsHandlers
 
-import "net/http"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"time"
+)
 
+// ListChatRoomsHandler lists the rooms the caller is a member of, most recently active first
 func ListChatRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+
+	response, err := listChatRooms(claims.UserID)
+	if err != nil {
+		http.Error(w, "Error listing chat rooms", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-func listChatRooms() {}
+func listChatRooms(userID string) (types.ListChatRoomsResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatRoomsCollection)
+	cursor, err := collection.Find(ctx, bson.M{"memberIds": userID}, options.Find().SetSort(bson.D{{Key: "updatedAt", Value: -1}}))
+	if err != nil {
+		fmt.Println("Error listing chat rooms:", err)
+		return types.ListChatRoomsResponse{}, err
+	}
+	defer cursor.Close(ctx)
+
+	rooms := []types.ChatRoom{}
+	if err := cursor.All(ctx, &rooms); err != nil {
+		fmt.Println("Error decoding chat rooms:", err)
+		return types.ListChatRoomsResponse{}, err
+	}
+
+	return types.ListChatRoomsResponse{Rooms: rooms}, nil
+}
@@ -1,7 +1,103 @@
 package chatsHandlers
 
-import "net/http"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"strconv"
+	"time"
+)
 
-func ListMessagesHandler(w http.ResponseWriter, r *http.Request) {}
+// ListMessagesHandler pages backwards through a room's history. Without "before" it returns the newest messages,
+// then the response's nextCursor is passed as "before" to get the page before.
+func ListMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
 
-func listMessages() {}
+	roomID := r.URL.Query().Get("roomId")
+	before := r.URL.Query().Get("before")
+	limitStr := r.URL.Query().Get("limit")
+
+	if roomID == "" {
+		http.Error(w, "Invalid request query, \"roomId\" cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	var limit int64 = 50
+	if limitStr != "" {
+		limitResult, err := strconv.ParseInt(limitStr, 10, 32)
+		if err != nil || limitResult <= 0 || limitResult > 100 {
+			http.Error(w, "Invalid request query, \"limit\" must be a number between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		limit = limitResult
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	room, err := chat.DefaultStore.Room(roomID)
+	if err != nil {
+		writeChatError(w, err, "Error listing messages")
+		return
+	}
+	if !containsID(room.MemberIDs, claims.UserID) {
+		writeChatError(w, chat.ErrNotRoomMember, "")
+		return
+	}
+
+	response, err := listMessages(roomID, before, limit)
+	if err != nil {
+		http.Error(w, "Error listing messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func listMessages(roomID, before string, limit int64) (types.ListMessagesResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"roomId": roomID}
+	if before != "" {
+		filter["messageId"] = bson.M{"$lt": before}
+	}
+
+	// One extra message tells whether there is another page
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "messageId", Value: -1}}).SetLimit(limit+1))
+	if err != nil {
+		fmt.Println("Error listing messages:", err)
+		return types.ListMessagesResponse{}, err
+	}
+	defer cursor.Close(ctx)
+
+	messages := []types.ChatMessage{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		fmt.Println("Error decoding messages:", err)
+		return types.ListMessagesResponse{}, err
+	}
+
+	response := types.ListMessagesResponse{}
+	if int64(len(messages)) > limit {
+		messages = messages[:limit]
+		response.NextCursor = messages[len(messages)-1].MessageID
+	}
+
+	// Newest first from the query, oldest first in the response
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	response.Messages = messages
+
+	return response, nil
+}
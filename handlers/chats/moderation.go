@@ -0,0 +1,153 @@
+package chatsHandlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MuteChatMemberHandler stops a member from sending messages for "minutes". Admins and teachers in the room can mute,
+// but only admins can mute a teacher.
+func MuteChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	req, room, ok := moderationRequest(w, r)
+	if !ok {
+		return
+	}
+	claims, _ := auth.ClaimsFromRequest(r)
+	if err := chat.CheckModerationTarget(req.UserID, claims.Role); err != nil {
+		writeChatError(w, err, "Error muting the chat room member")
+		return
+	}
+
+	duration := time.Duration(req.Minutes) * time.Minute
+	if duration <= 0 || duration > chat.MaxMuteDuration {
+		http.Error(w, fmt.Sprintf("Invalid request body, \"minutes\" must be between 1 and %d", int(chat.MaxMuteDuration.Minutes())), http.StatusBadRequest)
+		return
+	}
+
+	if err := chat.MuteMember(room, req.UserID, duration); err != nil {
+		writeChatError(w, err, "Error muting the chat room member")
+		return
+	}
+	writeModeratedRoom(w, req.RoomID)
+}
+
+// UnmuteChatMemberHandler lifts a mute before it runs out
+func UnmuteChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	req, room, ok := moderationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := chat.MuteMember(room, req.UserID, 0); err != nil {
+		writeChatError(w, err, "Error unmuting the chat room member")
+		return
+	}
+	writeModeratedRoom(w, req.RoomID)
+}
+
+// BanChatMemberHandler removes a member from the room and stops them being added back. Only admins can ban a teacher.
+func BanChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	req, room, ok := moderationRequest(w, r)
+	if !ok {
+		return
+	}
+	claims, _ := auth.ClaimsFromRequest(r)
+	if err := chat.CheckModerationTarget(req.UserID, claims.Role); err != nil {
+		writeChatError(w, err, "Error banning the chat room member")
+		return
+	}
+
+	room, err := chat.BanMember(room, req.UserID)
+	if err != nil {
+		writeChatError(w, err, "Error banning the chat room member")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.UpdateChatMembersResponse{IsUpdated: true, Room: room})
+}
+
+// UnbanChatMemberHandler lets a banned user be added to the room again, it doesn't add them
+func UnbanChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	req, room, ok := moderationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	room, err := chat.UnbanMember(room, req.UserID)
+	if err != nil {
+		writeChatError(w, err, "Error unbanning the chat room member")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.UpdateChatMembersResponse{IsUpdated: true, Room: room})
+}
+
+// WordFilterHandler returns the word filter clients have to apply before encrypting a message. Bodies are end to end
+// encrypted, so the filter is enforced by clients: the server checks the moderationText they send, but can't tell
+// whether it matches the ciphertext, and can't mask anything in mask mode. A modified client can get around it.
+func WordFilterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.WordFilterResponse{
+		Mode:    chat.DefaultWordFilter.Mode,
+		Words:   chat.DefaultWordFilter.Words,
+		Version: chat.DefaultWordFilter.Version,
+	})
+}
+
+// moderationRequest decodes the request and loads the room, writing the error response if the caller can't moderate it
+func moderationRequest(w http.ResponseWriter, r *http.Request) (types.ModerateChatMemberRequest, types.ChatRoom, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return types.ModerateChatMemberRequest{}, types.ChatRoom{}, false
+	}
+
+	var req types.ModerateChatMemberRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	req.UserID = strings.TrimSpace(req.UserID)
+	if err != nil || req.RoomID == "" || req.UserID == "" {
+		http.Error(w, "Invalid request body, \"roomId\" and \"userId\" are required", http.StatusBadRequest)
+		return req, types.ChatRoom{}, false
+	}
+
+	room, err := chat.FindRoom(req.RoomID)
+	if err != nil {
+		writeChatError(w, err, "Error moderating the chat room")
+		return req, room, false
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	if !chat.CanModerate(room, claims.UserID, claims.Role) {
+		http.Error(w, "You do not have permission to moderate this chat room", http.StatusForbidden)
+		return req, room, false
+	}
+	if req.UserID == claims.UserID {
+		http.Error(w, "You can't moderate yourself", http.StatusBadRequest)
+		return req, room, false
+	}
+
+	return req, room, true
+}
+
+func writeModeratedRoom(w http.ResponseWriter, roomID string) {
+	room, err := chat.FindRoom(roomID)
+	if err != nil {
+		writeChatError(w, err, "Error loading the chat room")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.UpdateChatMembersResponse{IsUpdated: true, Room: room})
+}
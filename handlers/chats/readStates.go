@@ -0,0 +1,103 @@
+package chatsHandlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+)
+
+// UpdateReadStateHandler marks everything in a room up to a message as delivered or read, for clients that aren't
+// connected to /ws. Connected clients send "delivered" and "read" frames instead.
+func UpdateReadStateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.UpdateReadStateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.RoomID == "" || req.MessageID == "" {
+		http.Error(w, "Invalid request body, \"roomId\" and \"messageId\" are required", http.StatusBadRequest)
+		return
+	}
+	if req.Status == "" {
+		req.Status = chat.ReceiptRead
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+
+	state, err := chat.DefaultHub.UpdateReadState(claims.UserID, req.RoomID, req.MessageID, req.Status)
+	if err != nil {
+		writeChatError(w, err, "Error updating the read receipt")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.UpdateReadStateResponse{
+		IsUpdated: true,
+		ReadState: state,
+	})
+}
+
+// ListReadStatesHandler returns how far every member of a room has received and read
+func ListReadStatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roomID := r.URL.Query().Get("roomId")
+	if roomID == "" {
+		http.Error(w, "Invalid request query, \"roomId\" cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	room, err := chat.DefaultStore.Room(roomID)
+	if err != nil {
+		writeChatError(w, err, "Error listing read receipts")
+		return
+	}
+	if !containsID(room.MemberIDs, claims.UserID) {
+		writeChatError(w, chat.ErrNotRoomMember, "")
+		return
+	}
+
+	states, err := chat.ReadStates(roomID)
+	if err != nil {
+		fmt.Println("Error listing read receipts:", err)
+		http.Error(w, "Error listing read receipts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.ListReadStatesResponse{ReadStates: states})
+}
+
+// ListUnreadCountsHandler returns the caller's unread message count for each of their rooms, for badges
+func ListUnreadCountsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+
+	counts, err := chat.UnreadCounts(claims.UserID)
+	if err != nil {
+		fmt.Println("Error counting unread messages:", err)
+		http.Error(w, "Error counting unread messages", http.StatusInternalServerError)
+		return
+	}
+
+	response := types.ListUnreadCountsResponse{Rooms: counts}
+	for _, count := range counts {
+		response.Total += count.UnreadCount
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
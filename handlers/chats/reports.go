@@ -0,0 +1,288 @@
+package chatsHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+
+	maxReportReasonLength = 1000
+)
+
+// ReportMessageHandler reports someone else's message in one of the caller's rooms to the room's moderators. Messages
+// are end to end encrypted, so the reporter's client includes the text it decrypted. That text is only the reporter's
+// word, the moderation queue sends the stored message along so moderators can decrypt it themselves.
+func ReportMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.ReportMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.MessageID == "" {
+		http.Error(w, "Invalid request body, \"messageId\" is required", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if len(req.Reason) > maxReportReasonLength || len(req.Body) > chat.MaxMessageLength {
+		http.Error(w, fmt.Sprintf("Invalid request body, \"reason\" can be at most %d and \"body\" %d bytes", maxReportReasonLength, chat.MaxMessageLength), http.StatusBadRequest)
+		return
+	}
+
+	message, err := findMessage(req.MessageID)
+	if err != nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	room, err := chat.DefaultStore.Room(message.RoomID)
+	if err != nil {
+		writeChatError(w, err, "Error reporting the message")
+		return
+	}
+	if !containsID(room.MemberIDs, claims.UserID) {
+		writeChatError(w, chat.ErrNotRoomMember, "")
+		return
+	}
+	if message.SenderID == claims.UserID {
+		http.Error(w, "You can't report your own messages", http.StatusBadRequest)
+		return
+	}
+
+	response, err := reportMessage(req, message, claims.UserID)
+	if mongo.IsDuplicateKeyError(err) {
+		http.Error(w, "You have already reported this message", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reporting the message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func reportMessage(req types.ReportMessageRequest, message types.ChatMessage, reporterID string) (types.ReportMessageResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	report := types.ChatReport{
+		ReportID:     uuid.New().String(),
+		MessageID:    message.MessageID,
+		RoomID:       message.RoomID,
+		ReporterID:   reporterID,
+		SenderID:     message.SenderID,
+		Reason:       req.Reason,
+		ReportedBody: req.Body,
+		Status:       ReportOpen,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatReportsCollection)
+	if _, err := collection.InsertOne(ctx, report); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			fmt.Println("Error inserting chat report into the database:", err)
+		}
+		return types.ReportMessageResponse{IsReported: false}, err
+	}
+
+	return types.ReportMessageResponse{
+		IsReported: true,
+		Report:     report,
+	}, nil
+}
+
+// ListReportsHandler is the moderation queue, oldest first. Teachers see reports from their rooms, admins see all
+// of them, and nobody sees reports about their own messages, those are left to another moderator or an admin.
+// "status" defaults to "open". Each report comes with the stored message, its ciphertext and key version, so the
+// moderator's client can decrypt what was actually sent instead of relying on the reporter's copy.
+func ListReportsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = ReportOpen
+	}
+	if status != ReportOpen && status != ReportResolved && status != ReportDismissed {
+		http.Error(w, "Invalid request query, \"status\" must be \"open\", \"resolved\" or \"dismissed\"", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	filter := bson.M{"status": status, "senderId": bson.M{"$ne": claims.UserID}}
+	roomID := r.URL.Query().Get("roomId")
+	if roomID != "" {
+		filter["roomId"] = roomID
+	}
+
+	if claims.Role != auth.RoleAdmin {
+		roomIDs, err := chat.RoomIDsForUser(claims.UserID)
+		if err != nil {
+			http.Error(w, "Error listing reports", http.StatusInternalServerError)
+			return
+		}
+		if roomID == "" {
+			filter["roomId"] = bson.M{"$in": roomIDs}
+		} else if !containsID(roomIDs, roomID) {
+			writeChatError(w, chat.ErrNotRoomMember, "")
+			return
+		}
+	}
+
+	response, err := listReports(filter)
+	if err != nil {
+		http.Error(w, "Error listing reports", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func listReports(filter bson.M) (types.ListReportsResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatReportsCollection)
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}).SetLimit(100))
+	if err != nil {
+		fmt.Println("Error listing chat reports:", err)
+		return types.ListReportsResponse{}, err
+	}
+	defer cursor.Close(ctx)
+
+	reports := []types.ChatReport{}
+	if err := cursor.All(ctx, &reports); err != nil {
+		fmt.Println("Error decoding chat reports:", err)
+		return types.ListReportsResponse{}, err
+	}
+
+	messageIDs := []string{}
+	for _, report := range reports {
+		if !containsID(messageIDs, report.MessageID) {
+			messageIDs = append(messageIDs, report.MessageID)
+		}
+	}
+	messages := []types.ChatMessage{}
+	if len(messageIDs) > 0 {
+		cursor, err := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection).Find(ctx, bson.M{"messageId": bson.M{"$in": messageIDs}})
+		if err != nil {
+			fmt.Println("Error finding reported chat messages:", err)
+			return types.ListReportsResponse{}, err
+		}
+		defer cursor.Close(ctx)
+		if err := cursor.All(ctx, &messages); err != nil {
+			fmt.Println("Error decoding reported chat messages:", err)
+			return types.ListReportsResponse{}, err
+		}
+	}
+	byID := make(map[string]types.ChatMessage, len(messages))
+	for _, message := range messages {
+		byID[message.MessageID] = message
+	}
+
+	listed := make([]types.ListedChatReport, len(reports))
+	for i, report := range reports {
+		listed[i] = types.ListedChatReport{ChatReport: report}
+		if message, ok := byID[report.MessageID]; ok {
+			listed[i].Message = &message
+		}
+	}
+	return types.ListReportsResponse{Reports: listed}, nil
+}
+
+// ResolveReportHandler closes an open report as resolved or dismissed. Acting on it, like deleting the message or
+// muting the sender, is done with the usual endpoints.
+func ResolveReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.ResolveReportRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.ReportID == "" || (req.Status != ReportResolved && req.Status != ReportDismissed) {
+		http.Error(w, "Invalid request body, \"reportId\" and \"status\" of \"resolved\" or \"dismissed\" are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatReportsCollection)
+
+	var report types.ChatReport
+	err = collection.FindOne(ctx, bson.M{"reportId": req.ReportID}).Decode(&report)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error finding chat report:", err)
+		http.Error(w, "Error resolving the report", http.StatusInternalServerError)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	if report.SenderID == claims.UserID {
+		http.Error(w, "You can't resolve a report about your own message", http.StatusForbidden)
+		return
+	}
+	room, err := chat.FindRoom(report.RoomID)
+	if err != nil && !errors.Is(err, chat.ErrRoomNotFound) {
+		http.Error(w, "Error resolving the report", http.StatusInternalServerError)
+		return
+	}
+	if claims.Role != auth.RoleAdmin && (err != nil || !chat.CanModerate(room, claims.UserID, claims.Role)) {
+		http.Error(w, "You do not have permission to resolve this report", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now().UTC()
+	err = collection.FindOneAndUpdate(ctx, bson.M{"reportId": req.ReportID, "status": ReportOpen}, bson.M{
+		"$set": bson.M{
+			"status":     req.Status,
+			"resolution": strings.TrimSpace(req.Resolution),
+			"resolvedBy": claims.UserID,
+			"resolvedAt": now,
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&report)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Report has already been closed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error resolving chat report:", err)
+		http.Error(w, "Error resolving the report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.ResolveReportResponse{
+		IsResolved: true,
+		Report:     report,
+	})
+}
@@ -0,0 +1,228 @@
+package chatsHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxSearchQueryTokens is the most tokens across all room keys in one search
+	maxSearchQueryTokens = 1000
+	// searchContextMessages is how many messages before and after each hit are returned
+	searchContextMessages = 2
+)
+
+// SearchMessagesHandler searches the caller's rooms by keyword, sender and date range. Bodies are end to end
+// encrypted, so keywords come in as blind index tokens (see types.SearchMessagesRequest) and the client highlights
+// the decrypted snippets itself.
+func SearchMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.SearchMessagesRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Keys) == 0 {
+		http.Error(w, "Invalid request body, \"keys\" cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = 20
+	}
+	if req.Limit < 0 || req.Limit > 50 {
+		http.Error(w, "Invalid request body, \"limit\" must be a number between 1 and 50", http.StatusBadRequest)
+		return
+	}
+
+	tokenCount := 0
+	for _, key := range req.Keys {
+		for _, token := range key.Tokens {
+			if !chat.IsSearchToken(token) {
+				http.Error(w, "Invalid request body, tokens must be 32 lowercase hex characters", http.StatusBadRequest)
+				return
+			}
+		}
+		tokenCount += len(key.Tokens)
+	}
+	if tokenCount == 0 || tokenCount > maxSearchQueryTokens {
+		http.Error(w, "Invalid request body, a search needs between 1 and "+strconv.Itoa(maxSearchQueryTokens)+" tokens", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	roomIDs, err := chat.RoomIDsForUser(claims.UserID)
+	if err != nil {
+		http.Error(w, "Error searching messages", http.StatusInternalServerError)
+		return
+	}
+	for _, key := range req.Keys {
+		if !containsID(roomIDs, key.RoomID) {
+			writeChatError(w, chat.ErrNotRoomMember, "")
+			return
+		}
+	}
+
+	response, err := searchMessages(req)
+	if err != nil {
+		http.Error(w, "Error searching messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func searchMessages(req types.SearchMessagesRequest) (types.SearchMessagesResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Tokens are keyed per room and key version, so a token only ever matches where it was made. Each key is its own
+	// clause of the query, so messages of other rooms and key versions are left out before the limit rather than after.
+	tokensByKey := make(map[string]map[string]bool)
+	terms := []string{}
+	keyClauses := bson.A{}
+	for _, key := range req.Keys {
+		id := searchKeyID(key.RoomID, key.KeyVersion)
+		if tokensByKey[id] == nil {
+			tokensByKey[id] = make(map[string]bool)
+		}
+		for _, token := range key.Tokens {
+			tokensByKey[id][token] = true
+			terms = append(terms, token)
+		}
+		keyClauses = append(keyClauses, bson.M{
+			"roomId":       key.RoomID,
+			"keyVersion":   key.KeyVersion,
+			"searchTokens": bson.M{"$in": key.Tokens},
+		})
+	}
+
+	filter := bson.M{
+		"$text":     bson.M{"$search": strings.Join(terms, " ")},
+		"$or":       keyClauses,
+		"isDeleted": false,
+	}
+	if req.SenderID != "" {
+		filter["senderId"] = req.SenderID
+	}
+	createdAt := bson.M{}
+	if req.From != nil {
+		createdAt["$gte"] = req.From.UTC()
+	}
+	if req.To != nil {
+		createdAt["$lt"] = req.To.UTC()
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+	cursor, err := collection.Find(ctx, filter, options.Find().
+		SetProjection(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		SetSort(bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "messageId", Value: -1}}).
+		SetLimit(req.Limit))
+	if err != nil {
+		fmt.Println("Error searching messages:", err)
+		return types.SearchMessagesResponse{}, err
+	}
+	defer cursor.Close(ctx)
+
+	var hits []struct {
+		types.ChatMessage `bson:",inline"`
+		Score             float64 `bson:"score"`
+	}
+	if err := cursor.All(ctx, &hits); err != nil {
+		fmt.Println("Error decoding search results:", err)
+		return types.SearchMessagesResponse{}, err
+	}
+
+	rooms := make(map[string]types.ChatRoom)
+	results := []types.SearchMessagesResult{}
+	for _, hit := range hits {
+		queryTokens := tokensByKey[searchKeyID(hit.RoomID, hit.KeyVersion)]
+		matched := []string{}
+		for _, token := range hit.SearchTokens {
+			if queryTokens[token] {
+				matched = append(matched, token)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		room, ok := rooms[hit.RoomID]
+		if !ok {
+			room, err = chat.FindRoom(hit.RoomID)
+			if err != nil {
+				fmt.Println("Error finding the search result's room:", err)
+				return types.SearchMessagesResponse{}, err
+			}
+			rooms[hit.RoomID] = room
+		}
+
+		before, err := contextMessages(ctx, hit.RoomID, hit.MessageID, true)
+		if err != nil {
+			return types.SearchMessagesResponse{}, err
+		}
+		after, err := contextMessages(ctx, hit.RoomID, hit.MessageID, false)
+		if err != nil {
+			return types.SearchMessagesResponse{}, err
+		}
+
+		results = append(results, types.SearchMessagesResult{
+			Room:          room,
+			Message:       hit.ChatMessage,
+			MatchedTokens: matched,
+			Before:        before,
+			After:         after,
+			Score:         hit.Score,
+		})
+	}
+
+	return types.SearchMessagesResponse{Results: results}, nil
+}
+
+// contextMessages returns the messages right before or after messageID in the room, oldest first
+func contextMessages(ctx context.Context, roomID, messageID string, before bool) ([]types.ChatMessage, error) {
+	filter := bson.M{"roomId": roomID, "messageId": bson.M{"$gt": messageID}}
+	sort := 1
+	if before {
+		filter["messageId"] = bson.M{"$lt": messageID}
+		sort = -1
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "messageId", Value: sort}}).SetLimit(searchContextMessages))
+	if err != nil {
+		fmt.Println("Error finding messages around a search result:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	messages := []types.ChatMessage{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	if before {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, nil
+}
+
+func searchKeyID(roomID string, keyVersion int) string {
+	return roomID + "/" + strconv.Itoa(keyVersion)
+}
@@ -1,7 +1,94 @@
 package chatsHandlers
 
-import "net/http"
+import (
+	"encoding/json"
+	"errors"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+)
 
-func SendMessageHandler(w http.ResponseWriter, r *http.Request) {}
+// SendMessageHandler sends a message without a WebSocket connection. Room members that are connected get it over /ws.
+func SendMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
 
-func sendMessage() {}
+	var req types.SendMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// The body is encrypted, so the word filter is checked against the plain text the client sends with it
+	if err := chat.DefaultWordFilter.CheckMessage(req.WordFilterVersion, req.Body, req.ModerationText); err != nil {
+		writeChatError(w, err, "")
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+
+	response, err := sendMessage(req, claims.UserID)
+	if err != nil {
+		writeChatError(w, err, "Error sending the message")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func sendMessage(req types.SendMessageRequest, senderID string) (types.SendMessageResponse, error) {
+	message, err := chat.DefaultHub.SendMessage(types.ChatMessage{
+		RoomID:        req.RoomID,
+		SenderID:      senderID,
+		Body:          req.Body,
+		KeyVersion:    req.KeyVersion,
+		ClientID:      req.ClientID,
+		AttachmentIDs: req.AttachmentIDs,
+		SearchTokens:  req.SearchTokens,
+	})
+	if err != nil {
+		return types.SendMessageResponse{IsSent: false}, err
+	}
+
+	return types.SendMessageResponse{
+		IsSent:  true,
+		Message: message,
+	}, nil
+}
+
+// writeChatError maps the chat package's errors to status codes
+func writeChatError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, chat.ErrRoomNotFound):
+		http.Error(w, "Chat room not found", http.StatusNotFound)
+	case errors.Is(err, chat.ErrAttachmentTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, chat.ErrAttachmentType):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.Is(err, chat.ErrAttachmentQuota):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, chat.ErrUnknownAttachment), errors.Is(err, chat.ErrTooManyAttachments),
+		errors.Is(err, chat.ErrSearchTokens):
+		http.Error(w, "Invalid request body, "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, chat.ErrUnknownMessage):
+		http.Error(w, "Message not found in this chat room", http.StatusNotFound)
+	case errors.Is(err, chat.ErrNotRoomMember):
+		http.Error(w, "You are not a member of this chat room", http.StatusForbidden)
+	case errors.Is(err, chat.ErrEmptyMessage), errors.Is(err, chat.ErrMessageLength), errors.Is(err, chat.ErrNotCiphertext),
+		errors.Is(err, chat.ErrMissingPublicKey), errors.Is(err, chat.ErrInvalidReceipt), errors.Is(err, chat.ErrModerationText):
+		http.Error(w, "Invalid request body, "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, chat.ErrMuted), errors.Is(err, chat.ErrBanned), errors.Is(err, chat.ErrCannotModerate):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, chat.ErrFilteredWord):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, chat.ErrStaleKeyVersion), errors.Is(err, chat.ErrRoomChanged), errors.Is(err, chat.ErrWordFilterVersion):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
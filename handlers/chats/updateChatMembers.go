@@ -0,0 +1,145 @@
+package chatsHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AddChatMemberHandler adds a user to a room. Any member can, the room moves to a new key that includes them but
+// they can't read anything sent before they joined.
+func AddChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, ok := decodeUpdateChatMembersRequest(w, r)
+	if !ok {
+		return
+	}
+
+	room, err := chat.FindRoom(req.RoomID)
+	if err != nil {
+		writeChatError(w, err, "Error adding the chat room member")
+		return
+	}
+	claims, _ := auth.ClaimsFromRequest(r)
+	if !containsID(room.MemberIDs, claims.UserID) && claims.Role != auth.RoleAdmin {
+		writeChatError(w, chat.ErrNotRoomMember, "")
+		return
+	}
+	if containsID(room.MemberIDs, req.UserID) {
+		http.Error(w, "User is already a member of this chat room", http.StatusConflict)
+		return
+	}
+	if containsID(room.BannedIDs, req.UserID) {
+		writeChatError(w, chat.ErrBanned, "")
+		return
+	}
+	if len(room.MemberIDs) >= MaxRoomMembers {
+		http.Error(w, fmt.Sprintf("A chat room can have at most %d members", MaxRoomMembers), http.StatusBadRequest)
+		return
+	}
+
+	exists, err := chatUserExists(req.UserID)
+	if err != nil {
+		http.Error(w, "Error adding the chat room member", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Every member must be an existing chat user", http.StatusBadRequest)
+		return
+	}
+
+	memberIDs := append(append([]string{}, room.MemberIDs...), req.UserID)
+	updateChatMembers(w, room, memberIDs)
+}
+
+// RemoveChatMemberHandler removes a user from a room. Members can remove themselves to leave, the room's creator or
+// an admin can remove anyone. The room moves to a new key so the removed user can't read what comes next.
+func RemoveChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, ok := decodeUpdateChatMembersRequest(w, r)
+	if !ok {
+		return
+	}
+
+	room, err := chat.FindRoom(req.RoomID)
+	if err != nil {
+		writeChatError(w, err, "Error removing the chat room member")
+		return
+	}
+	claims, _ := auth.ClaimsFromRequest(r)
+	if req.UserID != claims.UserID && room.CreatedBy != claims.UserID && claims.Role != auth.RoleAdmin {
+		http.Error(w, "You do not have permission to remove members from this chat room", http.StatusForbidden)
+		return
+	}
+	if !containsID(room.MemberIDs, req.UserID) {
+		http.Error(w, "User is not a member of this chat room", http.StatusNotFound)
+		return
+	}
+
+	memberIDs := []string{}
+	for _, memberID := range room.MemberIDs {
+		if memberID != req.UserID {
+			memberIDs = append(memberIDs, memberID)
+		}
+	}
+	if len(memberIDs) == 0 {
+		http.Error(w, "The last member can't leave a chat room, delete it instead", http.StatusConflict)
+		return
+	}
+
+	updateChatMembers(w, room, memberIDs)
+}
+
+func decodeUpdateChatMembersRequest(w http.ResponseWriter, r *http.Request) (types.UpdateChatMembersRequest, bool) {
+	var req types.UpdateChatMembersRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	req.UserID = strings.TrimSpace(req.UserID)
+	if err != nil || req.RoomID == "" || req.UserID == "" {
+		http.Error(w, "Invalid request body, \"roomId\" and \"userId\" are required", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+func updateChatMembers(w http.ResponseWriter, room types.ChatRoom, memberIDs []string) {
+	room, err := chat.RotateRoomKey(room, memberIDs)
+	if err != nil {
+		writeChatError(w, err, "Error updating the chat room members")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.UpdateChatMembersResponse{
+		IsUpdated: true,
+		Room:      room,
+	})
+}
+
+func chatUserExists(userID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.UsersCollection)
+	count, err := collection.CountDocuments(ctx, bson.M{"userId": userID})
+	if err != nil {
+		fmt.Println("Error finding chat user:", err)
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -1,7 +1,117 @@
 package chatsHandlers
 
-import "net/http"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"time"
+)
 
-func UpdateMessageHandler(w http.ResponseWriter, r *http.Request) {}
+// UpdateMessageHandler edits the body of a message. Only the sender can, while they're a member of the room and not
+// muted, and deleted messages can't be edited.
+func UpdateMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
 
-func updateMessage() {}
+	var req types.UpdateMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := chat.DefaultWordFilter.CheckMessage(req.WordFilterVersion, req.Body, req.ModerationText); err != nil {
+		writeChatError(w, err, "")
+		return
+	}
+
+	message, err := findMessage(req.MessageID)
+	if err != nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	claims, _ := auth.ClaimsFromRequest(r)
+	if message.SenderID != claims.UserID {
+		http.Error(w, "You can only edit your own messages", http.StatusForbidden)
+		return
+	}
+	if message.IsDeleted {
+		http.Error(w, "Deleted messages can't be edited", http.StatusConflict)
+		return
+	}
+
+	// Edits are encrypted with the current key too, even if the original was sent with an older one
+	room, err := chat.DefaultStore.Room(message.RoomID)
+	if err != nil {
+		writeChatError(w, err, "Error updating the message")
+		return
+	}
+	// The same gate as sending, or a muted or banned user could keep posting by editing old messages
+	if !containsID(room.MemberIDs, claims.UserID) {
+		writeChatError(w, chat.ErrNotRoomMember, "")
+		return
+	}
+	if chat.IsMuted(room, claims.UserID) {
+		writeChatError(w, chat.ErrMuted, "")
+		return
+	}
+	if err := chat.ValidateCiphertext(req.Body, req.KeyVersion, room); err != nil {
+		writeChatError(w, err, "")
+		return
+	}
+	if err := chat.ValidateSearchTokens(req.SearchTokens); err != nil {
+		writeChatError(w, err, "")
+		return
+	}
+
+	response, err := updateMessage(req)
+	if err != nil {
+		http.Error(w, "Error updating the message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func updateMessage(req types.UpdateMessageRequest) (types.UpdateMessageResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.ChatMessagesCollection)
+
+	var message types.ChatMessage
+	err := collection.FindOneAndUpdate(ctx, bson.M{"messageId": req.MessageID, "isDeleted": false}, bson.M{
+		"$set": bson.M{
+			"body":         req.Body,
+			"keyVersion":   req.KeyVersion,
+			"searchTokens": req.SearchTokens,
+			"editedAt":     time.Now().UTC(),
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&message)
+	if err != nil {
+		fmt.Println("Error updating the message in the database:", err)
+		return types.UpdateMessageResponse{IsUpdated: false}, err
+	}
+
+	if err := chat.DefaultHub.PublishToRoom(message.RoomID, types.ChatEvent{
+		Type:    chat.EventMessageUpdated,
+		RoomID:  message.RoomID,
+		Message: &message,
+	}); err != nil {
+		fmt.Println("Error publishing message update:", err)
+	}
+
+	return types.UpdateMessageResponse{
+		IsUpdated: true,
+		Message:   message,
+	}, nil
+}
@@ -3,14 +3,20 @@ package chatsHandlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/events"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"net/http"
 	"time"
 )
 
+// UpdateUserHandler changes the name and picture shown in chat. They're saved on the student or teacher record and
+// copied to the chat profile from there, so the two can't drift apart.
 func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
@@ -24,7 +30,17 @@ func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := updateUser(req)
+	claims, _ := auth.ClaimsFromRequest(r)
+	if claims.UserID != req.UserId && claims.Role != auth.RoleAdmin {
+		http.Error(w, "You do not have permission to modify this chat user", http.StatusForbidden)
+		return
+	}
+
+	response, err := updateUser(req, chatUserRole(req.UserType, claims))
+	if errors.Is(err, chat.ErrUserRecordNotFound) {
+		http.Error(w, "No student or teacher exists with this userId", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error updating chat user", http.StatusInternalServerError)
 		return
@@ -34,31 +50,39 @@ func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func updateUser(req types.UpdateUserRequest) (types.UpdateUserResponse, error) {
+func updateUser(req types.UpdateUserRequest, role string) (types.UpdateUserResponse, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	update := bson.M{}
 	if req.PreferredName != "" {
-		update["preferredName"] = req.PreferredName
+		update["preferredname"] = req.PreferredName
 	}
 	if req.ProfilePictureURL != "" {
-		update["profilePictureUrl"] = req.ProfilePictureURL
+		update["profilepictureurl"] = req.ProfilePictureURL
+	}
+	if len(update) == 0 {
+		return types.UpdateUserResponse{IsUpdated: true}, nil
 	}
 
-	collection := db.MongoClient.Database(db.DbName).Collection(db.UsersCollection)
-	var userResult bson.M
-	err := collection.FindOneAndUpdate(ctx, bson.M{
-		"userId": req.UserId,
-	}, bson.M{
-		"$set": update,
-	}).Decode(&userResult)
+	collectionName, idField := auth.UserCollection(role)
+	collection := db.MongoClient.Database(db.DbName).Collection(collectionName)
+	result, err := collection.UpdateOne(ctx, bson.M{idField: req.UserId}, bson.M{"$set": update})
 	if err != nil {
-		fmt.Println("Error attempting to find and update user in the database:", err)
+		fmt.Println("Error attempting to update the chat user's record in the database:", err)
 		return types.UpdateUserResponse{
 			IsUpdated: false,
 		}, err
 	}
+	if result.MatchedCount == 0 {
+		return types.UpdateUserResponse{IsUpdated: false}, chat.ErrUserRecordNotFound
+	}
+
+	if collectionName == db.TeachersCollection {
+		events.Publish(events.TeacherUpdated, auth.RoleTeacher, req.UserId)
+	} else {
+		events.Publish(events.StudentUpdated, auth.RoleStudent, req.UserId)
+	}
 
 	return types.UpdateUserResponse{
 		IsUpdated: true,
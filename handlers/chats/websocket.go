@@ -0,0 +1,19 @@
+package chatsHandlers
+
+import (
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"net/http"
+)
+
+// WebSocketHandler opens the real-time chat connection for the signed in user. Messages for every room the user is in
+// arrive over it, and messages can be sent over it as {"type":"message","roomId":"...","body":"..."} frames.
+func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	chat.DefaultHub.ServeWS(w, r, claims.UserID)
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"time"
+)
+
+// ConfirmVerificationHandler marks the email address as verified with a token from a verification email
+func ConfirmVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.ConfirmVerificationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Token == "" {
+		http.Error(w, "Invalid request body, \"token\" is required", http.StatusBadRequest)
+		return
+	}
+
+	response, err := confirmVerification(req.Token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Verification code is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error verifying email address", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func confirmVerification(token string) (types.ConfirmVerificationResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.VerificationsCollection)
+
+	// Confirming twice is harmless, so already verified tokens still match until they expire
+	var verification types.EmailVerification
+	err := collection.FindOneAndUpdate(ctx, bson.M{
+		"tokenHash": auth.HashToken(token),
+		"expiresAt": bson.M{"$gt": time.Now().UTC()},
+	}, bson.M{
+		"$set": bson.M{"isVerified": true},
+	}).Decode(&verification)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			fmt.Println("Error finding verification token:", err)
+		}
+		return types.ConfirmVerificationResponse{IsVerified: false}, err
+	}
+
+	// The address is only verified if the account still uses the address the email was sent to
+	collectionName, idField := auth.UserCollection(verification.Role)
+	usersCollection := db.MongoClient.Database(db.DbName).Collection(collectionName)
+	result, err := usersCollection.UpdateOne(ctx, bson.M{idField: verification.UserID, "emailaddress": verification.Email}, bson.M{
+		"$set": bson.M{"emailverified": true},
+	})
+	if err != nil {
+		fmt.Println("Error marking email address as verified:", err)
+		return types.ConfirmVerificationResponse{IsVerified: false}, err
+	}
+	if result.MatchedCount == 0 {
+		return types.ConfirmVerificationResponse{IsVerified: false}, mongo.ErrNoDocuments
+	}
+
+	fmt.Println("Verified email address for", verification.Role, verification.UserID)
+	return types.ConfirmVerificationResponse{IsVerified: true}, nil
+}
@@ -3,14 +3,42 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/mailer"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"net/http"
+	"os"
 	"time"
 )
 
+var (
+	// VerificationTTL is how long an emailed verification token can be used for
+	VerificationTTL = 24 * time.Hour
+	// VerificationResendInterval is the minimum time between two verification emails to the same address
+	VerificationResendInterval = 1 * time.Minute
+	// VerificationsPerHour is how many verification emails an address can get in an hour
+	VerificationsPerHour int64 = 5
+	// RequireEmailVerification blocks password logins until the email address has been verified
+	RequireEmailVerification = os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+)
+
+// errVerificationRateLimited carries how long the caller has to wait before another email is sent
+type errVerificationRateLimited struct {
+	retryAfter time.Duration
+}
+
+func (e errVerificationRateLimited) Error() string {
+	return fmt.Sprintf("verification email rate limited, retry after %s", e.retryAfter)
+}
+
+// CreateVerificationHandler (re)sends a verification email. The response is the same whether or not the account
+// exists so this can't be used to find accounts.
 func CreateVerificationHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
@@ -19,10 +47,23 @@ func CreateVerificationHandler(w http.ResponseWriter, r *http.Request) {
 
 	var req types.CreateVerificationRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
+	if err != nil || req.Email == "" {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if req.UserType == "" {
+		req.UserType = auth.RoleStudent
+	}
+	if req.UserType != auth.RoleStudent && req.UserType != auth.RoleTeacher {
+		http.Error(w, "Invalid request body, \"userType\" must be either \"student\" or \"teacher\"", http.StatusBadRequest)
+		return
+	}
+
+	// Limited before the account is looked up, so addresses with and without an account are answered alike
+	if wait := auth.DefaultEmailLimiter.Allow("verification", req.Email); wait > 0 {
+		auth.WriteTooManyEmails(w, wait)
+		return
+	}
 
 	response, err := createVerification(req)
 	if err != nil {
@@ -35,25 +76,92 @@ func CreateVerificationHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func createVerification(req types.CreateVerificationRequest) (types.CreateVerificationResponse, error) {
+	response := types.CreateVerificationResponse{
+		IsCreated: true,
+	}
+
+	userID, err := auth.FindUserIDByEmail(req.UserType, req.Email)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			fmt.Println("Verification requested for unknown", req.UserType, "email")
+			return response, nil
+		}
+		return types.CreateVerificationResponse{IsCreated: false}, err
+	}
+
+	// The address's own limit is dropped silently, a 429 here would only ever be seen for existing accounts
+	err = SendVerificationEmail(req.UserType, userID, req.Email)
+	var rateLimited errVerificationRateLimited
+	if errors.As(err, &rateLimited) {
+		fmt.Println("Verification email not sent, the address had too many recently")
+		return response, nil
+	}
+	if err != nil {
+		return types.CreateVerificationResponse{IsCreated: false}, err
+	}
+
+	return response, nil
+}
+
+// SendVerificationEmail emails a new verification token to the user, unless the address has had too many recently
+func SendVerificationEmail(role, userID, emailAddress string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	now := time.Now().UTC()
 	collection := db.MongoClient.Database(db.DbName).Collection(db.VerificationsCollection)
-	_, err := collection.InsertOne(ctx, bson.M{
-		"token":            req.Token,
-		"email":            req.Email,
-		"isVerified":       req.IsVerified,
-		"registrationCode": req.RegistrationCode,
-		"isRegistered":     req.IsRegistered,
+
+	var latest types.EmailVerification
+	err := collection.FindOne(ctx, bson.M{"email": emailAddress}, options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}})).Decode(&latest)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		fmt.Println("Error finding previous verification emails:", err)
+		return err
+	}
+	if err == nil {
+		if wait := latest.CreatedAt.Add(VerificationResendInterval).Sub(now); wait > 0 {
+			return errVerificationRateLimited{retryAfter: wait}
+		}
+
+		sentLastHour, err := collection.CountDocuments(ctx, bson.M{"email": emailAddress, "createdAt": bson.M{"$gt": now.Add(-time.Hour)}})
+		if err != nil {
+			fmt.Println("Error counting verification emails:", err)
+			return err
+		}
+		if sentLastHour >= VerificationsPerHour {
+			return errVerificationRateLimited{retryAfter: time.Hour}
+		}
+	}
+
+	token, err := auth.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.InsertOne(ctx, types.EmailVerification{
+		TokenHash:  auth.HashToken(token),
+		UserID:     userID,
+		Role:       role,
+		Email:      emailAddress,
+		IsVerified: false,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(VerificationTTL),
 	})
 	if err != nil {
 		fmt.Println("Error attempting to insert verification object into the database: ", err)
-		return types.CreateVerificationResponse{
-			IsCreated: false,
-		}, err
+		return err
 	}
 
-	return types.CreateVerificationResponse{
-		IsCreated: true,
-	}, nil
+	body := fmt.Sprintf("Welcome to Aspire To Expand!\n\n"+
+		"Your email verification code is:\n\n%s\n\n"+
+		"It expires in %d hours. If you didn't create an account you can ignore this email.\n",
+		token, int(VerificationTTL.Hours()))
+	if verifyURL := os.Getenv("EMAIL_VERIFICATION_URL"); verifyURL != "" {
+		body += fmt.Sprintf("\nOr open this link to verify your email address: %s?token=%s\n", verifyURL, token)
+	}
+
+	return mailer.Send(types.EmailMessage{
+		To:      emailAddress,
+		Subject: "Verify your Aspire To Expand email address",
+		Body:    body,
+	})
 }
@@ -0,0 +1,631 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A data export bundles everything held about a student or teacher into a zip of JSON files, next to copies of their
+// profile picture and chat attachments. Exports can be large, so they're built in the background and downloaded once
+// complete.
+
+const (
+	ExportPending  = "pending"
+	ExportRunning  = "running"
+	ExportComplete = "complete"
+	ExportFailed   = "failed"
+)
+
+// ExportsDir is where finished exports are kept until they expire. It isn't served directly.
+var ExportsDir = "exports"
+
+// ExportRetention is how long a finished export can be downloaded for
+var ExportRetention = 7 * 24 * time.Hour
+
+// ErrExportNotFound is returned when an export doesn't exist or has expired
+var ErrExportNotFound = errors.New("export not found")
+
+// Only a couple of exports are built at once, so a burst of requests doesn't starve the rest of the server
+var exportSlots = make(chan struct{}, 2)
+
+// Fields that are never exported: credentials, and Mongo's own ids
+var exportOmittedFields = map[string]bool{
+	"_id":           true,
+	"password":      true,
+	"salt":          true,
+	"totpsecret":    true,
+	"totplaststep":  true,
+	"recoverycodes": true,
+}
+
+// RequestDataExport queues an export of the student's or teacher's data. A request while an export for the same
+// account is still being built returns that export instead of starting another.
+func RequestDataExport(role, userID, requestedBy string) (types.DataExport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	role = accountRole(role)
+	collectionName, idField := auth.UserCollection(role)
+	count, err := db.MongoClient.Database(db.DbName).Collection(collectionName).CountDocuments(ctx, bson.M{idField: userID})
+	if err != nil {
+		return types.DataExport{}, err
+	}
+	if count == 0 {
+		return types.DataExport{}, ErrAccountNotFound
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.DataExportsCollection)
+
+	var export types.DataExport
+	err = collection.FindOne(ctx, bson.M{
+		"userId": userID,
+		"status": bson.M{"$in": []string{ExportPending, ExportRunning}},
+	}).Decode(&export)
+	if err == nil {
+		return export, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return types.DataExport{}, err
+	}
+
+	now := time.Now().UTC()
+	export = types.DataExport{
+		ExportID:    uuid.New().String(),
+		UserID:      userID,
+		Role:        role,
+		RequestedBy: requestedBy,
+		Status:      ExportPending,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ExportRetention),
+	}
+	if _, err := collection.InsertOne(ctx, export); err != nil {
+		fmt.Println("Error inserting data export:", err)
+		return types.DataExport{}, err
+	}
+
+	queueDataExport(export)
+	return export, nil
+}
+
+// FindDataExport loads an export that hasn't expired yet
+func FindDataExport(exportID string) (types.DataExport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.DataExportsCollection)
+
+	var export types.DataExport
+	err := collection.FindOne(ctx, bson.M{"exportId": exportID}).Decode(&export)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && export.ExpiresAt.Before(time.Now())) {
+		return types.DataExport{}, ErrExportNotFound
+	}
+	return export, err
+}
+
+// DataExportPath is where the zip for an export is written
+func DataExportPath(exportID string) string {
+	return filepath.Join(ExportsDir, exportID+".zip")
+}
+
+func queueDataExport(export types.DataExport) {
+	go func() {
+		exportSlots <- struct{}{}
+		defer func() { <-exportSlots }()
+
+		if err := runDataExport(export); err != nil {
+			fmt.Println("Error exporting data for", export.Role, export.UserID+":", err)
+		}
+	}()
+}
+
+// runDataExport builds the zip and records how it went
+func runDataExport(export types.DataExport) error {
+	collection := db.MongoClient.Database(db.DbName).Collection(db.DataExportsCollection)
+
+	setStatus := func(update bson.M) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := collection.UpdateOne(ctx, bson.M{"exportId": export.ExportID}, bson.M{"$set": update})
+		return err
+	}
+
+	if err := setStatus(bson.M{"status": ExportRunning}); err != nil {
+		return err
+	}
+
+	size, err := writeDataExport(export)
+	if err != nil {
+		if statusErr := setStatus(bson.M{"status": ExportFailed, "error": err.Error()}); statusErr != nil {
+			fmt.Println("Error marking data export as failed:", statusErr)
+		}
+		return err
+	}
+
+	completedAt := time.Now().UTC()
+	fmt.Println("Exported data for", export.Role, export.UserID, "-", size, "bytes")
+	return setStatus(bson.M{
+		"status":      ExportComplete,
+		"size":        size,
+		"completedAt": completedAt,
+		"expiresAt":   completedAt.Add(ExportRetention),
+	})
+}
+
+// writeDataExport writes the zip to a temporary file first, so a half written export is never downloaded
+func writeDataExport(export types.DataExport) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	if err := os.MkdirAll(ExportsDir, 0o755); err != nil {
+		return 0, err
+	}
+	finalPath := DataExportPath(export.ExportID)
+	tempPath := finalPath + ".tmp"
+
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tempPath)
+
+	zipWriter := zip.NewWriter(file)
+	manifest, err := writeDataExportFiles(ctx, zipWriter, export)
+	if err == nil {
+		err = writeJSONFile(zipWriter, "manifest.json", manifest)
+	}
+	if err == nil {
+		err = zipWriter.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tempPath, finalPath); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(finalPath)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func writeDataExportFiles(ctx context.Context, zipWriter *zip.Writer, export types.DataExport) (types.DataExportManifest, error) {
+	manifest := types.DataExportManifest{
+		ExportID:    export.ExportID,
+		UserID:      export.UserID,
+		Role:        export.Role,
+		GeneratedAt: time.Now().UTC(),
+	}
+	database := db.MongoClient.Database(db.DbName)
+
+	collectionName, idField := auth.UserCollection(export.Role)
+	profile, err := database.Collection(collectionName).FindOne(ctx, bson.M{idField: export.UserID}).Raw()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return manifest, ErrAccountNotFound
+	}
+	if err != nil {
+		return manifest, err
+	}
+	if err := writeExtJSONFile(zipWriter, "profile.json", profile); err != nil {
+		return manifest, err
+	}
+	manifest.Files = append(manifest.Files, types.DataExportManifestFile{
+		Name:        "profile.json",
+		Description: "Your " + export.Role + " profile. Passwords and two-factor secrets are left out.",
+		Records:     1,
+	})
+
+	type exportQuery struct {
+		name        string
+		description string
+		collection  string
+		filter      bson.M
+	}
+	queries := []exportQuery{
+		{"lessons.json", "Lessons you take part in", db.LessonsCollection, bson.M{idField: export.UserID}},
+		{"lessonSeries.json", "Recurring lesson series you take part in", db.LessonSeriesCollection, bson.M{idField: export.UserID}},
+	}
+	if export.Role == auth.RoleTeacher {
+		queries = append(queries,
+			exportQuery{"registrations.json", "Registration codes you created", db.RegistrationCollection, bson.M{"teacherid": export.UserID}},
+			exportQuery{"availability.json", "Your working hours, time off and holidays", db.TeacherAvailabilityCollection, bson.M{"teacherid": export.UserID}},
+		)
+	} else {
+		queries = append(queries,
+			exportQuery{"assignments.json", "Your assignments", db.StudentAssignmentsCollection, bson.M{"studentid": export.UserID}},
+			exportQuery{"games.json", "Your game results", db.StudentGamesCollection, bson.M{"studentid": export.UserID}},
+		)
+	}
+	queries = append(queries,
+		exportQuery{"chat/profile.json", "Your chat profile", db.UsersCollection, bson.M{"userId": export.UserID}},
+		exportQuery{"chat/rooms.json", "Chat rooms you are a member of", db.ChatRoomsCollection, bson.M{"memberIds": export.UserID}},
+		exportQuery{"chat/messages.json", "Chat messages you sent. Bodies are end-to-end encrypted, decrypt them with the room keys in chat/roomKeys.json and your private key.", db.ChatMessagesCollection, bson.M{"senderId": export.UserID}},
+		exportQuery{"chat/roomKeys.json", "Room keys wrapped with your public key", db.ChatRoomKeysCollection, bson.M{"userId": export.UserID}},
+		exportQuery{"chat/readStates.json", "How far you have read in each chat room", db.ChatReadStatesCollection, bson.M{"userId": export.UserID}},
+		exportQuery{"chat/attachments.json", "Files you attached to chat messages, the files themselves are in chat/attachments", db.ChatAttachmentsCollection, bson.M{"uploaderId": export.UserID}},
+	)
+
+	for _, query := range queries {
+		records, err := writeExtJSONArray(ctx, zipWriter, query.name, database.Collection(query.collection), query.filter)
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Files = append(manifest.Files, types.DataExportManifestFile{
+			Name:        query.name,
+			Description: query.description,
+			Records:     records,
+		})
+	}
+
+	cursor, err := database.Collection(db.ChatAttachmentsCollection).Find(ctx, bson.M{"uploaderId": export.UserID})
+	if err != nil {
+		return manifest, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var attachment types.ChatAttachment
+		if err := cursor.Decode(&attachment); err != nil {
+			return manifest, err
+		}
+		name := "chat/attachments/" + attachment.AttachmentID + "_" + path.Base(attachment.FileName)
+		size, err := copyFileToZip(zipWriter, name, chat.AttachmentPath(attachment.AttachmentID, false))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Files = append(manifest.Files, types.DataExportManifestFile{
+			Name:        name,
+			Description: "Chat attachment " + attachment.FileName,
+			Bytes:       size,
+		})
+	}
+	if err := cursor.Err(); err != nil {
+		return manifest, err
+	}
+
+	if pictureURL, _ := profile.Lookup("profilepictureurl").StringValueOK(); strings.Contains(pictureURL, "/uploads/profileImages/") {
+		fileName := path.Base(pictureURL)
+		name := "images/" + fileName
+		size, err := copyFileToZip(zipWriter, name, filepath.Join("uploads", "profileImages", fileName))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return manifest, err
+		}
+		if err == nil {
+			manifest.Files = append(manifest.Files, types.DataExportManifestFile{
+				Name:        name,
+				Description: "Your profile picture",
+				Bytes:       size,
+			})
+		}
+	}
+
+	keyPath := filepath.Join("keys", strings.ReplaceAll(export.UserID, "-", "_")+".pem")
+	size, err := copyFileToZip(zipWriter, "chat/publicKey.pem", keyPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return manifest, err
+	}
+	if err == nil {
+		manifest.Files = append(manifest.Files, types.DataExportManifestFile{
+			Name:        "chat/publicKey.pem",
+			Description: "The public key your chat room keys are wrapped with",
+			Bytes:       size,
+		})
+	}
+
+	return manifest, nil
+}
+
+// exportDocument drops the fields that are never exported
+func exportDocument(raw bson.Raw) (bson.D, error) {
+	var document bson.D
+	if err := bson.Unmarshal(raw, &document); err != nil {
+		return nil, err
+	}
+
+	kept := document[:0]
+	for _, element := range document {
+		if !exportOmittedFields[strings.ToLower(element.Key)] {
+			kept = append(kept, element)
+		}
+	}
+	return kept, nil
+}
+
+func writeJSONFile(zipWriter *zip.Writer, name string, value interface{}) error {
+	writer, err := zipWriter.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// writeExtJSONFile writes a single document as relaxed extended JSON, so dates and binary fields survive as they are
+func writeExtJSONFile(zipWriter *zip.Writer, name string, raw bson.Raw) error {
+	document, err := exportDocument(raw)
+	if err != nil {
+		return err
+	}
+	data, err := bson.MarshalExtJSONIndent(document, false, false, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	writer, err := zipWriter.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(data, '\n'))
+	return err
+}
+
+// writeExtJSONArray streams every matching document into a JSON array, so large histories aren't held in memory
+func writeExtJSONArray(ctx context.Context, zipWriter *zip.Writer, name string, collection *mongo.Collection, filter bson.M) (int, error) {
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	writer, err := zipWriter.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(writer, "["); err != nil {
+		return 0, err
+	}
+
+	records := 0
+	for cursor.Next(ctx) {
+		document, err := exportDocument(cursor.Current)
+		if err != nil {
+			return records, err
+		}
+		data, err := bson.MarshalExtJSONIndent(document, false, false, "  ", "  ")
+		if err != nil {
+			return records, err
+		}
+
+		separator := "\n  "
+		if records > 0 {
+			separator = ",\n  "
+		}
+		if _, err := io.WriteString(writer, separator); err != nil {
+			return records, err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return records, err
+		}
+		records++
+	}
+	if err := cursor.Err(); err != nil {
+		return records, err
+	}
+
+	closing := "]\n"
+	if records > 0 {
+		closing = "\n]\n"
+	}
+	_, err = io.WriteString(writer, closing)
+	return records, err
+}
+
+func copyFileToZip(zipWriter *zip.Writer, name, filePath string) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	writer, err := zipWriter.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(writer, file)
+}
+
+// RemoveExpiredDataExports deletes exports, and their zips, once they can no longer be downloaded
+func RemoveExpiredDataExports() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return removeDataExports(ctx, bson.M{"expiresAt": bson.M{"$lte": time.Now().UTC()}})
+}
+
+// removeDataExports deletes the matching exports and their zips. An export whose zip can't be removed is kept, so
+// it's tried again next time.
+func removeDataExports(ctx context.Context, filter bson.M) (int, error) {
+	collection := db.MongoClient.Database(db.DbName).Collection(db.DataExportsCollection)
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	exports := []types.DataExport{}
+	err = cursor.All(ctx, &exports)
+	cursor.Close(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, export := range exports {
+		if err := os.Remove(DataExportPath(export.ExportID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("Error removing data export:", err)
+			continue
+		}
+		if _, err := collection.DeleteOne(ctx, bson.M{"exportId": export.ExportID}); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// resumeDataExports queues the exports that were still pending or running when the server stopped
+func resumeDataExports() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.DataExportsCollection)
+	cursor, err := collection.Find(ctx, bson.M{"status": bson.M{"$in": []string{ExportPending, ExportRunning}}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	exports := []types.DataExport{}
+	if err := cursor.All(ctx, &exports); err != nil {
+		return err
+	}
+	for _, export := range exports {
+		queueDataExport(export)
+	}
+	return nil
+}
+
+// StartDataExportJob picks up exports interrupted by a restart, then removes expired exports every interval
+func StartDataExportJob(interval time.Duration) {
+	if err := resumeDataExports(); err != nil {
+		fmt.Println("Error resuming data exports:", err)
+	}
+
+	go func() {
+		for {
+			if _, err := RemoveExpiredDataExports(); err != nil {
+				fmt.Println("Error removing expired data exports:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// canAccessDataExport lets the account the export is about, whoever requested it, and admins see an export
+func canAccessDataExport(claims types.TokenClaims, export types.DataExport) bool {
+	return canDownloadDataExport(claims, export) || claims.UserID == export.RequestedBy
+}
+
+// canDownloadDataExport lets only the account the export is about and admins download it. A teacher can ask for a
+// student's export but not download it, it holds all of the student's chats, not just the ones with the teacher.
+func canDownloadDataExport(claims types.TokenClaims, export types.DataExport) bool {
+	return claims.Role == auth.RoleAdmin || claims.UserID == export.UserID
+}
+
+// WriteDataExportResponse writes the export with its download link once it's complete, if the caller may download it
+func WriteDataExportResponse(w http.ResponseWriter, r *http.Request, status int, export types.DataExport) {
+	response := types.DataExportResponse{Export: export}
+	if claims, _ := auth.ClaimsFromRequest(r); export.Status == ExportComplete && canDownloadDataExport(claims, export) {
+		response.DownloadURL = "/exports/download?exportId=" + export.ExportID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetDataExportStatusHandler reports how far along an export is
+func GetDataExportStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	exportID := r.URL.Query().Get("exportId")
+	if exportID == "" {
+		http.Error(w, "Invalid request query. The \"exportId\" query is required", http.StatusBadRequest)
+		return
+	}
+
+	export, ok := findAccessibleDataExport(w, r, exportID)
+	if !ok {
+		return
+	}
+
+	WriteDataExportResponse(w, r, http.StatusOK, export)
+}
+
+// DownloadDataExportHandler sends the zip of a complete export
+func DownloadDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	exportID := r.URL.Query().Get("exportId")
+	if exportID == "" {
+		http.Error(w, "Invalid request query. The \"exportId\" query is required", http.StatusBadRequest)
+		return
+	}
+
+	export, ok := findAccessibleDataExport(w, r, exportID)
+	if !ok {
+		return
+	}
+	if claims, _ := auth.ClaimsFromRequest(r); !canDownloadDataExport(claims, export) {
+		http.Error(w, "Only the account the export is about or an admin can download it", http.StatusForbidden)
+		return
+	}
+	if export.Status != ExportComplete {
+		http.Error(w, "The export is not ready yet, its status is "+export.Status, http.StatusConflict)
+		return
+	}
+
+	file, err := os.Open(DataExportPath(export.ExportID))
+	if err != nil {
+		fmt.Println("Error opening data export:", err)
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	fileName := fmt.Sprintf("aspire-%s-%s-%s.zip", export.Role, export.UserID, export.CompletedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, fileName, *export.CompletedAt, file)
+}
+
+func findAccessibleDataExport(w http.ResponseWriter, r *http.Request, exportID string) (types.DataExport, bool) {
+	export, err := FindDataExport(exportID)
+	if errors.Is(err, ErrExportNotFound) {
+		http.Error(w, "Export not found, it may have expired", http.StatusNotFound)
+		return export, false
+	}
+	if err != nil {
+		fmt.Println("Error finding data export:", err)
+		http.Error(w, "Error finding export", http.StatusInternalServerError)
+		return export, false
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	if !canAccessDataExport(claims, export) {
+		// Same response as a missing export, so export ids can't be probed
+		http.Error(w, "Export not found, it may have expired", http.StatusNotFound)
+		return export, false
+	}
+	return export, true
+}
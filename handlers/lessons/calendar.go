@@ -0,0 +1,215 @@
+package lessonsHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/ical"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Teachers and students can subscribe to their lessons from Google Calendar, Outlook and the like. The feed URL
+// carries a secret token, calendar apps poll it, and a lesson keeps its UID across changes so they update it in place.
+// Canceled lessons stay in the feed as STATUS:CANCELLED, moved ones come with a higher SEQUENCE.
+
+// CalendarFeedHistory is how far back the feed goes, older lessons drop out of subscribed calendars
+var CalendarFeedHistory = 90 * 24 * time.Hour
+
+const calendarFeedPath = "/calendar/feed.ics"
+
+// CreateCalendarFeedHandler creates the caller's calendar feed URL. Calling it again gives a new URL and the old one
+// stops working, which is how a leaked URL is replaced.
+func CreateCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	token, feed, err := auth.CreateCalendarFeedToken(claims.UserID, claims.Role)
+	if err != nil {
+		http.Error(w, "Error creating the calendar feed", http.StatusInternalServerError)
+		return
+	}
+
+	address := fmt.Sprintf("%s:8888%s?token=%s", os.Getenv("IP_ADDRESS"), calendarFeedPath, token)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.CalendarFeedResponse{
+		URL:       "https://" + address,
+		WebcalURL: "webcal://" + address,
+		CreatedAt: feed.CreatedAt,
+	})
+}
+
+// RevokeCalendarFeedHandler turns the caller's calendar feed off
+func RevokeCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	revoked, err := auth.RevokeCalendarFeed(claims.UserID)
+	if err != nil {
+		http.Error(w, "Error turning off the calendar feed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.RevokeCalendarFeedResponse{IsRevoked: revoked})
+}
+
+// CalendarFeedHandler serves the lessons of the feed's owner as text/calendar, with ?token= in place of an access
+// token
+func CalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	feed, err := auth.FindCalendarFeed(r.URL.Query().Get("token"))
+	if errors.Is(err, auth.ErrInvalidToken) {
+		http.Error(w, "Calendar feed not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error loading the calendar feed", http.StatusInternalServerError)
+		return
+	}
+
+	calendar, err := lessonCalendar(feed)
+	if err != nil {
+		http.Error(w, "Error loading the calendar feed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="lessons.ics"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := ical.Write(w, calendar); err != nil {
+		fmt.Println("Error writing the calendar feed:", err)
+	}
+}
+
+// lessonCalendar turns the owner's lessons from CalendarFeedHistory ago onwards into events
+func lessonCalendar(feed types.CalendarFeed) (ical.Calendar, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	idField, partnerRole := "studentid", auth.RoleTeacher
+	if feed.Role != auth.RoleStudent {
+		idField, partnerRole = "teacherid", auth.RoleStudent
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonsCollection)
+	cursor, err := collection.Find(ctx, bson.M{
+		idField:             feed.UserID,
+		"scheduleddatetime": bson.M{"$gte": time.Now().Add(-CalendarFeedHistory).Unix()},
+	}, options.Find().SetSort(bson.D{{Key: "scheduleddatetime", Value: 1}}))
+	if err != nil {
+		fmt.Println("Error finding the lessons of the calendar feed:", err)
+		return ical.Calendar{}, err
+	}
+	defer cursor.Close(ctx)
+
+	lessons := []types.Lesson{}
+	if err := cursor.All(ctx, &lessons); err != nil {
+		fmt.Println("Error decoding the lessons of the calendar feed:", err)
+		return ical.Calendar{}, err
+	}
+
+	partnerIDs := []string{}
+	for _, lesson := range lessons {
+		if partnerRole == auth.RoleTeacher {
+			partnerIDs = append(partnerIDs, lesson.TeacherID)
+		} else {
+			partnerIDs = append(partnerIDs, lesson.StudentId)
+		}
+	}
+	names, err := userNames(ctx, partnerRole, partnerIDs)
+	if err != nil {
+		return ical.Calendar{}, err
+	}
+
+	calendar := ical.Calendar{Name: "Aspire with Alina lessons", Events: []ical.Event{}}
+	for _, lesson := range lessons {
+		partnerID := lesson.StudentId
+		if partnerRole == auth.RoleTeacher {
+			partnerID = lesson.TeacherID
+		}
+		calendar.Events = append(calendar.Events, lessonEvent(lesson, names[partnerID]))
+	}
+	return calendar, nil
+}
+
+// lessonEvent is the feed's event for a lesson, partner is the name of the teacher or student it's with
+func lessonEvent(lesson types.Lesson, partner string) ical.Event {
+	start := time.Unix(lesson.ScheduledDateTime, 0)
+	event := ical.Event{
+		UID:      lesson.LessonID + "@aspirewithalina",
+		Summary:  lesson.Subject,
+		Start:    start,
+		End:      start.Add(lessonDuration(lesson)),
+		Sequence: lesson.Sequence,
+		Status:   ical.StatusConfirmed,
+	}
+	if event.Summary == "" {
+		event.Summary = "Lesson"
+	}
+	if partner != "" {
+		event.Summary += " with " + partner
+	}
+	if lesson.Room != 0 {
+		event.Location = fmt.Sprintf("Room %d", lesson.Room)
+	}
+	if lesson.IsCanceled {
+		event.Status = ical.StatusCancelled
+	}
+	return event
+}
+
+// userNames maps the IDs of students or teachers to the names they go by
+func userNames(ctx context.Context, role string, userIDs []string) (map[string]string, error) {
+	names := map[string]string{}
+	if len(userIDs) == 0 {
+		return names, nil
+	}
+
+	collectionName, idField := auth.UserCollection(role)
+	collection := db.MongoClient.Database(db.DbName).Collection(collectionName)
+	cursor, err := collection.Find(ctx, bson.M{idField: bson.M{"$in": userIDs}}, options.Find().SetProjection(bson.M{
+		idField: 1, "firstname": 1, "preferredname": 1, "lastname": 1,
+	}))
+	if err != nil {
+		fmt.Println("Error finding names for the calendar feed:", err)
+		return names, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var user bson.M
+		if err := cursor.Decode(&user); err != nil {
+			return names, err
+		}
+		id, _ := user[idField].(string)
+		firstName, _ := user["preferredname"].(string)
+		if firstName == "" {
+			firstName, _ = user["firstname"].(string)
+		}
+		lastName, _ := user["lastname"].(string)
+		names[id] = strings.TrimSpace(firstName + " " + lastName)
+	}
+	return names, cursor.Err()
+}
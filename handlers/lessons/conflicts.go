@@ -0,0 +1,236 @@
+package lessonsHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Lessons can't overlap for the same teacher, student or room, counting LessonBuffer either side of each lesson.
+// Canceled lessons never clash.
+
+const (
+	DefaultLessonDuration = 60 * time.Minute
+	MaxLessonDuration     = 8 * time.Hour
+)
+
+// LessonBuffer is the time kept free between two lessons, LESSON_BUFFER_MINUTES or none
+var LessonBuffer = lessonBufferFromEnv()
+
+// The check and the write that follows it happen while holding the locks of the teacher, student and room involved,
+// so two requests can't both pass the check and book the same slot. The locks are documents with a unique index, so
+// they hold across server processes too.
+const (
+	// schedulingLockTTL is how long a lock lasts if its request never releases it, e.g. because the server crashed
+	schedulingLockTTL = time.Minute
+	// schedulingLockWait is how long a request waits for locks held by another before giving up with ErrScheduleBusy
+	schedulingLockWait = 10 * time.Second
+	// schedulingLockRetry is the pause between attempts to take the locks
+	schedulingLockRetry = 50 * time.Millisecond
+)
+
+// ErrScheduleBusy is returned when the locks of a schedule can't be taken in time
+var ErrScheduleBusy = errors.New("the schedule is being changed by another request, try again")
+
+// conflictError is returned when scheduling would double book someone, the handler answers it with a 409
+type conflictError struct {
+	Conflicts []types.LessonConflict
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("the lesson clashes with %d other lessons", len(e.Conflicts))
+}
+
+func lessonBufferFromEnv() time.Duration {
+	if v, err := strconv.Atoi(os.Getenv("LESSON_BUFFER_MINUTES")); err == nil && v >= 0 {
+		return time.Duration(v) * time.Minute
+	}
+	return 0
+}
+
+// lessonDuration is how long the lesson lasts, lessons created before durations count as DefaultLessonDuration
+func lessonDuration(lesson types.Lesson) time.Duration {
+	if lesson.DurationMinutes <= 0 {
+		return DefaultLessonDuration
+	}
+	return time.Duration(lesson.DurationMinutes) * time.Minute
+}
+
+// validDurationMinutes reports whether a requested duration can be used, 0 meaning the default
+func validDurationMinutes(minutes int64) bool {
+	return minutes >= 0 && time.Duration(minutes)*time.Minute <= MaxLessonDuration
+}
+
+// lockSchedules takes the locks of the teachers, students and rooms of the lessons and returns the function that
+// releases them. The locks are taken in sorted order, and all of them are given back before trying again, so two
+// requests never wait on each other forever.
+func lockSchedules(lessons ...types.Lesson) (func(), error) {
+	resources := []string{}
+	for _, lesson := range lessons {
+		resources = append(resources, "teacher:"+lesson.TeacherID, "student:"+lesson.StudentId)
+		if lesson.Room != 0 {
+			resources = append(resources, "room:"+strconv.FormatInt(lesson.Room, 10))
+		}
+	}
+	sort.Strings(resources)
+	resources = slices.Compact(resources)
+
+	owner := uuid.New().String()
+	collection := db.MongoClient.Database(db.DbName).Collection(db.SchedulingLocksCollection)
+	release := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := collection.DeleteMany(ctx, bson.M{"resource": bson.M{"$in": resources}, "owner": owner}); err != nil {
+			fmt.Println("Error releasing scheduling locks, they expire on their own:", err)
+		}
+	}
+
+	deadline := time.Now().Add(schedulingLockWait)
+	for {
+		acquired, err := acquireSchedulingLocks(resources, owner)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if acquired {
+			return release, nil
+		}
+		release()
+		if time.Now().After(deadline) {
+			return nil, ErrScheduleBusy
+		}
+		time.Sleep(schedulingLockRetry)
+	}
+}
+
+// acquireSchedulingLocks tries to take every lock once, reporting false as soon as one is held by someone else
+func acquireSchedulingLocks(resources []string, owner string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.SchedulingLocksCollection)
+	now := time.Now().UTC()
+	for _, resource := range resources {
+		// Mongo's TTL monitor only runs once a minute, an expired lock is taken over straight away
+		if _, err := collection.DeleteOne(ctx, bson.M{"resource": resource, "expiresAt": bson.M{"$lt": now}}); err != nil {
+			return false, err
+		}
+		_, err := collection.InsertOne(ctx, types.SchedulingLock{Resource: resource, Owner: owner, ExpiresAt: now.Add(schedulingLockTTL)})
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		if err != nil {
+			fmt.Println("Error taking a scheduling lock:", err)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// findConflicts returns the lessons that overlap the given one for its teacher, student or room. Lessons of the
+// series in ignoreSeriesIDs are left out, they're about to be replaced.
+func findConflicts(ctx context.Context, lesson types.Lesson, ignoreSeriesIDs ...string) ([]types.LessonConflict, error) {
+	conflicts := []types.LessonConflict{}
+	if lesson.IsCanceled {
+		return conflicts, nil
+	}
+
+	buffer := int64(LessonBuffer.Seconds())
+	start := lesson.ScheduledDateTime
+	end := start + int64(lessonDuration(lesson).Seconds())
+
+	people := bson.A{bson.M{"teacherid": lesson.TeacherID}, bson.M{"studentid": lesson.StudentId}}
+	if lesson.Room != 0 {
+		people = append(people, bson.M{"room": lesson.Room})
+	}
+
+	// The range on scheduleddatetime narrows it down with the indexes, $expr compares each lesson's own end
+	storedDuration := bson.M{"$cond": bson.A{
+		bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{"$durationminutes", 0}}, 0}},
+		bson.M{"$multiply": bson.A{"$durationminutes", 60}},
+		int64(DefaultLessonDuration.Seconds()),
+	}}
+	filter := bson.M{
+		"lessonid":   bson.M{"$ne": lesson.LessonID},
+		"iscanceled": false,
+		"$or":        people,
+		"scheduleddatetime": bson.M{
+			"$lt": end + buffer,
+			"$gt": start - int64(MaxLessonDuration.Seconds()) - buffer,
+		},
+		"$expr": bson.M{"$gt": bson.A{
+			bson.M{"$add": bson.A{"$scheduleddatetime", storedDuration, buffer}},
+			start,
+		}},
+	}
+	if len(ignoreSeriesIDs) > 0 {
+		filter["seriesid"] = bson.M{"$nin": ignoreSeriesIDs}
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonsCollection)
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		fmt.Println("Error finding conflicting lessons:", err)
+		return conflicts, err
+	}
+	defer cursor.Close(ctx)
+
+	existing := []types.Lesson{}
+	if err := cursor.All(ctx, &existing); err != nil {
+		fmt.Println("Error decoding conflicting lessons:", err)
+		return conflicts, err
+	}
+
+	for _, other := range existing {
+		conflict := types.LessonConflict{
+			Lesson:  &other,
+			Start:   other.ScheduledDateTime,
+			End:     other.ScheduledDateTime + int64(lessonDuration(other).Seconds()),
+			Reasons: []string{},
+		}
+		if other.TeacherID == lesson.TeacherID {
+			conflict.Reasons = append(conflict.Reasons, "teacher")
+		}
+		if other.StudentId == lesson.StudentId {
+			conflict.Reasons = append(conflict.Reasons, "student")
+		}
+		if lesson.Room != 0 && other.Room == lesson.Room {
+			conflict.Reasons = append(conflict.Reasons, "room")
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, nil
+}
+
+// writeConflicts answers with a 409 that lists what the lesson clashes with. Only staff see the clashing lessons,
+// anyone else gets their times and whether the teacher, student or room is taken.
+func writeConflicts(w http.ResponseWriter, r *http.Request, err *conflictError) {
+	conflicts := err.Conflicts
+	if claims, _ := auth.ClaimsFromRequest(r); !auth.IsStaff(claims) {
+		conflicts = make([]types.LessonConflict, len(err.Conflicts))
+		for i, conflict := range err.Conflicts {
+			conflict.Lesson = nil
+			conflicts[i] = conflict
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(types.LessonConflictResponse{
+		Message:   "The lesson clashes with other lessons for the same teacher, student or room",
+		Conflicts: conflicts,
+	})
+}
@@ -3,8 +3,10 @@ package lessonsHandlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"net/http"
@@ -24,7 +26,41 @@ func CreateLessonHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	claims, _ := auth.ClaimsFromRequest(r)
+	if claims.Role == auth.RoleTeacher {
+		if req.TeacherID == "" {
+			req.TeacherID = claims.UserID
+		}
+		if req.TeacherID != claims.UserID {
+			http.Error(w, "Teachers can only create lessons for themselves", http.StatusForbidden)
+			return
+		}
+	}
+	allowed, err := auth.CanAccessStudent(claims, req.StudentId)
+	if err != nil {
+		http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "You do not have permission to create lessons for this student", http.StatusForbidden)
+		return
+	}
+
+	if !validDurationMinutes(req.DurationMinutes) {
+		http.Error(w, "Invalid request body, \"duration_minutes\" must be between 1 and 480", http.StatusBadRequest)
+		return
+	}
+
 	response, err := createLesson(req)
+	var conflict *conflictError
+	if errors.As(err, &conflict) {
+		writeConflicts(w, r, conflict)
+		return
+	}
+	if errors.Is(err, ErrScheduleBusy) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error creating lesson", http.StatusInternalServerError)
 		return
@@ -41,6 +77,7 @@ func createLesson(req types.CreateLessonRequest) (types.CreateLessonResponse, er
 		StudentId:         req.StudentId,
 		Subject:           req.Subject,
 		ScheduledDateTime: req.ScheduledDateTime,
+		DurationMinutes:   req.DurationMinutes,
 		Room:              req.Room,
 		IsCanceled:        false,
 		IsCompleted:       false,
@@ -48,16 +85,35 @@ func createLesson(req types.CreateLessonRequest) (types.CreateLessonResponse, er
 		IsStudentLate:     false,
 		IsTeacherLate:     false,
 		IsConnectionLost:  false,
+		ImportUID:         req.ImportUID,
+	}
+	if newLesson.DurationMinutes == 0 {
+		newLesson.DurationMinutes = int64(DefaultLessonDuration.Minutes())
+	}
+
+	unlock, err := lockSchedules(newLesson)
+	if err != nil {
+		return types.CreateLessonResponse{}, err
 	}
+	defer unlock()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	conflicts, err := findConflicts(ctx, newLesson)
+	if err != nil {
+		return types.CreateLessonResponse{}, err
+	}
+	if len(conflicts) > 0 {
+		return types.CreateLessonResponse{}, &conflictError{Conflicts: conflicts}
+	}
+
 	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonsCollection)
 
-	_, err := collection.InsertOne(ctx, newLesson)
+	_, err = collection.InsertOne(ctx, newLesson)
 
 	if err != nil {
-		fmt.Errorf("Error inserting new lesson into the database: %v", err)
+		fmt.Println("Error inserting new lesson into the database:", err)
 		return types.CreateLessonResponse{}, err
 	}
 
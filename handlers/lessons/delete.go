@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"net/http"
@@ -24,6 +25,23 @@ func DeleteLessonHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	lesson, err := findLesson(req.LessonID)
+	if err != nil {
+		http.Error(w, "Lesson not found", http.StatusNotFound)
+		return
+	}
+	claims, _ := auth.ClaimsFromRequest(r)
+	if !auth.IsStaff(claims) || !auth.CanAccessLesson(claims, lesson) {
+		http.Error(w, "You do not have permission to delete this lesson", http.StatusForbidden)
+		return
+	}
+
+	// A deleted occurrence of a series must not be created again
+	if err := excludeSeriesOccurrence(lesson); err != nil {
+		http.Error(w, "Error deleting the lesson", http.StatusInternalServerError)
+		return
+	}
+
 	response, err := deleteLesson(req)
 	if err != nil {
 		http.Error(w, "Error deleting the lesson", http.StatusInternalServerError)
@@ -39,9 +57,9 @@ func deleteLesson(req types.DeleteLessonRequest) (types.DeleteLessonResponse, er
 	defer cancel()
 
 	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonsCollection)
-	_, err := collection.DeleteOne(ctx, bson.M{"lessonID": req.LessonID})
+	_, err := collection.DeleteOne(ctx, bson.M{"lessonid": req.LessonID})
 	if err != nil {
-		fmt.Errorf("Error deleting the lesson from the database: %v", err)
+		fmt.Println("Error deleting the lesson from the database:", err)
 		return types.DeleteLessonResponse{
 			IsDeleted: false,
 		}, err
@@ -0,0 +1,25 @@
+package lessonsHandlers
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"time"
+)
+
+func findLesson(lessonID string) (types.Lesson, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonsCollection)
+	var lesson types.Lesson
+	err := collection.FindOne(ctx, bson.M{"lessonid": lessonID}).Decode(&lesson)
+	if err != nil {
+		fmt.Println("Error finding lesson", lessonID, "in the database:", err)
+		return types.Lesson{}, err
+	}
+
+	return lesson, nil
+}
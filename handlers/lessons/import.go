@@ -0,0 +1,350 @@
+package lessonsHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/ical"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/recurrence"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Teachers moving from another calendar upload it as an .ics file. Upcoming events become lessons, recurring ones
+// become lesson series, and changed occurrences of a recurring event become lessons of their own. Each lesson goes
+// through the same conflict check as one created by hand, events that can't be imported are listed with the reason.
+// Importing the same file again skips the events it already imported.
+
+// MaxImportSize is the largest .ics file that can be imported
+const MaxImportSize = 5 << 20
+
+// ImportLessonsHandler imports an .ics file sent as multipart form data. Fields:
+//   - calendar: the .ics file
+//   - teacherID: whose lessons they become, teachers can only import their own
+//   - student_id: the student for events without an attendee who is one of the teacher's students
+func ImportLessonsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxImportSize+1<<20)
+	if err := r.ParseMultipartForm(MaxImportSize); err != nil {
+		http.Error(w, "Unable to parse form, .ics files can be at most 5MB", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("calendar")
+	if err != nil {
+		http.Error(w, "Unable to retrieve file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	teacherID := r.FormValue("teacherID")
+	if claims.Role == auth.RoleTeacher {
+		if teacherID == "" {
+			teacherID = claims.UserID
+		}
+		if teacherID != claims.UserID {
+			http.Error(w, "Teachers can only import lessons for themselves", http.StatusForbidden)
+			return
+		}
+	}
+	if teacherID == "" {
+		http.Error(w, "Invalid request body, \"teacherID\" is required", http.StatusBadRequest)
+		return
+	}
+
+	studentID := r.FormValue("student_id")
+	if studentID != "" {
+		allowed, err := auth.CanAccessStudent(claims, studentID)
+		if err != nil {
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "You do not have permission to create lessons for this student", http.StatusForbidden)
+			return
+		}
+	}
+
+	timeZone, err := handlers.UserTimeZone(auth.RoleTeacher, teacherID)
+	if err != nil {
+		http.Error(w, "Error importing lessons", http.StatusInternalServerError)
+		return
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	events, err := ical.Parse(io.LimitReader(file, MaxImportSize), loc)
+	if err != nil {
+		http.Error(w, "The file isn't a valid .ics calendar", http.StatusBadRequest)
+		return
+	}
+
+	response, err := importLessons(teacherID, studentID, events)
+	if err != nil {
+		http.Error(w, "Error importing lessons", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// importLessons creates the lessons and series of the events. Events that can't be imported end up in Skipped, the
+// error is only for failures of the database.
+func importLessons(teacherID, defaultStudentID string, events []ical.Event) (types.ImportLessonsResponse, error) {
+	response := types.ImportLessonsResponse{
+		Lessons: []types.Lesson{},
+		Series:  []types.LessonSeries{},
+		Skipped: []types.ImportSkippedEvent{},
+	}
+
+	students, err := studentsByEmail(teacherID)
+	if err != nil {
+		return response, err
+	}
+
+	// A changed occurrence is left out of its series and imported as a lesson of its own
+	overrides := map[string][]int64{}
+	for _, event := range events {
+		if !event.RecurrenceID.IsZero() {
+			overrides[event.UID] = append(overrides[event.UID], event.RecurrenceID.Unix())
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return isSeriesEvent(events[i]) && !isSeriesEvent(events[j])
+	})
+
+	now := time.Now()
+	for _, event := range events {
+		skip := func(reason string, conflicts []types.LessonConflict) {
+			skipped := types.ImportSkippedEvent{UID: event.UID, Summary: event.Summary, Reason: reason, Conflicts: conflicts}
+			if !event.Start.IsZero() {
+				skipped.Start = event.Start.Unix()
+			}
+			response.Skipped = append(response.Skipped, skipped)
+		}
+
+		switch {
+		case event.UnknownTimeZone != "":
+			skip(fmt.Sprintf("The event's time zone %q isn't known, so its time can't be worked out", event.UnknownTimeZone), nil)
+			continue
+		case event.Start.IsZero():
+			skip("The event has no start time", nil)
+			continue
+		case event.AllDay:
+			skip("All day events aren't imported as lessons", nil)
+			continue
+		case event.Status == ical.StatusCancelled:
+			skip("The event is canceled", nil)
+			continue
+		case !isSeriesEvent(event) && !event.End.After(now):
+			skip("The event is already over", nil)
+			continue
+		}
+
+		duration := event.End.Sub(event.Start)
+		if duration > MaxLessonDuration {
+			skip("The event is longer than 8 hours", nil)
+			continue
+		}
+		durationMinutes := int64(duration / time.Minute)
+		if durationMinutes <= 0 {
+			durationMinutes = int64(DefaultLessonDuration.Minutes())
+		}
+
+		studentID := defaultStudentID
+		for _, attendee := range event.Attendees {
+			if id, ok := students[attendee]; ok {
+				studentID = id
+				break
+			}
+		}
+		if studentID == "" {
+			skip("None of the attendees is one of the teacher's students and no student_id was given", nil)
+			continue
+		}
+
+		importUID := event.UID
+		if importUID != "" && !event.RecurrenceID.IsZero() {
+			importUID += "/" + strconv.FormatInt(event.RecurrenceID.Unix(), 10)
+		}
+		imported, err := alreadyImported(teacherID, importUID)
+		if err != nil {
+			return response, err
+		}
+		if imported {
+			skip("The event was imported before", nil)
+			continue
+		}
+
+		if !isSeriesEvent(event) {
+			created, err := createLesson(types.CreateLessonRequest{
+				TeacherID:         teacherID,
+				StudentId:         studentID,
+				Subject:           event.Summary,
+				ScheduledDateTime: event.Start.Unix(),
+				DurationMinutes:   durationMinutes,
+				ImportUID:         importUID,
+			})
+			var conflict *conflictError
+			if errors.As(err, &conflict) {
+				skip("The lesson clashes with other lessons", conflict.Conflicts)
+				continue
+			}
+			if errors.Is(err, ErrScheduleBusy) {
+				skip(err.Error(), nil)
+				continue
+			}
+			if err != nil {
+				return response, err
+			}
+			response.Lessons = append(response.Lessons, created.Lesson)
+			continue
+		}
+
+		series := types.LessonSeries{
+			SeriesID:        uuid.New().String(),
+			TeacherID:       teacherID,
+			StudentId:       studentID,
+			Subject:         event.Summary,
+			Start:           event.Start.Unix(),
+			DurationMinutes: durationMinutes,
+			TimeZone:        event.TimeZone,
+			RRule:           event.RRule,
+			ExDates:         append([]int64{}, overrides[event.UID]...),
+			GeneratedUntil:  now.Unix(),
+			CreatedAt:       now.UTC(),
+			ImportUID:       importUID,
+		}
+		for _, exDate := range event.ExDates {
+			series.ExDates = append(series.ExDates, exDate.Unix())
+		}
+
+		upcoming, err := hasUpcomingOccurrence(series, now)
+		if err != nil {
+			skip(err.Error(), nil)
+			continue
+		}
+		if !upcoming {
+			skip("The recurring event has no lessons in the next 26 weeks", nil)
+			continue
+		}
+
+		created, err := createLessonSeries(series)
+		var conflict *conflictError
+		switch {
+		case errors.As(err, &conflict):
+			skip("Some of the recurring event's lessons clash with other lessons", conflict.Conflicts)
+			continue
+		case errors.Is(err, recurrence.ErrInvalidRule), errors.Is(err, ErrSeriesStart), errors.Is(err, ErrSeriesTimeZone),
+			errors.Is(err, ErrScheduleBusy):
+			skip(err.Error(), nil)
+			continue
+		case err != nil:
+			return response, err
+		}
+		response.Series = append(response.Series, created.Series)
+		response.Lessons = append(response.Lessons, created.Lessons...)
+	}
+
+	fmt.Println("Imported", len(response.Lessons), "lessons for teacher", teacherID, "- skipped", len(response.Skipped), "events")
+	return response, nil
+}
+
+// isSeriesEvent reports whether the event recurs, rather than being a single event or a changed occurrence
+func isSeriesEvent(event ical.Event) bool {
+	return event.RRule != "" && event.RecurrenceID.IsZero()
+}
+
+// hasUpcomingOccurrence reports whether the series has an occurrence between now and LessonSeriesHorizon
+func hasUpcomingOccurrence(series types.LessonSeries, now time.Time) (bool, error) {
+	rule, loc, err := parseSeriesRule(series)
+	if err != nil {
+		return false, err
+	}
+
+	exDates := map[int64]bool{}
+	for _, exDate := range series.ExDates {
+		exDates[exDate] = true
+	}
+	for _, occurrence := range rule.Occurrences(time.Unix(series.Start, 0).In(loc), now, now.Add(LessonSeriesHorizon)) {
+		if !exDates[occurrence.Unix()] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// studentsByEmail maps the lower case email addresses of the teacher's students to their IDs
+func studentsByEmail(teacherID string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.StudentsCollection)
+	cursor, err := collection.Find(ctx, bson.M{"teacherid": teacherID}, options.Find().SetProjection(bson.M{
+		"studentid": 1, "emailaddress": 1,
+	}))
+	if err != nil {
+		fmt.Println("Error finding the teacher's students:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var students []struct {
+		StudentID    string `bson:"studentid"`
+		EmailAddress string `bson:"emailaddress"`
+	}
+	if err := cursor.All(ctx, &students); err != nil {
+		fmt.Println("Error decoding the teacher's students:", err)
+		return nil, err
+	}
+
+	byEmail := map[string]string{}
+	for _, student := range students {
+		if student.EmailAddress != "" {
+			byEmail[strings.ToLower(student.EmailAddress)] = student.StudentID
+		}
+	}
+	return byEmail, nil
+}
+
+// alreadyImported reports whether the teacher has a lesson or series imported from the event
+func alreadyImported(teacherID, importUID string) (bool, error) {
+	if importUID == "" {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"teacherid": teacherID, "importuid": importUID}
+	for _, collectionName := range []string{db.LessonsCollection, db.LessonSeriesCollection} {
+		count, err := db.MongoClient.Database(db.DbName).Collection(collectionName).CountDocuments(ctx, filter, options.Count().SetLimit(1))
+		if err != nil {
+			fmt.Println("Error checking for imported events:", err)
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
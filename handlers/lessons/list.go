@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"net/http"
@@ -13,40 +14,47 @@ import (
 	"time"
 )
 
+const (
+	LessonStatusAll       = "all"
+	LessonStatusUpcoming  = "upcoming"  // Still to be held: not canceled, not completed and scheduled from now on
+	LessonStatusPast      = "past"      // Scheduled before now and not canceled
+	LessonStatusCanceled  = "canceled"  // Canceled, whenever they were scheduled for
+	LessonStatusCompleted = "completed" // Completed, whenever they were scheduled for
+)
+
+// ListLessonsHandler lists lessons a page at a time. Every query is optional:
+//   - userId: only lessons of this teacher or student
+//   - status: "all" (default), "upcoming", "past", "canceled" or "completed"
+//   - from, to: Unix seconds, lessons scheduled at or after from and before to
+//   - page, limit: page starts at 1, limit is 20 by default and at most 100
+//
+// The older isCanceled and isCompleted queries still filter on those fields when no status is given.
 func ListLessonsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var isCanceled bool
-	var isCompleted bool
-	isCanceledStr := r.URL.Query().Get("isCanceled")
-	isCompletedStr := r.URL.Query().Get("isCompleted")
-
-	if isCanceledStr == "" {
-		http.Error(w, "Invalid request query, \"isCanceled\" cannot be empty", http.StatusBadRequest)
-		return
-	}
-	if isCompletedStr == "" {
-		http.Error(w, "Invalid request query, \"isCompleted\" cannot be empty", http.StatusBadRequest)
+	req, errMessage := parseListLessonsRequest(r)
+	if errMessage != "" {
+		http.Error(w, errMessage, http.StatusBadRequest)
 		return
 	}
 
-	if isCanceledResult, err := strconv.ParseBool(isCanceledStr); err == nil {
-		isCanceled = isCanceledResult
-	} else {
-		http.Error(w, "Invalid request query, \"isCanceled\" must be either \"true\" or \"false\"", http.StatusBadRequest)
-		return
-	}
-	if isCompletedResult, err := strconv.ParseBool(isCompletedStr); err == nil {
-		isCompleted = isCompletedResult
-	} else {
-		http.Error(w, "Invalid request query, \"isCompleted\" must be either \"true\" or \"false\"", http.StatusBadRequest)
-		return
+	claims, _ := auth.ClaimsFromRequest(r)
+	if req.UserID != "" && req.UserID != claims.UserID {
+		allowed, err := canListLessonsOf(claims, req.UserID)
+		if err != nil {
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "You do not have permission to list this user's lessons", http.StatusForbidden)
+			return
+		}
 	}
 
-	response, err := listLessons(isCanceled, isCompleted)
+	response, err := listLessons(req, claims, time.Now().UTC())
 	if err != nil {
 		http.Error(w, "Error listing the lessons", http.StatusInternalServerError)
 		return
@@ -56,55 +64,206 @@ func ListLessonsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func listLessons(isCanceled, isCompleted bool) (types.ListLessonsResponse, error) {
+// parseListLessonsRequest reads the filters from the query, returning a message for the first invalid one
+func parseListLessonsRequest(r *http.Request) (types.ListLessonsRequest, string) {
+	query := r.URL.Query()
+	req := types.ListLessonsRequest{
+		UserID: query.Get("userId"),
+		Status: query.Get("status"),
+		Page:   1,
+		Limit:  20,
+	}
+
+	switch req.Status {
+	case "":
+		req.Status = LessonStatusAll
+	case LessonStatusAll, LessonStatusUpcoming, LessonStatusPast, LessonStatusCanceled, LessonStatusCompleted:
+	default:
+		return req, "Invalid request query, \"status\" must be one of \"all\", \"upcoming\", \"past\", \"canceled\" or \"completed\""
+	}
+
+	if pageStr := query.Get("page"); pageStr != "" {
+		page, err := strconv.ParseInt(pageStr, 10, 64)
+		if err != nil || page <= 0 || page > 1000000 {
+			return req, "Invalid request query, \"page\" must be a number between 1 and 1,000,000"
+		}
+		req.Page = page
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.ParseInt(limitStr, 10, 32)
+		if err != nil || limit <= 0 || limit > 100 {
+			return req, "Invalid request query, \"limit\" must be a number between 1 and 100"
+		}
+		req.Limit = limit
+	}
+
+	if fromStr := query.Get("from"); fromStr != "" {
+		from, err := strconv.ParseInt(fromStr, 10, 64)
+		if err != nil {
+			return req, "Invalid request query, \"from\" must be a Unix timestamp in seconds"
+		}
+		req.From = from
+	}
+	if toStr := query.Get("to"); toStr != "" {
+		to, err := strconv.ParseInt(toStr, 10, 64)
+		if err != nil {
+			return req, "Invalid request query, \"to\" must be a Unix timestamp in seconds"
+		}
+		req.To = to
+	}
+	if req.From != 0 && req.To != 0 && req.To <= req.From {
+		return req, "Invalid request query, \"to\" must be after \"from\""
+	}
+
+	if isCanceledStr := query.Get("isCanceled"); isCanceledStr != "" {
+		isCanceled, err := strconv.ParseBool(isCanceledStr)
+		if err != nil {
+			return req, "Invalid request query, \"isCanceled\" must be either \"true\" or \"false\""
+		}
+		req.IsCanceled = &isCanceled
+	}
+	if isCompletedStr := query.Get("isCompleted"); isCompletedStr != "" {
+		isCompleted, err := strconv.ParseBool(isCompletedStr)
+		if err != nil {
+			return req, "Invalid request query, \"isCompleted\" must be either \"true\" or \"false\""
+		}
+		req.IsCompleted = &isCompleted
+	}
+
+	return req, ""
+}
+
+// canListLessonsOf reports whether the caller may filter by another user's id. Students only have their own
+// lessons, teachers can filter by their students, admins by anyone.
+func canListLessonsOf(claims types.TokenClaims, userID string) (bool, error) {
+	switch claims.Role {
+	case auth.RoleAdmin:
+		return true, nil
+	case auth.RoleTeacher:
+		return auth.CanAccessStudent(claims, userID)
+	}
+	return false, nil
+}
+
+// lessonsMatch builds the filter for the request. Students and teachers only ever see their own lessons.
+func lessonsMatch(req types.ListLessonsRequest, claims types.TokenClaims, now time.Time) bson.M {
+	match := bson.M{}
+	switch claims.Role {
+	case auth.RoleStudent:
+		match["studentid"] = claims.UserID
+	case auth.RoleTeacher:
+		match["teacherid"] = claims.UserID
+	}
+
+	if req.UserID != "" {
+		if claims.Role == auth.RoleAdmin {
+			match["$or"] = bson.A{bson.M{"teacherid": req.UserID}, bson.M{"studentid": req.UserID}}
+		} else if req.UserID != claims.UserID {
+			match["studentid"] = req.UserID
+		}
+	}
+
+	scheduled := bson.M{}
+	if req.From != 0 {
+		scheduled["$gte"] = req.From
+	}
+	if req.To != 0 {
+		scheduled["$lt"] = req.To
+	}
+
+	switch req.Status {
+	case LessonStatusUpcoming:
+		match["iscanceled"] = false
+		match["iscompleted"] = false
+		if from, ok := scheduled["$gte"].(int64); !ok || from < now.Unix() {
+			scheduled["$gte"] = now.Unix()
+		}
+	case LessonStatusPast:
+		match["iscanceled"] = false
+		if to, ok := scheduled["$lt"].(int64); !ok || to > now.Unix() {
+			scheduled["$lt"] = now.Unix()
+		}
+	case LessonStatusCanceled:
+		match["iscanceled"] = true
+	case LessonStatusCompleted:
+		match["iscompleted"] = true
+	}
+	if len(scheduled) > 0 {
+		match["scheduleddatetime"] = scheduled
+	}
+
+	// The older boolean filters only apply when no status is asked for
+	if req.Status == LessonStatusAll {
+		if req.IsCanceled != nil {
+			match["iscanceled"] = *req.IsCanceled
+		}
+		if req.IsCompleted != nil {
+			match["iscompleted"] = *req.IsCompleted
+		}
+	}
+
+	return match
+}
+
+func listLessons(req types.ListLessonsRequest, claims types.TokenClaims, now time.Time) (types.ListLessonsResponse, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	response := types.ListLessonsResponse{
+		Lessons: []types.Lesson{},
+		Page:    req.Page,
+		Limit:   req.Limit,
+	}
+
+	// Upcoming lessons read soonest first, everything else most recent first
+	sortOrder := -1
+	if req.Status == LessonStatusUpcoming {
+		sortOrder = 1
+	}
+
 	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonsCollection)
 	pipeline := mongo.Pipeline{
-		{{"$match", bson.M{
-			"iscanceled":  isCanceled,
-			"iscompleted": isCompleted,
-		}}},
-		{{"$sort", bson.D{{"scheduleddatetime", -1}}}},
-		{{"$project", bson.M{
-			"lessonid":          1,
-			"teacherid":         1,
-			"studentid":         1,
-			"subject":           1,
-			"scheduleddatetime": 1,
-			"room":              1,
-			"iscanceled":        1,
-			"iscompleted":       1,
-			"timesrescheduled":  1,
-			"isstudentlate":     1,
-			"isteacherlate":     1,
-			"isconnectionlost":  1,
-			"_id":               0, // Exclude MongoDB internal _id
+		{{Key: "$match", Value: lessonsMatch(req, claims, now)}},
+		{{Key: "$facet", Value: bson.M{
+			"lessons": bson.A{
+				bson.M{"$sort": bson.D{{Key: "scheduleddatetime", Value: sortOrder}, {Key: "lessonid", Value: sortOrder}}},
+				bson.M{"$skip": (req.Page - 1) * req.Limit},
+				bson.M{"$limit": req.Limit},
+				bson.M{"$project": bson.M{"_id": 0}}, // Exclude MongoDB internal _id
+			},
+			"total": bson.A{
+				bson.M{"$count": "count"},
+			},
 		}}},
 	}
 
 	cursor, err := collection.Aggregate(ctx, pipeline)
 	if err != nil {
-		fmt.Errorf("Error aggregating lessons from the database: %v", err)
-		return types.ListLessonsResponse{
-			Lessons: nil,
-			Page:    1, // TODO: figure out pagination for this
-		}, err
+		fmt.Println("Error aggregating lessons from the database:", err)
+		return response, err
 	}
 	defer cursor.Close(ctx)
 
-	var results []types.Lesson
+	var results []struct {
+		Lessons []types.Lesson `bson:"lessons"`
+		Total   []struct {
+			Count int64 `bson:"count"`
+		} `bson:"total"`
+	}
 	if err = cursor.All(ctx, &results); err != nil {
-		fmt.Errorf("Error compiling all lessons into results: %v", err)
-		return types.ListLessonsResponse{
-			Lessons: nil,
-			Page:    1, // TODO: figure out pagination for this
-		}, err
+		fmt.Println("Error compiling all lessons into results:", err)
+		return response, err
+	}
+
+	if len(results) > 0 {
+		if results[0].Lessons != nil {
+			response.Lessons = results[0].Lessons
+		}
+		if len(results[0].Total) > 0 {
+			response.Total = results[0].Total[0].Count
+		}
 	}
+	response.TotalPages = (response.Total + req.Limit - 1) / req.Limit
 
-	return types.ListLessonsResponse{
-		Lessons: results,
-		Page:    1, // TODO: figure out pagination for this
-	}, nil
+	return response, nil
 }
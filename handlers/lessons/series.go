@@ -0,0 +1,774 @@
+package lessonsHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/recurrence"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"time"
+)
+
+// A lesson series stores its occurrences as ordinary lessons, so listing, updating and deleting a single occurrence
+// works like any other lesson. Deleting one records it in the series' ExDates so it isn't created again, updating one
+// marks it as an exception. "This and following" changes split the series in two at the chosen occurrence.
+
+// LessonSeriesHorizon is how far ahead occurrences are created as lessons
+var LessonSeriesHorizon = 26 * 7 * 24 * time.Hour
+
+var (
+	ErrSeriesStart    = errors.New("the start isn't an occurrence of the recurrence rule")
+	ErrSeriesTimeZone = errors.New("unknown time zone")
+	ErrSeriesNotFound = errors.New("lesson series not found")
+)
+
+// CreateLessonSeriesHandler creates a recurring series and its lessons up to LessonSeriesHorizon
+func CreateLessonSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.CreateLessonSeriesRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Start == 0 || req.RRule == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validDurationMinutes(req.DurationMinutes) {
+		http.Error(w, "Invalid request body, \"duration_minutes\" must be between 1 and 480", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	if claims.Role == auth.RoleTeacher {
+		if req.TeacherID == "" {
+			req.TeacherID = claims.UserID
+		}
+		if req.TeacherID != claims.UserID {
+			http.Error(w, "Teachers can only create lessons for themselves", http.StatusForbidden)
+			return
+		}
+	}
+	allowed, err := auth.CanAccessStudent(claims, req.StudentId)
+	if err != nil {
+		http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "You do not have permission to create lessons for this student", http.StatusForbidden)
+		return
+	}
+
+	series := types.LessonSeries{
+		SeriesID:        uuid.New().String(),
+		TeacherID:       req.TeacherID,
+		StudentId:       req.StudentId,
+		Subject:         req.Subject,
+		Room:            req.Room,
+		Start:           req.Start,
+		DurationMinutes: req.DurationMinutes,
+		TimeZone:        req.TimeZone,
+		RRule:           req.RRule,
+		ExDates:         []int64{},
+		CreatedAt:       time.Now().UTC(),
+	}
+
+	response, err := createLessonSeries(series)
+	if err != nil {
+		writeSeriesError(w, r, err, "Error creating the lesson series")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func createLessonSeries(series types.LessonSeries) (types.LessonSeriesResponse, error) {
+	if err := prepareSeries(&series); err != nil {
+		return types.LessonSeriesResponse{}, err
+	}
+
+	unlock, err := lockSchedules(seriesOccurrence(series, series.Start))
+	if err != nil {
+		return types.LessonSeriesResponse{}, err
+	}
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Imported series only create their lessons from the time of the import
+	if series.GeneratedUntil < series.Start {
+		series.GeneratedUntil = series.Start
+	}
+	horizon := time.Now().Add(LessonSeriesHorizon)
+	if err := checkSeriesConflicts(ctx, series, horizon); err != nil {
+		return types.LessonSeriesResponse{}, err
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonSeriesCollection)
+	if _, err := collection.InsertOne(ctx, series); err != nil {
+		fmt.Println("Error inserting the lesson series:", err)
+		return types.LessonSeriesResponse{}, err
+	}
+
+	lessons, skipped, err := generateSeriesLessons(&series, horizon)
+	if err != nil {
+		return types.LessonSeriesResponse{}, err
+	}
+
+	return types.LessonSeriesResponse{Series: series, Lessons: lessons, Skipped: skipped}, nil
+}
+
+// GetLessonSeriesHandler returns a series with ?seriesID=
+func GetLessonSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seriesID := r.URL.Query().Get("seriesID")
+	if seriesID == "" {
+		http.Error(w, "Invalid request query. The \"seriesID\" query is required", http.StatusBadRequest)
+		return
+	}
+
+	series, err := findLessonSeries(seriesID)
+	claims, _ := auth.ClaimsFromRequest(r)
+	if errors.Is(err, ErrSeriesNotFound) || (err == nil && !auth.CanAccessLesson(claims, seriesLesson(series))) {
+		http.Error(w, "Lesson series not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error finding the lesson series", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.LessonSeriesResponse{Series: series, Lessons: []types.Lesson{}, Skipped: []types.LessonConflict{}})
+}
+
+// UpdateLessonSeriesHandler changes an occurrence and every one after it. Lessons already completed are left as they
+// were. When only the subject, room or duration change, one-off changes to later occurrences are kept, when the time,
+// time zone or rule change, the later occurrences are created again from the new rule.
+func UpdateLessonSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.UpdateLessonSeriesRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.LessonID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validDurationMinutes(req.DurationMinutes) {
+		http.Error(w, "Invalid request body, \"duration_minutes\" must be between 1 and 480", http.StatusBadRequest)
+		return
+	}
+
+	lesson, ok := findSeriesOccurrence(w, r, req.LessonID)
+	if !ok {
+		return
+	}
+
+	response, err := updateLessonSeries(lesson, req)
+	if err != nil {
+		writeSeriesError(w, r, err, "Error updating the lesson series")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func updateLessonSeries(lesson types.Lesson, req types.UpdateLessonSeriesRequest) (types.LessonSeriesResponse, error) {
+	series, err := findLessonSeries(lesson.SeriesID)
+	if err != nil {
+		return types.LessonSeriesResponse{}, err
+	}
+
+	locked := []types.Lesson{lesson, seriesOccurrence(series, series.Start)}
+	if req.Room != nil {
+		locked = append(locked, types.Lesson{TeacherID: series.TeacherID, StudentId: series.StudentId, Room: *req.Room})
+	}
+	unlock, err := lockSchedules(locked...)
+	if err != nil {
+		return types.LessonSeriesResponse{}, err
+	}
+	defer unlock()
+
+	// Read again now that nobody else can change it
+	series, err = findLessonSeries(lesson.SeriesID)
+	if err != nil {
+		return types.LessonSeriesResponse{}, err
+	}
+	rule, loc, err := parseSeriesRule(series)
+	if err != nil {
+		return types.LessonSeriesResponse{}, err
+	}
+
+	at := lesson.OccurrenceStart
+	earlier := len(rule.Occurrences(time.Unix(series.Start, 0).In(loc), time.Unix(series.Start, 0), time.Unix(at, 0)))
+
+	following := series
+	following.ExDates = []int64{}
+	following.Start = at
+	if req.Subject != "" {
+		following.Subject = req.Subject
+	}
+	if req.Room != nil {
+		following.Room = *req.Room
+	}
+	if req.Start != 0 {
+		following.Start = req.Start
+	}
+	if req.DurationMinutes > 0 {
+		following.DurationMinutes = req.DurationMinutes
+	}
+	if req.TimeZone != "" {
+		following.TimeZone = req.TimeZone
+	}
+	if req.RRule != "" {
+		following.RRule = req.RRule
+	} else if rule.Count > 0 {
+		// The occurrences before the split are no longer part of the count
+		remaining := rule
+		remaining.Count = rule.Count - earlier
+		following.RRule = remaining.String()
+	}
+	if err := prepareSeries(&following); err != nil {
+		return types.LessonSeriesResponse{}, err
+	}
+	timingChanged := following.Start != at || following.TimeZone != series.TimeZone || req.RRule != ""
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The following occurrences are checked as they will be, ignoring the lessons they replace
+	horizon := time.Now().Add(LessonSeriesHorizon)
+	check := following
+	check.ExDates = series.ExDates
+	check.GeneratedUntil = at
+	if timingChanged {
+		check.ExDates = nil
+		check.GeneratedUntil = following.Start
+	}
+	if err := checkSeriesConflicts(ctx, check, horizon, series.SeriesID); err != nil {
+		return types.LessonSeriesResponse{}, err
+	}
+
+	seriesCollection := db.MongoClient.Database(db.DbName).Collection(db.LessonSeriesCollection)
+	lessonsCollection := db.MongoClient.Database(db.DbName).Collection(db.LessonsCollection)
+
+	if earlier == 0 {
+		// Changing the series from its first occurrence changes the whole series
+		following.SeriesID = series.SeriesID
+		following.CreatedAt = series.CreatedAt
+		following.GeneratedUntil = series.GeneratedUntil
+		if timingChanged {
+			following.GeneratedUntil = following.Start
+		} else {
+			following.ExDates = series.ExDates
+		}
+		if _, err := seriesCollection.ReplaceOne(ctx, bson.M{"seriesid": series.SeriesID}, following); err != nil {
+			fmt.Println("Error updating the lesson series:", err)
+			return types.LessonSeriesResponse{}, err
+		}
+	} else {
+		if err := endSeriesBefore(ctx, series, rule, at, earlier); err != nil {
+			return types.LessonSeriesResponse{}, err
+		}
+
+		following.SeriesID = uuid.New().String()
+		following.CreatedAt = time.Now().UTC()
+		following.GeneratedUntil = following.Start
+		if !timingChanged {
+			following.GeneratedUntil = series.GeneratedUntil
+			for _, exDate := range series.ExDates {
+				if exDate >= at {
+					following.ExDates = append(following.ExDates, exDate)
+				}
+			}
+		}
+		if _, err := seriesCollection.InsertOne(ctx, following); err != nil {
+			fmt.Println("Error inserting the following lesson series:", err)
+			return types.LessonSeriesResponse{}, err
+		}
+	}
+
+	fromHere := bson.M{"seriesid": series.SeriesID, "occurrencestart": bson.M{"$gte": at}}
+	if timingChanged {
+		// Completed lessons stay as they were, the rest are created again from the new rule
+		fromHere["iscompleted"] = false
+		if _, err := lessonsCollection.DeleteMany(ctx, fromHere); err != nil {
+			fmt.Println("Error deleting the following lessons:", err)
+			return types.LessonSeriesResponse{}, err
+		}
+	} else {
+		// Only what the request changed is set, and only on lessons that still have the series' value, so an exception
+		// keeps the subject, room or duration it was given on its own
+		type fieldChange struct {
+			field         string
+			before, after any
+		}
+		changes := []fieldChange{}
+		if req.Subject != "" && following.Subject != series.Subject {
+			changes = append(changes, fieldChange{"subject", series.Subject, following.Subject})
+		}
+		if req.Room != nil && following.Room != series.Room {
+			changes = append(changes, fieldChange{"room", series.Room, following.Room})
+		}
+		if req.DurationMinutes > 0 && following.DurationMinutes != series.DurationMinutes {
+			changes = append(changes, fieldChange{"durationminutes", series.DurationMinutes, following.DurationMinutes})
+		}
+		for _, change := range changes {
+			update := bson.M{"$set": bson.M{change.field: change.after}}
+			// Calendar feeds pick up a longer or shorter lesson by its higher SEQUENCE, like updateLesson
+			if change.field == "durationminutes" {
+				update["$inc"] = bson.M{"sequence": 1}
+			}
+			unchanged := bson.M{"seriesid": series.SeriesID, "occurrencestart": bson.M{"$gte": at}, "iscompleted": false, change.field: change.before}
+			if _, err := lessonsCollection.UpdateMany(ctx, unchanged, update); err != nil {
+				fmt.Println("Error updating the following lessons:", err)
+				return types.LessonSeriesResponse{}, err
+			}
+		}
+		if _, err := lessonsCollection.UpdateMany(ctx, fromHere, bson.M{"$set": bson.M{"seriesid": following.SeriesID}}); err != nil {
+			fmt.Println("Error moving the following lessons to the new series:", err)
+			return types.LessonSeriesResponse{}, err
+		}
+	}
+
+	lessons, skipped, err := generateSeriesLessons(&following, horizon)
+	if err != nil {
+		return types.LessonSeriesResponse{}, err
+	}
+
+	return types.LessonSeriesResponse{Series: following, Lessons: lessons, Skipped: skipped}, nil
+}
+
+// DeleteLessonSeriesHandler deletes an occurrence and every one after it, ending the series before it. Completed
+// lessons are kept.
+func DeleteLessonSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.DeleteLessonSeriesRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.LessonID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	lesson, ok := findSeriesOccurrence(w, r, req.LessonID)
+	if !ok {
+		return
+	}
+
+	response, err := deleteLessonSeries(lesson)
+	if err != nil {
+		writeSeriesError(w, r, err, "Error deleting the lesson series")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func deleteLessonSeries(lesson types.Lesson) (types.DeleteLessonSeriesResponse, error) {
+	// Keeps the series job from creating lessons of the series while it's being deleted
+	unlock, err := lockSchedules(lesson)
+	if err != nil {
+		return types.DeleteLessonSeriesResponse{}, err
+	}
+	defer unlock()
+
+	series, err := findLessonSeries(lesson.SeriesID)
+	if err != nil {
+		return types.DeleteLessonSeriesResponse{}, err
+	}
+	rule, loc, err := parseSeriesRule(series)
+	if err != nil {
+		return types.DeleteLessonSeriesResponse{}, err
+	}
+
+	at := lesson.OccurrenceStart
+	earlier := len(rule.Occurrences(time.Unix(series.Start, 0).In(loc), time.Unix(series.Start, 0), time.Unix(at, 0)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	seriesCollection := db.MongoClient.Database(db.DbName).Collection(db.LessonSeriesCollection)
+	lessonsCollection := db.MongoClient.Database(db.DbName).Collection(db.LessonsCollection)
+
+	if earlier == 0 {
+		if _, err := seriesCollection.DeleteOne(ctx, bson.M{"seriesid": series.SeriesID}); err != nil {
+			fmt.Println("Error deleting the lesson series:", err)
+			return types.DeleteLessonSeriesResponse{}, err
+		}
+	} else if err := endSeriesBefore(ctx, series, rule, at, earlier); err != nil {
+		return types.DeleteLessonSeriesResponse{}, err
+	}
+
+	result, err := lessonsCollection.DeleteMany(ctx, bson.M{
+		"seriesid":        series.SeriesID,
+		"occurrencestart": bson.M{"$gte": at},
+		"iscompleted":     false,
+	})
+	if err != nil {
+		fmt.Println("Error deleting the following lessons:", err)
+		return types.DeleteLessonSeriesResponse{}, err
+	}
+
+	if earlier == 0 {
+		// Completed lessons of a deleted series carry on as single lessons
+		if _, err := lessonsCollection.UpdateMany(ctx, bson.M{"seriesid": series.SeriesID}, bson.M{
+			"$unset": bson.M{"seriesid": "", "occurrencestart": "", "isexception": ""},
+		}); err != nil {
+			fmt.Println("Error detaching completed lessons from the series:", err)
+			return types.DeleteLessonSeriesResponse{}, err
+		}
+	}
+
+	return types.DeleteLessonSeriesResponse{IsDeleted: true, LessonsDeleted: result.DeletedCount}, nil
+}
+
+// endSeriesBefore limits the series to the occurrences before at, keeping COUNT rules as COUNT rules
+func endSeriesBefore(ctx context.Context, series types.LessonSeries, rule recurrence.Rule, at int64, earlier int) error {
+	if rule.Count > 0 {
+		rule.Count = earlier
+	} else {
+		rule.Until = time.Unix(at-1, 0).UTC()
+	}
+
+	exDates := []int64{}
+	for _, exDate := range series.ExDates {
+		if exDate < at {
+			exDates = append(exDates, exDate)
+		}
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonSeriesCollection)
+	_, err := collection.UpdateOne(ctx, bson.M{"seriesid": series.SeriesID}, bson.M{"$set": bson.M{
+		"rrule":          rule.String(),
+		"exdates":        exDates,
+		"generateduntil": min(series.GeneratedUntil, at),
+	}})
+	if err != nil {
+		fmt.Println("Error ending the lesson series:", err)
+	}
+	return err
+}
+
+// prepareSeries fills in the default duration and the teacher's time zone, and checks the rule and start
+func prepareSeries(series *types.LessonSeries) error {
+	if series.DurationMinutes == 0 {
+		series.DurationMinutes = int64(DefaultLessonDuration.Minutes())
+	}
+	if series.TimeZone == "" {
+		timeZone, err := handlers.UserTimeZone(auth.RoleTeacher, series.TeacherID)
+		if err != nil {
+			return err
+		}
+		series.TimeZone = timeZone
+	}
+
+	rule, loc, err := parseSeriesRule(*series)
+	if err != nil {
+		return err
+	}
+	series.RRule = rule.String()
+
+	start := time.Unix(series.Start, 0).In(loc)
+	if !rule.Matches(start, start) {
+		return ErrSeriesStart
+	}
+	return nil
+}
+
+func parseSeriesRule(series types.LessonSeries) (recurrence.Rule, *time.Location, error) {
+	loc, err := time.LoadLocation(series.TimeZone)
+	if err != nil {
+		return recurrence.Rule{}, nil, ErrSeriesTimeZone
+	}
+	rule, err := recurrence.Parse(series.RRule, loc)
+	return rule, loc, err
+}
+
+// generateSeriesLessons creates the series' lessons from GeneratedUntil up to until and moves GeneratedUntil along.
+// It returns the lessons it created, and the clashes of the occurrences it skipped because another lesson was booked
+// at their time since.
+func generateSeriesLessons(series *types.LessonSeries, until time.Time) ([]types.Lesson, []types.LessonConflict, error) {
+	created := []types.Lesson{}
+	skipped := []types.LessonConflict{}
+	if until.Unix() <= series.GeneratedUntil {
+		return created, skipped, nil
+	}
+
+	rule, loc, err := parseSeriesRule(*series)
+	if err != nil {
+		return created, skipped, err
+	}
+
+	exDates := map[int64]bool{}
+	for _, exDate := range series.ExDates {
+		exDates[exDate] = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lessonsCollection := db.MongoClient.Database(db.DbName).Collection(db.LessonsCollection)
+	start := time.Unix(series.Start, 0).In(loc)
+	for _, occurrence := range rule.Occurrences(start, time.Unix(series.GeneratedUntil, 0), until) {
+		if exDates[occurrence.Unix()] {
+			continue
+		}
+
+		lesson := seriesOccurrence(*series, occurrence.Unix())
+		lesson.LessonID = uuid.New().String()
+		conflicts, err := findConflicts(ctx, lesson, series.SeriesID)
+		if err != nil {
+			return created, skipped, err
+		}
+		if len(conflicts) > 0 {
+			for _, conflict := range conflicts {
+				conflict.OccurrenceStart = occurrence.Unix()
+				skipped = append(skipped, conflict)
+			}
+			continue
+		}
+
+		result, err := lessonsCollection.UpdateOne(ctx,
+			bson.M{"seriesid": series.SeriesID, "occurrencestart": occurrence.Unix()},
+			bson.M{"$setOnInsert": lesson},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			fmt.Println("Error creating a lesson of the series:", err)
+			return created, skipped, err
+		}
+		if result.UpsertedCount > 0 {
+			created = append(created, lesson)
+		}
+	}
+
+	seriesCollection := db.MongoClient.Database(db.DbName).Collection(db.LessonSeriesCollection)
+	series.GeneratedUntil = until.Unix()
+	if _, err := seriesCollection.UpdateOne(ctx, bson.M{"seriesid": series.SeriesID}, bson.M{
+		"$max": bson.M{"generateduntil": series.GeneratedUntil},
+	}); err != nil {
+		fmt.Println("Error updating how far the lesson series is generated:", err)
+		return created, skipped, err
+	}
+
+	return created, skipped, nil
+}
+
+// checkSeriesConflicts returns a conflictError listing every occurrence from GeneratedUntil up to until that clashes
+// with another lesson
+func checkSeriesConflicts(ctx context.Context, series types.LessonSeries, until time.Time, ignoreSeriesIDs ...string) error {
+	rule, loc, err := parseSeriesRule(series)
+	if err != nil {
+		return err
+	}
+
+	exDates := map[int64]bool{}
+	for _, exDate := range series.ExDates {
+		exDates[exDate] = true
+	}
+
+	conflicts := []types.LessonConflict{}
+	start := time.Unix(series.Start, 0).In(loc)
+	for _, occurrence := range rule.Occurrences(start, time.Unix(series.GeneratedUntil, 0), until) {
+		if exDates[occurrence.Unix()] {
+			continue
+		}
+
+		found, err := findConflicts(ctx, seriesOccurrence(series, occurrence.Unix()), append(ignoreSeriesIDs, series.SeriesID)...)
+		if err != nil {
+			return err
+		}
+		for _, conflict := range found {
+			conflict.OccurrenceStart = occurrence.Unix()
+			conflicts = append(conflicts, conflict)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return &conflictError{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// seriesOccurrence is the lesson for one occurrence of the series, without a lessonID
+func seriesOccurrence(series types.LessonSeries, occurrenceStart int64) types.Lesson {
+	return types.Lesson{
+		TeacherID:         series.TeacherID,
+		StudentId:         series.StudentId,
+		Subject:           series.Subject,
+		ScheduledDateTime: occurrenceStart,
+		DurationMinutes:   series.DurationMinutes,
+		Room:              series.Room,
+		SeriesID:          series.SeriesID,
+		OccurrenceStart:   occurrenceStart,
+	}
+}
+
+// ExtendLessonSeries creates the lessons that came within LessonSeriesHorizon since the series were last generated
+func ExtendLessonSeries() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	until := time.Now().Add(LessonSeriesHorizon)
+	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonSeriesCollection)
+	cursor, err := collection.Find(ctx, bson.M{"generateduntil": bson.M{"$lt": until.Unix()}})
+	if err != nil {
+		return 0, err
+	}
+
+	seriesList := []types.LessonSeries{}
+	err = cursor.All(ctx, &seriesList)
+	cursor.Close(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	created, skipped := 0, 0
+	for _, series := range seriesList {
+		lessons, clashes, err := extendLessonSeries(series, until)
+		if err != nil {
+			fmt.Println("Error extending lesson series", series.SeriesID+":", err)
+			continue
+		}
+		created += len(lessons)
+		skipped += len(clashes)
+	}
+	if skipped > 0 {
+		fmt.Println("Extended lesson series by", created, "lessons -", skipped, "clashes with other lessons were skipped")
+	}
+	return created, nil
+}
+
+// extendLessonSeries generates one series up to until, holding only the locks of its teacher, student and room
+func extendLessonSeries(series types.LessonSeries, until time.Time) ([]types.Lesson, []types.LessonConflict, error) {
+	unlock, err := lockSchedules(seriesOccurrence(series, series.Start))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	// It may have been changed or deleted since the list was read
+	series, err = findLessonSeries(series.SeriesID)
+	if errors.Is(err, ErrSeriesNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return generateSeriesLessons(&series, until)
+}
+
+// StartLessonSeriesJob runs ExtendLessonSeries every interval
+func StartLessonSeriesJob(interval time.Duration) {
+	go func() {
+		for {
+			if _, err := ExtendLessonSeries(); err != nil {
+				fmt.Println("Error extending lesson series:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// excludeSeriesOccurrence stops a deleted occurrence from being created again
+func excludeSeriesOccurrence(lesson types.Lesson) error {
+	if lesson.SeriesID == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonSeriesCollection)
+	_, err := collection.UpdateOne(ctx, bson.M{"seriesid": lesson.SeriesID}, bson.M{
+		"$addToSet": bson.M{"exdates": lesson.OccurrenceStart},
+	})
+	if err != nil {
+		fmt.Println("Error excluding the occurrence from its series:", err)
+	}
+	return err
+}
+
+func findLessonSeries(seriesID string) (types.LessonSeries, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonSeriesCollection)
+
+	var series types.LessonSeries
+	err := collection.FindOne(ctx, bson.M{"seriesid": seriesID}).Decode(&series)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return series, ErrSeriesNotFound
+	}
+	if err != nil {
+		fmt.Println("Error finding lesson series", seriesID, "in the database:", err)
+	}
+	return series, err
+}
+
+// findSeriesOccurrence loads the lesson for a "this and following" change and checks the caller may make it
+func findSeriesOccurrence(w http.ResponseWriter, r *http.Request, lessonID string) (types.Lesson, bool) {
+	lesson, err := findLesson(lessonID)
+	if err != nil {
+		http.Error(w, "Lesson not found", http.StatusNotFound)
+		return lesson, false
+	}
+	claims, _ := auth.ClaimsFromRequest(r)
+	if !auth.IsStaff(claims) || !auth.CanAccessLesson(claims, lesson) {
+		http.Error(w, "You do not have permission to change this lesson series", http.StatusForbidden)
+		return lesson, false
+	}
+	if lesson.SeriesID == "" {
+		http.Error(w, "The lesson isn't part of a series", http.StatusBadRequest)
+		return lesson, false
+	}
+	return lesson, true
+}
+
+// seriesLesson lets the lesson permission checks apply to a series
+func seriesLesson(series types.LessonSeries) types.Lesson {
+	return types.Lesson{TeacherID: series.TeacherID, StudentId: series.StudentId}
+}
+
+func writeSeriesError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	var conflict *conflictError
+	switch {
+	case errors.As(err, &conflict):
+		writeConflicts(w, r, conflict)
+	case errors.Is(err, recurrence.ErrInvalidRule):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrSeriesStart), errors.Is(err, ErrSeriesTimeZone):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrScheduleBusy):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, ErrSeriesNotFound):
+		http.Error(w, "Lesson series not found", http.StatusNotFound)
+	default:
+		http.Error(w, message, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,311 @@
+package lessonsHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MaxSlotsRange is the longest period slots can be listed for at once
+const MaxSlotsRange = 31 * 24 * time.Hour
+
+// ListSlotsHandler lists the times a teacher can be booked: their availability less the lessons they, or the student
+// asking, already have. Queries:
+//   - teacherID: defaults to the student's teacher
+//   - from, to: Unix seconds, from now for a week by default
+//   - durationMinutes: defaults to the teacher's slot length
+//   - timeZone: the time zone of start_local and end_local, the caller's by default
+func ListSlotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	query := r.URL.Query()
+
+	teacherID, ok := bookableTeacher(w, claims, query.Get("teacherID"))
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	from, to := now, now.Add(7*24*time.Hour)
+	if fromStr := query.Get("from"); fromStr != "" {
+		fromResult, err := strconv.ParseInt(fromStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid request query, \"from\" must be a Unix timestamp in seconds", http.StatusBadRequest)
+			return
+		}
+		from = time.Unix(fromResult, 0)
+		to = from.Add(7 * 24 * time.Hour)
+	}
+	if toStr := query.Get("to"); toStr != "" {
+		toResult, err := strconv.ParseInt(toStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid request query, \"to\" must be a Unix timestamp in seconds", http.StatusBadRequest)
+			return
+		}
+		to = time.Unix(toResult, 0)
+	}
+	if from.Before(now) {
+		from = now
+	}
+	if !to.After(from) || to.Sub(from) > MaxSlotsRange {
+		http.Error(w, "Invalid request query, \"to\" must be after \"from\" and at most 31 days later", http.StatusBadRequest)
+		return
+	}
+
+	timeZone := query.Get("timeZone")
+	if timeZone == "" {
+		var err error
+		if timeZone, err = handlers.UserTimeZone(claims.Role, claims.UserID); err != nil {
+			http.Error(w, "Error listing slots", http.StatusInternalServerError)
+			return
+		}
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		http.Error(w, "Invalid request query, \"timeZone\" must be an IANA time zone such as Europe/London", http.StatusBadRequest)
+		return
+	}
+
+	availability, err := handlers.FindAvailability(teacherID)
+	if errors.Is(err, handlers.ErrNoAvailability) {
+		http.Error(w, "The teacher hasn't published their availability", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error listing slots", http.StatusInternalServerError)
+		return
+	}
+
+	durationMinutes := availability.SlotMinutes
+	if durationStr := query.Get("durationMinutes"); durationStr != "" {
+		durationResult, err := strconv.ParseInt(durationStr, 10, 64)
+		if err != nil || durationResult <= 0 || !validDurationMinutes(durationResult) {
+			http.Error(w, "Invalid request query, \"durationMinutes\" must be between 1 and 480", http.StatusBadRequest)
+			return
+		}
+		durationMinutes = durationResult
+	}
+
+	studentID := ""
+	if claims.Role == auth.RoleStudent {
+		studentID = claims.UserID
+	}
+
+	slots, err := listSlots(availability, studentID, from, to, time.Duration(durationMinutes)*time.Minute)
+	if err != nil {
+		http.Error(w, "Error listing slots", http.StatusInternalServerError)
+		return
+	}
+
+	response := types.ListSlotsResponse{TeacherID: teacherID, TimeZone: timeZone, Slots: []types.LessonSlot{}}
+	for _, slot := range slots {
+		response.Slots = append(response.Slots, types.LessonSlot{
+			Start:      slot.Start.Unix(),
+			End:        slot.End.Unix(),
+			StartLocal: slot.Start.In(loc).Format(time.RFC3339),
+			EndLocal:   slot.End.In(loc).Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// listSlots steps through the available hours a slot length at a time, keeping the slots that start between from
+// and to and don't clash with a lesson
+func listSlots(availability types.TeacherAvailability, studentID string, from, to time.Time, duration time.Duration) ([]handlers.TimeRange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	busy, err := busyRanges(ctx, availability.TeacherID, studentID, from, to.Add(duration))
+	if err != nil {
+		return nil, err
+	}
+
+	step := time.Duration(availability.SlotMinutes) * time.Minute
+	slots := []handlers.TimeRange{}
+	for _, available := range handlers.AvailableRanges(availability, from, to) {
+		for start := available.Start; !start.Add(duration).After(available.End); start = start.Add(step) {
+			if start.Before(from) || !start.Before(to) {
+				continue
+			}
+
+			slot := handlers.TimeRange{Start: start, End: start.Add(duration)}
+			free := true
+			for _, lesson := range busy {
+				if slot.Overlaps(lesson) {
+					free = false
+					break
+				}
+			}
+			if free {
+				slots = append(slots, slot)
+			}
+		}
+	}
+	return slots, nil
+}
+
+// busyRanges returns the lessons of the teacher or student around from and to, widened by LessonBuffer
+func busyRanges(ctx context.Context, teacherID, studentID string, from, to time.Time) ([]handlers.TimeRange, error) {
+	people := bson.A{bson.M{"teacherid": teacherID}}
+	if studentID != "" {
+		people = append(people, bson.M{"studentid": studentID})
+	}
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonsCollection)
+	cursor, err := collection.Find(ctx, bson.M{
+		"iscanceled": false,
+		"$or":        people,
+		"scheduleddatetime": bson.M{
+			"$gt": from.Add(-MaxLessonDuration - LessonBuffer).Unix(),
+			"$lt": to.Add(LessonBuffer).Unix(),
+		},
+	})
+	if err != nil {
+		fmt.Println("Error finding booked lessons:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	lessons := []types.Lesson{}
+	if err := cursor.All(ctx, &lessons); err != nil {
+		fmt.Println("Error decoding booked lessons:", err)
+		return nil, err
+	}
+
+	busy := []handlers.TimeRange{}
+	for _, lesson := range lessons {
+		start := time.Unix(lesson.ScheduledDateTime, 0)
+		busy = append(busy, handlers.TimeRange{
+			Start: start.Add(-LessonBuffer),
+			End:   start.Add(lessonDuration(lesson) + LessonBuffer),
+		})
+	}
+	return busy, nil
+}
+
+// BookLessonHandler lets a student book a lesson with their teacher inside the teacher's availability. The check and
+// the booking happen together, so two students can't book the same slot.
+func BookLessonHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.BookLessonRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Start == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.DurationMinutes < 0 || !validDurationMinutes(req.DurationMinutes) {
+		http.Error(w, "Invalid request body, \"duration_minutes\" must be between 1 and 480", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	teacherID, ok := bookableTeacher(w, claims, req.TeacherID)
+	if !ok {
+		return
+	}
+
+	start := time.Unix(req.Start, 0)
+	if start.Before(time.Now()) {
+		http.Error(w, "Lessons can't be booked in the past", http.StatusBadRequest)
+		return
+	}
+
+	availability, err := handlers.FindAvailability(teacherID)
+	if errors.Is(err, handlers.ErrNoAvailability) {
+		http.Error(w, "The teacher hasn't published their availability", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error booking the lesson", http.StatusInternalServerError)
+		return
+	}
+	if req.DurationMinutes == 0 {
+		req.DurationMinutes = availability.SlotMinutes
+	}
+
+	slot := handlers.TimeRange{Start: start, End: start.Add(time.Duration(req.DurationMinutes) * time.Minute)}
+	inAvailability := false
+	for _, available := range handlers.AvailableRanges(availability, slot.Start, slot.End) {
+		if available.Contains(slot) {
+			inAvailability = true
+			break
+		}
+	}
+	if !inAvailability {
+		http.Error(w, "The teacher isn't available at that time", http.StatusConflict)
+		return
+	}
+
+	response, err := createLesson(types.CreateLessonRequest{
+		TeacherID:         teacherID,
+		StudentId:         claims.UserID,
+		Subject:           req.Subject,
+		ScheduledDateTime: req.Start,
+		DurationMinutes:   req.DurationMinutes,
+	})
+	var conflict *conflictError
+	if errors.As(err, &conflict) {
+		writeConflicts(w, r, conflict)
+		return
+	}
+	if errors.Is(err, ErrScheduleBusy) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error booking the lesson", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// bookableTeacher works out whose slots the caller is after. Students only book their own teacher, teachers can look
+// at their own slots and admins at anyone's.
+func bookableTeacher(w http.ResponseWriter, claims types.TokenClaims, teacherID string) (string, bool) {
+	if claims.Role != auth.RoleStudent {
+		if teacherID == "" {
+			teacherID = claims.UserID
+		}
+		if !auth.CanAccessTeacher(claims, teacherID) {
+			http.Error(w, "You do not have permission to see this teacher's slots", http.StatusForbidden)
+			return "", false
+		}
+		return teacherID, true
+	}
+
+	studentTeacherID, err := handlers.StudentTeacherID(claims.UserID)
+	if err != nil {
+		http.Error(w, "Error finding your teacher", http.StatusInternalServerError)
+		return "", false
+	}
+	if studentTeacherID == "" {
+		http.Error(w, "You don't have a teacher to book lessons with yet", http.StatusNotFound)
+		return "", false
+	}
+	if teacherID != "" && teacherID != studentTeacherID {
+		http.Error(w, "You can only book lessons with your own teacher", http.StatusForbidden)
+		return "", false
+	}
+	return studentTeacherID, true
+}
@@ -3,8 +3,11 @@ package lessonsHandlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"net/http"
@@ -24,7 +27,32 @@ func UpdateLessonHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := updateLesson(req)
+	lesson, err := findLesson(req.LessonID)
+	if err != nil {
+		http.Error(w, "Lesson not found", http.StatusNotFound)
+		return
+	}
+	claims, _ := auth.ClaimsFromRequest(r)
+	if !auth.IsStaff(claims) || !auth.CanAccessLesson(claims, lesson) {
+		http.Error(w, "You do not have permission to update this lesson", http.StatusForbidden)
+		return
+	}
+
+	if !validDurationMinutes(req.DurationMinutes) {
+		http.Error(w, "Invalid request body, \"duration_minutes\" must be between 1 and 480", http.StatusBadRequest)
+		return
+	}
+
+	response, err := updateLesson(req, lesson)
+	var conflict *conflictError
+	if errors.As(err, &conflict) {
+		writeConflicts(w, r, conflict)
+		return
+	}
+	if errors.Is(err, ErrScheduleBusy) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error updating the lesson", http.StatusInternalServerError)
 		return
@@ -34,7 +62,7 @@ func UpdateLessonHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func updateLesson(req types.UpdateLessonRequest) (types.UpdateLessonResponse, error) {
+func updateLesson(req types.UpdateLessonRequest, lesson types.Lesson) (types.UpdateLessonResponse, error) {
 	updatedLesson := types.Lesson{}
 	update := bson.M{}
 
@@ -82,17 +110,54 @@ func updateLesson(req types.UpdateLessonRequest) (types.UpdateLessonResponse, er
 		update["isconnectionlost"] = req.IsConnectionLost
 	}
 
+	if req.DurationMinutes > 0 {
+		update["durationminutes"] = req.DurationMinutes
+	}
+	// Changing one occurrence of a series on its own makes it an exception to the series
+	if lesson.SeriesID != "" {
+		update["isexception"] = true
+	}
+
 	updateCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// Checked against the lesson as it will be once updated
+	proposed := lesson
+	proposed.ScheduledDateTime = req.ScheduledDateTime
+	proposed.Room = req.Room
+	proposed.IsCanceled = req.IsCanceled
+	if req.DurationMinutes > 0 {
+		proposed.DurationMinutes = req.DurationMinutes
+	}
+
+	unlock, err := lockSchedules(lesson, proposed)
+	if err != nil {
+		return types.UpdateLessonResponse{}, err
+	}
+	defer unlock()
+
+	conflicts, err := findConflicts(updateCtx, proposed)
+	if err != nil {
+		return types.UpdateLessonResponse{}, err
+	}
+	if len(conflicts) > 0 {
+		return types.UpdateLessonResponse{}, &conflictError{Conflicts: conflicts}
+	}
+
+	changes := bson.M{"$set": update}
+	// Calendar feeds pick up a moved or canceled lesson by its higher SEQUENCE
+	if proposed.ScheduledDateTime != lesson.ScheduledDateTime || proposed.IsCanceled != lesson.IsCanceled ||
+		lessonDuration(proposed) != lessonDuration(lesson) {
+		changes["$inc"] = bson.M{"sequence": 1}
+	}
+
 	collection := db.MongoClient.Database(db.DbName).Collection(db.LessonsCollection)
 
 	var updateLessonResult types.Lesson
-	err := collection.FindOneAndUpdate(updateCtx, bson.M{"lessonID": req.LessonID}, bson.M{
-		"$set": update,
-	}).Decode(&updateLessonResult)
+	err = collection.FindOneAndUpdate(updateCtx, bson.M{"lessonid": req.LessonID}, changes,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updateLessonResult)
 	if err != nil {
-		fmt.Errorf("Error finding and/or updating the lesson in the database: %v", err)
+		fmt.Println("Error finding and/or updating the lesson in the database:", err)
 		return types.UpdateLessonResponse{}, err
 	}
 
@@ -101,13 +166,18 @@ func updateLesson(req types.UpdateLessonRequest) (types.UpdateLessonResponse, er
 	updatedLesson.StudentId = updateLessonResult.StudentId
 	updatedLesson.Subject = updateLessonResult.Subject
 	updatedLesson.ScheduledDateTime = updateLessonResult.ScheduledDateTime
+	updatedLesson.DurationMinutes = updateLessonResult.DurationMinutes
 	updatedLesson.Room = updateLessonResult.Room
 	updatedLesson.TimesRescheduled = updateLessonResult.TimesRescheduled
+	updatedLesson.Sequence = updateLessonResult.Sequence
 	updatedLesson.IsCanceled = updateLessonResult.IsCanceled
 	updatedLesson.IsCompleted = updateLessonResult.IsCompleted
 	updatedLesson.IsTeacherLate = updateLessonResult.IsTeacherLate
 	updatedLesson.IsStudentLate = updateLessonResult.IsStudentLate
 	updatedLesson.IsConnectionLost = updateLessonResult.IsConnectionLost
+	updatedLesson.SeriesID = updateLessonResult.SeriesID
+	updatedLesson.OccurrenceStart = updateLessonResult.OccurrenceStart
+	updatedLesson.IsException = updateLessonResult.IsException
 
 	return types.UpdateLessonResponse{
 		Lesson: updatedLesson,
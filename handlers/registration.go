@@ -2,73 +2,111 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base32"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"net/http"
+	"strings"
 	"time"
 )
 
+const (
+	DefaultRegistrationExpiryDays = 14
+	MaxRegistrationExpiryDays     = 90
+	MaxRegistrationUses           = 100
+)
+
+// ErrInvalidRegistrationCode is returned when a code doesn't exist, has expired, was revoked or has no uses left
+var ErrInvalidRegistrationCode = errors.New("registration code is invalid, expired or already used")
+
 func CreateRegistrationHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
+	claims, _ := auth.ClaimsFromRequest(r)
+
 	var req types.CreateRegistrationRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > MaxRegistrationExpiryDays {
+		http.Error(w, fmt.Sprintf("Invalid request body, \"expires_in_days\" must be between 1 and %d", MaxRegistrationExpiryDays), http.StatusBadRequest)
+		return
+	}
+	if req.MaxUses < 0 || req.MaxUses > MaxRegistrationUses {
+		http.Error(w, fmt.Sprintf("Invalid request body, \"max_uses\" must be between 1 and %d", MaxRegistrationUses), http.StatusBadRequest)
+		return
+	}
 
 	fmt.Println("CreateRegistration request incoming...")
-	fmt.Println(req.RegistrationCode)
 	fmt.Println(req.FirstName)
 	fmt.Println(req.LastName)
 	fmt.Println(req.EmailAddress)
-	fmt.Println(req.IsValid)
 
-	// Validate registration code
-	result, err := createRegistration(req)
+	result, err := createRegistration(req, claims.UserID)
 	if err != nil {
 		fmt.Println("Error Creating registration result...")
 		http.Error(w, "Error Creating registration result...", http.StatusInternalServerError)
 		return
 	}
 
-	response := types.CreateRegistrationResponse{
-		RegistrationCode: result.RegistrationCode,
-		FirstName:        result.FirstName,
-		LastName:         result.LastName,
-		EmailAddress:     result.EmailAddress,
-		IsValid:          result.IsValid,
-	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(result)
 }
 
-func createRegistration(req types.CreateRegistrationRequest) (types.CreateRegistrationResponse, error) {
-	response := types.CreateRegistrationResponse{
-		RegistrationCode: "abcd-1234",
-		FirstName:        "Bob",
-		LastName:         "Smith",
-		EmailAddress:     "bob@gmail.com",
-		IsValid:          true,
+func createRegistration(req types.CreateRegistrationRequest, teacherID string) (types.CreateRegistrationResponse, error) {
+	response := types.CreateRegistrationResponse{IsValid: false}
+
+	code, err := generateRegistrationCode()
+	if err != nil {
+		fmt.Println("Error generating registration code:", err)
+		return response, err
+	}
+
+	expiresInDays := req.ExpiresInDays
+	if expiresInDays == 0 {
+		expiresInDays = DefaultRegistrationExpiryDays
+	}
+	maxUses := req.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
 	}
+
+	now := time.Now().UTC()
+	registration := types.Registration{
+		RegistrationID:   uuid.New().String(),
+		FirstName:        req.FirstName,
+		LastName:         req.LastName,
+		EmailAddress:     req.EmailAddress,
+		RegistrationCode: code,
+		TeacherID:        teacherID,
+		CreatedAt:        now,
+		ExpiresAt:        now.AddDate(0, 0, expiresInDays),
+		MaxUses:          maxUses,
+		Uses:             0,
+		Revoked:          false,
+		RedeemedBy:       []string{},
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	collection := db.MongoClient.Database(db.DbName).Collection(db.RegistrationCollection)
 
-	_, err := collection.InsertOne(ctx, bson.M{
-		"registrationcode": req.RegistrationCode,
-		"firstname":        req.FirstName,
-		"lastname":         req.LastName,
-		"emailaddress":     req.EmailAddress,
-	})
+	_, err = collection.InsertOne(ctx, registration)
 	if err != nil {
 		fmt.Println("Error inserting registration code...")
 		fmt.Println("Error is: " + err.Error())
@@ -76,12 +114,85 @@ func createRegistration(req types.CreateRegistrationRequest) (types.CreateRegist
 	}
 
 	fmt.Println("Successfully inserted new registration...")
-	response.RegistrationCode = req.RegistrationCode
-	response.FirstName = req.FirstName
-	response.LastName = req.LastName
-	response.EmailAddress = req.EmailAddress
-	response.IsValid = req.IsValid
-	return response, nil
+	return types.CreateRegistrationResponse{
+		RegistrationID:   registration.RegistrationID,
+		RegistrationCode: registration.RegistrationCode,
+		FirstName:        registration.FirstName,
+		LastName:         registration.LastName,
+		EmailAddress:     registration.EmailAddress,
+		ExpiresAt:        registration.ExpiresAt,
+		MaxUses:          registration.MaxUses,
+		IsValid:          true,
+	}, nil
+}
+
+// generateRegistrationCode returns a code like "7KQ2-MXT4-PA3D", 60 random bits so codes can't be guessed
+func generateRegistrationCode() (string, error) {
+	randomBytes := make([]byte, 8)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)[:12]
+	return encoded[:4] + "-" + encoded[4:8] + "-" + encoded[8:], nil
+}
+
+// redeemableFilter matches codes that can still be used. Codes created before expiry and use limits existed are
+// treated as not expiring and single use.
+func redeemableFilter(now time.Time) bson.M {
+	return bson.M{
+		"revoked": bson.M{"$ne": true},
+		"$or": bson.A{
+			bson.M{"expiresat": bson.M{"$gt": now}},
+			bson.M{"expiresat": bson.M{"$exists": false}},
+		},
+		"$expr": bson.M{"$lt": bson.A{
+			bson.M{"$ifNull": bson.A{"$uses", 0}},
+			bson.M{"$ifNull": bson.A{"$maxuses", 1}},
+		}},
+	}
+}
+
+// RedeemRegistrationCode uses up one redemption of the code for the student. The check and the increment happen in
+// one update, so two sign ups can't both take the last use.
+func RedeemRegistrationCode(code, studentID string) (types.Registration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.RegistrationCollection)
+
+	filter := redeemableFilter(time.Now().UTC())
+	filter["registrationcode"] = strings.TrimSpace(code)
+
+	var registration types.Registration
+	err := collection.FindOneAndUpdate(ctx, filter, bson.M{
+		"$inc":  bson.M{"uses": 1},
+		"$push": bson.M{"redeemedby": studentID},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&registration)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return registration, ErrInvalidRegistrationCode
+	}
+	if err != nil {
+		fmt.Println("Error redeeming registration code:", err)
+		return registration, err
+	}
+
+	return registration, nil
+}
+
+// ReleaseRegistrationCode gives back a redemption when creating the student failed after the code was redeemed
+func ReleaseRegistrationCode(code, studentID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.RegistrationCollection)
+
+	_, err := collection.UpdateOne(ctx, bson.M{"registrationcode": strings.TrimSpace(code), "redeemedby": studentID}, bson.M{
+		"$inc":  bson.M{"uses": -1},
+		"$pull": bson.M{"redeemedby": studentID},
+	})
+	if err != nil {
+		fmt.Println("Error releasing registration code:", err)
+	}
 }
 
 // HTTP handler for validating registration code
@@ -100,7 +211,6 @@ func ValidateRegistrationHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fmt.Println("Registration request incoming...")
-	fmt.Println(req.RegistrationCode)
 
 	// Validate registration code
 	result, err := validateRegistrationCode(req.RegistrationCode)
@@ -121,47 +231,132 @@ func ValidateRegistrationHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// Function to validate the registration code
+// Function to validate the registration code. This only checks the code, it is redeemed when the student is created.
 func validateRegistrationCode(code string) (types.RegistrationValidationResult, error) {
-	// For testing purposes, auto-validate the test code
-	if code == "test-registration-code" {
-		return types.RegistrationValidationResult{
-			IsValid: false,
-			Result: types.Registration{
-				FirstName:        "Student",
-				LastName:         "Pupil",
-				EmailAddress:     "student@alina.edu",
-				RegistrationCode: "Student-12345678",
-			},
-		}, nil
-	}
-
 	// Check MongoDB for the registration code
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	collection := db.MongoClient.Database(db.DbName).Collection(db.RegistrationCollection)
 
+	filter := redeemableFilter(time.Now().UTC())
+	filter["registrationcode"] = strings.TrimSpace(code)
+
 	// Query MongoDB
 	var result types.Registration
-	err := collection.FindOne(ctx, bson.M{"registrationcode": code}).Decode(&result)
+	err := collection.FindOne(ctx, filter).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return types.RegistrationValidationResult{IsValid: false}, nil
+	}
 	if err != nil {
 		fmt.Println("Error finding registration... returning error.")
 		fmt.Println("Error: " + err.Error())
-		return types.RegistrationValidationResult{
-			IsValid: false,
-			Result: types.Registration{
-				FirstName:        "",
-				LastName:         "",
-				EmailAddress:     "",
-				RegistrationCode: "",
-			},
-		}, err
-	}
-
-	// If no error, code exists, so it's valid
+		return types.RegistrationValidationResult{IsValid: false}, err
+	}
+
 	return types.RegistrationValidationResult{
 		IsValid: true,
 		Result:  result,
 	}, nil
 }
+
+// ListRegistrationsHandler lists the invitations that can still be used. Teachers see their own, admins see all.
+func ListRegistrationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+
+	registrations, err := listRegistrations(claims)
+	if err != nil {
+		http.Error(w, "Error listing registration codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.ListRegistrationsResponse{Registrations: registrations})
+}
+
+func listRegistrations(claims types.TokenClaims) ([]types.Registration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.RegistrationCollection)
+
+	filter := redeemableFilter(time.Now().UTC())
+	if claims.Role != auth.RoleAdmin {
+		filter["teacherid"] = claims.UserID
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}}))
+	if err != nil {
+		fmt.Println("Error listing registrations:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	registrations := []types.Registration{}
+	if err := cursor.All(ctx, &registrations); err != nil {
+		fmt.Println("Error decoding registrations:", err)
+		return nil, err
+	}
+
+	return registrations, nil
+}
+
+// RevokeRegistrationHandler stops an invitation from being used. Teachers can only revoke their own.
+func RevokeRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+
+	var req types.RevokeRegistrationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.RegistrationID == "" {
+		http.Error(w, "Invalid request body, \"registration_id\" is required", http.StatusBadRequest)
+		return
+	}
+
+	response, err := revokeRegistration(req.RegistrationID, claims)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Registration code not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error revoking registration code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func revokeRegistration(registrationID string, claims types.TokenClaims) (types.RevokeRegistrationResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.RegistrationCollection)
+
+	// Someone else's invitation is reported as not found so teachers can't probe for IDs
+	filter := bson.M{"registrationid": registrationID}
+	if claims.Role != auth.RoleAdmin {
+		filter["teacherid"] = claims.UserID
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		fmt.Println("Error revoking registration:", err)
+		return types.RevokeRegistrationResponse{IsRevoked: false}, err
+	}
+	if result.MatchedCount == 0 {
+		return types.RevokeRegistrationResponse{IsRevoked: false}, mongo.ErrNoDocuments
+	}
+
+	fmt.Println("Revoked registration", registrationID)
+	return types.RevokeRegistrationResponse{IsRevoked: true}, nil
+}
@@ -3,10 +3,13 @@ package studentsHandlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/events"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/utils"
 	"net/http"
@@ -27,10 +30,19 @@ func CreateNewStudentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.RegistrationCode == "" {
+		http.Error(w, "Invalid request body, \"registration_code\" cannot be empty", http.StatusBadRequest)
+		return
+	}
+
 	fmt.Println("CreateNewStudent request incoming...")
 
 	newStudentId, err := createNewStudent(req)
 
+	if errors.Is(err, handlers.ErrInvalidRegistrationCode) {
+		http.Error(w, "Registration code is invalid, expired or has already been used.", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error saving new student. Data was not saved.", http.StatusInternalServerError)
 		return
@@ -59,24 +71,23 @@ func createNewStudent(req types.CreateNewStudentLoginRequest) (string, error) {
 	newStudent.LessonsRemaining = 0
 	newStudent.LessonsCompleted = 0
 
-	salt, err := utils.GenerateSalt(10)
+	// Redeem the code before anything is saved so a code can't be used more often than it allows
+	registration, err := handlers.RedeemRegistrationCode(req.RegistrationCode, newStudent.StudentId)
 	if err != nil {
-		fmt.Println("Error generating salt... using email address instead.") // Handle this better later
-		salt = req.EmailAddress
+		fmt.Println("Error redeeming registration code:", err)
+		return "", err
 	}
-	fmt.Println("Salt: " + salt)
-	fmt.Println("Req.password: " + req.Password)
+	newStudent.TeacherID = registration.TeacherID
 
-	hashedPassword, err := utils.HashPassword(req.Password + salt)
+	hashedPassword, err := utils.HashPassword(req.Password)
 	if err != nil {
-		fmt.Println("Error hashing password and salt... returning an error") // Handle this better later
+		fmt.Println("Error hashing password... returning an error") // Handle this better later
 		fmt.Println("Error is: " + err.Error())
+		handlers.ReleaseRegistrationCode(req.RegistrationCode, newStudent.StudentId)
 		return "", err
 	}
-	fmt.Println("hashedPassword: " + hashedPassword)
 
 	newStudent.Password = hashedPassword
-	newStudent.Salt = salt
 	newStudent.StudentSince = time.Now().UTC().String()
 
 	// Check MongoDB for the registration code
@@ -88,35 +99,25 @@ func createNewStudent(req types.CreateNewStudentLoginRequest) (string, error) {
 	result, err := collection.InsertOne(ctx, newStudent)
 
 	if err != nil {
+		handlers.ReleaseRegistrationCode(req.RegistrationCode, newStudent.StudentId)
 		return "", err
 	} else {
 		fmt.Println(result)
 	}
 
+	// Failing to send the email doesn't fail the sign up, the student can ask for another one
+	if err := handlers.SendVerificationEmail(auth.RoleStudent, newStudent.StudentId, newStudent.EmailAddress); err != nil {
+		fmt.Println("Error sending verification email:", err)
+	}
+
 	if req.PublicKey != "" {
 		studentID := newStudent.StudentId
 		formattedStudentID := strings.ReplaceAll(studentID, "-", "_")
 		utils.SavePublicKey(formattedStudentID, req.PublicKey)
 	}
 
-	usersCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	usersCollection := db.MongoClient.Database(db.DbName).Collection(db.UsersCollection)
-	usersResult, err := usersCollection.InsertOne(usersCtx, bson.M{
-		"userId":            newStudent.StudentId,
-		"userType":          "student",
-		"preferredName":     newStudent.PreferredName,
-		"firstName":         newStudent.FirstName,
-		"lastName":          newStudent.LastName,
-		"profilePictureUrl": newStudent.ProfilePictureURL,
-	})
-	if err != nil {
-		return "", err
-	} else {
-		fmt.Println("Users result:")
-		fmt.Println(usersResult)
-	}
+	// Creates the student's chat profile
+	events.Publish(events.StudentCreated, auth.RoleStudent, newStudent.StudentId)
 
-	return newStudent.StudentId, err
+	return newStudent.StudentId, nil
 }
@@ -1,14 +1,12 @@
 package studentsHandlers
 
 import (
-	"context"
 	"encoding/json"
-	"fmt"
-	"go.mongodb.org/mongo-driver/bson"
-	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"errors"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"net/http"
-	"time"
 )
 
 func HandleDeleteStudent(w http.ResponseWriter, r *http.Request) {
@@ -24,7 +22,22 @@ func HandleDeleteStudent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := deleteStudent(req.StudentId)
+	claims, _ := auth.ClaimsFromRequest(r)
+	allowed, err := auth.CanAccessStudent(claims, req.StudentId)
+	if err != nil {
+		http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+		return
+	}
+	if !allowed || !auth.IsStaff(claims) {
+		http.Error(w, "You do not have permission to delete this student", http.StatusForbidden)
+		return
+	}
+
+	response, err := deleteStudent(req.StudentId, claims.UserID)
+	if errors.Is(err, handlers.ErrAccountNotFound) {
+		http.Error(w, "Student not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error deleting student. Student was not deleted", http.StatusInternalServerError)
 		return
@@ -34,15 +47,10 @@ func HandleDeleteStudent(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func deleteStudent(StudentId string) (types.DeleteStudentResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	collection := db.MongoClient.Database(db.DbName).Collection(db.StudentsCollection)
-
-	_, err := collection.DeleteOne(ctx, bson.M{"studentid": StudentId})
+// deleteStudent soft deletes the student, they can be restored until the grace period is over and are purged after
+func deleteStudent(studentID, deletedBy string) (types.DeleteStudentResponse, error) {
+	account, err := handlers.SoftDeleteAccount(auth.RoleStudent, studentID, deletedBy)
 	if err != nil {
-		fmt.Errorf("Error deleting student from database: %v", err)
 		return types.DeleteStudentResponse{
 			IsDeleted: false,
 		}, err
@@ -50,5 +58,6 @@ func deleteStudent(StudentId string) (types.DeleteStudentResponse, error) {
 
 	return types.DeleteStudentResponse{
 		IsDeleted: true,
+		PurgeAt:   &account.PurgeAt,
 	}, nil
 }
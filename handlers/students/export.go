@@ -0,0 +1,52 @@
+package studentsHandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+)
+
+// ExportStudentHandler starts an export of everything held about a student. The student, their teacher or an admin
+// can ask for it, then follow it with /exports/status. Only the student or an admin can download it.
+func ExportStudentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.ExportStudentRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.StudentId == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	allowed, err := auth.CanAccessStudent(claims, req.StudentId)
+	if err != nil {
+		fmt.Println("Error checking student access:", err)
+		http.Error(w, "Error exporting student", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "You do not have permission to export this student", http.StatusForbidden)
+		return
+	}
+
+	export, err := handlers.RequestDataExport(auth.RoleStudent, req.StudentId, claims.UserID)
+	if errors.Is(err, handlers.ErrAccountNotFound) {
+		http.Error(w, "Student not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error requesting student export:", err)
+		http.Error(w, "Error exporting student", http.StatusInternalServerError)
+		return
+	}
+
+	handlers.WriteDataExportResponse(w, r, http.StatusAccepted, export)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"net/http"
@@ -25,6 +26,17 @@ func GetStudentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Println("For StudentID:", studentID)
 
+	claims, _ := auth.ClaimsFromRequest(r)
+	allowed, err := auth.CanAccessStudent(claims, studentID)
+	if err != nil {
+		http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "You do not have permission to access this student", http.StatusForbidden)
+		return
+	}
+
 	response, err := getStudent(studentID)
 	if err != nil {
 		http.Error(w, "Error getting student", http.StatusInternalServerError)
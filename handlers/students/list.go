@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"log"
@@ -63,7 +64,14 @@ func ListStudentsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := listStudents(page, limit)
+	// Teachers only see the students assigned to them, admins see everyone
+	claims, _ := auth.ClaimsFromRequest(r)
+	teacherID := ""
+	if claims.Role == auth.RoleTeacher {
+		teacherID = claims.UserID
+	}
+
+	response, err := listStudents(page, limit, teacherID)
 	if err != nil {
 		http.Error(w, "Error listing students", http.StatusInternalServerError)
 		return
@@ -73,20 +81,27 @@ func ListStudentsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func listStudents(page, limit int64) (types.ListStudentsResponse, error) {
+func listStudents(page, limit int64, teacherID string) (types.ListStudentsResponse, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	match := bson.M{}
+	if teacherID != "" {
+		match["teacherid"] = teacherID
+	}
+
 	collection := db.MongoClient.Database(db.DbName).Collection(db.StudentsCollection)
 	pipeline := mongo.Pipeline{
-		{{"$sort", bson.D{{"preferredname", 1}}}},
-		{{"$project", bson.M{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: bson.D{{Key: "preferredname", Value: 1}}}},
+		{{Key: "$project", Value: bson.M{
 			"preferredname":     1,
 			"firstname":         1,
 			"lastname":          1,
 			"studentid":         1,
 			"emailaddress":      1,
 			"profilepictureurl": 1,
+			"teacherid":         1,
 			"_id":               0,
 		}}},
 	}
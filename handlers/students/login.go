@@ -3,9 +3,13 @@ package studentsHandlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/utils"
 	"net/http"
@@ -27,16 +31,50 @@ func ValidateLoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Println("ValidateLogin request incoming...")
 
-	result, err := validateLogin(req)
+	var result types.ValidateLoginResult
+	if req.ChallengeToken != "" {
+		// Second step of a two-factor login, the password was already checked when the challenge was issued
+		claims, ok := auth.VerifyChallenge(w, r, req.ChallengeToken, req.TOTPCode, auth.RoleStudent)
+		if !ok {
+			return
+		}
+		studentResult, err := findStudentByID(claims.UserID)
+		if err != nil {
+			http.Error(w, "Error validating student login.", http.StatusInternalServerError)
+			return
+		}
+		result.IsValid = true
+		result.StudentInfo = studentLoginResponse(studentResult)
+	} else {
+		clientIP := auth.ClientIP(r)
+		if retryAfter := auth.DefaultLoginLimiter.Check(auth.RoleStudent, req.EmailAddress, clientIP); retryAfter > 0 {
+			auth.WriteTooManyAttempts(w, retryAfter)
+			return
+		}
 
-	if err != nil {
-		http.Error(w, "Error validating student login.", http.StatusInternalServerError)
-		return
-	}
+		result, err = validateLogin(req)
 
-	if !result.IsValid {
-		http.Error(w, "Email address or password is incorrect.", http.StatusUnauthorized)
-		return
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Error validating student login.", http.StatusInternalServerError)
+			return
+		}
+
+		if err != nil || !result.IsValid {
+			auth.DefaultLoginLimiter.Failure(auth.RoleStudent, req.EmailAddress, clientIP)
+			http.Error(w, "Email address or password is incorrect.", http.StatusUnauthorized)
+			return
+		}
+		auth.DefaultLoginLimiter.Success(auth.RoleStudent, req.EmailAddress)
+
+		if handlers.RequireEmailVerification && !result.EmailVerified {
+			http.Error(w, "Email address has not been verified. Check your inbox for the verification email.", http.StatusForbidden)
+			return
+		}
+
+		if result.RequiresTOTP {
+			auth.WriteMFAChallenge(w, result.StudentInfo.StudentId, auth.RoleStudent)
+			return
+		}
 	}
 
 	response := types.ValidateLoginResponse{
@@ -55,6 +93,15 @@ func ValidateLoginHandler(w http.ResponseWriter, r *http.Request) {
 		TimeZone:           result.StudentInfo.TimeZone,
 	}
 
+	tokens, err := auth.IssueSessionTokens(response.StudentId, auth.RoleStudent)
+	if err != nil {
+		http.Error(w, "Error generating session tokens.", http.StatusInternalServerError)
+		return
+	}
+	response.AccessToken = tokens.AccessToken
+	response.ExpiresAt = tokens.ExpiresAt
+	response.RefreshToken = tokens.RefreshToken
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
@@ -94,25 +141,14 @@ func validateLogin(req types.ValidateLoginRequest) (types.ValidateLoginResult, e
 		return validateLoginResult, err
 	}
 
-	student.StudentId = studentResult.StudentId
-	student.FirstName = studentResult.FirstName
-	student.PreferredName = studentResult.PreferredName
-	student.LastName = studentResult.LastName
-	student.EmailAddress = studentResult.EmailAddress
-	student.NativeLanguage = studentResult.NativeLanguage
-	student.PreferredLanguage = studentResult.PreferredLanguage
-	student.StudentSince = studentResult.StudentSince
-	student.ProfilePictureURL = studentResult.ProfilePictureURL
-	student.ProfilePicturePath = studentResult.ProfilePicturePath
-	student.ThemeMode = studentResult.ThemeMode
-	student.FontStyle = studentResult.FontStyle
-	student.TimeZone = studentResult.TimeZone
-	student.LessonsRemaining = studentResult.LessonsRemaining
-	student.LessonsCompleted = studentResult.LessonsCompleted
-
-	isPasswordValid := utils.CheckPasswordHash(req.Password+studentResult.Salt, studentResult.Password)
+	isPasswordValid, needsRehash := utils.VerifyPassword(req.Password, studentResult.Salt, studentResult.Password)
+	if isPasswordValid {
+		auth.UpgradePasswordHash(auth.RoleStudent, studentResult.StudentId, req.Password, needsRehash)
+	}
 	validateLoginResult.IsValid = isPasswordValid
-	validateLoginResult.StudentInfo = student
+	validateLoginResult.StudentInfo = studentLoginResponse(studentResult)
+	validateLoginResult.RequiresTOTP = isPasswordValid && studentResult.TOTPEnabled
+	validateLoginResult.EmailVerified = studentResult.EmailVerified
 
 	if isPasswordValid {
 		fmt.Println("Password is valid: TRUE")
@@ -135,43 +171,94 @@ func ValidateGoogleLoginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	fmt.Println("Email: " + req.Email)
-	fmt.Println("EmailVerified: " + req.EmailVerified)
-
-	if req.EmailVerified != "true" {
-		http.Error(w, "Email not verified", http.StatusBadRequest)
-		fmt.Println("Email not verified...")
+	if req.IDToken == "" {
+		http.Error(w, "Invalid request body, \"id_token\" cannot be empty", http.StatusBadRequest)
 		return
 	}
 
 	fmt.Println("ValidateGoogleLogin request incoming...")
 
-	response, err := validateGoogleLogin(req)
+	claims, err := auth.VerifyGoogleIDToken(req.IDToken)
 	if err != nil {
-		http.Error(w, "Error validating student's Google login.", http.StatusInternalServerError)
+		fmt.Println("Error verifying Google ID token:", err)
+		if errors.Is(err, auth.ErrEmailNotVerified) {
+			http.Error(w, "Email not verified", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Invalid Google ID token.", http.StatusUnauthorized)
+		return
+	}
+	fmt.Println("Email: " + claims.Email)
+
+	var response types.ValidateLoginResponse
+	if req.ChallengeToken != "" {
+		// Second step of a two-factor login. The ID token is still verified above, so the challenge has to be
+		// completed with the same Google account that started it.
+		challenge, ok := auth.VerifyChallenge(w, r, req.ChallengeToken, req.TOTPCode, auth.RoleStudent)
+		if !ok {
+			return
+		}
+		studentResult, err := findStudentByID(challenge.UserID)
+		if err != nil {
+			http.Error(w, "Error validating student's Google login.", http.StatusInternalServerError)
+			return
+		}
+		if studentResult.GoogleSubject != claims.Subject {
+			http.Error(w, "Invalid or expired two-factor challenge. Please log in again.", http.StatusUnauthorized)
+			return
+		}
+		response = studentLoginResponse(studentResult)
+	} else {
+		result, err := validateGoogleLogin(claims, req.Password)
+		if err != nil {
+			writeGoogleLoginError(w, err)
+			return
+		}
+		if result.RequiresTOTP {
+			auth.WriteMFAChallenge(w, result.StudentInfo.StudentId, auth.RoleStudent)
+			return
+		}
+		response = result.StudentInfo
+	}
+
+	tokens, err := auth.IssueSessionTokens(response.StudentId, auth.RoleStudent)
+	if err != nil {
+		http.Error(w, "Error generating session tokens.", http.StatusInternalServerError)
 		return
 	}
+	response.AccessToken = tokens.AccessToken
+	response.ExpiresAt = tokens.ExpiresAt
+	response.RefreshToken = tokens.RefreshToken
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func validateGoogleLogin(req types.ValidateGoogleLoginRequest) (types.ValidateLoginResponse, error) {
-	student := types.ValidateLoginResponse{
-		StudentId:          "",
-		FirstName:          "",
-		PreferredName:      "",
-		LastName:           "",
-		EmailAddress:       "",
-		NativeLanguage:     "",
-		PreferredLanguage:  "",
-		StudentSince:       "",
-		ProfilePictureURL:  "",
-		ProfilePicturePath: "",
-		ThemeMode:          "",
-		FontStyle:          "",
-		TimeZone:           "",
+func writeGoogleLoginError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		http.Error(w, "No student account exists for this Google account.", http.StatusNotFound)
+	case errors.Is(err, errGoogleLinkRequired):
+		http.Error(w, "This account uses a password. Sign in with Google again and include your password to link your Google account.", http.StatusConflict)
+	case errors.Is(err, errGoogleAccountMismatch):
+		http.Error(w, "This account is linked to a different Google account.", http.StatusUnauthorized)
+	case errors.Is(err, errGoogleLinkPasswordInvalid):
+		http.Error(w, "Password is incorrect.", http.StatusUnauthorized)
+	default:
+		http.Error(w, "Error validating student's Google login.", http.StatusInternalServerError)
 	}
+}
+
+var (
+	errGoogleLinkRequired        = errors.New("password is required to link a google account")
+	errGoogleAccountMismatch     = errors.New("student is linked to a different google account")
+	errGoogleLinkPasswordInvalid = errors.New("password is incorrect, google account was not linked")
+)
+
+// validateGoogleLogin finds the student for a verified Google account. Students are matched on the Google subject
+// first, then on email. A student that signed up with a password has to confirm it once to link their Google account.
+func validateGoogleLogin(claims types.GoogleIDTokenClaims, password string) (types.ValidateLoginResult, error) {
+	var result types.ValidateLoginResult
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -180,26 +267,79 @@ func validateGoogleLogin(req types.ValidateGoogleLoginRequest) (types.ValidateLo
 
 	// Query MongoDB
 	var studentResult types.Student
-	err := collection.FindOne(ctx, bson.M{"emailaddress": req.Email}).Decode(&studentResult)
-	if err != nil {
+	err := collection.FindOne(ctx, bson.M{"googlesubject": claims.Subject}).Decode(&studentResult)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		err = collection.FindOne(ctx, bson.M{"emailaddress": claims.Email}).Decode(&studentResult)
+		if err != nil {
+			fmt.Println("Error finding student account... returning error")
+			fmt.Println("Error is: " + err.Error())
+			return result, err
+		}
+
+		if studentResult.GoogleSubject != "" {
+			return result, errGoogleAccountMismatch
+		}
+		if studentResult.Password != "" {
+			if password == "" {
+				return result, errGoogleLinkRequired
+			}
+			isPasswordValid, needsRehash := utils.VerifyPassword(password, studentResult.Salt, studentResult.Password)
+			if !isPasswordValid {
+				return result, errGoogleLinkPasswordInvalid
+			}
+			auth.UpgradePasswordHash(auth.RoleStudent, studentResult.StudentId, password, needsRehash)
+		}
+
+		_, err = collection.UpdateOne(ctx, bson.M{"studentid": studentResult.StudentId}, bson.M{
+			// Google has already verified the address, checked in VerifyGoogleIDToken
+			"$set": bson.M{"googlesubject": claims.Subject, "emailverified": true},
+		})
+		if err != nil {
+			fmt.Println("Error linking Google account to student:", err)
+			return result, err
+		}
+		fmt.Println("Linked Google account to student", studentResult.StudentId)
+	} else if err != nil {
 		fmt.Println("Error finding student account... returning error")
 		fmt.Println("Error is: " + err.Error())
-		return student, err
-	}
-
-	student.StudentId = studentResult.StudentId
-	student.FirstName = studentResult.FirstName
-	student.PreferredName = studentResult.PreferredName
-	student.LastName = studentResult.LastName
-	student.EmailAddress = studentResult.EmailAddress
-	student.NativeLanguage = studentResult.NativeLanguage
-	student.PreferredLanguage = studentResult.PreferredLanguage
-	student.StudentSince = studentResult.StudentSince
-	student.ProfilePictureURL = studentResult.ProfilePictureURL
-	student.ProfilePicturePath = studentResult.ProfilePicturePath
-	student.ThemeMode = studentResult.ThemeMode
-	student.FontStyle = studentResult.FontStyle
-	student.TimeZone = studentResult.TimeZone
-
-	return student, nil
+		return result, err
+	}
+
+	result.IsValid = true
+	result.StudentInfo = studentLoginResponse(studentResult)
+	result.RequiresTOTP = studentResult.TOTPEnabled
+
+	return result, nil
+}
+
+func studentLoginResponse(studentResult types.Student) types.ValidateLoginResponse {
+	return types.ValidateLoginResponse{
+		StudentId:          studentResult.StudentId,
+		FirstName:          studentResult.FirstName,
+		PreferredName:      studentResult.PreferredName,
+		LastName:           studentResult.LastName,
+		EmailAddress:       studentResult.EmailAddress,
+		NativeLanguage:     studentResult.NativeLanguage,
+		PreferredLanguage:  studentResult.PreferredLanguage,
+		StudentSince:       studentResult.StudentSince,
+		ProfilePictureURL:  studentResult.ProfilePictureURL,
+		ProfilePicturePath: studentResult.ProfilePicturePath,
+		ThemeMode:          studentResult.ThemeMode,
+		FontStyle:          studentResult.FontStyle,
+		TimeZone:           studentResult.TimeZone,
+		LessonsRemaining:   studentResult.LessonsRemaining,
+		LessonsCompleted:   studentResult.LessonsCompleted,
+	}
+}
+
+// findStudentByID loads the student completing a two-factor login
+func findStudentByID(studentID string) (types.Student, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.StudentsCollection)
+
+	var studentResult types.Student
+	err := collection.FindOne(ctx, bson.M{"studentid": studentID}).Decode(&studentResult)
+	return studentResult, err
 }
@@ -3,13 +3,16 @@ package studentsHandlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/utils"
 	"net/http"
-	"os"
 	"time"
 )
 
@@ -26,59 +29,105 @@ func ValidateLoginMobileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := validateLoginMobile(req)
-	if err != nil {
-		http.Error(w, "Error occurred while logging in", http.StatusInternalServerError)
-		return
+	var result types.ValidateLoginMobileResult
+	if req.ChallengeToken != "" {
+		// Second step of a two-factor login, the password was already checked when the challenge was issued
+		claims, ok := auth.VerifyChallenge(w, r, req.ChallengeToken, req.TOTPCode, auth.RoleStudent)
+		if !ok {
+			return
+		}
+		studentResult, err := findStudentByID(claims.UserID)
+		if err != nil {
+			http.Error(w, "Error occurred while logging in", http.StatusInternalServerError)
+			return
+		}
+		result.IsValid = true
+		result.StudentInfo = studentLoginMobileResponse(studentResult)
+	} else {
+		clientIP := auth.ClientIP(r)
+		if retryAfter := auth.DefaultLoginLimiter.Check(auth.RoleStudent, req.EmailAddress, clientIP); retryAfter > 0 {
+			auth.WriteTooManyAttempts(w, retryAfter)
+			return
+		}
+
+		result, err = validateLoginMobile(req)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Error occurred while logging in", http.StatusInternalServerError)
+			return
+		}
+		if err != nil || !result.IsValid {
+			auth.DefaultLoginLimiter.Failure(auth.RoleStudent, req.EmailAddress, clientIP)
+			http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+			fmt.Println("Unauthorized login attempt from", clientIP, "for email:", req.EmailAddress)
+			return
+		}
+		auth.DefaultLoginLimiter.Success(auth.RoleStudent, req.EmailAddress)
+
+		if handlers.RequireEmailVerification && !result.EmailVerified {
+			http.Error(w, "Email address has not been verified. Check your inbox for the verification email.", http.StatusForbidden)
+			return
+		}
+
+		if result.RequiresTOTP {
+			auth.WriteMFAChallenge(w, result.StudentInfo.StudentId, auth.RoleStudent)
+			return
+		}
 	}
-	if !result.IsValid {
-		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
-		// add logging here for unauthorized attempts later
-		fmt.Println("Unauthorized login attempt. Invalid password for email: ", req.EmailAddress)
+
+	response := result.StudentInfo
+	tokens, err := auth.IssueSessionTokens(response.StudentId, auth.RoleStudent)
+	if err != nil {
+		http.Error(w, "Error generating session tokens", http.StatusInternalServerError)
 		return
 	}
+	response.AccessToken = tokens.AccessToken
+	response.ExpiresAt = tokens.ExpiresAt
+	response.RefreshToken = tokens.RefreshToken
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result.StudentInfo)
+	json.NewEncoder(w).Encode(response)
 }
 
 func validateLoginMobile(req types.ValidateLoginMobileRequest) (types.ValidateLoginMobileResult, error) {
-	salt := os.Getenv("SALT")
-	hashedPassword, err := utils.HashPasswordMobile(req.Password + salt)
-	if err != nil {
-		fmt.Println("An error occurred while trying to initially hash password: ", err)
-		return types.ValidateLoginMobileResult{}, err
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	collection := db.MongoClient.Database(db.DbName).Collection(db.StudentsCollection)
 	var result types.Student
-	err = collection.FindOne(ctx, bson.M{"emailaddress": req.EmailAddress}).Decode(&result)
+	err := collection.FindOne(ctx, bson.M{"emailaddress": req.EmailAddress}).Decode(&result)
 	if err != nil {
 		fmt.Println("An error occurred while attempting to find the student in the database: ", err)
 		return types.ValidateLoginMobileResult{}, err
 	}
 
-	isPasswordValid := utils.CheckPasswordHash(hashedPassword+result.Salt, result.Password)
+	// The mobile app sends the plain password like the desktop app, so both verify the same way
+	isPasswordValid, needsRehash := utils.VerifyPassword(req.Password, result.Salt, result.Password)
+	if isPasswordValid {
+		auth.UpgradePasswordHash(auth.RoleStudent, result.StudentId, req.Password, needsRehash)
+	}
 	return types.ValidateLoginMobileResult{
-		IsValid: isPasswordValid,
-		StudentInfo: types.ValidateLoginMobileResponse{
-			StudentId:          result.StudentId,
-			FirstName:          result.FirstName,
-			PreferredName:      result.PreferredName,
-			LastName:           result.LastName,
-			EmailAddress:       result.EmailAddress,
-			NativeLanguage:     result.NativeLanguage,
-			PreferredLanguage:  result.PreferredLanguage,
-			StudentSince:       result.StudentSince,
-			ProfilePictureURL:  result.ProfilePictureURL,
-			ProfilePicturePath: result.ProfilePicturePath,
-			ThemeMode:          result.ThemeMode,
-			FontStyle:          result.FontStyle,
-			LessonsRemaining:   result.LessonsRemaining,
-			LessonsCompleted:   result.LessonsCompleted,
-		},
+		IsValid:       isPasswordValid,
+		StudentInfo:   studentLoginMobileResponse(result),
+		RequiresTOTP:  isPasswordValid && result.TOTPEnabled,
+		EmailVerified: result.EmailVerified,
 	}, nil
 }
+
+func studentLoginMobileResponse(result types.Student) types.ValidateLoginMobileResponse {
+	return types.ValidateLoginMobileResponse{
+		StudentId:          result.StudentId,
+		FirstName:          result.FirstName,
+		PreferredName:      result.PreferredName,
+		LastName:           result.LastName,
+		EmailAddress:       result.EmailAddress,
+		NativeLanguage:     result.NativeLanguage,
+		PreferredLanguage:  result.PreferredLanguage,
+		StudentSince:       result.StudentSince,
+		ProfilePictureURL:  result.ProfilePictureURL,
+		ProfilePicturePath: result.ProfilePicturePath,
+		ThemeMode:          result.ThemeMode,
+		FontStyle:          result.FontStyle,
+		LessonsRemaining:   result.LessonsRemaining,
+		LessonsCompleted:   result.LessonsCompleted,
+	}
+}
@@ -0,0 +1,54 @@
+package studentsHandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+)
+
+// RestoreStudentHandler brings back a deleted student before they're purged. Their teacher or an admin can.
+func RestoreStudentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.RestoreStudentRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.StudentId == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	account, err := handlers.FindDeletedAccount(req.StudentId)
+	if errors.Is(err, handlers.ErrAccountNotFound) || (err == nil && account.Role != auth.RoleStudent) {
+		http.Error(w, "No deleted student found, they may have been purged already", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error restoring student", http.StatusInternalServerError)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	if claims.Role != auth.RoleAdmin && (claims.Role != auth.RoleTeacher || claims.UserID != account.TeacherID) {
+		http.Error(w, "You do not have permission to restore this student", http.StatusForbidden)
+		return
+	}
+
+	err = handlers.RestoreAccount(account)
+	if errors.Is(err, handlers.ErrEmailInUse) {
+		http.Error(w, "Another account uses this student's email address now", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error restoring student", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.RestoreAccountResponse{IsRestored: true})
+}
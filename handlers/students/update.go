@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/events"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/utils"
 	"net/http"
@@ -36,7 +38,18 @@ func UpdateStudentInfoHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("req.PublicKey: " + req.PublicKey)
 	fmt.Println("req.LessonsRemaining:", req.LessonsRemaining)
 
-	result, err := updateStudentInfo(req)
+	claims, _ := auth.ClaimsFromRequest(r)
+	allowed, err := auth.CanAccessStudent(claims, req.StudentId)
+	if err != nil {
+		http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "You do not have permission to update this student", http.StatusForbidden)
+		return
+	}
+
+	result, err := updateStudentInfo(req, claims)
 
 	if err != nil {
 		http.Error(w, "Error updating student information.", http.StatusInternalServerError)
@@ -63,7 +76,7 @@ func UpdateStudentInfoHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func updateStudentInfo(req types.UpdateStudentInfoRequest) (types.UpdateStudentInfoResponse, error) {
+func updateStudentInfo(req types.UpdateStudentInfoRequest, claims types.TokenClaims) (types.UpdateStudentInfoResponse, error) {
 	findCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -92,7 +105,6 @@ func updateStudentInfo(req types.UpdateStudentInfoRequest) (types.UpdateStudentI
 	}
 
 	update := bson.M{}
-	usersUpdate := bson.M{}
 
 	if req.ThemeMode != "" {
 		update["thememode"] = req.ThemeMode
@@ -104,7 +116,6 @@ func updateStudentInfo(req types.UpdateStudentInfoRequest) (types.UpdateStudentI
 
 	if req.ProfilePictureURL != "" {
 		update["profilepictureurl"] = req.ProfilePictureURL
-		usersUpdate["profilePictureUrl"] = req.ProfilePictureURL
 	}
 
 	if req.ProfilePicturePath != "" {
@@ -113,7 +124,6 @@ func updateStudentInfo(req types.UpdateStudentInfoRequest) (types.UpdateStudentI
 
 	if req.PreferredName != "" {
 		update["preferredname"] = req.PreferredName
-		usersUpdate["preferredName"] = req.PreferredName
 	}
 
 	if req.PreferredLanguage != "" {
@@ -124,12 +134,19 @@ func updateStudentInfo(req types.UpdateStudentInfoRequest) (types.UpdateStudentI
 		update["timezone"] = req.TimeZone
 	}
 
-	if req.LessonsRemaining != studentInfo.LessonsRemaining {
-		update["lessonsremaining"] = req.LessonsRemaining
+	// Students can't change their own lesson counts
+	if auth.IsStaff(claims) {
+		if req.LessonsRemaining != studentInfo.LessonsRemaining {
+			update["lessonsremaining"] = req.LessonsRemaining
+		}
+
+		if req.LessonsCompleted != studentInfo.LessonsCompleted {
+			update["lessonscompleted"] = req.LessonsCompleted
+		}
 	}
 
-	if req.LessonsCompleted != studentInfo.LessonsCompleted {
-		update["lessonscompleted"] = req.LessonsCompleted
+	if claims.Role == auth.RoleAdmin && req.TeacherID != "" {
+		update["teacherid"] = req.TeacherID
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -138,10 +155,7 @@ func updateStudentInfo(req types.UpdateStudentInfoRequest) (types.UpdateStudentI
 	// Query MongoDB
 	var studentResult types.Student
 	err = collection.FindOneAndUpdate(ctx, bson.M{
-		"$or": []bson.M{
-			{"studentid": req.StudentId},
-			{"emailaddress": req.EmailAddress}, // add StudentID here later
-		},
+		"studentid": req.StudentId,
 	}, bson.M{
 		"$set": update,
 	}).Decode(&studentResult)
@@ -173,21 +187,8 @@ func updateStudentInfo(req types.UpdateStudentInfoRequest) (types.UpdateStudentI
 		utils.SavePublicKey(formattedStudentID, req.PublicKey)
 	}
 
-	usersCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	usersCollection := db.MongoClient.Database(db.DbName).Collection(db.UsersCollection)
-	var userResult bson.M
-	err = usersCollection.FindOneAndUpdate(usersCtx, bson.M{
-		"userId": student.StudentId,
-	}, bson.M{
-		"$set": usersUpdate,
-	}).Decode(&userResult)
-	if err != nil {
-		fmt.Println("Error updating user info in mongodb... returning error")
-		fmt.Println("Error is: " + err.Error())
-		return student, err
-	}
+	// Updates the student's chat profile
+	events.Publish(events.StudentUpdated, auth.RoleStudent, student.StudentId)
 
 	return student, nil
 }
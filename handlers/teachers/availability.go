@@ -0,0 +1,108 @@
+package teachersHandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+	"time"
+)
+
+// GetAvailabilityHandler returns a teacher's weekly hours, time off and holidays with ?teacherID=. The teacher, their
+// students and admins can see it.
+func GetAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	teacherID := r.URL.Query().Get("teacherID")
+	if teacherID == "" {
+		http.Error(w, "Invalid request query. The \"teacherID\" query is required", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	allowed := auth.CanAccessTeacher(claims, teacherID)
+	if claims.Role == auth.RoleStudent {
+		studentTeacherID, err := handlers.StudentTeacherID(claims.UserID)
+		if err != nil && !errors.Is(err, handlers.ErrAccountNotFound) {
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+		allowed = studentTeacherID == teacherID
+	}
+	if !allowed {
+		http.Error(w, "You do not have permission to see this teacher's availability", http.StatusForbidden)
+		return
+	}
+
+	availability, err := handlers.FindAvailability(teacherID)
+	if errors.Is(err, handlers.ErrNoAvailability) {
+		http.Error(w, "The teacher hasn't published their availability", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error finding the availability", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.AvailabilityResponse{Availability: availability})
+}
+
+// UpdateAvailabilityHandler replaces a teacher's weekly hours, time off and holidays. Lessons already booked are kept
+// even when they fall outside the new availability.
+func UpdateAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.UpdateAvailabilityRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	if req.TeacherID == "" {
+		req.TeacherID = claims.UserID
+	}
+	if !auth.CanAccessTeacher(claims, req.TeacherID) {
+		http.Error(w, "You do not have permission to update this teacher's availability", http.StatusForbidden)
+		return
+	}
+
+	availability := types.TeacherAvailability{
+		TeacherID:   req.TeacherID,
+		TimeZone:    req.TimeZone,
+		SlotMinutes: req.SlotMinutes,
+		WeeklyHours: req.WeeklyHours,
+		TimeOff:     req.TimeOff,
+		Holidays:    req.Holidays,
+		UpdatedAt:   time.Now().UTC(),
+	}
+	err = handlers.ValidateAvailability(&availability)
+	if errors.Is(err, handlers.ErrInvalidAvailability) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error validating teacher availability:", err)
+		http.Error(w, "Error updating the availability", http.StatusInternalServerError)
+		return
+	}
+
+	if err := handlers.SaveAvailability(availability); err != nil {
+		http.Error(w, "Error updating the availability", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.AvailabilityResponse{Availability: availability})
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/events"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/utils"
 	"log"
@@ -32,6 +34,7 @@ func CreateTeacherHandler(w http.ResponseWriter, r *http.Request) {
 	result, err := createTeacher(req)
 	if err != nil {
 		http.Error(w, "Error creating teacher: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	response := types.CreateTeacherResponse{
@@ -48,6 +51,7 @@ func CreateTeacherHandler(w http.ResponseWriter, r *http.Request) {
 		FontStyle:          result.FontStyle,
 		TimeZone:           result.TimeZone,
 		LessonsTaught:      result.LessonsTaught,
+		Role:               result.Role,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -69,6 +73,10 @@ func createTeacher(req types.CreateTeacherRequest) (types.CreateTeacherResponse,
 		FontStyle:          req.FontStyle,
 		TimeZone:           req.TimeZone,
 		LessonsTaught:      0,
+		Role:               auth.RoleTeacher,
+	}
+	if req.Role == auth.RoleAdmin {
+		newTeacher.Role = auth.RoleAdmin
 	}
 	response := types.CreateTeacherResponse{
 		TeacherID:          req.TeacherID,
@@ -84,6 +92,7 @@ func createTeacher(req types.CreateTeacherRequest) (types.CreateTeacherResponse,
 		FontStyle:          req.FontStyle,
 		TimeZone:           req.TimeZone,
 		LessonsTaught:      0,
+		Role:               newTeacher.Role,
 	}
 
 	fmt.Println("TeacherID:", newTeacher.TeacherID)
@@ -99,25 +108,16 @@ func createTeacher(req types.CreateTeacherRequest) (types.CreateTeacherResponse,
 	fmt.Println("FontStyle:", newTeacher.FontStyle)
 	fmt.Println("TimeZone:", newTeacher.TimeZone)
 	fmt.Println("LessonsTaught:", newTeacher.LessonsTaught)
+	fmt.Println("Role:", newTeacher.Role)
 
-	salt, err := utils.GenerateSalt(10)
-	if err != nil {
-		fmt.Println("Error generating salt... using email address instead.") // Handle this better later
-		salt = req.EmailAddress
-	}
-	fmt.Println("Salt: " + salt)
-	fmt.Println("Req.password: " + req.Password)
-
-	hashedPassword, err := utils.HashPassword(req.Password + salt)
+	hashedPassword, err := utils.HashPassword(req.Password)
 	if err != nil {
-		fmt.Println("Error hashing password and salt... returning an error") // Handle this better later
+		fmt.Println("Error hashing password... returning an error") // Handle this better later
 		fmt.Println("Error is: " + err.Error())
 		return response, err
 	}
-	fmt.Println("hashedPassword: " + hashedPassword)
 
 	newTeacher.Password = hashedPassword
-	newTeacher.Salt = salt
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -130,28 +130,19 @@ func createTeacher(req types.CreateTeacherRequest) (types.CreateTeacherResponse,
 		return response, err
 	}
 
+	// Failing to send the email doesn't fail the sign up, the teacher can ask for another one
+	if err := handlers.SendVerificationEmail(auth.RoleTeacher, newTeacher.TeacherID, newTeacher.EmailAddress); err != nil {
+		log.Println("Error sending verification email: " + err.Error())
+	}
+
 	if req.PublicKey != "" {
 		teacherID := req.TeacherID
 		formattedTeacherID := strings.ReplaceAll(teacherID, "-", "_")
 		utils.SavePublicKey(formattedTeacherID, req.PublicKey)
 	}
 
-	usersCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	usersCollection := db.MongoClient.Database(db.DbName).Collection(db.UsersCollection)
-	_, err = usersCollection.InsertOne(usersCtx, bson.M{
-		"userId":            newTeacher.TeacherID,
-		"userType":          "teacher",
-		"preferredName":     newTeacher.PreferredName,
-		"firstName":         newTeacher.FirstName,
-		"lastName":          newTeacher.LastName,
-		"profilePictureUrl": newTeacher.ProfilePictureURL,
-	})
-	if err != nil {
-		log.Println("Error inserting user into usersCollection: " + err.Error())
-		return response, err
-	}
+	// Creates the teacher's chat profile
+	events.Publish(events.TeacherCreated, auth.RoleTeacher, newTeacher.TeacherID)
 
 	return response, nil
 }
@@ -1,14 +1,12 @@
 package teachersHandlers
 
 import (
-	"context"
 	"encoding/json"
-	"fmt"
-	"go.mongodb.org/mongo-driver/bson"
-	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"errors"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"net/http"
-	"time"
 )
 
 func DeleteTeacherHandler(w http.ResponseWriter, r *http.Request) {
@@ -23,7 +21,13 @@ func DeleteTeacherHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := deleteTeacher(teacherID)
+	claims, _ := auth.ClaimsFromRequest(r)
+
+	response, err := deleteTeacher(teacherID, claims.UserID)
+	if errors.Is(err, handlers.ErrAccountNotFound) {
+		http.Error(w, "Teacher not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error deleting teacher", http.StatusInternalServerError)
 		return
@@ -33,14 +37,10 @@ func DeleteTeacherHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func deleteTeacher(teacherID string) (types.DeleteTeacherResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	collection := db.MongoClient.Database(db.DbName).Collection(db.TeachersCollection)
-	_, err := collection.DeleteOne(ctx, bson.M{"teacherid": teacherID})
+// deleteTeacher soft deletes the teacher, they can be restored until the grace period is over and are purged after
+func deleteTeacher(teacherID, deletedBy string) (types.DeleteTeacherResponse, error) {
+	account, err := handlers.SoftDeleteAccount(auth.RoleTeacher, teacherID, deletedBy)
 	if err != nil {
-		fmt.Println("Error attempting to delete the teacher from the database:", err)
 		return types.DeleteTeacherResponse{
 			IsDeleted: false,
 		}, err
@@ -48,5 +48,6 @@ func deleteTeacher(teacherID string) (types.DeleteTeacherResponse, error) {
 
 	return types.DeleteTeacherResponse{
 		IsDeleted: true,
+		PurgeAt:   &account.PurgeAt,
 	}, nil
 }
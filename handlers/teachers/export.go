@@ -0,0 +1,43 @@
+package teachersHandlers
+
+import (
+	"errors"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
+	"net/http"
+)
+
+// ExportTeacherHandler starts an export of everything held about a teacher. Teachers can export themselves, admins
+// can export anyone. Follow it with /exports/status.
+func ExportTeacherHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	teacherID := r.URL.Query().Get("teacherID")
+	if teacherID == "" {
+		http.Error(w, "Invalid request query. The \"teacherID\" query is required", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := auth.ClaimsFromRequest(r)
+	if !auth.CanAccessTeacher(claims, teacherID) {
+		http.Error(w, "You do not have permission to export this teacher", http.StatusForbidden)
+		return
+	}
+
+	export, err := handlers.RequestDataExport(auth.RoleTeacher, teacherID, claims.UserID)
+	if errors.Is(err, handlers.ErrAccountNotFound) {
+		http.Error(w, "Teacher not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error requesting teacher export:", err)
+		http.Error(w, "Error exporting teacher", http.StatusInternalServerError)
+		return
+	}
+
+	handlers.WriteDataExportResponse(w, r, http.StatusAccepted, export)
+}
@@ -34,14 +34,15 @@ func listTeachers() (types.ListTeachersResponse, error) {
 
 	collection := db.MongoClient.Database(db.DbName).Collection(db.TeachersCollection)
 	pipeline := mongo.Pipeline{
-		{{"$sort", bson.D{{"preferredname", 1}}}},
-		{{"$project", bson.M{
+		{{Key: "$sort", Value: bson.D{{Key: "preferredname", Value: 1}}}},
+		{{Key: "$project", Value: bson.M{
 			"teacherid":         1,
 			"firstname":         1,
 			"preferredname":     1,
 			"lastname":          1,
 			"emailaddress":      1,
 			"profilepictureurl": 1,
+			"role":              1,
 			"_id":               0,
 		}}},
 	}
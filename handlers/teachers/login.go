@@ -3,9 +3,13 @@ package teachersHandlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/utils"
 	"net/http"
@@ -27,16 +31,50 @@ func ValidateTeacherLoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Println("ValidateTeacherLogin request incoming...")
 
-	result, err := validateTeacherLogin(req)
-
-	if err != nil {
-		http.Error(w, "Error validating teacher login.", http.StatusInternalServerError)
-		return
-	}
-
-	if !result.IsValid {
-		http.Error(w, "Email address, TeacherID, or password is incorrect.", http.StatusUnauthorized)
-		return
+	var result types.ValidateTeacherLoginResult
+	if req.ChallengeToken != "" {
+		// Second step of a two-factor login, the password was already checked when the challenge was issued
+		claims, ok := auth.VerifyChallenge(w, r, req.ChallengeToken, req.TOTPCode, auth.RoleTeacher, auth.RoleAdmin)
+		if !ok {
+			return
+		}
+		teacherResult, err := findTeacherByID(claims.UserID)
+		if err != nil {
+			http.Error(w, "Error validating teacher login.", http.StatusInternalServerError)
+			return
+		}
+		result.IsValid = true
+		result.TeacherInfo = teacherLoginResponse(teacherResult)
+	} else {
+		clientIP := auth.ClientIP(r)
+		if retryAfter := auth.DefaultLoginLimiter.Check(auth.RoleTeacher, req.EmailAddress, clientIP); retryAfter > 0 {
+			auth.WriteTooManyAttempts(w, retryAfter)
+			return
+		}
+
+		result, err = validateTeacherLogin(req)
+
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Error validating teacher login.", http.StatusInternalServerError)
+			return
+		}
+
+		if err != nil || !result.IsValid {
+			auth.DefaultLoginLimiter.Failure(auth.RoleTeacher, req.EmailAddress, clientIP)
+			http.Error(w, "Email address, TeacherID, or password is incorrect.", http.StatusUnauthorized)
+			return
+		}
+		auth.DefaultLoginLimiter.Success(auth.RoleTeacher, req.EmailAddress)
+
+		if handlers.RequireEmailVerification && !result.EmailVerified {
+			http.Error(w, "Email address has not been verified. Check your inbox for the verification email.", http.StatusForbidden)
+			return
+		}
+
+		if result.RequiresTOTP {
+			auth.WriteMFAChallenge(w, result.TeacherInfo.TeacherID, result.TeacherInfo.Role)
+			return
+		}
 	}
 
 	response := types.ValidateTeacherLoginResponse{
@@ -52,8 +90,18 @@ func ValidateTeacherLoginHandler(w http.ResponseWriter, r *http.Request) {
 		ThemeMode:          result.TeacherInfo.ThemeMode,
 		FontStyle:          result.TeacherInfo.FontStyle,
 		TimeZone:           result.TeacherInfo.TimeZone,
+		Role:               result.TeacherInfo.Role,
 	}
 
+	tokens, err := auth.IssueSessionTokens(response.TeacherID, response.Role)
+	if err != nil {
+		http.Error(w, "Error generating session tokens.", http.StatusInternalServerError)
+		return
+	}
+	response.AccessToken = tokens.AccessToken
+	response.ExpiresAt = tokens.ExpiresAt
+	response.RefreshToken = tokens.RefreshToken
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
@@ -92,22 +140,14 @@ func validateTeacherLogin(req types.ValidateTeacherLoginRequest) (types.Validate
 		return validateLoginResult, err
 	}
 
-	teacher.TeacherID = teacherResult.TeacherID
-	teacher.FirstName = teacherResult.FirstName
-	teacher.PreferredName = teacherResult.PreferredName
-	teacher.LastName = teacherResult.LastName
-	teacher.EmailAddress = teacherResult.EmailAddress
-	teacher.NativeLanguage = teacherResult.NativeLanguage
-	teacher.PreferredLanguage = teacherResult.PreferredLanguage
-	teacher.ProfilePictureURL = teacherResult.ProfilePictureURL
-	teacher.ProfilePicturePath = teacherResult.ProfilePicturePath
-	teacher.ThemeMode = teacherResult.ThemeMode
-	teacher.FontStyle = teacherResult.FontStyle
-	teacher.TimeZone = teacherResult.TimeZone
-
-	isPasswordValid := utils.CheckPasswordHash(req.Password+teacherResult.Salt, teacherResult.Password)
+	isPasswordValid, needsRehash := utils.VerifyPassword(req.Password, teacherResult.Salt, teacherResult.Password)
+	if isPasswordValid {
+		auth.UpgradePasswordHash(auth.RoleTeacher, teacherResult.TeacherID, req.Password, needsRehash)
+	}
 	validateLoginResult.IsValid = isPasswordValid
-	validateLoginResult.TeacherInfo = teacher
+	validateLoginResult.TeacherInfo = teacherLoginResponse(teacherResult)
+	validateLoginResult.RequiresTOTP = isPasswordValid && teacherResult.TOTPEnabled
+	validateLoginResult.EmailVerified = teacherResult.EmailVerified
 
 	if isPasswordValid {
 		fmt.Println("Teacher Password is valid: TRUE")
@@ -117,3 +157,37 @@ func validateTeacherLogin(req types.ValidateTeacherLoginRequest) (types.Validate
 
 	return validateLoginResult, nil
 }
+
+func teacherLoginResponse(teacherResult types.Teacher) types.ValidateTeacherLoginResponse {
+	teacher := types.ValidateTeacherLoginResponse{
+		TeacherID:          teacherResult.TeacherID,
+		FirstName:          teacherResult.FirstName,
+		PreferredName:      teacherResult.PreferredName,
+		LastName:           teacherResult.LastName,
+		EmailAddress:       teacherResult.EmailAddress,
+		NativeLanguage:     teacherResult.NativeLanguage,
+		PreferredLanguage:  teacherResult.PreferredLanguage,
+		ProfilePictureURL:  teacherResult.ProfilePictureURL,
+		ProfilePicturePath: teacherResult.ProfilePicturePath,
+		ThemeMode:          teacherResult.ThemeMode,
+		FontStyle:          teacherResult.FontStyle,
+		TimeZone:           teacherResult.TimeZone,
+		Role:               auth.RoleTeacher,
+	}
+	if teacherResult.Role == auth.RoleAdmin {
+		teacher.Role = auth.RoleAdmin
+	}
+	return teacher
+}
+
+// findTeacherByID loads the teacher completing a two-factor login
+func findTeacherByID(teacherID string) (types.Teacher, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.MongoClient.Database(db.DbName).Collection(db.TeachersCollection)
+
+	var teacherResult types.Teacher
+	err := collection.FindOne(ctx, bson.M{"teacherid": teacherID}).Decode(&teacherResult)
+	return teacherResult, err
+}
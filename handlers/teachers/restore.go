@@ -0,0 +1,47 @@
+package teachersHandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net/http"
+)
+
+// RestoreTeacherHandler brings back a deleted teacher before they're purged
+func RestoreTeacherHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	teacherID := r.URL.Query().Get("teacherID")
+	if teacherID == "" {
+		http.Error(w, "Invalid request query. The \"teacherID\" query is required", http.StatusBadRequest)
+		return
+	}
+
+	account, err := handlers.FindDeletedAccount(teacherID)
+	if errors.Is(err, handlers.ErrAccountNotFound) || (err == nil && account.Role != auth.RoleTeacher) {
+		http.Error(w, "No deleted teacher found, they may have been purged already", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error restoring teacher", http.StatusInternalServerError)
+		return
+	}
+
+	err = handlers.RestoreAccount(account)
+	if errors.Is(err, handlers.ErrEmailInUse) {
+		http.Error(w, "Another account uses this teacher's email address now", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error restoring teacher", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.RestoreAccountResponse{IsRestored: true})
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/events"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/utils"
 	"log"
@@ -27,6 +29,12 @@ func UpdateTeacherInfoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	claims, _ := auth.ClaimsFromRequest(r)
+	if !auth.CanAccessTeacher(claims, req.TeacherID) {
+		http.Error(w, "You do not have permission to update this teacher", http.StatusForbidden)
+		return
+	}
+
 	result, err := updateTeacherInfo(req)
 	if err != nil {
 		http.Error(w, "Error updating teacher info: "+err.Error(), http.StatusInternalServerError)
@@ -65,7 +73,6 @@ func updateTeacherInfo(req types.UpdateTeacherInfoRequest) (types.UpdateTeacherI
 	}
 
 	update := bson.M{}
-	usersUpdate := bson.M{}
 
 	if req.ThemeMode != "" {
 		update["thememode"] = req.ThemeMode
@@ -77,7 +84,6 @@ func updateTeacherInfo(req types.UpdateTeacherInfoRequest) (types.UpdateTeacherI
 
 	if req.ProfilePictureURL != "" {
 		update["profilepictureurl"] = req.ProfilePictureURL
-		usersUpdate["profilePictureUrl"] = req.ProfilePictureURL
 	}
 
 	if req.ProfilePicturePath != "" {
@@ -86,7 +92,6 @@ func updateTeacherInfo(req types.UpdateTeacherInfoRequest) (types.UpdateTeacherI
 
 	if req.PreferredName != "" {
 		update["preferredname"] = req.PreferredName
-		usersUpdate["preferredName"] = req.PreferredName
 	}
 
 	if req.PreferredLanguage != "" {
@@ -108,10 +113,7 @@ func updateTeacherInfo(req types.UpdateTeacherInfoRequest) (types.UpdateTeacherI
 
 	var teacherResult types.Teacher
 	err = collection.FindOneAndUpdate(ctx, bson.M{
-		"$or": []bson.M{
-			{"teacherid": req.TeacherID},
-			{"emailaddress": req.EmailAddress},
-		},
+		"teacherid": req.TeacherID,
 	}, bson.M{
 		"$set": update,
 	}).Decode(&teacherResult)
@@ -126,20 +128,8 @@ func updateTeacherInfo(req types.UpdateTeacherInfoRequest) (types.UpdateTeacherI
 		utils.SavePublicKey(formattedTeacherID, req.PublicKey)
 	}
 
-	usersCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	usersCollection := db.MongoClient.Database(db.DbName).Collection(db.UsersCollection)
-	var userResult bson.M
-	err = usersCollection.FindOneAndUpdate(usersCtx, bson.M{
-		"userId": teacherInfo.TeacherID,
-	}, bson.M{
-		"$set": usersUpdate,
-	}).Decode(&userResult)
-	if err != nil {
-		log.Println("Error finding and updating user info: ", err.Error())
-		return updateTeacherInfoResponse, nil
-	}
+	// Updates the teacher's chat profile
+	events.Publish(events.TeacherUpdated, auth.RoleTeacher, teacherResult.TeacherID)
 
 	return updateTeacherInfoResponse, nil
 }
@@ -3,11 +3,24 @@ package handlers
 import (
 	"fmt"
 	"io"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// profileImageExtensions are the image types a profile picture can be, by their sniffed content type
+var profileImageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// HandleUploadProfileImage saves the caller's profile picture. The file is named after the user it belongs to, never
+// after the uploaded file, so nobody can overwrite someone else's picture. Staff can upload for a student they can
+// access with the "student_id" form field, admins for a teacher with "teacherID".
 func HandleUploadProfileImage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
@@ -20,20 +33,58 @@ func HandleUploadProfileImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, handler, err := r.FormFile("image")
+	claims, _ := auth.ClaimsFromRequest(r)
+	userID := claims.UserID
+	if studentID := r.FormValue("student_id"); studentID != "" && studentID != claims.UserID {
+		allowed, err := auth.CanAccessStudent(claims, studentID)
+		if err != nil {
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "You do not have permission to change this student's picture", http.StatusForbidden)
+			return
+		}
+		userID = studentID
+	} else if teacherID := r.FormValue("teacherID"); teacherID != "" && teacherID != claims.UserID {
+		if !auth.CanAccessTeacher(claims, teacherID) {
+			http.Error(w, "You do not have permission to change this teacher's picture", http.StatusForbidden)
+			return
+		}
+		userID = teacherID
+	}
+	if userID == "" || strings.ContainsAny(userID, `/\.`) {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("image")
 	if err != nil {
 		http.Error(w, "Unable to retrieve file", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	savePath := filepath.Join("uploads", "profileImages", handler.Filename)
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(file, sniff)
+	extension, ok := profileImageExtensions[http.DetectContentType(sniff[:n])]
+	if !ok {
+		http.Error(w, "Profile pictures must be JPEG, PNG, GIF or WebP images", http.StatusBadRequest)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Unable to retrieve file", http.StatusBadRequest)
+		return
+	}
+
+	fileName := userID + extension
+	savePath := filepath.Join("uploads", "profileImages", fileName)
 	dst, err := os.Create(savePath)
 	if err != nil {
 		http.Error(w, "Unable to save file", http.StatusInternalServerError)
 		return
 	}
-	// defer dst.Close() // <- close doesn't exist?
+	defer dst.Close()
 
 	_, err = io.Copy(dst, file)
 	if err != nil {
@@ -41,8 +92,15 @@ func HandleUploadProfileImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	imageURL := fmt.Sprintf("https://%s:8888/uploads/profileImages/%s", os.Getenv("IP_ADDRESS"), handler.Filename)
-	w.WriteHeader(http.StatusOK)
+	// A picture of another type is left over when the user switches, e.g. from PNG to JPEG
+	for _, other := range profileImageExtensions {
+		if other != extension {
+			os.Remove(filepath.Join("uploads", "profileImages", userID+other))
+		}
+	}
+
+	imageURL := fmt.Sprintf("https://%s:8888/uploads/profileImages/%s", os.Getenv("IP_ADDRESS"), fileName)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, `{"imageURL": "%s"}`, imageURL)
 }
@@ -0,0 +1,115 @@
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Event is a VEVENT, the subset of RFC 5545 lessons need. Times are absolute, TimeZone is the location DTSTART was
+// given in so recurrence rules can be expanded in it.
+type Event struct {
+	UID          string
+	Summary      string
+	Description  string
+	Location     string
+	Status       string // "CONFIRMED", "TENTATIVE" or "CANCELLED", empty when not given
+	Sequence     int64
+	Start        time.Time // Zero when DTSTART is missing or can't be read
+	End          time.Time
+	AllDay       bool
+	TimeZone     string
+	RRule        string      // Without the "RRULE:" prefix
+	ExDates      []time.Time // Occurrences left out of RRule
+	RecurrenceID time.Time   // Set on an event that replaces one occurrence of the event with the same UID
+	Attendees    []string    // Lower case email addresses of the ATTENDEE properties
+	// The TZID of a time that couldn't be read because the time zone isn't known, the time is left out. Importers
+	// skip such events rather than guess the time.
+	UnknownTimeZone string
+
+	duration time.Duration // DURATION, until DTSTART is known
+}
+
+// Calendar is a VCALENDAR to be published as a feed
+type Calendar struct {
+	Name   string // Shown by most clients as the calendar's name
+	Events []Event
+}
+
+const (
+	StatusConfirmed = "CONFIRMED"
+	StatusTentative = "TENTATIVE"
+	StatusCancelled = "CANCELLED"
+)
+
+const (
+	prodID        = "-//Aspire with Alina//Lessons//EN"
+	dateTimeUTC   = "20060102T150405Z"
+	maxLineOctets = 75
+)
+
+// Write writes the calendar as text/calendar. Times are written in UTC, so the feed doesn't need VTIMEZONEs.
+func Write(w io.Writer, calendar Calendar) error {
+	buffered := bufio.NewWriter(w)
+	stamp := time.Now().UTC().Format(dateTimeUTC)
+
+	writeLine(buffered, "BEGIN:VCALENDAR")
+	writeLine(buffered, "VERSION:2.0")
+	writeLine(buffered, "PRODID:"+prodID)
+	writeLine(buffered, "CALSCALE:GREGORIAN")
+	writeLine(buffered, "METHOD:PUBLISH")
+	if calendar.Name != "" {
+		writeLine(buffered, "X-WR-CALNAME:"+escapeText(calendar.Name))
+	}
+
+	for _, event := range calendar.Events {
+		writeLine(buffered, "BEGIN:VEVENT")
+		writeLine(buffered, "UID:"+escapeText(event.UID))
+		writeLine(buffered, "DTSTAMP:"+stamp)
+		writeLine(buffered, "DTSTART:"+event.Start.UTC().Format(dateTimeUTC))
+		writeLine(buffered, "DTEND:"+event.End.UTC().Format(dateTimeUTC))
+		writeLine(buffered, fmt.Sprintf("SEQUENCE:%d", event.Sequence))
+		writeLine(buffered, "SUMMARY:"+escapeText(event.Summary))
+		if event.Description != "" {
+			writeLine(buffered, "DESCRIPTION:"+escapeText(event.Description))
+		}
+		if event.Location != "" {
+			writeLine(buffered, "LOCATION:"+escapeText(event.Location))
+		}
+		if event.Status != "" {
+			writeLine(buffered, "STATUS:"+event.Status)
+		}
+		writeLine(buffered, "END:VEVENT")
+	}
+
+	writeLine(buffered, "END:VCALENDAR")
+	return buffered.Flush()
+}
+
+// writeLine ends the line with CRLF and folds it so no line is longer than 75 octets, without splitting a UTF-8
+// character. Continuation lines start with a space.
+func writeLine(w *bufio.Writer, line string) {
+	limit := maxLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.WriteString(line[:cut])
+		w.WriteString("\r\n ")
+		line = line[cut:]
+		limit = maxLineOctets - 1 // The leading space counts
+	}
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
+
+var textEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+// escapeText escapes a TEXT value
+func escapeText(value string) string {
+	return textEscaper.Replace(value)
+}
@@ -0,0 +1,289 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // TZIDs from other calendars are looked up here, so don't rely on the host having zoneinfo
+)
+
+var (
+	ErrInvalidCalendar = errors.New("invalid iCalendar file")
+	ErrUnknownTimeZone = errors.New("unknown time zone")
+)
+
+// windowsTimeZones maps the Windows time zone names Outlook writes as TZIDs to IANA names, for the zones lessons are
+// most likely to be in
+var windowsTimeZones = map[string]string{
+	"GMT Standard Time":              "Europe/London",
+	"Greenwich Standard Time":        "Atlantic/Reykjavik",
+	"W. Europe Standard Time":        "Europe/Berlin",
+	"Central Europe Standard Time":   "Europe/Budapest",
+	"Romance Standard Time":          "Europe/Paris",
+	"Central European Standard Time": "Europe/Warsaw",
+	"E. Europe Standard Time":        "Europe/Chisinau",
+	"FLE Standard Time":              "Europe/Kiev",
+	"GTB Standard Time":              "Europe/Bucharest",
+	"Russian Standard Time":          "Europe/Moscow",
+	"Eastern Standard Time":          "America/New_York",
+	"Central Standard Time":          "America/Chicago",
+	"Mountain Standard Time":         "America/Denver",
+	"Pacific Standard Time":          "America/Los_Angeles",
+	"UTC":                            "UTC",
+}
+
+// Parse reads the VEVENTs of an iCalendar file. Times without a time zone are read in loc. Events are returned even
+// when some of their properties can't be read, an unreadable DTSTART leaves Start zero. A time in a TZID that can't be
+// found is left out too and the TZID goes in UnknownTimeZone, guessing the zone would put the lesson at the wrong time.
+func Parse(r io.Reader, loc *time.Location) ([]Event, error) {
+	lines, err := unfoldLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []Event{}
+	components := []string{}
+	var event *Event
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		name, params, value, ok := parseContentLine(line)
+		if !ok {
+			continue
+		}
+
+		switch name {
+		case "BEGIN":
+			components = append(components, strings.ToUpper(value))
+			if len(components) == 1 && components[0] != "VCALENDAR" {
+				return nil, ErrInvalidCalendar
+			}
+			if strings.EqualFold(value, "VEVENT") {
+				event = &Event{}
+			}
+			continue
+		case "END":
+			if len(components) == 0 || components[len(components)-1] != strings.ToUpper(value) {
+				return nil, ErrInvalidCalendar
+			}
+			components = components[:len(components)-1]
+			if strings.EqualFold(value, "VEVENT") && event != nil {
+				finishEvent(event)
+				events = append(events, *event)
+				event = nil
+			}
+			continue
+		}
+
+		// Properties of components inside the event, like VALARM, aren't the event's
+		if event == nil || components[len(components)-1] != "VEVENT" {
+			continue
+		}
+		readProperty(event, name, params, value, loc)
+	}
+
+	if len(components) != 0 {
+		return nil, ErrInvalidCalendar
+	}
+	return events, nil
+}
+
+// unfoldLines splits the file into content lines, joining the lines that continue the one before
+func unfoldLines(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	lines := []string{}
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(strings.TrimSpace(lines[0]), "BEGIN:VCALENDAR") {
+		return nil, ErrInvalidCalendar
+	}
+	return lines, nil
+}
+
+// parseContentLine splits "NAME;PARAM=value:value" up. Parameter values can be quoted and contain ":" and ";".
+func parseContentLine(line string) (string, map[string]string, string, bool) {
+	params := map[string]string{}
+	quoted := false
+	fieldStart := 0
+	name := ""
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == ';' || c == ':':
+			field := line[fieldStart:i]
+			if name == "" {
+				name = strings.ToUpper(field)
+			} else if key, value, found := strings.Cut(field, "="); found {
+				params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+			}
+			fieldStart = i + 1
+			if c == ':' {
+				return name, params, line[i+1:], name != ""
+			}
+		}
+	}
+	return "", nil, "", false
+}
+
+func readProperty(event *Event, name string, params map[string]string, value string, loc *time.Location) {
+	switch name {
+	case "UID":
+		event.UID = unescapeText(value)
+	case "SUMMARY":
+		event.Summary = unescapeText(value)
+	case "DESCRIPTION":
+		event.Description = unescapeText(value)
+	case "LOCATION":
+		event.Location = unescapeText(value)
+	case "STATUS":
+		event.Status = strings.ToUpper(strings.TrimSpace(value))
+	case "SEQUENCE":
+		event.Sequence, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	case "DTSTART":
+		if start, allDay, timeZone, err := parseEventTime(event, value, params, loc); err == nil {
+			event.Start, event.AllDay, event.TimeZone = start, allDay, timeZone
+		}
+	case "DTEND":
+		if end, _, _, err := parseEventTime(event, value, params, loc); err == nil {
+			event.End = end
+		}
+	case "DURATION":
+		// Applied once DTSTART is known, see finishEvent
+		if duration, err := parseDuration(value); err == nil {
+			event.duration = duration
+		}
+	case "RRULE":
+		event.RRule = strings.TrimSpace(value)
+	case "EXDATE":
+		for _, exDate := range strings.Split(value, ",") {
+			if t, _, _, err := parseEventTime(event, exDate, params, loc); err == nil {
+				event.ExDates = append(event.ExDates, t)
+			}
+		}
+	case "RECURRENCE-ID":
+		if t, _, _, err := parseEventTime(event, value, params, loc); err == nil {
+			event.RecurrenceID = t
+		}
+	case "ATTENDEE":
+		email := params["EMAIL"]
+		if len(value) > 7 && strings.EqualFold(value[:7], "mailto:") {
+			email = value[7:]
+		}
+		if email != "" {
+			event.Attendees = append(event.Attendees, strings.ToLower(strings.TrimSpace(email)))
+		}
+	}
+}
+
+// finishEvent works out the end from DURATION, or the default of a day for all day events and no time otherwise
+func finishEvent(event *Event) {
+	if event.Start.IsZero() {
+		return
+	}
+	switch {
+	case event.End.IsZero() && event.duration != 0:
+		event.End = event.Start.Add(event.duration)
+	case event.End.IsZero() && event.AllDay:
+		event.End = event.Start.AddDate(0, 0, 1)
+	case event.End.IsZero():
+		event.End = event.Start
+	}
+}
+
+// parseEventTime is parseDateTime that records an unknown TZID on the event
+func parseEventTime(event *Event, value string, params map[string]string, loc *time.Location) (time.Time, bool, string, error) {
+	t, allDay, timeZone, err := parseDateTime(value, params, loc)
+	if errors.Is(err, ErrUnknownTimeZone) && event.UnknownTimeZone == "" {
+		event.UnknownTimeZone = strings.TrimSpace(params["TZID"])
+	}
+	return t, allDay, timeZone, err
+}
+
+// parseDateTime reads a DATE or DATE-TIME value, returning whether it's a date and the name of its location
+func parseDateTime(value string, params map[string]string, loc *time.Location) (time.Time, bool, string, error) {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(params["VALUE"], "DATE") || len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, loc.String(), err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(dateTimeUTC, value)
+		return t, false, "UTC", err
+	}
+	if tzid, ok := params["TZID"]; ok {
+		found, ok := location(tzid)
+		if !ok {
+			return time.Time{}, false, "", fmt.Errorf("%w: %q", ErrUnknownTimeZone, tzid)
+		}
+		loc = found
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, loc.String(), err
+}
+
+// location finds a TZID, which some calendars write with a leading "/" and Outlook as a Windows time zone name
+func location(tzid string) (*time.Location, bool) {
+	tzid = strings.TrimPrefix(strings.TrimSpace(tzid), "/")
+	if name, ok := windowsTimeZones[tzid]; ok {
+		tzid = name
+	}
+	if tzid == "" || tzid == "Local" {
+		return nil, false
+	}
+	loc, err := time.LoadLocation(tzid)
+	return loc, err == nil
+}
+
+var durationPattern = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseDuration reads a DURATION such as "PT1H30M" or "P1D"
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	match := durationPattern.FindStringSubmatch(value)
+	if match == nil || strings.HasSuffix(value, "P") || strings.HasSuffix(value, "T") {
+		return 0, ErrInvalidCalendar
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var duration time.Duration
+	for i, unit := range units {
+		if match[i+2] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(match[i+2])
+		if err != nil {
+			return 0, ErrInvalidCalendar
+		}
+		duration += time.Duration(n) * unit
+	}
+	if match[1] == "-" {
+		duration = -duration
+	}
+	return duration, nil
+}
+
+var textUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+// unescapeText reads a TEXT value
+func unescapeText(value string) string {
+	return textUnescaper.Replace(value)
+}
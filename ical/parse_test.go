@@ -0,0 +1,259 @@
+package ical
+
+import (
+	"errors"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/recurrence"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseFixture parses a file in testdata with times without a time zone read in loc
+func parseFixture(t *testing.T, name string, loc *time.Location) map[string][]Event {
+	t.Helper()
+	file, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	events, err := Parse(file, loc)
+	if err != nil {
+		t.Fatalf("Parse(%s): %v", name, err)
+	}
+	byUID := map[string][]Event{}
+	for _, event := range events {
+		byUID[event.UID] = append(byUID[event.UID], event)
+	}
+	return byUID
+}
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("loading %s: %v", name, err)
+	}
+	return loc
+}
+
+func TestParseTimeZones(t *testing.T) {
+	tokyo := mustLoad(t, "Asia/Tokyo")
+	events := parseFixture(t, "tzid.ics", tokyo)
+
+	tests := []struct {
+		uid             string
+		start, end      time.Time
+		timeZone        string
+		unknownTimeZone string
+	}{
+		{
+			uid:      "iana@example.com",
+			start:    time.Date(2024, time.March, 5, 22, 0, 0, 0, time.UTC),
+			end:      time.Date(2024, time.March, 5, 23, 0, 0, 0, time.UTC),
+			timeZone: "America/New_York",
+		},
+		{
+			uid:      "windows@example.com",
+			start:    time.Date(2024, time.July, 10, 7, 0, 0, 0, time.UTC),
+			end:      time.Date(2024, time.July, 10, 7, 45, 0, 0, time.UTC),
+			timeZone: "Europe/Berlin",
+		},
+		{
+			uid:      "slash@example.com",
+			start:    time.Date(2024, time.January, 15, 16, 0, 0, 0, time.UTC),
+			end:      time.Date(2024, time.January, 15, 16, 30, 0, 0, time.UTC),
+			timeZone: "Europe/London",
+		},
+		{
+			uid:      "utc@example.com",
+			start:    time.Date(2024, time.February, 1, 12, 0, 0, 0, time.UTC),
+			end:      time.Date(2024, time.February, 1, 13, 0, 0, 0, time.UTC),
+			timeZone: "UTC",
+		},
+		{
+			uid:      "floating@example.com",
+			start:    time.Date(2024, time.February, 2, 1, 0, 0, 0, time.UTC),
+			end:      time.Date(2024, time.February, 2, 2, 0, 0, 0, time.UTC),
+			timeZone: "Asia/Tokyo",
+		},
+		{
+			// Not read in the fallback zone, that would quietly put the lesson at the wrong time
+			uid:             "unknown@example.com",
+			unknownTimeZone: "Customized Time Zone",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.uid, func(t *testing.T) {
+			if len(events[test.uid]) != 1 {
+				t.Fatalf("got %d events, want 1", len(events[test.uid]))
+			}
+			event := events[test.uid][0]
+			if !event.Start.Equal(test.start) || !event.End.Equal(test.end) {
+				t.Errorf("got %v to %v, want %v to %v", event.Start, event.End, test.start, test.end)
+			}
+			if event.TimeZone != test.timeZone {
+				t.Errorf("TimeZone = %q, want %q", event.TimeZone, test.timeZone)
+			}
+			if event.UnknownTimeZone != test.unknownTimeZone {
+				t.Errorf("UnknownTimeZone = %q, want %q", event.UnknownTimeZone, test.unknownTimeZone)
+			}
+		})
+	}
+}
+
+func TestParseAllDayEvents(t *testing.T) {
+	london := mustLoad(t, "Europe/London")
+	events := parseFixture(t, "allday.ics", london)
+
+	tests := []struct {
+		uid        string
+		start, end time.Time
+	}{
+		{"holiday@example.com", time.Date(2024, time.August, 12, 0, 0, 0, 0, london), time.Date(2024, time.August, 17, 0, 0, 0, 0, london)},
+		// Without DTEND an all day event lasts the day
+		{"birthday@example.com", time.Date(2024, time.June, 1, 0, 0, 0, 0, london), time.Date(2024, time.June, 2, 0, 0, 0, 0, london)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.uid, func(t *testing.T) {
+			if len(events[test.uid]) != 1 {
+				t.Fatalf("got %d events, want 1", len(events[test.uid]))
+			}
+			event := events[test.uid][0]
+			if !event.AllDay {
+				t.Error("AllDay = false, want true")
+			}
+			if !event.Start.Equal(test.start) || !event.End.Equal(test.end) {
+				t.Errorf("got %v to %v, want %v to %v", event.Start, event.End, test.start, test.end)
+			}
+		})
+	}
+}
+
+func TestParseRecurringEvents(t *testing.T) {
+	london := mustLoad(t, "Europe/London")
+	events := parseFixture(t, "recurring.ics", time.UTC)
+
+	weekly := events["weekly@example.com"]
+	if len(weekly) != 2 {
+		t.Fatalf("got %d events for the weekly UID, want the series and its moved occurrence", len(weekly))
+	}
+	series, moved := weekly[0], weekly[1]
+
+	t.Run("series", func(t *testing.T) {
+		if want := "Weekly piano lesson with a summary long enough that the calendar folded it"; series.Summary != want {
+			t.Errorf("Summary = %q, want the unfolded %q", series.Summary, want)
+		}
+		if want := "FREQ=WEEKLY;BYDAY=TU;UNTIL=20241217T235959Z"; series.RRule != want {
+			t.Errorf("RRule = %q, want %q", series.RRule, want)
+		}
+		if want := time.Date(2024, time.September, 10, 17, 0, 0, 0, london); !series.Start.Equal(want) {
+			t.Errorf("Start = %v, want %v", series.Start, want)
+		}
+		if series.TimeZone != "Europe/London" {
+			t.Errorf("TimeZone = %q, want Europe/London", series.TimeZone)
+		}
+		if !series.RecurrenceID.IsZero() {
+			t.Errorf("RecurrenceID = %v, want zero", series.RecurrenceID)
+		}
+		if len(series.Attendees) != 1 || series.Attendees[0] != "sam@example.com" {
+			t.Errorf("Attendees = %v, want [sam@example.com]", series.Attendees)
+		}
+		if series.Description != "" {
+			t.Errorf("Description = %q, the VALARM's description isn't the event's", series.Description)
+		}
+	})
+
+	t.Run("EXDATE", func(t *testing.T) {
+		// A list in one EXDATE, and a second EXDATE, across the end of summer time
+		want := []time.Time{
+			time.Date(2024, time.October, 22, 16, 0, 0, 0, time.UTC),
+			time.Date(2024, time.October, 29, 17, 0, 0, 0, time.UTC),
+			time.Date(2024, time.December, 24, 17, 0, 0, 0, time.UTC),
+		}
+		if len(series.ExDates) != len(want) {
+			t.Fatalf("ExDates = %v, want %v", series.ExDates, want)
+		}
+		for i := range want {
+			if !series.ExDates[i].Equal(want[i]) {
+				t.Errorf("ExDates[%d] = %v, want %v", i, series.ExDates[i], want[i])
+			}
+		}
+	})
+
+	t.Run("RECURRENCE-ID", func(t *testing.T) {
+		if want := time.Date(2024, time.November, 5, 17, 0, 0, 0, london); !moved.RecurrenceID.Equal(want) {
+			t.Errorf("RecurrenceID = %v, want %v", moved.RecurrenceID, want)
+		}
+		if want := time.Date(2024, time.November, 6, 17, 0, 0, 0, london); !moved.Start.Equal(want) {
+			t.Errorf("Start = %v, want %v", moved.Start, want)
+		}
+		if moved.Sequence != 2 {
+			t.Errorf("Sequence = %d, want 2", moved.Sequence)
+		}
+	})
+
+	t.Run("WKST=SU", func(t *testing.T) {
+		// Outlook and Google Calendar start their weeks on Sunday
+		events := events["outlook@example.com"]
+		if len(events) != 1 {
+			t.Fatalf("got %d events, want 1", len(events))
+		}
+		loc := mustLoad(t, events[0].TimeZone)
+		rule, err := recurrence.Parse(events[0].RRule, loc)
+		if err != nil {
+			t.Fatalf("recurrence.Parse(%q): %v", events[0].RRule, err)
+		}
+		start := events[0].Start.In(loc)
+		got := rule.Occurrences(start, start, start.AddDate(1, 0, 0))
+		want := []time.Time{
+			time.Date(2024, time.September, 9, 16, 0, 0, 0, london),
+			time.Date(2024, time.September, 16, 16, 0, 0, 0, london),
+			time.Date(2024, time.September, 23, 16, 0, 0, 0, london),
+			time.Date(2024, time.September, 30, 16, 0, 0, 0, london),
+			time.Date(2024, time.October, 7, 16, 0, 0, 0, london),
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		for i := range want {
+			if !got[i].Equal(want[i]) {
+				t.Errorf("occurrence %d is %v, want %v", i, got[i], want[i])
+			}
+		}
+	})
+
+	t.Run("EXDATE in an unknown time zone", func(t *testing.T) {
+		events := events["exdate-unknown@example.com"]
+		if len(events) != 1 {
+			t.Fatalf("got %d events, want 1", len(events))
+		}
+		if events[0].UnknownTimeZone != "Mars/Olympus_Mons" {
+			t.Errorf("UnknownTimeZone = %q, want Mars/Olympus_Mons", events[0].UnknownTimeZone)
+		}
+		if len(events[0].ExDates) != 0 {
+			t.Errorf("ExDates = %v, want none", events[0].ExDates)
+		}
+	})
+}
+
+func TestParseInvalidCalendars(t *testing.T) {
+	tests := map[string]string{
+		"empty":             "",
+		"not a calendar":    "BEGIN:VEVENT\r\nEND:VEVENT\r\n",
+		"unclosed":          "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a\r\n",
+		"mismatched END":    "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VTODO\r\nEND:VCALENDAR\r\n",
+		"second top level ": "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VEVENT\r\n",
+	}
+	for name, calendar := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse(strings.NewReader(calendar), time.UTC); !errors.Is(err, ErrInvalidCalendar) {
+				t.Errorf("Parse = %v, want ErrInvalidCalendar", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package mailer
+
+import (
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileMailer writes each email to its own .eml file in Dir instead of sending it
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(message types.EmailMessage) error {
+	if err := os.MkdirAll(m.Dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	fileName := fmt.Sprintf("%d_%s.eml", time.Now().UTC().UnixNano(), filepath.Base(message.To))
+	return os.WriteFile(filepath.Join(m.Dir, fileName), formatMessage("noreply@localhost", message), 0600)
+}
+
+// MemoryMailerLimit is how many emails a MemoryMailer keeps, the oldest are dropped after that
+const MemoryMailerLimit = 100
+
+// MemoryMailer keeps the last MemoryMailerLimit emails it is given so they can be inspected later
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []types.EmailMessage
+}
+
+func (m *MemoryMailer) Send(message types.EmailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Println("Email to", message.To, "with subject", message.Subject, "was kept in memory and not sent")
+	m.sent = append(m.sent, message)
+	if len(m.sent) > MemoryMailerLimit {
+		m.sent = append([]types.EmailMessage(nil), m.sent[len(m.sent)-MemoryMailerLimit:]...)
+	}
+	return nil
+}
+
+// Sent returns a copy of the emails kept so far
+func (m *MemoryMailer) Sent() []types.EmailMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]types.EmailMessage(nil), m.sent...)
+}
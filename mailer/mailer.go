@@ -0,0 +1,59 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"os"
+)
+
+// Mailer sends emails. SMTPMailer is used in production, FileMailer and MemoryMailer let flows like password
+// resets be checked without a mail server.
+type Mailer interface {
+	Send(message types.EmailMessage) error
+}
+
+// Default is the Mailer used by the handlers, set it with NewFromEnv when the server starts
+var Default Mailer = &MemoryMailer{}
+
+// NewFromEnv picks a Mailer based on the MAILER env variable: "smtp", "file" or "memory". There's no default, so a
+// server that was never given a mail server fails at startup instead of quietly dropping every email. "file" and
+// "memory" are for development and testing.
+func NewFromEnv() (Mailer, error) {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		if os.Getenv("SMTP_HOST") == "" || os.Getenv("MAIL_FROM") == "" {
+			return nil, errors.New("MAILER is smtp but SMTP_HOST or MAIL_FROM isn't set")
+		}
+		return &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "./mail"
+		}
+		fmt.Println("MAILER is file, emails are written to", dir, "and not sent")
+		return &FileMailer{Dir: dir}, nil
+	case "memory":
+		fmt.Println("MAILER is memory, emails are not sent")
+		return &MemoryMailer{}, nil
+	case "":
+		return nil, errors.New("MAILER isn't set, use smtp, or file or memory for development")
+	}
+
+	return nil, fmt.Errorf("unknown MAILER %q, use smtp, or file or memory for development", os.Getenv("MAILER"))
+}
+
+// Send sends the message with the Default Mailer
+func Send(message types.EmailMessage) error {
+	return Default.Send(message)
+}
@@ -0,0 +1,49 @@
+package mailer
+
+import (
+	"fmt"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/types"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// SMTPMailer sends emails through an SMTP server using PLAIN auth
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(message types.EmailMessage) error {
+	if m.Host == "" || m.From == "" {
+		return fmt.Errorf("SMTP mailer is not configured, SMTP_HOST and MAIL_FROM are required")
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	err := smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{message.To}, formatMessage(m.From, message))
+	if err != nil {
+		fmt.Println("Error sending email to", message.To, ":", err)
+		return err
+	}
+
+	return nil
+}
+
+func formatMessage(from string, message types.EmailMessage) []byte {
+	var builder strings.Builder
+	builder.WriteString("From: " + from + "\r\n")
+	builder.WriteString("To: " + message.To + "\r\n")
+	builder.WriteString("Subject: " + message.Subject + "\r\n")
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n")
+	builder.WriteString("\r\n")
+	builder.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	return []byte(builder.String())
+}
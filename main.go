@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/auth"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/chat"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/db"
 	"io.winapps.aspirewithalina.aspirewithalinaserver/handlers"
+	authHandlers "io.winapps.aspirewithalina.aspirewithalinaserver/handlers/auth"
 	chatsHandlers "io.winapps.aspirewithalina.aspirewithalinaserver/handlers/chats"
 	lessonsHandlers "io.winapps.aspirewithalina.aspirewithalinaserver/handlers/lessons"
 	studentsHandlers "io.winapps.aspirewithalina.aspirewithalinaserver/handlers/students"
 	teachersHandlers "io.winapps.aspirewithalina.aspirewithalinaserver/handlers/teachers"
+	"io.winapps.aspirewithalina.aspirewithalinaserver/mailer"
 	"log"
 	"net/http"
 	"time"
@@ -33,11 +37,31 @@ func main() {
 		}
 	}()
 
+	if err := db.EnsureIndexes(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	if mailer.Default, err = mailer.NewFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	chat.DefaultStore = chat.MongoStore{}
+	chat.SubscribeToUserEvents()
+	chat.StartChatUserReconciliation(time.Hour)
+	chat.StartAttachmentCleanupJob(time.Hour)
+	handlers.StartAccountPurgeJob(time.Hour)
+	handlers.StartDataExportJob(time.Hour)
+	lessonsHandlers.StartLessonSeriesJob(24 * time.Hour)
+
 	// Setup HTTPS server handlers
+	// Routes wrapped in auth.RequireAuth need an "Authorization: Bearer <access_token>" header from one of the login handlers,
+	// auth.RequireRole additionally limits the route to the given roles. Ownership is checked inside the handlers.
 	// Registration handlers
-	http.HandleFunc("/registration/create", handlers.CreateRegistrationHandler)
+	http.HandleFunc("/registration/create", auth.RequireRole(handlers.CreateRegistrationHandler, auth.RoleTeacher, auth.RoleAdmin))
+	http.HandleFunc("/registrations", auth.RequireRole(handlers.ListRegistrationsHandler, auth.RoleTeacher, auth.RoleAdmin))
+	http.HandleFunc("/registration/revoke", auth.RequireRole(handlers.RevokeRegistrationHandler, auth.RoleTeacher, auth.RoleAdmin))
 	http.HandleFunc("/validate/registration", handlers.ValidateRegistrationHandler)
 	http.HandleFunc("/verifications/create", handlers.CreateVerificationHandler)
+	http.HandleFunc("/verifications/confirm", handlers.ConfirmVerificationHandler)
 
 	// Login handlers
 	http.HandleFunc("/validate/login", studentsHandlers.ValidateLoginHandler)
@@ -45,37 +69,87 @@ func main() {
 	http.HandleFunc("/validate/login/google", studentsHandlers.ValidateGoogleLoginHandler)
 	http.HandleFunc("/teachers/validate/login", teachersHandlers.ValidateTeacherLoginHandler)
 
+	// Session handlers
+	http.HandleFunc("/auth/refresh", authHandlers.RefreshTokenHandler)
+	http.HandleFunc("/auth/logout", authHandlers.LogoutHandler)
+	http.HandleFunc("/auth/logout-all", auth.RequireAuth(authHandlers.LogoutAllHandler))
+	http.HandleFunc("/auth/password/forgot", authHandlers.ForgotPasswordHandler)
+	http.HandleFunc("/auth/password/reset", authHandlers.ResetPasswordHandler)
+	http.HandleFunc("/auth/unlock", auth.RequireRole(authHandlers.UnlockAccountHandler, auth.RoleAdmin))
+	http.HandleFunc("/auth/totp/enroll", auth.RequireAuth(authHandlers.TOTPEnrollHandler))
+	http.HandleFunc("/auth/totp/confirm", auth.RequireAuth(authHandlers.TOTPConfirmHandler))
+	http.HandleFunc("/auth/totp/disable", auth.RequireAuth(authHandlers.TOTPDisableHandler))
+
 	// Teacher CRUD handlers
-	http.HandleFunc("/teacher", teachersHandlers.GetTeacherHandler)
-	http.HandleFunc("/teachers", teachersHandlers.ListTeachersHandler)
-	http.HandleFunc("/teachers/create", teachersHandlers.CreateTeacherHandler)
-	http.HandleFunc("/teachers/delete", teachersHandlers.DeleteTeacherHandler)
-	http.HandleFunc("/teachers/update", teachersHandlers.UpdateTeacherInfoHandler)
+	http.HandleFunc("/teacher", auth.RequireAuth(teachersHandlers.GetTeacherHandler))
+	http.HandleFunc("/teachers", auth.RequireAuth(teachersHandlers.ListTeachersHandler))
+	http.HandleFunc("/teachers/create", auth.RequireRole(teachersHandlers.CreateTeacherHandler, auth.RoleAdmin))
+	http.HandleFunc("/teachers/delete", auth.RequireRole(teachersHandlers.DeleteTeacherHandler, auth.RoleAdmin))
+	http.HandleFunc("/teachers/restore", auth.RequireRole(teachersHandlers.RestoreTeacherHandler, auth.RoleAdmin))
+	http.HandleFunc("/teachers/update", auth.RequireAuth(teachersHandlers.UpdateTeacherInfoHandler))
+	http.HandleFunc("/teachers/availability", auth.RequireAuth(teachersHandlers.GetAvailabilityHandler))
+	http.HandleFunc("/teachers/availability/update", auth.RequireRole(teachersHandlers.UpdateAvailabilityHandler, auth.RoleTeacher, auth.RoleAdmin))
+	http.HandleFunc("/teachers/export", auth.RequireRole(teachersHandlers.ExportTeacherHandler, auth.RoleTeacher, auth.RoleAdmin))
 
 	// Student CRUD handlers
 	http.HandleFunc("/students/create", studentsHandlers.CreateNewStudentHandler)
-	http.HandleFunc("/students/update", studentsHandlers.UpdateStudentInfoHandler)
-	http.HandleFunc("/students", studentsHandlers.ListStudentsHandler)
-	http.HandleFunc("/student", studentsHandlers.GetStudentHandler)
-	http.HandleFunc("/students/update/image", handlers.HandleUploadProfileImage)
-	http.HandleFunc("/students/delete", studentsHandlers.HandleDeleteStudent)
+	http.HandleFunc("/students/update", auth.RequireAuth(studentsHandlers.UpdateStudentInfoHandler))
+	http.HandleFunc("/students", auth.RequireRole(studentsHandlers.ListStudentsHandler, auth.RoleTeacher, auth.RoleAdmin))
+	http.HandleFunc("/student", auth.RequireAuth(studentsHandlers.GetStudentHandler))
+	http.HandleFunc("/students/update/image", auth.RequireAuth(handlers.HandleUploadProfileImage))
+	http.HandleFunc("/students/delete", auth.RequireAuth(studentsHandlers.HandleDeleteStudent))
+	http.HandleFunc("/students/restore", auth.RequireRole(studentsHandlers.RestoreStudentHandler, auth.RoleTeacher, auth.RoleAdmin))
+	http.HandleFunc("/students/export", auth.RequireAuth(studentsHandlers.ExportStudentHandler))
+	http.HandleFunc("/accounts/deleted", auth.RequireRole(handlers.ListDeletedAccountsHandler, auth.RoleAdmin))
+	http.HandleFunc("/exports/status", auth.RequireAuth(handlers.GetDataExportStatusHandler))
+	http.HandleFunc("/exports/download", auth.RequireAuth(handlers.DownloadDataExportHandler))
 
 	// Lessons CRUD handlers
-	http.HandleFunc("/lessons/create", lessonsHandlers.CreateLessonHandler)
-	http.HandleFunc("/lessons/update", lessonsHandlers.UpdateLessonHandler)
-	http.HandleFunc("/lessons/delete", lessonsHandlers.DeleteLessonHandler)
-	http.HandleFunc("/lessons", lessonsHandlers.ListLessonsHandler)
+	http.HandleFunc("/lessons/create", auth.RequireRole(lessonsHandlers.CreateLessonHandler, auth.RoleTeacher, auth.RoleAdmin))
+	http.HandleFunc("/lessons/update", auth.RequireAuth(lessonsHandlers.UpdateLessonHandler))
+	http.HandleFunc("/lessons/delete", auth.RequireAuth(lessonsHandlers.DeleteLessonHandler))
+	http.HandleFunc("/lessons", auth.RequireAuth(lessonsHandlers.ListLessonsHandler))
+	http.HandleFunc("/lessons/slots", auth.RequireAuth(lessonsHandlers.ListSlotsHandler))
+	http.HandleFunc("/lessons/book", auth.RequireRole(lessonsHandlers.BookLessonHandler, auth.RoleStudent))
+	http.HandleFunc("/lessons/series/create", auth.RequireRole(lessonsHandlers.CreateLessonSeriesHandler, auth.RoleTeacher, auth.RoleAdmin))
+	http.HandleFunc("/lessons/series/update", auth.RequireAuth(lessonsHandlers.UpdateLessonSeriesHandler))
+	http.HandleFunc("/lessons/series/delete", auth.RequireAuth(lessonsHandlers.DeleteLessonSeriesHandler))
+	http.HandleFunc("/lessons/series", auth.RequireAuth(lessonsHandlers.GetLessonSeriesHandler))
+	http.HandleFunc("/lessons/import", auth.RequireRole(lessonsHandlers.ImportLessonsHandler, auth.RoleTeacher, auth.RoleAdmin))
+
+	// Calendar feed handlers. The feed itself is opened by calendar apps with the token in its URL.
+	http.HandleFunc("/calendar/feed/create", auth.RequireAuth(lessonsHandlers.CreateCalendarFeedHandler))
+	http.HandleFunc("/calendar/feed/delete", auth.RequireAuth(lessonsHandlers.RevokeCalendarFeedHandler))
+	http.HandleFunc("/calendar/feed.ics", lessonsHandlers.CalendarFeedHandler)
 
 	// Chats/Messaging CRUD handlers
-	http.HandleFunc("/chats/create", chatsHandlers.CreateChatRoomHandler)
-	http.HandleFunc("/chats/delete", chatsHandlers.DeleteChatRoomHandler)
-	http.HandleFunc("/chats", chatsHandlers.ListChatRoomsHandler)
-	http.HandleFunc("/messages/send", chatsHandlers.SendMessageHandler)
-	http.HandleFunc("/messages/delete", chatsHandlers.DeleteMessageHandler)
-	http.HandleFunc("/messages/update", chatsHandlers.UpdateMessageHandler)
-	http.HandleFunc("/messages", chatsHandlers.ListMessagesHandler)
-	http.HandleFunc("/chatUsers/create", chatsHandlers.CreateUserHandler)
-	http.HandleFunc("/chatUsers/update", chatsHandlers.UpdateUserHandler)
+	http.HandleFunc("/chats/create", auth.RequireAuth(chatsHandlers.CreateChatRoomHandler))
+	http.HandleFunc("/chats/delete", auth.RequireAuth(chatsHandlers.DeleteChatRoomHandler))
+	http.HandleFunc("/chats", auth.RequireAuth(chatsHandlers.ListChatRoomsHandler))
+	http.HandleFunc("/chats/keys", auth.RequireAuth(chatsHandlers.GetChatRoomKeysHandler))
+	http.HandleFunc("/chats/members/add", auth.RequireAuth(chatsHandlers.AddChatMemberHandler))
+	http.HandleFunc("/chats/members/remove", auth.RequireAuth(chatsHandlers.RemoveChatMemberHandler))
+	http.HandleFunc("/chats/receipts/update", auth.RequireAuth(chatsHandlers.UpdateReadStateHandler))
+	http.HandleFunc("/chats/receipts", auth.RequireAuth(chatsHandlers.ListReadStatesHandler))
+	http.HandleFunc("/chats/unread", auth.RequireAuth(chatsHandlers.ListUnreadCountsHandler))
+	http.HandleFunc("/chats/members/mute", auth.RequireAuth(chatsHandlers.MuteChatMemberHandler))
+	http.HandleFunc("/chats/members/unmute", auth.RequireAuth(chatsHandlers.UnmuteChatMemberHandler))
+	http.HandleFunc("/chats/members/ban", auth.RequireAuth(chatsHandlers.BanChatMemberHandler))
+	http.HandleFunc("/chats/members/unban", auth.RequireAuth(chatsHandlers.UnbanChatMemberHandler))
+	http.HandleFunc("/chats/wordFilter", auth.RequireAuth(chatsHandlers.WordFilterHandler))
+	http.HandleFunc("/chats/attachments/upload", auth.RequireAuth(chatsHandlers.UploadAttachmentHandler))
+	http.HandleFunc("/chats/attachments", auth.RequireAuth(chatsHandlers.GetAttachmentHandler))
+	http.HandleFunc("/messages/send", auth.RequireAuth(chatsHandlers.SendMessageHandler))
+	http.HandleFunc("/messages/delete", auth.RequireAuth(chatsHandlers.DeleteMessageHandler))
+	http.HandleFunc("/messages/update", auth.RequireAuth(chatsHandlers.UpdateMessageHandler))
+	http.HandleFunc("/messages/search", auth.RequireAuth(chatsHandlers.SearchMessagesHandler))
+	http.HandleFunc("/messages/report", auth.RequireAuth(chatsHandlers.ReportMessageHandler))
+	http.HandleFunc("/moderation/reports", auth.RequireRole(chatsHandlers.ListReportsHandler, auth.RoleTeacher, auth.RoleAdmin))
+	http.HandleFunc("/moderation/reports/resolve", auth.RequireRole(chatsHandlers.ResolveReportHandler, auth.RoleTeacher, auth.RoleAdmin))
+	http.HandleFunc("/messages", auth.RequireAuth(chatsHandlers.ListMessagesHandler))
+	http.HandleFunc("/chatUsers/create", auth.RequireAuth(chatsHandlers.CreateUserHandler))
+	http.HandleFunc("/chatUsers/update", auth.RequireAuth(chatsHandlers.UpdateUserHandler))
+	http.HandleFunc("/ws", auth.RequireAuth(chatsHandlers.WebSocketHandler))
 
 	// Serve profile images
 	http.Handle("/uploads/profileImages/", http.StripPrefix("/uploads/profileImages", http.FileServer(http.Dir("./uploads/profileImages"))))
@@ -102,7 +176,7 @@ func enableCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
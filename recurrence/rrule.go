@@ -0,0 +1,377 @@
+package recurrence
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // Series are expanded in the teacher's time zone, so don't rely on the host having zoneinfo
+)
+
+// Rule is the subset of an RFC 5545 recurrence rule lessons use: FREQ of DAILY, WEEKLY, MONTHLY or YEARLY, with
+// INTERVAL, COUNT, UNTIL, BYDAY, BYMONTHDAY and WKST. Occurrences keep the wall clock time of the series start in its
+// location, so a 17:00 lesson stays at 17:00 across daylight saving changes.
+type Rule struct {
+	Freq       string
+	Interval   int
+	Count      int       // 0 when the rule isn't limited by a count
+	Until      time.Time // Zero when the rule isn't limited by a date, inclusive otherwise
+	ByDay      []Weekday
+	ByMonthDay []int
+	WeekStart  time.Weekday // Only changes WEEKLY rules with an INTERVAL, Parse makes it Monday when there's no WKST
+}
+
+// Weekday is a BYDAY entry. N is the ordinal inside the month for MONTHLY rules, e.g. 2 for "2TU" or -1 for "-1FR",
+// and 0 for every such weekday.
+type Weekday struct {
+	Day time.Weekday
+	N   int
+}
+
+const (
+	Daily   = "DAILY"
+	Weekly  = "WEEKLY"
+	Monthly = "MONTHLY"
+	Yearly  = "YEARLY"
+)
+
+var ErrInvalidRule = errors.New("invalid recurrence rule")
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// Parse reads a rule such as "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=20", with or without the "RRULE:" prefix. An UNTIL
+// without a trailing Z is read in loc.
+func Parse(value string, loc *time.Location) (Rule, error) {
+	value = strings.TrimSpace(value)
+	if len(value) >= 6 && strings.EqualFold(value[:6], "RRULE:") {
+		value = value[6:]
+	}
+
+	rule := Rule{Interval: 1, WeekStart: time.Monday}
+	for _, part := range strings.Split(value, ";") {
+		if part == "" {
+			continue
+		}
+		name, partValue, ok := strings.Cut(part, "=")
+		if !ok {
+			return Rule{}, fmt.Errorf("%w: %q is not NAME=VALUE", ErrInvalidRule, part)
+		}
+
+		var err error
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(partValue)
+			if rule.Freq != Daily && rule.Freq != Weekly && rule.Freq != Monthly && rule.Freq != Yearly {
+				return Rule{}, fmt.Errorf("%w: FREQ must be DAILY, WEEKLY, MONTHLY or YEARLY", ErrInvalidRule)
+			}
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(partValue)
+			if err != nil || rule.Interval <= 0 {
+				return Rule{}, fmt.Errorf("%w: INTERVAL must be a positive number", ErrInvalidRule)
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(partValue)
+			if err != nil || rule.Count <= 0 {
+				return Rule{}, fmt.Errorf("%w: COUNT must be a positive number", ErrInvalidRule)
+			}
+		case "UNTIL":
+			rule.Until, err = parseUntil(partValue, loc)
+			if err != nil {
+				return Rule{}, fmt.Errorf("%w: UNTIL must look like 20060102T150405Z", ErrInvalidRule)
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(partValue, ",") {
+				weekday, err := parseWeekday(day)
+				if err != nil {
+					return Rule{}, err
+				}
+				if !slices.Contains(rule.ByDay, weekday) {
+					rule.ByDay = append(rule.ByDay, weekday)
+				}
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(partValue, ",") {
+				monthDay, err := strconv.Atoi(day)
+				if err != nil || monthDay == 0 || monthDay < -31 || monthDay > 31 {
+					return Rule{}, fmt.Errorf("%w: BYMONTHDAY must be between 1 and 31 or -31 and -1", ErrInvalidRule)
+				}
+				if !slices.Contains(rule.ByMonthDay, monthDay) {
+					rule.ByMonthDay = append(rule.ByMonthDay, monthDay)
+				}
+			}
+		case "WKST":
+			// Outlook and Google Calendar write WKST=SU, it only matters to WEEKLY rules that skip weeks
+			day, ok := weekdayCodes[strings.ToUpper(partValue)]
+			if !ok {
+				return Rule{}, fmt.Errorf("%w: %q is not a WKST weekday", ErrInvalidRule, partValue)
+			}
+			rule.WeekStart = day
+		default:
+			return Rule{}, fmt.Errorf("%w: %s is not supported", ErrInvalidRule, strings.ToUpper(name))
+		}
+	}
+
+	if rule.Freq == "" {
+		return Rule{}, fmt.Errorf("%w: FREQ is required", ErrInvalidRule)
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return Rule{}, fmt.Errorf("%w: COUNT and UNTIL can't be used together", ErrInvalidRule)
+	}
+	for _, weekday := range rule.ByDay {
+		if weekday.N != 0 && rule.Freq != Monthly {
+			return Rule{}, fmt.Errorf("%w: BYDAY ordinals like 2TU are only supported with FREQ=MONTHLY", ErrInvalidRule)
+		}
+	}
+	if len(rule.ByMonthDay) > 0 && rule.Freq == Weekly {
+		return Rule{}, fmt.Errorf("%w: BYMONTHDAY can't be used with FREQ=WEEKLY", ErrInvalidRule)
+	}
+	if rule.Freq == Yearly && (len(rule.ByDay) > 0 || len(rule.ByMonthDay) > 0) {
+		return Rule{}, fmt.Errorf("%w: FREQ=YEARLY only repeats on the start's date", ErrInvalidRule)
+	}
+
+	return rule, nil
+}
+
+func parseUntil(value string, loc *time.Location) (time.Time, error) {
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse("20060102T150405Z", value)
+	}
+	if len(value) == len("20060102") {
+		// A date on its own includes the whole day
+		day, err := time.ParseInLocation("20060102", value, loc)
+		return day.AddDate(0, 0, 1).Add(-time.Second), err
+	}
+	return time.ParseInLocation("20060102T150405", value, loc)
+}
+
+func parseWeekday(value string) (Weekday, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if len(value) < 2 {
+		return Weekday{}, fmt.Errorf("%w: %q is not a BYDAY weekday", ErrInvalidRule, value)
+	}
+
+	day, ok := weekdayCodes[value[len(value)-2:]]
+	if !ok {
+		return Weekday{}, fmt.Errorf("%w: %q is not a BYDAY weekday", ErrInvalidRule, value)
+	}
+	weekday := Weekday{Day: day}
+	if ordinal := value[:len(value)-2]; ordinal != "" {
+		n, err := strconv.Atoi(ordinal)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return Weekday{}, fmt.Errorf("%w: %q has an invalid ordinal", ErrInvalidRule, value)
+		}
+		weekday.N = n
+	}
+	return weekday, nil
+}
+
+// String writes the rule back out without the "RRULE:" prefix, UNTIL in UTC
+func (r Rule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, weekday := range r.ByDay {
+			days[i] = strings.ToUpper(weekday.Day.String()[:2])
+			if weekday.N != 0 {
+				days[i] = strconv.Itoa(weekday.N) + days[i]
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		days := make([]string, len(r.ByMonthDay))
+		for i, monthDay := range r.ByMonthDay {
+			days[i] = strconv.Itoa(monthDay)
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if r.Freq == Weekly && r.Interval > 1 && r.WeekStart != time.Monday {
+		parts = append(parts, "WKST="+strings.ToUpper(r.WeekStart.String()[:2]))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Occurrences returns the occurrences of a series starting at start that fall in [from, to), in order and each only
+// once. COUNT is counted from start, so it holds however late from is. Occurrences before start never happen.
+func (r Rule) Occurrences(start, from, to time.Time) []time.Time {
+	occurrences := []time.Time{}
+	count := 0
+	var previous time.Time
+
+	for period := 0; ; period++ {
+		periodStart, candidates := r.period(start, period*r.Interval)
+		if !periodStart.Before(to) {
+			return occurrences
+		}
+
+		for _, candidate := range candidates {
+			// A rule built by hand can still name the same day twice, e.g. BYDAY=MO,MO
+			if candidate.Before(start) || candidate.Equal(previous) {
+				continue
+			}
+			previous = candidate
+			count++
+			if r.Count > 0 && count > r.Count {
+				return occurrences
+			}
+			if !r.Until.IsZero() && candidate.After(r.Until) {
+				return occurrences
+			}
+			if !candidate.Before(to) {
+				return occurrences
+			}
+			if !candidate.Before(from) {
+				occurrences = append(occurrences, candidate)
+			}
+		}
+	}
+}
+
+// Matches reports whether t is one of the rule's occurrences for a series starting at start
+func (r Rule) Matches(start, t time.Time) bool {
+	for _, occurrence := range r.Occurrences(start, t, t.Add(time.Second)) {
+		if occurrence.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// period returns the first day of the nth period after the one start is in, and the candidate occurrences in it
+func (r Rule) period(start time.Time, n int) (time.Time, []time.Time) {
+	loc := start.Location()
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, start.Hour(), start.Minute(), start.Second(), 0, loc)
+	}
+	startDay := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+
+	switch r.Freq {
+	case Daily:
+		day := startDay.AddDate(0, 0, n)
+		if !r.matchesDay(day) {
+			return day, nil
+		}
+		return day, []time.Time{at(day.Year(), day.Month(), day.Day())}
+
+	case Weekly:
+		// Which week a day falls in depends on WKST, so with an INTERVAL it decides which days are skipped
+		sinceWeekStart := func(day time.Weekday) int { return (int(day) - int(r.WeekStart) + 7) % 7 }
+		weekStart := startDay.AddDate(0, 0, -sinceWeekStart(start.Weekday())+7*n)
+		days := r.ByDay
+		if len(days) == 0 {
+			days = []Weekday{{Day: start.Weekday()}}
+		}
+		candidates := []time.Time{}
+		for _, weekday := range days {
+			day := weekStart.AddDate(0, 0, sinceWeekStart(weekday.Day))
+			candidates = append(candidates, at(day.Year(), day.Month(), day.Day()))
+		}
+		sortTimes(candidates)
+		return weekStart, candidates
+
+	case Monthly:
+		first := time.Date(start.Year(), start.Month()+time.Month(n), 1, 0, 0, 0, 0, loc)
+		daysInMonth := first.AddDate(0, 1, -1).Day()
+		candidates := []time.Time{}
+		for day := 1; day <= daysInMonth; day++ {
+			date := time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, loc)
+			if r.matchesMonthDay(date, daysInMonth, start.Day()) {
+				candidates = append(candidates, at(first.Year(), first.Month(), day))
+			}
+		}
+		return first, candidates
+
+	default:
+		year := start.Year() + n
+		first := time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+		// A series started on the 29th of February only happens in leap years
+		if date := time.Date(year, start.Month(), start.Day(), 0, 0, 0, 0, loc); date.Day() != start.Day() {
+			return first, nil
+		}
+		return first, []time.Time{at(year, start.Month(), start.Day())}
+	}
+}
+
+func (r Rule) matchesDay(day time.Time) bool {
+	if len(r.ByDay) > 0 && !containsWeekday(r.ByDay, day.Weekday()) {
+		return false
+	}
+	if len(r.ByMonthDay) > 0 {
+		daysInMonth := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, day.Location()).Day()
+		if !containsMonthDay(r.ByMonthDay, day.Day(), daysInMonth) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesMonthDay applies BYMONTHDAY and BYDAY inside a month. Without either, the series repeats on the start's day
+// of the month and skips months that don't have it.
+func (r Rule) matchesMonthDay(date time.Time, daysInMonth, startDay int) bool {
+	if len(r.ByMonthDay) == 0 && len(r.ByDay) == 0 {
+		return date.Day() == startDay
+	}
+	if len(r.ByMonthDay) > 0 && !containsMonthDay(r.ByMonthDay, date.Day(), daysInMonth) {
+		return false
+	}
+	if len(r.ByDay) == 0 {
+		return true
+	}
+
+	for _, weekday := range r.ByDay {
+		if weekday.Day != date.Weekday() {
+			continue
+		}
+		switch {
+		case weekday.N == 0:
+			return true
+		case weekday.N > 0 && (date.Day()-1)/7+1 == weekday.N:
+			return true
+		case weekday.N < 0 && (daysInMonth-date.Day())/7+1 == -weekday.N:
+			return true
+		}
+	}
+	return false
+}
+
+func containsWeekday(days []Weekday, day time.Weekday) bool {
+	for _, weekday := range days {
+		if weekday.Day == day {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMonthDay(monthDays []int, day, daysInMonth int) bool {
+	for _, monthDay := range monthDays {
+		if monthDay == day || (monthDay < 0 && daysInMonth+monthDay+1 == day) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortTimes(times []time.Time) {
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+}
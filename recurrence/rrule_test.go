@@ -0,0 +1,246 @@
+package recurrence
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("loading %s: %v", name, err)
+	}
+	return loc
+}
+
+func TestOccurrences(t *testing.T) {
+	london := mustLoad(t, "Europe/London")
+	newYork := mustLoad(t, "America/New_York")
+	berlin := mustLoad(t, "Europe/Berlin")
+
+	tests := []struct {
+		name     string
+		rule     string
+		loc      *time.Location
+		start    string // Local to loc
+		from, to string // Local to loc, from defaults to start
+		want     []string
+	}{
+		{
+			name:  "weekly BYDAY with COUNT",
+			rule:  "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=4",
+			loc:   london,
+			start: "2024-01-02 17:00",
+			to:    "2024-03-01 00:00",
+			want:  []string{"2024-01-02 17:00", "2024-01-04 17:00", "2024-01-09 17:00", "2024-01-11 17:00"},
+		},
+		{
+			name:  "duplicate BYDAY entries give each occurrence once",
+			rule:  "FREQ=WEEKLY;BYDAY=MO,MO,WE;COUNT=4",
+			loc:   london,
+			start: "2024-01-01 09:00",
+			to:    "2024-03-01 00:00",
+			want:  []string{"2024-01-01 09:00", "2024-01-03 09:00", "2024-01-08 09:00", "2024-01-10 09:00"},
+		},
+		{
+			name:  "COUNT is counted from start, not from",
+			rule:  "FREQ=DAILY;COUNT=5",
+			loc:   london,
+			start: "2024-01-01 10:00",
+			from:  "2024-01-04 00:00",
+			to:    "2024-02-01 00:00",
+			want:  []string{"2024-01-04 10:00", "2024-01-05 10:00"},
+		},
+		{
+			name:  "UNTIL in UTC is inclusive",
+			rule:  "FREQ=DAILY;UNTIL=20240105T170000Z",
+			loc:   time.UTC,
+			start: "2024-01-01 17:00",
+			to:    "2024-02-01 00:00",
+			want:  []string{"2024-01-01 17:00", "2024-01-02 17:00", "2024-01-03 17:00", "2024-01-04 17:00", "2024-01-05 17:00"},
+		},
+		{
+			name:  "UNTIL as a date includes the whole day in the location",
+			rule:  "FREQ=WEEKLY;UNTIL=20240115",
+			loc:   newYork,
+			start: "2024-01-01 20:00",
+			to:    "2024-03-01 00:00",
+			want:  []string{"2024-01-01 20:00", "2024-01-08 20:00", "2024-01-15 20:00"},
+		},
+		{
+			name:  "wall clock time is kept when clocks go forward",
+			rule:  "FREQ=WEEKLY",
+			loc:   newYork,
+			start: "2024-03-03 17:00",
+			to:    "2024-03-18 00:00",
+			want:  []string{"2024-03-03 17:00", "2024-03-10 17:00", "2024-03-17 17:00"},
+		},
+		{
+			name:  "wall clock time is kept when clocks go back",
+			rule:  "FREQ=DAILY;COUNT=3",
+			loc:   berlin,
+			start: "2024-10-26 09:30",
+			to:    "2024-11-01 00:00",
+			want:  []string{"2024-10-26 09:30", "2024-10-27 09:30", "2024-10-28 09:30"},
+		},
+		{
+			name:  "every other week",
+			rule:  "FREQ=WEEKLY;INTERVAL=2;BYDAY=FR",
+			loc:   london,
+			start: "2024-01-05 16:00",
+			to:    "2024-02-10 00:00",
+			want:  []string{"2024-01-05 16:00", "2024-01-19 16:00", "2024-02-02 16:00"},
+		},
+		{
+			// RFC 5545's example of WKST changing the occurrences
+			name:  "every other week with weeks starting on Monday",
+			rule:  "FREQ=WEEKLY;INTERVAL=2;COUNT=4;BYDAY=TU,SU;WKST=MO",
+			loc:   newYork,
+			start: "1997-08-05 09:00",
+			to:    "1997-12-01 00:00",
+			want:  []string{"1997-08-05 09:00", "1997-08-10 09:00", "1997-08-19 09:00", "1997-08-24 09:00"},
+		},
+		{
+			name:  "every other week with weeks starting on Sunday",
+			rule:  "FREQ=WEEKLY;INTERVAL=2;COUNT=4;BYDAY=TU,SU;WKST=SU",
+			loc:   newYork,
+			start: "1997-08-05 09:00",
+			to:    "1997-12-01 00:00",
+			want:  []string{"1997-08-05 09:00", "1997-08-17 09:00", "1997-08-19 09:00", "1997-08-31 09:00"},
+		},
+		{
+			name:  "last Friday of the month",
+			rule:  "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3",
+			loc:   london,
+			start: "2024-01-26 15:00",
+			to:    "2025-01-01 00:00",
+			want:  []string{"2024-01-26 15:00", "2024-02-23 15:00", "2024-03-29 15:00"},
+		},
+		{
+			name:  "monthly on a day some months don't have",
+			rule:  "FREQ=MONTHLY;COUNT=3",
+			loc:   london,
+			start: "2024-01-31 12:00",
+			to:    "2025-01-01 00:00",
+			want:  []string{"2024-01-31 12:00", "2024-03-31 12:00", "2024-05-31 12:00"},
+		},
+		{
+			name:  "duplicate BYMONTHDAY entries give each occurrence once",
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=31,-1;COUNT=2",
+			loc:   london,
+			start: "2024-01-31 12:00",
+			to:    "2025-01-01 00:00",
+			want:  []string{"2024-01-31 12:00", "2024-02-29 12:00"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parse := func(value string) time.Time {
+				t.Helper()
+				parsed, err := time.ParseInLocation("2006-01-02 15:04", value, test.loc)
+				if err != nil {
+					t.Fatalf("parsing %q: %v", value, err)
+				}
+				return parsed
+			}
+
+			rule, err := Parse(test.rule, test.loc)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", test.rule, err)
+			}
+			start := parse(test.start)
+			from := start
+			if test.from != "" {
+				from = parse(test.from)
+			}
+
+			got := rule.Occurrences(start, from, parse(test.to))
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d occurrences %v, want %d %v", len(got), got, len(test.want), test.want)
+			}
+			for i, occurrence := range got {
+				if want := parse(test.want[i]); !occurrence.Equal(want) {
+					t.Errorf("occurrence %d is %v, want %v", i, occurrence, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOccurrencesKeepsLocalTimeAcrossDST(t *testing.T) {
+	newYork := mustLoad(t, "America/New_York")
+	rule, err := Parse("FREQ=WEEKLY", newYork)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, time.March, 3, 17, 0, 0, 0, newYork)
+	got := rule.Occurrences(start, start, start.AddDate(0, 0, 8))
+	if len(got) != 2 {
+		t.Fatalf("got %d occurrences, want 2", len(got))
+	}
+	if gap := got[1].Sub(got[0]); gap != 7*24*time.Hour-time.Hour {
+		t.Errorf("a week across the change to daylight saving time is %v, want one hour less than a week", gap)
+	}
+}
+
+func TestOccurrencesSkipsDuplicatesInHandBuiltRules(t *testing.T) {
+	rule := Rule{Freq: Weekly, Interval: 1, Count: 3, ByDay: []Weekday{{Day: time.Monday}, {Day: time.Monday}}}
+	start := time.Date(2024, time.January, 1, 9, 0, 0, 0, time.UTC)
+
+	got := rule.Occurrences(start, start, start.AddDate(0, 2, 0))
+	want := []time.Time{start, start.AddDate(0, 0, 7), start.AddDate(0, 0, 14)}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("occurrence %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string // The rule written back out
+		invalid bool
+	}{
+		{value: "RRULE:FREQ=WEEKLY;BYDAY=TU,TH;COUNT=20", want: "FREQ=WEEKLY;COUNT=20;BYDAY=TU,TH"},
+		{value: "FREQ=WEEKLY;BYDAY=MO,MO,WE", want: "FREQ=WEEKLY;BYDAY=MO,WE"},
+		{value: "FREQ=MONTHLY;BYDAY=2TU", want: "FREQ=MONTHLY;BYDAY=2TU"},
+		{value: "FREQ=DAILY;INTERVAL=1", want: "FREQ=DAILY"},
+		{value: "FREQ=WEEKLY;COUNT=3;UNTIL=20240101T000000Z", invalid: true},
+		{value: "FREQ=WEEKLY;BYDAY=2TU", invalid: true},
+		{value: "FREQ=WEEKLY;BYMONTHDAY=1", invalid: true},
+		{value: "FREQ=HOURLY", invalid: true},
+		{value: "BYDAY=MO", invalid: true},
+		{value: "FREQ=WEEKLY;COUNT=0", invalid: true},
+		{value: "FREQ=WEEKLY;UNTIL=20241217T235959Z;INTERVAL=1;BYDAY=MO;WKST=SU", want: "FREQ=WEEKLY;UNTIL=20241217T235959Z;BYDAY=MO"},
+		{value: "FREQ=MONTHLY;BYDAY=-1FR;WKST=SU", want: "FREQ=MONTHLY;BYDAY=-1FR"},
+		{value: "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,SU;WKST=SU", want: "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,SU;WKST=SU"},
+		{value: "FREQ=WEEKLY;INTERVAL=2;WKST=MO", want: "FREQ=WEEKLY;INTERVAL=2"},
+		{value: "FREQ=WEEKLY;WKST=XX", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			rule, err := Parse(test.value, time.UTC)
+			if test.invalid {
+				if !errors.Is(err, ErrInvalidRule) {
+					t.Fatalf("Parse(%q) = %v, want ErrInvalidRule", test.value, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", test.value, err)
+			}
+			if got := rule.String(); got != test.want {
+				t.Errorf("Parse(%q).String() = %q, want %q", test.value, got, test.want)
+			}
+		})
+	}
+}
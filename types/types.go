@@ -1,28 +1,40 @@
 package types
 
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"time"
+)
+
 //===============//
 // STUDENT TYPES //
 //===============//
 
 // Student struct that determines how students will be stored in the database
 type Student struct {
-	StudentId          string `json:"student_id"` // TODO: Update to be like TeacherID; needs done in Electron apps too
-	FirstName          string `json:"first_name"`
-	PreferredName      string `json:"preferred_name"`
-	LastName           string `json:"last_name"`
-	EmailAddress       string `json:"email_address"`
-	Password           string `json:"password"`
-	Salt               string `json:"salt"`
-	NativeLanguage     string `json:"native_language"`
-	PreferredLanguage  string `json:"preferred_language"`
-	StudentSince       string `json:"student_since"`
-	ProfilePictureURL  string `json:"profile_picture_url"`
-	ProfilePicturePath string `json:"profile_picture_path"`
-	ThemeMode          string `json:"theme_mode"`
-	FontStyle          string `json:"font_style"`
-	TimeZone           string `json:"time_zone"`
-	LessonsRemaining   int64  `json:"lessons_remaining"`
-	LessonsCompleted   int64  `json:"lessons_completed"`
+	StudentId          string   `json:"student_id"` // TODO: Update to be like TeacherID; needs done in Electron apps too
+	FirstName          string   `json:"first_name"`
+	PreferredName      string   `json:"preferred_name"`
+	LastName           string   `json:"last_name"`
+	EmailAddress       string   `json:"email_address"`
+	Password           string   `json:"password"`
+	Salt               string   `json:"salt"` // Only set for legacy bcrypt hashes, argon2id hashes carry their own salt
+	NativeLanguage     string   `json:"native_language"`
+	PreferredLanguage  string   `json:"preferred_language"`
+	StudentSince       string   `json:"student_since"`
+	ProfilePictureURL  string   `json:"profile_picture_url"`
+	ProfilePicturePath string   `json:"profile_picture_path"`
+	ThemeMode          string   `json:"theme_mode"`
+	FontStyle          string   `json:"font_style"`
+	TimeZone           string   `json:"time_zone"`
+	LessonsRemaining   int64    `json:"lessons_remaining"`
+	LessonsCompleted   int64    `json:"lessons_completed"`
+	TeacherID          string   `json:"teacherID"`      // The teacher this student is assigned to
+	GoogleSubject      string   `json:"google_subject"` // The "sub" claim of the linked Google account, if any
+	TOTPSecret         string   `json:"-"`              // Set while enrolling, only used once TOTPEnabled is true
+	TOTPEnabled        bool     `json:"totp_enabled"`
+	TOTPLastStep       int64    `json:"-"` // Last TOTP time step used, so a code can't be replayed
+	RecoveryCodes      []string `json:"-"` // sha256 hashes of unused recovery codes
+	EmailVerified      bool     `json:"email_verified"`
 }
 
 // StudentInfo struct that determines the info that can be retrieved about a student securely (i.e. no passwords, salts, etc.)
@@ -42,6 +54,7 @@ type StudentInfo struct {
 	TimeZone           string `json:"time_zone"`
 	LessonsRemaining   int64  `json:"lessons_remaining"`
 	LessonsCompleted   int64  `json:"lessons_completed"`
+	TeacherID          string `json:"teacherID"` // The teacher this student is assigned to
 }
 
 // ListStudentsRequest struct to handle incoming request to list all students
@@ -69,13 +82,11 @@ type UserVerification struct {
 	VerificationCode string `bson:"verificationCode" json:"verificationCode"`
 }
 
-// CreateVerificationRequest struct to handle incoming request to create a verification object
+// CreateVerificationRequest struct to handle incoming request to (re)send a verification email. UserType is "student"
+// when left empty.
 type CreateVerificationRequest struct {
-	Token            string `bson:"token" json:"token"`
-	Email            string `bson:"email" json:"email"`
-	IsVerified       bool   `bson:"isVerified" json:"isVerified"`
-	RegistrationCode string `bson:"registrationCode" json:"registrationCode"`
-	IsRegistered     bool   `bson:"isRegistered" json:"isRegistered"`
+	Email    string `bson:"email" json:"email"`
+	UserType string `bson:"userType" json:"userType"`
 }
 
 // CreateVerificationResponse struct to handle outgoing response to create a verification object
@@ -83,22 +94,47 @@ type CreateVerificationResponse struct {
 	IsCreated bool `bson:"isCreated" json:"isCreated"`
 }
 
-// CreateRegistrationRequest Struct to handle incoming create registration code request
+// EmailVerification struct that determines how email verification tokens are stored in verificationsCollection
+type EmailVerification struct {
+	TokenHash  string    `bson:"tokenHash" json:"-"` // sha256 of the token that was emailed, the raw token is never stored
+	UserID     string    `bson:"userId" json:"userId"`
+	Role       string    `bson:"role" json:"role"`
+	Email      string    `bson:"email" json:"email"`
+	IsVerified bool      `bson:"isVerified" json:"isVerified"`
+	CreatedAt  time.Time `bson:"createdAt" json:"createdAt"`
+	ExpiresAt  time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+// ConfirmVerificationRequest struct to handle incoming request to confirm an email address with an emailed token
+type ConfirmVerificationRequest struct {
+	Token string `bson:"token" json:"token"`
+}
+
+// ConfirmVerificationResponse struct to handle outgoing confirm verification response
+type ConfirmVerificationResponse struct {
+	IsVerified bool `bson:"isVerified" json:"isVerified"`
+}
+
+// CreateRegistrationRequest Struct to handle incoming create registration code request. The code itself is generated
+// by the server, ExpiresInDays and MaxUses fall back to the defaults when left at zero.
 type CreateRegistrationRequest struct {
-	RegistrationCode string `json:"registration_code"`
-	FirstName        string `json:"first_name"`
-	LastName         string `json:"last_name"`
-	EmailAddress     string `json:"email_address"`
-	IsValid          bool   `json:"is_valid"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	EmailAddress  string `json:"email_address"`
+	ExpiresInDays int    `json:"expires_in_days"`
+	MaxUses       int64  `json:"max_uses"`
 }
 
 // CreateRegistrationResponse struct to handle outgoing create registration code response
 type CreateRegistrationResponse struct {
-	RegistrationCode string `json:"registration_code"`
-	FirstName        string `json:"first_name"`
-	LastName         string `json:"last_name"`
-	EmailAddress     string `json:"email_address"`
-	IsValid          bool   `json:"is_valid"`
+	RegistrationID   string    `json:"registration_id"`
+	RegistrationCode string    `json:"registration_code"`
+	FirstName        string    `json:"first_name"`
+	LastName         string    `json:"last_name"`
+	EmailAddress     string    `json:"email_address"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	MaxUses          int64     `json:"max_uses"`
+	IsValid          bool      `json:"is_valid"`
 }
 
 // RegistrationRequest Struct to handle incoming registration code request
@@ -106,11 +142,36 @@ type RegistrationRequest struct {
 	RegistrationCode string `json:"registration_code"`
 }
 
+// Registration is an invitation a teacher sends to a new student. It can be redeemed MaxUses times before ExpiresAt,
+// unless the teacher revokes it first.
 type Registration struct {
-	FirstName        string `json:"first_name"`
-	LastName         string `json:"last_name"`
-	EmailAddress     string `json:"email_address"`
-	RegistrationCode string `json:"registration_code"`
+	RegistrationID   string    `bson:"registrationid" json:"registration_id"`
+	FirstName        string    `json:"first_name"`
+	LastName         string    `json:"last_name"`
+	EmailAddress     string    `json:"email_address"`
+	RegistrationCode string    `json:"registration_code"`
+	TeacherID        string    `bson:"teacherid" json:"teacher_id"` // The teacher who sent the invitation, assigned to the new student
+	CreatedAt        time.Time `bson:"createdat" json:"created_at"`
+	ExpiresAt        time.Time `bson:"expiresat" json:"expires_at"`
+	MaxUses          int64     `bson:"maxuses" json:"max_uses"`
+	Uses             int64     `bson:"uses" json:"uses"`
+	Revoked          bool      `bson:"revoked" json:"revoked"`
+	RedeemedBy       []string  `bson:"redeemedby" json:"redeemed_by"` // StudentIDs of the accounts created with the code
+}
+
+// ListRegistrationsResponse struct to handle outgoing list of outstanding registration codes
+type ListRegistrationsResponse struct {
+	Registrations []Registration `json:"registrations"`
+}
+
+// RevokeRegistrationRequest struct to handle incoming request to revoke a registration code
+type RevokeRegistrationRequest struct {
+	RegistrationID string `json:"registration_id"`
+}
+
+// RevokeRegistrationResponse struct to handle outgoing revoke registration code response
+type RevokeRegistrationResponse struct {
+	IsRevoked bool `json:"is_revoked"`
 }
 type RegistrationValidationResult struct {
 	IsValid bool         `json:"is_valid"`
@@ -143,6 +204,7 @@ type CreateNewStudentLoginRequest struct {
 	PublicKey          string `json:"public_key"`
 	LessonsRemaining   int64  `json:"lessons_remaining"`
 	LessonsCompleted   int64  `json:"lessons_completed"`
+	RegistrationCode   string `json:"registration_code"`
 }
 
 // CreateNewStudentResponse Struct to handle outgoing create new student response
@@ -150,10 +212,13 @@ type CreateNewStudentResponse struct {
 	StudentId string `json:"student_id"` // TODO: Update to be like TeacherID; needs done in Electron apps too
 }
 
-// ValidateLoginRequest Struct to handle incoming login request
+// ValidateLoginRequest Struct to handle incoming login request. When two-factor authentication is enabled the
+// first request returns a MFAChallengeResponse, then the same endpoint is called again with ChallengeToken and TOTPCode.
 type ValidateLoginRequest struct {
-	EmailAddress string `bson:"email_address" json:"email_address"`
-	Password     string `bson:"password" json:"password"`
+	EmailAddress   string `bson:"email_address" json:"email_address"`
+	Password       string `bson:"password" json:"password"`
+	ChallengeToken string `bson:"challenge_token" json:"challenge_token"`
+	TOTPCode       string `bson:"totp_code" json:"totp_code"` // A TOTP code or one of the recovery codes
 }
 
 // ValidateLoginResponse Struct to handle outgoing login response
@@ -173,19 +238,26 @@ type ValidateLoginResponse struct {
 	TimeZone           string `bson:"time_zone" json:"time_zone"`
 	LessonsRemaining   int64  `bson:"lessons_remaining" json:"lessons_remaining"`
 	LessonsCompleted   int64  `bson:"lessons_completed" json:"lessons_completed"`
+	AccessToken        string `bson:"access_token" json:"access_token"`
+	ExpiresAt          int64  `bson:"expires_at" json:"expires_at"`
+	RefreshToken       string `bson:"refresh_token" json:"refresh_token"`
 }
 
 type ValidateLoginResult struct {
-	IsValid     bool                  `bson:"is_valid" json:"is_valid"`
-	StudentInfo ValidateLoginResponse `bson:"student_info" json:"student_info"`
+	IsValid       bool                  `bson:"is_valid" json:"is_valid"`
+	RequiresTOTP  bool                  `bson:"requires_totp" json:"requires_totp"`
+	EmailVerified bool                  `bson:"email_verified" json:"email_verified"`
+	StudentInfo   ValidateLoginResponse `bson:"student_info" json:"student_info"`
 }
 
 // Actually, I probably don't need this struct below, it's the same as ValidateLoginRequest
 
 // ValidateLoginMobileRequest struct to handle incoming login requests from the mobile app
 type ValidateLoginMobileRequest struct {
-	EmailAddress string `bson:"email_address" json:"email_address"`
-	Password     string `bson:"password" json:"password"`
+	EmailAddress   string `bson:"email_address" json:"email_address"`
+	Password       string `bson:"password" json:"password"`
+	ChallengeToken string `bson:"challenge_token" json:"challenge_token"`
+	TOTPCode       string `bson:"totp_code" json:"totp_code"`
 }
 
 // Actually, I probably don't need this struct below, it's the same as StudentInfo
@@ -207,18 +279,25 @@ type ValidateLoginMobileResponse struct {
 	TimeZone           string `json:"time_zone"`
 	LessonsRemaining   int64  `json:"lessons_remaining"`
 	LessonsCompleted   int64  `json:"lessons_completed"`
+	AccessToken        string `json:"access_token"`
+	ExpiresAt          int64  `json:"expires_at"`
+	RefreshToken       string `json:"refresh_token"`
 }
 
 // ValidateLoginMobileResult struct for handling the result of the login to mobile attempt
 type ValidateLoginMobileResult struct {
-	IsValid     bool                        `bson:"is_valid" json:"is_valid"`
-	StudentInfo ValidateLoginMobileResponse `bson:"student_info" json:"student_info"`
+	IsValid       bool                        `bson:"is_valid" json:"is_valid"`
+	RequiresTOTP  bool                        `bson:"requires_totp" json:"requires_totp"`
+	EmailVerified bool                        `bson:"email_verified" json:"email_verified"`
+	StudentInfo   ValidateLoginMobileResponse `bson:"student_info" json:"student_info"`
 }
 
+// ValidateGoogleLoginRequest struct to handle incoming Google sign in requests. The email is taken from the verified ID token.
 type ValidateGoogleLoginRequest struct {
-	Email         string `json:"email"`
-	EmailVerified string `json:"email_verified"`
-	// Later add picture and name and JWT here
+	IDToken        string `json:"id_token"`
+	Password       string `json:"password"` // Only needed the first time a student who signed up with a password links their Google account
+	ChallengeToken string `json:"challenge_token"`
+	TOTPCode       string `json:"totp_code"`
 }
 
 // UpdateStudentInfoRequest Struct to handle incoming updates to student info
@@ -239,6 +318,7 @@ type UpdateStudentInfoRequest struct {
 	PublicKey          string `json:"public_key"`
 	LessonsRemaining   int64  `json:"lessons_remaining"`
 	LessonsCompleted   int64  `json:"lessons_completed"`
+	TeacherID          string `json:"teacherID"` // Only admins can reassign a student
 }
 
 // UpdateStudentInfoResponse Struct to handle outgoing response after updating student info
@@ -267,7 +347,18 @@ type DeleteStudentRequest struct {
 
 // DeleteStudentResponse struct to handle outgoing response to delete a student
 type DeleteStudentResponse struct {
-	IsDeleted bool `json:"is_deleted"`
+	IsDeleted bool       `json:"is_deleted"`
+	PurgeAt   *time.Time `json:"purge_at,omitempty"` // The student can be restored until then
+}
+
+// RestoreStudentRequest struct to handle incoming request to restore a deleted student
+type RestoreStudentRequest struct {
+	StudentId string `json:"student_id"`
+}
+
+// ExportStudentRequest struct to handle incoming request to export everything held about a student
+type ExportStudentRequest struct {
+	StudentId string `json:"student_id"`
 }
 
 //===============//
@@ -276,21 +367,27 @@ type DeleteStudentResponse struct {
 
 // Teacher struct that determines how a teacher is stored in the database
 type Teacher struct {
-	TeacherID          string `json:"teacherID"`
-	FirstName          string `json:"first_name"`
-	PreferredName      string `json:"preferred_name"`
-	LastName           string `json:"last_name"`
-	NativeLanguage     string `json:"native_language"`
-	PreferredLanguage  string `json:"preferred_language"`
-	EmailAddress       string `json:"email_address"`
-	Password           string `json:"password"`
-	Salt               string `json:"salt"`
-	ProfilePictureURL  string `json:"profile_picture_url"`
-	ProfilePicturePath string `json:"profile_picture_path"`
-	ThemeMode          string `json:"theme_mode"`
-	FontStyle          string `json:"font_style"`
-	TimeZone           string `json:"time_zone"`
-	LessonsTaught      int64  `json:"lessons_taught"`
+	TeacherID          string   `json:"teacherID"`
+	FirstName          string   `json:"first_name"`
+	PreferredName      string   `json:"preferred_name"`
+	LastName           string   `json:"last_name"`
+	NativeLanguage     string   `json:"native_language"`
+	PreferredLanguage  string   `json:"preferred_language"`
+	EmailAddress       string   `json:"email_address"`
+	Password           string   `json:"password"`
+	Salt               string   `json:"salt"` // Only set for legacy bcrypt hashes, argon2id hashes carry their own salt
+	ProfilePictureURL  string   `json:"profile_picture_url"`
+	ProfilePicturePath string   `json:"profile_picture_path"`
+	ThemeMode          string   `json:"theme_mode"`
+	FontStyle          string   `json:"font_style"`
+	TimeZone           string   `json:"time_zone"`
+	LessonsTaught      int64    `json:"lessons_taught"`
+	Role               string   `json:"role"` // "teacher" or "admin"
+	TOTPSecret         string   `json:"-"`    // Set while enrolling, only used once TOTPEnabled is true
+	TOTPEnabled        bool     `json:"totp_enabled"`
+	TOTPLastStep       int64    `json:"-"` // Last TOTP time step used, so a code can't be replayed
+	RecoveryCodes      []string `json:"-"` // sha256 hashes of unused recovery codes
+	EmailVerified      bool     `json:"email_verified"`
 }
 
 // TeacherInfo struct that determines the info that can be retrieved about a teacher securely (i.e. no passwords, salts, etc.)
@@ -308,6 +405,7 @@ type TeacherInfo struct {
 	FontStyle          string `json:"font_style"`
 	TimeZone           string `json:"time_zone"`
 	LessonsTaught      int64  `json:"lessons_taught"`
+	Role               string `json:"role"` // "teacher" or "admin"
 }
 
 type CreateTeacherRequest struct {
@@ -325,6 +423,7 @@ type CreateTeacherRequest struct {
 	FontStyle          string `json:"font_style"`
 	TimeZone           string `json:"time_zone"`
 	PublicKey          string `json:"public_key"`
+	Role               string `json:"role"` // Defaults to "teacher"
 }
 
 type CreateTeacherResponse struct {
@@ -341,6 +440,7 @@ type CreateTeacherResponse struct {
 	FontStyle          string `json:"font_style"`
 	TimeZone           string `json:"time_zone"`
 	LessonsTaught      int64  `json:"lessons_taught"`
+	Role               string `json:"role"`
 }
 
 type GetTeacherRequest struct {
@@ -397,13 +497,16 @@ type DeleteTeacherRequest struct{}
 
 // DeleteTeacherResponse struct to handle outgoing response to delete a teacher
 type DeleteTeacherResponse struct {
-	IsDeleted bool `json:"is_deleted"`
+	IsDeleted bool       `json:"is_deleted"`
+	PurgeAt   *time.Time `json:"purge_at,omitempty"` // The teacher can be restored until then
 }
 
 type ValidateTeacherLoginRequest struct {
-	EmailAddress string `json:"email_address"`
-	Password     string `json:"password"`
-	TeacherID    string `json:"teacherID"`
+	EmailAddress   string `json:"email_address"`
+	Password       string `json:"password"`
+	TeacherID      string `json:"teacherID"`
+	ChallengeToken string `json:"challenge_token"`
+	TOTPCode       string `json:"totp_code"`
 }
 
 type ValidateTeacherLoginResponse struct {
@@ -420,11 +523,63 @@ type ValidateTeacherLoginResponse struct {
 	FontStyle          string `json:"font_style"`
 	TimeZone           string `json:"time_zone"`
 	LessonsTaught      int64  `json:"lessons_taught"`
+	Role               string `json:"role"`
+	AccessToken        string `json:"access_token"`
+	ExpiresAt          int64  `json:"expires_at"`
+	RefreshToken       string `json:"refresh_token"`
 }
 
 type ValidateTeacherLoginResult struct {
-	TeacherInfo ValidateTeacherLoginResponse
-	IsValid     bool
+	TeacherInfo   ValidateTeacherLoginResponse
+	IsValid       bool
+	RequiresTOTP  bool
+	EmailVerified bool
+}
+
+// TeacherAvailability struct to be stored in teacherAvailabilityCollection, when students can book the teacher
+type TeacherAvailability struct {
+	TeacherID   string               `json:"teacherID"`
+	TimeZone    string               `json:"time_zone"`    // IANA name WeeklyHours and Holidays are in, the teacher's by default
+	SlotMinutes int64                `json:"slot_minutes"` // Length of a bookable slot, 60 by default
+	WeeklyHours []AvailabilityWindow `json:"weekly_hours"`
+	TimeOff     []TimeOff            `json:"time_off"`
+	Holidays    []Holiday            `json:"holidays"`
+	UpdatedAt   time.Time            `json:"updated_at"`
+}
+
+// AvailabilityWindow struct for the hours a teacher works on one day of the week
+type AvailabilityWindow struct {
+	Weekday int    `json:"weekday"` // 0 is Sunday
+	Start   string `json:"start"`   // "15:00"
+	End     string `json:"end"`     // "19:30", after Start on the same day
+}
+
+// TimeOff struct for a period the teacher can't be booked in
+type TimeOff struct {
+	Start  int64  `json:"start"` // Unix seconds
+	End    int64  `json:"end"`   // Unix seconds
+	Reason string `json:"reason,omitempty"`
+}
+
+// Holiday struct for a whole day the teacher can't be booked on
+type Holiday struct {
+	Date string `json:"date"` // "2006-01-02" in the availability's time zone
+	Name string `json:"name,omitempty"`
+}
+
+// UpdateAvailabilityRequest struct to handle incoming request to replace a teacher's availability
+type UpdateAvailabilityRequest struct {
+	TeacherID   string               `json:"teacherID"` // Defaults to the caller
+	TimeZone    string               `json:"time_zone"`
+	SlotMinutes int64                `json:"slot_minutes"`
+	WeeklyHours []AvailabilityWindow `json:"weekly_hours"`
+	TimeOff     []TimeOff            `json:"time_off"`
+	Holidays    []Holiday            `json:"holidays"`
+}
+
+// AvailabilityResponse struct to handle outgoing response with a teacher's availability
+type AvailabilityResponse struct {
+	Availability TeacherAvailability `json:"availability"`
 }
 
 //==============//
@@ -437,14 +592,43 @@ type Lesson struct {
 	TeacherID         string `json:"teacherID"`
 	StudentId         string `json:"student_id"` // TODO: Update to be like TeacherID; needs done in Electron apps too
 	Subject           string `json:"subject"`
-	ScheduledDateTime int64  `json:"scheduled_date_time"`
+	ScheduledDateTime int64  `json:"scheduled_date_time"` // Unix seconds
+	DurationMinutes   int64  `json:"duration_minutes"`    // 0 on lessons from before durations, which count as 60
 	Room              int64  `json:"room"`
 	IsCanceled        bool   `json:"is_canceled"`
 	IsCompleted       bool   `json:"is_completed"`
 	TimesRescheduled  int64  `json:"times_rescheduled"`
+	Sequence          int64  `json:"sequence"`           // iCalendar SEQUENCE, goes up whenever the lesson is moved or canceled
 	IsStudentLate     bool   `json:"is_student_late"`    // Only true when 5 minutes or more late
 	IsTeacherLate     bool   `json:"is_teacher_late"`    // Only true when 5 minutes or more late
 	IsConnectionLost  bool   `json:"is_connection_lost"` // Need to really think about this implementation
+
+	// Set on lessons imported from an .ics file, the UID of the event they came from
+	ImportUID string `bson:"importuid,omitempty" json:"import_uid,omitempty"`
+
+	// Only set on occurrences of a LessonSeries. OccurrenceStart is the Unix seconds the series scheduled the
+	// occurrence for, IsException is true once it was changed on its own.
+	SeriesID        string `bson:"seriesid,omitempty" json:"seriesID,omitempty"`
+	OccurrenceStart int64  `bson:"occurrencestart,omitempty" json:"occurrence_start,omitempty"`
+	IsException     bool   `bson:"isexception,omitempty" json:"is_exception,omitempty"`
+}
+
+// LessonSeries struct to be stored in lessonSeriesCollection. Its occurrences are stored as lessons up to
+// GeneratedUntil, which a background job keeps ahead of now.
+type LessonSeries struct {
+	SeriesID        string    `json:"seriesID"`
+	TeacherID       string    `json:"teacherID"`
+	StudentId       string    `json:"student_id"`
+	Subject         string    `json:"subject"`
+	Room            int64     `json:"room"`
+	Start           int64     `json:"start"` // Unix seconds of the first occurrence
+	DurationMinutes int64     `json:"duration_minutes"`
+	TimeZone        string    `json:"time_zone"` // IANA name the rule is expanded in, the teacher's by default
+	RRule           string    `json:"rrule"`     // RFC 5545 recurrence rule, e.g. "FREQ=WEEKLY;BYDAY=TU;COUNT=20"
+	ExDates         []int64   `json:"exdates"`   // Occurrences deleted on their own, as the Unix seconds they were scheduled for
+	GeneratedUntil  int64     `json:"generated_until"`
+	CreatedAt       time.Time `json:"created_at"`
+	ImportUID       string    `bson:"importuid,omitempty" json:"import_uid,omitempty"` // Set on series imported from an .ics file
 }
 
 // CreateLessonRequest struct to handle incoming request for creating a new lesson
@@ -453,7 +637,9 @@ type CreateLessonRequest struct {
 	StudentId         string `json:"student_id"` // TODO: Update to be like TeacherID; needs done in Electron apps too
 	Subject           string `json:"subject"`
 	ScheduledDateTime int64  `json:"scheduled_date_time"`
+	DurationMinutes   int64  `json:"duration_minutes"` // Defaults to 60
 	Room              int64  `json:"room"`
+	ImportUID         string `json:"-"` // Set by the .ics import, see Lesson.ImportUID
 }
 
 // CreateLessonResponse struct to handle outgoing response for creating a new lesson
@@ -466,6 +652,7 @@ type UpdateLessonRequest struct {
 	LessonID          string `json:"lessonID"`
 	Subject           string `json:"subject"`
 	ScheduledDateTime int64  `json:"scheduled_date_time"`
+	DurationMinutes   int64  `json:"duration_minutes"`
 	Room              int64  `json:"room"`
 	IsCanceled        bool   `json:"is_canceled"`
 	IsCompleted       bool   `json:"is_completed"`
@@ -480,6 +667,95 @@ type UpdateLessonResponse struct {
 	Lesson Lesson `json:"lesson"`
 }
 
+// CreateLessonSeriesRequest struct to handle incoming request for creating a recurring lesson series
+type CreateLessonSeriesRequest struct {
+	TeacherID       string `json:"teacherID"`
+	StudentId       string `json:"student_id"`
+	Subject         string `json:"subject"`
+	Room            int64  `json:"room"`
+	Start           int64  `json:"start"`            // Unix seconds of the first occurrence, which must match RRule
+	DurationMinutes int64  `json:"duration_minutes"` // Defaults to 60
+	TimeZone        string `json:"time_zone"`        // Defaults to the teacher's time zone
+	RRule           string `json:"rrule"`
+}
+
+// LessonSeriesResponse struct to handle outgoing response with a lesson series and the lessons that were created
+type LessonSeriesResponse struct {
+	Series  LessonSeries     `json:"series"`
+	Lessons []Lesson         `json:"lessons"`
+	Skipped []LessonConflict `json:"skipped"` // Occurrences that weren't created because they clash, by OccurrenceStart
+}
+
+// UpdateLessonSeriesRequest struct to handle incoming request for changing an occurrence and the ones following it.
+// Empty fields are left as they are.
+type UpdateLessonSeriesRequest struct {
+	LessonID        string `json:"lessonID"` // The first occurrence to change
+	Subject         string `json:"subject"`
+	Room            *int64 `json:"room"`
+	Start           int64  `json:"start"` // New Unix seconds for this occurrence, the following ones keep the same wall clock time
+	DurationMinutes int64  `json:"duration_minutes"`
+	TimeZone        string `json:"time_zone"`
+	RRule           string `json:"rrule"`
+}
+
+// DeleteLessonSeriesRequest struct to handle incoming request for deleting an occurrence and the ones following it
+type DeleteLessonSeriesRequest struct {
+	LessonID string `json:"lessonID"`
+}
+
+// DeleteLessonSeriesResponse struct to handle outgoing response for deleting part of a lesson series
+type DeleteLessonSeriesResponse struct {
+	IsDeleted      bool  `json:"is_deleted"`
+	LessonsDeleted int64 `json:"lessons_deleted"`
+}
+
+// LessonConflict struct for a lesson that clashes with one being scheduled. Students only get the time and the
+// reasons, the lesson itself is left out because it can be someone else's.
+type LessonConflict struct {
+	Lesson          *Lesson  `json:"lesson,omitempty"`
+	Start           int64    `json:"start"` // When the clashing lesson starts and ends, unix seconds
+	End             int64    `json:"end"`
+	Reasons         []string `json:"reasons"`                    // "teacher", "student" and/or "room"
+	OccurrenceStart int64    `json:"occurrence_start,omitempty"` // The occurrence of a series being scheduled that clashes
+}
+
+// LessonConflictResponse struct to handle outgoing response when scheduling a lesson would double book someone
+type LessonConflictResponse struct {
+	Message   string           `json:"message"`
+	Conflicts []LessonConflict `json:"conflicts"`
+}
+
+// SchedulingLock struct that determines how the lock on a teacher's, student's or room's schedule is stored in
+// schedulingLocksCollection while lessons are checked for conflicts and written
+type SchedulingLock struct {
+	Resource  string    `bson:"resource" json:"resource"` // "teacher:<id>", "student:<id>" or "room:<number>"
+	Owner     string    `bson:"owner" json:"owner"`       // Random per request, only the owner releases the lock
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+// LessonSlot struct for a time a student can book
+type LessonSlot struct {
+	Start      int64  `json:"start"` // Unix seconds
+	End        int64  `json:"end"`
+	StartLocal string `json:"start_local"` // RFC 3339 in the response's time zone
+	EndLocal   string `json:"end_local"`
+}
+
+// ListSlotsResponse struct to handle outgoing response for listing the slots a teacher can be booked in
+type ListSlotsResponse struct {
+	TeacherID string       `json:"teacherID"`
+	TimeZone  string       `json:"time_zone"` // The student's time zone unless another was asked for
+	Slots     []LessonSlot `json:"slots"`
+}
+
+// BookLessonRequest struct to handle incoming request for a student booking a lesson
+type BookLessonRequest struct {
+	TeacherID       string `json:"teacherID"`        // Defaults to the student's teacher
+	Start           int64  `json:"start"`            // Unix seconds
+	DurationMinutes int64  `json:"duration_minutes"` // Defaults to the teacher's slot length
+	Subject         string `json:"subject"`
+}
+
 // DeleteLessonRequest struct to handle incoming request for deleting an existing lesson
 type DeleteLessonRequest struct {
 	LessonID string `json:"lessonID"`
@@ -490,20 +766,62 @@ type DeleteLessonResponse struct {
 	IsDeleted bool `json:"is_deleted"`
 }
 
-// ListLessonsRequest struct to handle incoming request for listing lessons
+// ListLessonsRequest struct to handle incoming request for listing lessons, read from the query of /lessons
 type ListLessonsRequest struct {
-	UserID      string `json:"ID"` // This is just "UserID" because teacherID and studentID will be used interchangeably
-	Page        int64  `json:"page"`
+	UserID      string `json:"ID"`     // This is just "UserID" because teacherID and studentID will be used interchangeably
+	Status      string `json:"status"` // "all" (default), "upcoming", "past", "canceled" or "completed"
+	From        int64  `json:"from"`   // Unix seconds, only lessons scheduled at or after this
+	To          int64  `json:"to"`     // Unix seconds, only lessons scheduled before this
+	Page        int64  `json:"page"`   // Starts at 1
 	Limit       int64  `json:"limit"`
-	IsCanceled  bool   `json:"is_canceled"`  // IsCanceled=true & IsCompleted=false returns only canceled classes
-	IsCompleted bool   `json:"is_completed"` // IsCanceled=false & IsCompleted=true returns only completed classes,
-	// IsCanceled=false & IsCompleted=false returns only upcoming classes
+	IsCanceled  *bool  `json:"is_canceled"`  // IsCanceled=true & IsCompleted=false returns only canceled classes
+	IsCompleted *bool  `json:"is_completed"` // IsCanceled=false & IsCompleted=true returns only completed classes,
+	// IsCanceled=false & IsCompleted=false returns only classes that are still to be held. Superseded by Status.
 }
 
 // ListLessonsResponse struct to handle outgoing response for listing lessons
 type ListLessonsResponse struct {
-	Lessons []Lesson `json:"lessons"`
-	Page    int64    `json:"page"`
+	Lessons    []Lesson `json:"lessons"`
+	Page       int64    `json:"page"`
+	Limit      int64    `json:"limit"`
+	Total      int64    `json:"total"` // Lessons matching the filters across every page
+	TotalPages int64    `json:"total_pages"`
+}
+
+// CalendarFeed struct that determines how calendar feed tokens are stored in calendarFeedsCollection
+type CalendarFeed struct {
+	TokenHash string `bson:"tokenHash" json:"-"` // sha256 of the token, the raw token is never stored
+	UserID    string `bson:"userId" json:"userId"`
+	Role      string `bson:"role" json:"role"`
+	CreatedAt int64  `bson:"createdAt" json:"createdAt"`
+}
+
+// CalendarFeedResponse struct to handle outgoing response with a new calendar feed URL. The URL is only shown once.
+type CalendarFeedResponse struct {
+	URL       string `json:"url"`
+	WebcalURL string `json:"webcal_url"` // The same feed for clients that subscribe on webcal:// links
+	CreatedAt int64  `json:"created_at"`
+}
+
+// RevokeCalendarFeedResponse struct to handle outgoing response for turning a calendar feed off
+type RevokeCalendarFeedResponse struct {
+	IsRevoked bool `json:"is_revoked"`
+}
+
+// ImportLessonsResponse struct to handle outgoing response for importing lessons from an .ics file
+type ImportLessonsResponse struct {
+	Lessons []Lesson             `json:"lessons"` // Every lesson created, including those of imported series
+	Series  []LessonSeries       `json:"series"`
+	Skipped []ImportSkippedEvent `json:"skipped"`
+}
+
+// ImportSkippedEvent struct for an event of an imported .ics file that didn't become a lesson
+type ImportSkippedEvent struct {
+	UID       string           `json:"uid"`
+	Summary   string           `json:"summary"`
+	Start     int64            `json:"start"` // Unix seconds, 0 when the event has no start
+	Reason    string           `json:"reason"`
+	Conflicts []LessonConflict `json:"conflicts,omitempty"`
 }
 
 //====================//
@@ -538,47 +856,206 @@ type UpdateUserResponse struct {
 	IsUpdated bool `bson:"isUpdated" json:"isUpdated"`
 }
 
+// ChatMessage struct that determines how chat messages are stored and sent to clients. MessageID is a Mongo ObjectID
+// in hex, so IDs sort in the order messages were sent.
+type ChatMessage struct {
+	MessageID     string     `bson:"messageId" json:"messageId"`
+	RoomID        string     `bson:"roomId" json:"roomId"`
+	SenderID      string     `bson:"senderId" json:"senderId"`
+	Body          string     `bson:"body" json:"body"`                                       // Base64 AES-GCM ciphertext, the server never sees the plain text
+	KeyVersion    int        `bson:"keyVersion" json:"keyVersion"`                           // Version of the room key the body is encrypted with
+	ClientID      string     `bson:"clientId,omitempty" json:"clientId,omitempty"`           // Set by the sender so it can match the echo to what it sent
+	AttachmentIDs []string   `bson:"attachmentIds,omitempty" json:"attachmentIds,omitempty"` // Uploaded with /chats/attachments/upload first
+	SearchTokens  []string   `bson:"searchTokens,omitempty" json:"-"`                        // Blind index of the words in the body, see SearchMessagesRequest
+	CreatedAt     time.Time  `bson:"createdAt" json:"createdAt"`
+	EditedAt      *time.Time `bson:"editedAt,omitempty" json:"editedAt,omitempty"`
+	IsDeleted     bool       `bson:"isDeleted" json:"isDeleted"` // Deleted messages are kept as tombstones with an empty body
+	DeletedAt     *time.Time `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+}
+
+// ChatAttachment struct that determines how chat attachments are stored in chatAttachmentsCollection. The file itself
+// is on disk and only served to members of the room through /chats/attachments.
+type ChatAttachment struct {
+	AttachmentID string    `bson:"attachmentId" json:"attachmentId"`
+	RoomID       string    `bson:"roomId" json:"roomId"`
+	UploaderID   string    `bson:"uploaderId" json:"uploaderId"`
+	MessageID    string    `bson:"messageId" json:"messageId"` // Empty until a message is sent with the attachment
+	FileName     string    `bson:"fileName" json:"fileName"`
+	ContentType  string    `bson:"contentType" json:"contentType"` // Sniffed from the content, not taken from the upload
+	Size         int64     `bson:"size" json:"size"`
+	HasThumbnail bool      `bson:"hasThumbnail" json:"hasThumbnail"`
+	CreatedAt    time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// ChatAttachmentUsage struct that determines how the bytes of attachments a user stores are kept in
+// chatAttachmentUsageCollection
+type ChatAttachmentUsage struct {
+	UserID string `bson:"userId" json:"userId"`
+	Bytes  int64  `bson:"bytes" json:"bytes"`
+}
+
+// ChatRoom struct that determines how chat rooms are stored in chatRoomsCollection. MemberIDs are userIds from
+// usersCollection.
+type ChatRoom struct {
+	RoomID     string               `bson:"roomId" json:"roomId"`
+	Name       string               `bson:"name" json:"name"`
+	MemberIDs  []string             `bson:"memberIds" json:"memberIds"`
+	CreatedBy  string               `bson:"createdBy" json:"createdBy"`
+	CreatedAt  time.Time            `bson:"createdAt" json:"createdAt"`
+	UpdatedAt  time.Time            `bson:"updatedAt" json:"updatedAt"`                       // Bumped by every new message so the busiest rooms list first
+	KeyVersion int                  `bson:"keyVersion" json:"keyVersion"`                     // Current room key, a new one is made whenever members change
+	MutedUntil map[string]time.Time `bson:"mutedUntil,omitempty" json:"mutedUntil,omitempty"` // Members that can't send messages until then, by userId
+	BannedIDs  []string             `bson:"bannedIds,omitempty" json:"bannedIds,omitempty"`   // Removed members that can't be added back
+}
+
+// ChatRoomKey struct that determines how room keys are stored in chatRoomKeysCollection. There is one per member for
+// every key version, wrapped with that member's RSA public key. The unwrapped key is never stored.
+type ChatRoomKey struct {
+	RoomID     string    `bson:"roomId" json:"roomId"`
+	KeyVersion int       `bson:"keyVersion" json:"keyVersion"`
+	UserID     string    `bson:"userId" json:"userId"`
+	WrappedKey string    `bson:"wrappedKey" json:"wrappedKey"` // Base64 RSA-OAEP (SHA-256) ciphertext of the 256 bit AES key
+	CreatedAt  time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// ChatReadState struct that determines how a member's delivered and read watermarks are stored in
+// chatReadStatesCollection. Both are message IDs, everything up to and including them counts as delivered or read.
+type ChatReadState struct {
+	RoomID             string    `bson:"roomId" json:"roomId"`
+	UserID             string    `bson:"userId" json:"userId"`
+	DeliveredMessageID string    `bson:"deliveredMessageId" json:"deliveredMessageId"`
+	ReadMessageID      string    `bson:"readMessageId" json:"readMessageId"`
+	UpdatedAt          time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// ChatEvent struct for the frames the server sends over the /ws WebSocket
+type ChatEvent struct {
+	Type       string         `json:"type"` // "message", "message_updated", "message_deleted", "receipt", "typing", "room_deleted", "room_key_rotated", "removed_from_room", "resync" or "error"
+	RoomID     string         `json:"roomId,omitempty"`
+	KeyVersion int            `json:"keyVersion,omitempty"` // Set on "room_key_rotated", fetch the new key from /chats/keys
+	Message    *ChatMessage   `json:"message,omitempty"`
+	ReadState  *ChatReadState `json:"readState,omitempty"` // Set on "receipt"
+	UserID     string         `json:"userId,omitempty"`    // Set on "typing"
+	IsTyping   bool           `json:"isTyping,omitempty"`  // Set on "typing", clients stop showing it after a few seconds without a refresh
+	Error      string         `json:"error,omitempty"`
+}
+
+// ChatClientFrame struct for the frames clients send over the /ws WebSocket
+type ChatClientFrame struct {
+	Type              string   `json:"type"` // "message", "delivered", "read", "typing_start" or "typing_stop"
+	RoomID            string   `json:"roomId"`
+	Body              string   `json:"body"`
+	KeyVersion        int      `json:"keyVersion"`
+	ClientID          string   `json:"clientId"`
+	AttachmentIDs     []string `json:"attachmentIds"`
+	SearchTokens      []string `json:"searchTokens"`
+	WordFilterVersion string   `json:"wordFilterVersion"` // Version of the word filter the client applied, see WordFilterResponse
+	ModerationText    string   `json:"moderationText"`    // The plain text of Body, only checked against the word filter
+	MessageID         string   `json:"messageId"`         // The newest message delivered or read
+}
+
 // CreateChatRoomRequest struct to handle incoming request to create a new chat room
-type CreateChatRoomRequest struct{}
+type CreateChatRoomRequest struct {
+	Name      string   `bson:"name" json:"name"`
+	MemberIDs []string `bson:"memberIds" json:"memberIds"` // The creator is always added
+}
 
 // CreateChatRoomResponse struct to handle outgoing response to create a new chat room
-type CreateChatRoomResponse struct{}
+type CreateChatRoomResponse struct {
+	IsCreated bool     `bson:"isCreated" json:"isCreated"`
+	Room      ChatRoom `bson:"room" json:"room"`
+}
 
 // DeleteChatRoomRequest struct to handle incoming request to delete a chat room
-type DeleteChatRoomRequest struct{}
+type DeleteChatRoomRequest struct {
+	RoomID string `bson:"roomId" json:"roomId"`
+}
 
 // DeleteChatRoomResponse struct to handle outgoing response to delete a chat room
-type DeleteChatRoomResponse struct{}
+type DeleteChatRoomResponse struct {
+	IsDeleted bool `bson:"isDeleted" json:"isDeleted"`
+}
 
 // ListChatRoomsRequest struct to handle incoming request to list all chat rooms
 type ListChatRoomsRequest struct{}
 
 // ListChatRoomsResponse struct to handle outgoing response to list all chat rooms
-type ListChatRoomsResponse struct{}
+type ListChatRoomsResponse struct {
+	Rooms []ChatRoom `bson:"rooms" json:"rooms"`
+}
 
 // SendMessageRequest struct to handle incoming request to send a chat message
-type SendMessageRequest struct{}
+type SendMessageRequest struct {
+	RoomID            string   `bson:"roomId" json:"roomId"`
+	Body              string   `bson:"body" json:"body"`
+	KeyVersion        int      `bson:"keyVersion" json:"keyVersion"`
+	ClientID          string   `bson:"clientId" json:"clientId"`
+	AttachmentIDs     []string `bson:"attachmentIds" json:"attachmentIds"` // The body can be empty when there are attachments
+	SearchTokens      []string `bson:"searchTokens" json:"searchTokens"`
+	WordFilterVersion string   `bson:"wordFilterVersion" json:"wordFilterVersion"` // Version of the word filter the client applied, see WordFilterResponse
+	ModerationText    string   `bson:"moderationText" json:"moderationText"`       // The plain text of Body, only checked against the word filter and never stored
+}
 
 // SendMessageResponse struct to handle outgoing response to send a chat message
-type SendMessageResponse struct{}
+type SendMessageResponse struct {
+	IsSent  bool        `bson:"isSent" json:"isSent"`
+	Message ChatMessage `bson:"message" json:"message"`
+}
 
 // UpdateMessageRequest struct to handle incoming request to update a chat message
-type UpdateMessageRequest struct{}
+type UpdateMessageRequest struct {
+	MessageID         string   `bson:"messageId" json:"messageId"`
+	Body              string   `bson:"body" json:"body"`
+	KeyVersion        int      `bson:"keyVersion" json:"keyVersion"`
+	SearchTokens      []string `bson:"searchTokens" json:"searchTokens"` // Replace the message's tokens
+	WordFilterVersion string   `bson:"wordFilterVersion" json:"wordFilterVersion"`
+	ModerationText    string   `bson:"moderationText" json:"moderationText"`
+}
 
 // UpdateMessageResponse struct to handle outgoing response to update a chat message
-type UpdateMessageResponse struct{}
+type UpdateMessageResponse struct {
+	IsUpdated bool        `bson:"isUpdated" json:"isUpdated"`
+	Message   ChatMessage `bson:"message" json:"message"`
+}
 
 // DeleteMessageRequest struct to handle incoming request to delete a chat message
-type DeleteMessageRequest struct{}
+type DeleteMessageRequest struct {
+	MessageID string `bson:"messageId" json:"messageId"`
+}
 
 // DeleteMessageResponse struct to handle outgoing response to delete a chat message
-type DeleteMessageResponse struct{}
+type DeleteMessageResponse struct {
+	IsDeleted bool        `bson:"isDeleted" json:"isDeleted"`
+	Message   ChatMessage `bson:"message" json:"message"`
+}
+
+// GetChatRoomKeysResponse struct to handle outgoing response with the caller's wrapped keys for a chat room
+type GetChatRoomKeysResponse struct {
+	RoomID     string        `bson:"roomId" json:"roomId"`
+	KeyVersion int           `bson:"keyVersion" json:"keyVersion"` // The version new messages have to be encrypted with
+	Keys       []ChatRoomKey `bson:"keys" json:"keys"`
+}
+
+// UpdateChatMembersRequest struct to handle incoming request to add a member to or remove a member from a chat room
+type UpdateChatMembersRequest struct {
+	RoomID string `bson:"roomId" json:"roomId"`
+	UserID string `bson:"userId" json:"userId"`
+}
+
+// UpdateChatMembersResponse struct to handle outgoing response after chat room members changed
+type UpdateChatMembersResponse struct {
+	IsUpdated bool     `bson:"isUpdated" json:"isUpdated"`
+	Room      ChatRoom `bson:"room" json:"room"`
+}
 
 // ListMessagesRequest struct to handle incoming request for all chat messages in a chat room
 type ListMessagesRequest struct{}
 
 // ListMessagesResponse struct to handle outgoing response for all chat messages in a chat room
-type ListMessagesResponse struct{}
+type ListMessagesResponse struct {
+	Messages   []ChatMessage `bson:"messages" json:"messages"`     // Oldest first
+	NextCursor string        `bson:"nextCursor" json:"nextCursor"` // Pass as "before" to get the page before this one, empty on the first message
+}
 
 //==================//
 // ASSIGNMENT TYPES //
@@ -643,3 +1120,394 @@ type StudentGames struct {
 	Wordio          []WordioGame          `json:"wordio"`           // Mario-like game
 	SpellingPuddles []SpellingPuddlesGame `json:"spelling_puddles"` // Rain drops containing characters fall down to spell words game
 }
+
+//============//
+// AUTH TYPES //
+//============//
+
+// TokenClaims struct that determines what is stored inside of a signed access token
+type TokenClaims struct {
+	UserID    string `json:"sub"`               // StudentId or TeacherID depending on the role
+	Role      string `json:"role"`              // "student", "teacher" or "admin"
+	Purpose   string `json:"purpose,omitempty"` // Empty for access tokens, "mfa" for login challenges
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// SessionTokens struct that holds the tokens handed out on login and on refresh
+type SessionTokens struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken struct that determines how refresh tokens are stored in refreshTokensCollection
+type RefreshToken struct {
+	TokenHash string    `bson:"tokenHash" json:"-"` // sha256 of the token, the raw token is never stored
+	FamilyID  string    `bson:"familyId" json:"familyId"`
+	UserID    string    `bson:"userId" json:"userId"`
+	Role      string    `bson:"role" json:"role"`
+	CreatedAt int64     `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"` // time.Time so the TTL index can clean these up
+	UsedAt    int64     `bson:"usedAt" json:"usedAt"`       // 0 until the token has been rotated
+	IsRevoked bool      `bson:"isRevoked" json:"isRevoked"`
+}
+
+// RefreshTokenRequest struct to handle incoming request to exchange a refresh token for new tokens
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshTokenResponse struct to handle outgoing response with the new tokens
+type RefreshTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// LogoutRequest struct to handle incoming request to log out of a single session
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// LogoutResponse struct to handle outgoing response to log out of a single session
+type LogoutResponse struct {
+	IsLoggedOut bool `json:"is_logged_out"`
+}
+
+// LogoutAllResponse struct to handle outgoing response to log out of every session
+type LogoutAllResponse struct {
+	IsLoggedOut     bool  `json:"is_logged_out"`
+	SessionsRevoked int64 `json:"sessions_revoked"`
+}
+
+// GoogleIDTokenClaims struct that holds the claims of a verified Google ID token
+type GoogleIDTokenClaims struct {
+	Issuer        string      `json:"iss"`
+	Audience      string      `json:"aud"`
+	Subject       string      `json:"sub"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"` // Google sends a bool, but some clients have sent it as a string
+	Name          string      `json:"name"`
+	Picture       string      `json:"picture"`
+	IssuedAt      int64       `json:"iat"`
+	ExpiresAt     int64       `json:"exp"`
+}
+
+// IsEmailVerified handles email_verified being either a bool or a string
+func (c GoogleIDTokenClaims) IsEmailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// PasswordReset struct that determines how password reset tokens are stored in passwordResetsCollection
+type PasswordReset struct {
+	TokenHash string    `bson:"tokenHash" json:"-"` // sha256 of the token that was emailed, the raw token is never stored
+	UserID    string    `bson:"userId" json:"userId"`
+	Role      string    `bson:"role" json:"role"`
+	Email     string    `bson:"email" json:"email"`
+	CreatedAt int64     `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"`
+	UsedAt    int64     `bson:"usedAt" json:"usedAt"` // 0 until the token has been used, tokens are single use
+}
+
+// ForgotPasswordRequest struct to handle incoming request to email a password reset token
+type ForgotPasswordRequest struct {
+	EmailAddress string `json:"email_address"`
+	UserType     string `json:"user_type"` // "student" (default) or "teacher"
+}
+
+// ForgotPasswordResponse struct to handle outgoing response to a forgot password request. It never says whether the account exists.
+type ForgotPasswordResponse struct {
+	IsSent bool `json:"is_sent"`
+}
+
+// ResetPasswordRequest struct to handle incoming request to set a new password with a reset token
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// ResetPasswordResponse struct to handle outgoing response after resetting a password
+type ResetPasswordResponse struct {
+	IsReset bool `json:"is_reset"`
+}
+
+// MFAChallengeResponse struct to handle outgoing login response when a TOTP code is still needed
+type MFAChallengeResponse struct {
+	MFARequired    bool   `json:"mfa_required"`
+	ChallengeToken string `json:"challenge_token"` // Send back to the same login endpoint along with "totp_code"
+	ExpiresAt      int64  `json:"expires_at"`
+}
+
+// MFASettings struct that holds the two-factor fields shared by students and teachers
+type MFASettings struct {
+	TOTPSecret    string   `bson:"totpsecret"`
+	TOTPEnabled   bool     `bson:"totpenabled"`
+	TOTPLastStep  int64    `bson:"totplaststep"`
+	RecoveryCodes []string `bson:"recoverycodes"`
+	EmailAddress  string   `bson:"emailaddress"`
+}
+
+// TOTPEnrollResponse struct to handle outgoing response when starting two-factor enrollment
+type TOTPEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"` // Render this as a QR code for authenticator apps
+}
+
+// TOTPConfirmRequest struct to handle incoming request to finish two-factor enrollment
+type TOTPConfirmRequest struct {
+	Code string `json:"code"`
+}
+
+// TOTPConfirmResponse struct to handle outgoing response after two-factor is enabled. Recovery codes are only ever shown here.
+type TOTPConfirmResponse struct {
+	IsEnabled     bool     `json:"is_enabled"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// TOTPDisableRequest struct to handle incoming request to turn off two-factor authentication
+type TOTPDisableRequest struct {
+	Code string `json:"code"` // A TOTP code or one of the recovery codes
+}
+
+// TOTPDisableResponse struct to handle outgoing response after turning off two-factor authentication
+type TOTPDisableResponse struct {
+	IsDisabled bool `json:"is_disabled"`
+}
+
+// UnlockAccountRequest struct to handle incoming request from an admin to clear a login lockout
+type UnlockAccountRequest struct {
+	EmailAddress string `json:"email_address"`
+	UserType     string `json:"user_type"` // "student" (default) or "teacher"
+	IPAddress    string `json:"ip_address"`
+}
+
+// UnlockAccountResponse struct to handle outgoing response after clearing a login lockout
+type UnlockAccountResponse struct {
+	IsUnlocked       bool `json:"is_unlocked"`
+	WasAccountLocked bool `json:"was_account_locked"` // false when there were no failed logins recorded for the account
+	WasIPLocked      bool `json:"was_ip_locked"`
+}
+
+//============//
+// MAIL TYPES //
+//============//
+
+// EmailMessage struct that holds a plain text email to be sent by a mailer.Mailer
+type EmailMessage struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// UpdateReadStateRequest struct to handle incoming request to mark messages in a room as delivered or read
+type UpdateReadStateRequest struct {
+	RoomID    string `bson:"roomId" json:"roomId"`
+	MessageID string `bson:"messageId" json:"messageId"`
+	Status    string `bson:"status" json:"status"` // "delivered" or "read", reading a message also delivers it
+}
+
+// UpdateReadStateResponse struct to handle outgoing response after marking messages as delivered or read
+type UpdateReadStateResponse struct {
+	IsUpdated bool          `bson:"isUpdated" json:"isUpdated"`
+	ReadState ChatReadState `bson:"readState" json:"readState"`
+}
+
+// ListReadStatesResponse struct to handle outgoing response with every member's watermarks in a chat room
+type ListReadStatesResponse struct {
+	ReadStates []ChatReadState `bson:"readStates" json:"readStates"`
+}
+
+// ChatUnreadCount struct for the number of unread messages in one chat room
+type ChatUnreadCount struct {
+	RoomID        string `bson:"roomId" json:"roomId"`
+	UnreadCount   int64  `bson:"unreadCount" json:"unreadCount"`
+	ReadMessageID string `bson:"readMessageId" json:"readMessageId"`
+}
+
+// ListUnreadCountsResponse struct to handle outgoing response with the caller's unread messages per chat room
+type ListUnreadCountsResponse struct {
+	Rooms []ChatUnreadCount `bson:"rooms" json:"rooms"`
+	Total int64             `bson:"total" json:"total"`
+}
+
+// UploadAttachmentResponse struct to handle outgoing response after uploading a chat attachment
+type UploadAttachmentResponse struct {
+	IsUploaded bool           `bson:"isUploaded" json:"isUploaded"`
+	Attachment ChatAttachment `bson:"attachment" json:"attachment"`
+	QuotaUsed  int64          `bson:"quotaUsed" json:"quotaUsed"`   // Bytes of attachments the caller has stored
+	QuotaLimit int64          `bson:"quotaLimit" json:"quotaLimit"` // Most bytes of attachments the caller can store
+}
+
+// SearchMessagesRequest struct to handle incoming request to search chat history. Message bodies are end to end
+// encrypted, so instead of words clients send blind index tokens: the first 16 bytes, in lowercase hex, of
+// HMAC-SHA256 over each lowercased word, keyed with HKDF-SHA256(room key, info "aspire-chat-search"). Clients send the
+// same tokens with every message, and search with one set of tokens per room key version they hold.
+type SearchMessagesRequest struct {
+	Keys     []SearchMessagesKey `bson:"keys" json:"keys"`
+	SenderID string              `bson:"senderId" json:"senderId"` // Optional
+	From     *time.Time          `bson:"from" json:"from"`         // Optional, inclusive
+	To       *time.Time          `bson:"to" json:"to"`             // Optional, exclusive
+	Limit    int64               `bson:"limit" json:"limit"`       // Default 20, at most 50
+}
+
+// SearchMessagesKey struct for the search tokens of one room key version
+type SearchMessagesKey struct {
+	RoomID     string   `bson:"roomId" json:"roomId"`
+	KeyVersion int      `bson:"keyVersion" json:"keyVersion"`
+	Tokens     []string `bson:"tokens" json:"tokens"`
+}
+
+// SearchMessagesResult struct for one message found by a search. The client decrypts the message and highlights the
+// words behind MatchedTokens, the messages before and after give the hit some context.
+type SearchMessagesResult struct {
+	Room          ChatRoom      `bson:"room" json:"room"`
+	Message       ChatMessage   `bson:"message" json:"message"`
+	MatchedTokens []string      `bson:"matchedTokens" json:"matchedTokens"`
+	Before        []ChatMessage `bson:"before" json:"before"`
+	After         []ChatMessage `bson:"after" json:"after"`
+	Score         float64       `bson:"score" json:"score"`
+}
+
+// SearchMessagesResponse struct to handle outgoing response with chat search results, best match first
+type SearchMessagesResponse struct {
+	Results []SearchMessagesResult `bson:"results" json:"results"`
+}
+
+// ChatReport struct that determines how reported messages are stored in chatReportsCollection. The server can't read
+// messages, so ReportedBody is the plain text as decrypted by the reporter's client. It's supplied by the reporter and
+// can't be verified, moderators check it against the stored message (see ListedChatReport).
+type ChatReport struct {
+	ReportID     string     `bson:"reportId" json:"reportId"`
+	MessageID    string     `bson:"messageId" json:"messageId"`
+	RoomID       string     `bson:"roomId" json:"roomId"`
+	ReporterID   string     `bson:"reporterId" json:"reporterId"`
+	SenderID     string     `bson:"senderId" json:"senderId"`
+	Reason       string     `bson:"reason" json:"reason"`
+	ReportedBody string     `bson:"reportedBody" json:"reportedBody"` // Supplied by the reporter, not proof of what was sent
+	Status       string     `bson:"status" json:"status"`             // "open", "resolved" or "dismissed"
+	Resolution   string     `bson:"resolution,omitempty" json:"resolution,omitempty"`
+	ResolvedBy   string     `bson:"resolvedBy,omitempty" json:"resolvedBy,omitempty"`
+	CreatedAt    time.Time  `bson:"createdAt" json:"createdAt"`
+	ResolvedAt   *time.Time `bson:"resolvedAt,omitempty" json:"resolvedAt,omitempty"`
+}
+
+// ReportMessageRequest struct to handle incoming request to report a chat message
+type ReportMessageRequest struct {
+	MessageID string `bson:"messageId" json:"messageId"`
+	Reason    string `bson:"reason" json:"reason"`
+	Body      string `bson:"body" json:"body"` // The decrypted message as the reporter's client shows it, stored as ReportedBody
+}
+
+// ReportMessageResponse struct to handle outgoing response after reporting a chat message
+type ReportMessageResponse struct {
+	IsReported bool       `bson:"isReported" json:"isReported"`
+	Report     ChatReport `bson:"report" json:"report"`
+}
+
+// ListedChatReport is a report in the moderation queue with the message as it's stored. Moderators are members of the
+// room, so their client decrypts Message.Body with the room key to see what was really sent rather than trusting
+// ReportedBody. Message is nil if the message is gone, and has an empty body if it was deleted.
+type ListedChatReport struct {
+	ChatReport `bson:",inline"`
+	Message    *ChatMessage `bson:"message,omitempty" json:"message,omitempty"`
+}
+
+// ListReportsResponse struct to handle outgoing response with the moderation queue
+type ListReportsResponse struct {
+	Reports []ListedChatReport `bson:"reports" json:"reports"`
+}
+
+// ResolveReportRequest struct to handle incoming request to close a report
+type ResolveReportRequest struct {
+	ReportID   string `bson:"reportId" json:"reportId"`
+	Status     string `bson:"status" json:"status"` // "resolved" or "dismissed"
+	Resolution string `bson:"resolution" json:"resolution"`
+}
+
+// ResolveReportResponse struct to handle outgoing response after closing a report
+type ResolveReportResponse struct {
+	IsResolved bool       `bson:"isResolved" json:"isResolved"`
+	Report     ChatReport `bson:"report" json:"report"`
+}
+
+// ModerateChatMemberRequest struct to handle incoming request to mute, unmute, ban or unban a chat room member
+type ModerateChatMemberRequest struct {
+	RoomID  string `bson:"roomId" json:"roomId"`
+	UserID  string `bson:"userId" json:"userId"`
+	Minutes int    `bson:"minutes" json:"minutes"` // How long a mute lasts
+}
+
+// WordFilterResponse struct to handle outgoing response with the chat word filter. Message bodies are end to end
+// encrypted, so clients apply the filter before encrypting and send Version and the plain text with every message.
+type WordFilterResponse struct {
+	Mode    string   `bson:"mode" json:"mode"` // "mask" replaces the words with asterisks, "reject" refuses the message
+	Words   []string `bson:"words" json:"words"`
+	Version string   `bson:"version" json:"version"`
+}
+
+// DeletedAccount struct that determines how deleted students and teachers are kept in deletedAccountsCollection until
+// they're purged. Record is the student or teacher document as it was.
+type DeletedAccount struct {
+	UserID    string    `bson:"userId" json:"userId"`
+	Role      string    `bson:"role" json:"role"`
+	Email     string    `bson:"email" json:"email"`
+	TeacherID string    `bson:"teacherId,omitempty" json:"teacherId,omitempty"` // A deleted student's teacher, who can restore them
+	Record    bson.Raw  `bson:"record" json:"-"`
+	DeletedBy string    `bson:"deletedBy" json:"deletedBy"`
+	DeletedAt time.Time `bson:"deletedAt" json:"deletedAt"`
+	PurgeAt   time.Time `bson:"purgeAt" json:"purgeAt"`
+}
+
+// RestoreAccountResponse struct to handle outgoing response to restore a deleted student or teacher
+type RestoreAccountResponse struct {
+	IsRestored bool `json:"is_restored"`
+}
+
+// ListDeletedAccountsResponse struct to handle outgoing response with the accounts waiting to be purged
+type ListDeletedAccountsResponse struct {
+	Accounts []DeletedAccount `json:"accounts"`
+}
+
+// DataExport struct that determines how personal data export jobs are stored in dataExportsCollection
+type DataExport struct {
+	ExportID    string     `bson:"exportId" json:"exportId"`
+	UserID      string     `bson:"userId" json:"userId"`
+	Role        string     `bson:"role" json:"role"`
+	RequestedBy string     `bson:"requestedBy" json:"requestedBy"`
+	Status      string     `bson:"status" json:"status"` // "pending", "running", "complete" or "failed"
+	Error       string     `bson:"error,omitempty" json:"error,omitempty"`
+	Size        int64      `bson:"size" json:"size"` // Bytes in the zip once complete
+	CreatedAt   time.Time  `bson:"createdAt" json:"createdAt"`
+	CompletedAt *time.Time `bson:"completedAt,omitempty" json:"completedAt,omitempty"`
+	ExpiresAt   time.Time  `bson:"expiresAt" json:"expiresAt"` // The zip is deleted after this
+}
+
+// DataExportResponse struct to handle outgoing response about a personal data export
+type DataExportResponse struct {
+	Export      DataExport `json:"export"`
+	DownloadURL string     `json:"downloadUrl,omitempty"` // Set once the export is complete
+}
+
+// DataExportManifest struct for manifest.json at the root of a personal data export
+type DataExportManifest struct {
+	ExportID    string                   `json:"exportId"`
+	UserID      string                   `json:"userId"`
+	Role        string                   `json:"role"`
+	GeneratedAt time.Time                `json:"generatedAt"`
+	Files       []DataExportManifestFile `json:"files"`
+}
+
+// DataExportManifestFile struct for one file listed in a data export's manifest
+type DataExportManifestFile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Records     int    `json:"records,omitempty"` // Number of entries in JSON files
+	Bytes       int64  `json:"bytes,omitempty"`   // Size of copied files
+}
@@ -35,14 +35,29 @@ func LoadPublicKey(userID string) (*rsa.PublicKey, error) {
 }
 
 func GenerateAndEncryptSymmetricKey(userID string) (string, error) {
-	publicKey, err := LoadPublicKey(userID)
+	symmetricKey, err := GenerateSymmetricKey()
 	if err != nil {
-		return "", fmt.Errorf("Failed to load public key: %v", err)
+		return "", err
 	}
 
+	return EncryptSymmetricKey(userID, symmetricKey)
+}
+
+// GenerateSymmetricKey returns a random 256 bit key
+func GenerateSymmetricKey() ([]byte, error) {
 	symmetricKey := make([]byte, 32)
 	if _, err := rand.Read(symmetricKey); err != nil {
-		return "", fmt.Errorf("Failed to generate symmetric key: %v", err)
+		return nil, fmt.Errorf("Failed to generate symmetric key: %v", err)
+	}
+
+	return symmetricKey, nil
+}
+
+// EncryptSymmetricKey wraps the key with the user's public key (RSA-OAEP with SHA-256) so only they can read it
+func EncryptSymmetricKey(userID string, symmetricKey []byte) (string, error) {
+	publicKey, err := LoadPublicKey(userID)
+	if err != nil {
+		return "", fmt.Errorf("Failed to load public key: %v", err)
 	}
 
 	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, symmetricKey, nil)
@@ -2,40 +2,152 @@ package utils
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strconv"
+	"strings"
 )
 
-// Generate a new salt
-func GenerateSalt(length int) (string, error) {
-	// Generate random bytes
-	randomBytes := make([]byte, length)
-	_, err := rand.Read(randomBytes)
-	if err != nil {
-		return "", err
+// Password hashes are stored in the PHC string format, so the algorithm and its parameters are kept with the hash:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+//
+// Older accounts still have a bcrypt hash of the password concatenated with the separate salt field. Those are
+// verified on the legacy path and reported as needing a rehash so the login handlers can upgrade them.
+
+// Argon2Params are the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordHashParams are used for new hashes. Stored hashes with different parameters are upgraded on login.
+var PasswordHashParams = argon2ParamsFromEnv()
+
+var ErrInvalidHash = errors.New("invalid password hash")
+
+func argon2ParamsFromEnv() Argon2Params {
+	params := Argon2Params{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+		SaltLength:  16,
+		KeyLength:   32,
 	}
 
-	// Encode to Base64
-	return base64.StdEncoding.EncodeToString(randomBytes), nil
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY_KIB"), 10, 32); err == nil && v > 0 {
+		params.Memory = uint32(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_ITERATIONS"), 10, 32); err == nil && v > 0 {
+		params.Iterations = uint32(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_PARALLELISM"), 10, 8); err == nil && v > 0 {
+		params.Parallelism = uint8(v)
+	}
+
+	return params
 }
 
-// Hash password
+// HashPassword hashes a password with argon2id and the current parameters
 func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 15)
+	params := PasswordHashParams
+
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
 
-	return string(bytes), err
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.Memory,
+		params.Iterations,
+		params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
 }
 
-// HashPasswordMobile - hashes password for mobile as the Desktop app does
-func HashPasswordMobile(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+// VerifyPassword checks a password against a stored hash. The algorithm is detected from the hash, legacySalt is
+// only used for bcrypt hashes. needsRehash is true when the password is valid but the hash is weaker than what
+// HashPassword would produce now.
+func VerifyPassword(password, legacySalt, encodedHash string) (valid bool, needsRehash bool) {
+	switch {
+	case strings.HasPrefix(encodedHash, "$argon2id$"):
+		params, salt, key, err := decodeArgon2Hash(encodedHash)
+		if err != nil {
+			fmt.Println("Error decoding password hash:", err)
+			return false, false
+		}
 
-	return string(bytes), err
+		otherKey := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+			return false, false
+		}
+
+		current := PasswordHashParams
+		needsRehash = params.Memory < current.Memory ||
+			params.Iterations < current.Iterations ||
+			params.Parallelism != current.Parallelism ||
+			params.SaltLength < current.SaltLength ||
+			params.KeyLength < current.KeyLength
+		return true, needsRehash
+	case strings.HasPrefix(encodedHash, "$2a$"), strings.HasPrefix(encodedHash, "$2b$"), strings.HasPrefix(encodedHash, "$2y$"):
+		// Legacy bcrypt hashes, always upgraded. The cost is checked anyway so it shows up in the logs.
+		if bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password+legacySalt)) != nil {
+			return false, false
+		}
+		if cost, err := bcrypt.Cost([]byte(encodedHash)); err == nil {
+			fmt.Println("Verified legacy bcrypt hash with cost", cost)
+		}
+		return true, true
+	default:
+		return false, false
+	}
 }
 
-// Check password hash
-func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+func decodeArgon2Hash(encodedHash string) (Argon2Params, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=2", salt, key
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 {
+		return Argon2Params{}, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return Argon2Params{}, nil, nil, err
+	}
+	if version != argon2.Version {
+		return Argon2Params{}, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return Argon2Params{}, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2Params{}, nil, nil, err
+	}
+	if len(salt) == 0 || len(key) == 0 {
+		return Argon2Params{}, nil, nil, ErrInvalidHash
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
 
-	return err == nil
+	return params, salt, key, nil
 }